@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"sso/internal/lib/passpolicy"
+)
+
+const usage = `usage: breachfilter [flags] -out <filter> <list>
+
+Builds the breached password filter password_policy.breached_filter points
+at. The list has one entry per line: a plaintext password, or with
+-format sha1 an uppercase or lowercase SHA-1 hex digest optionally followed
+by :count, as in the Pwned Passwords downloads.
+
+flags:
+`
+
+func main() {
+	outPath := flag.String("out", "", "Write the filter to this file")
+	format := flag.String("format", "sha1", "List format, sha1 or plain")
+	fpRate := flag.Float64("fp", 0.001, "False positive rate of the filter")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || *outPath == "" || (*format != "sha1" && *format != "plain") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := build(flag.Arg(0), *outPath, *format, *fpRate); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func build(listPath, outPath, format string, fpRate float64) error {
+	list, err := os.Open(listPath)
+	if err != nil {
+		return err
+	}
+	defer list.Close()
+
+	// the filter is sized up front, so the list is read twice
+	n := 0
+	err = eachLine(list, func(string) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := list.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	filter, err := passpolicy.NewFilter(n, fpRate)
+	if err != nil {
+		return err
+	}
+	line := 0
+	err = eachLine(list, func(entry string) error {
+		line++
+		if format == "plain" {
+			filter.Add(sha1.Sum([]byte(entry)))
+			return nil
+		}
+
+		digest, _, _ := strings.Cut(entry, ":")
+		raw, err := hex.DecodeString(digest)
+		if err != nil || len(raw) != sha1.Size {
+			return fmt.Errorf("line %d: not a SHA-1 digest", line)
+		}
+		filter.Add([sha1.Size]byte(raw))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(outPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := filter.WriteTo(out); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "wrote %d entries to %s\n", n, outPath)
+	return nil
+}
+
+// eachLine calls fn with every non-empty line of r.
+func eachLine(r io.Reader, fn func(string) error) error {
+	lines := bufio.NewScanner(r)
+	for lines.Scan() {
+		entry := strings.TrimRight(lines.Text(), "\r")
+		if entry == "" {
+			continue
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return lines.Err()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"sso/internal/app"
+	"sso/internal/config"
+	"sso/internal/services/gdpr"
+)
+
+const usage = `usage: gdpr [-config path] [flags] <command> <user-id>
+
+commands:
+  export   write everything stored about the user as a JSON archive
+  erase    delete the user and all their data for good, leaving a tombstone
+
+flags:
+`
+
+func main() {
+	outPath := flag.String("out", "", "Write the export archive to this file instead of stdout")
+	reason := flag.String("reason", "", "Reason recorded in the tombstone of an erased user")
+	yes := flag.Bool("yes", false, "Confirm erase, it cannot be undone")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+
+	cfg := config.MustLoad()
+
+	args := flag.Args()
+	if len(args) != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmd := args[0]
+	userID, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || userID <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid user id %q\n", args[1])
+		os.Exit(2)
+	}
+
+	// logs go to stderr, stdout is for the archive
+	log := app.NewLogger(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}), cfg.Env, cfg.Log)
+
+	storage, err := app.NewStorage(log, cfg.Storage.Driver, cfg.Storage.SQLitePath, cfg.PgDb)
+	if err != nil {
+		log.Error("failed to open storage", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	defer storage.Close()
+
+	service := gdpr.New(log, storage)
+
+	switch cmd {
+	case "export":
+		err = export(context.Background(), service, userID, *outPath)
+	case "erase":
+		if !*yes {
+			fmt.Fprintln(os.Stderr, "erase cannot be undone, rerun with -yes to confirm")
+			storage.Close()
+			os.Exit(2)
+		}
+		err = service.Erase(context.Background(), userID, 0, *reason)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q, run gdpr -h for usage\n", cmd)
+		storage.Close()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Error(cmd+" failed", slog.String("error", err.Error()))
+		storage.Close()
+		os.Exit(1)
+	}
+}
+
+func export(ctx context.Context, service *gdpr.GDPR, userID int64, outPath string) error {
+	archive, err := service.Export(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if outPath != "" {
+		// the archive is personal data, keep it private to the operator
+		out, err = os.OpenFile(outPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(archive)
+}
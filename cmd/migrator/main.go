@@ -1,68 +1,235 @@
 package main
 
 import (
-	"database/sql"
 	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
-	_ "github.com/lib/pq"
+
+	"sso/internal/config"
+	"sso/internal/migrator"
 )
 
+const usage = `usage: migrator [-config path] [flags] <command> [args]
+
+Migrations embedded in the binary are used unless -migrations is set.
+
+commands:
+  up [n]            apply all pending migrations, or the next n
+  down [n]          roll back n migrations (default 1)
+  goto <version>    migrate up or down to the given version
+  force <version>   set the version without running migrations, clears the dirty flag
+  version, status   print the current version, the dirty flag and the latest available version
+  create <name>     scaffold the next numbered up/down migration files, in
+                    -migrations or the default directory of the configured
+                    driver, needing no config when -migrations is set
+
+flags:
+`
+
 func main() {
-	// Флаги командной строки
-	host := flag.String("host", "localhost", "Database host")
-	port := flag.Int("port", 5432, "Database port")
-	user := flag.String("user", "postgres", "Database user")
-	password := flag.String("password", "admin", "Database password")
-	dbname := flag.String("dbname", "test_auth", "Database name")
-	sslMode := flag.String("ssl", "disable", "SSL mode")
-	migrationsPath := flag.String("migrations", "migrations", "Path to migrations")
-	migrationsTable := flag.String("migrations-table", "schema_migrations", "Migrations table name")
+	// Флаги командной строки, настройки БД берутся из того же YAML, что и у sso
+	configPath := flag.String("config", "", "Path to the sso config file (default $CONFIG_PATH)")
+	migrationsPath := flag.String("migrations", "", "Read migrations from this directory instead of the ones embedded in the binary")
+	migrationsTable := flag.String("migrations-table", "", "Migrations table name (default migrations.table from config)")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
 
 	flag.Parse()
+	if *configPath == "" {
+		*configPath = os.Getenv("CONFIG_PATH")
+	}
 
-	// Формирование строки подключения
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
-		*host, *port, *user, *password, *dbname, *sslMode)
-
-	db, err := sql.Open("postgres", psqlInfo)
-	if err != nil {
-		log.Fatal(err)
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
 	}
-	defer db.Close()
+	cmd, args := args[0], args[1:]
 
-	if err = db.Ping(); err != nil {
-		log.Fatal("Connection test failed:", err)
+	// create only touches the source tree, no need for a database
+	if cmd == "create" {
+		if len(args) != 1 {
+			log.Fatal("usage: migrator create <name>")
+		}
+		dir := *migrationsPath
+		if dir == "" {
+			driver := config.StorageDriverPostgres
+			if *configPath != "" {
+				driver = config.MustLoadPath(*configPath).Storage.Driver
+			}
+			dir = defaultMigrationsPath(driver)
+		}
+		if err := create(dir, args[0]); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	driver, err := postgres.WithInstance(db, &postgres.Config{
-		MigrationsTable: *migrationsTable,
-	})
-	if err != nil {
-		log.Fatal(err)
+	cfg := config.MustLoadPath(*configPath)
+	if *migrationsTable == "" {
+		*migrationsTable = cfg.Migrate.Table
 	}
 
-	m, err := migrate.NewWithDatabaseInstance(
-		"file://"+*migrationsPath,
-		"postgres",
-		driver,
+	var (
+		src fs.FS
+		err error
 	)
+	if *migrationsPath != "" {
+		src = os.DirFS(*migrationsPath)
+	} else {
+		src, err = migrator.Embedded(cfg.Storage.Driver)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	m, err := migrator.New(cfg, src, *migrationsTable)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer m.Close()
 
-	if err := m.Up(); err != nil {
+	if err := run(m, src, cmd, args); err != nil {
 		if errors.Is(err, migrate.ErrNoChange) {
-			fmt.Println("No new migrations to apply")
+			fmt.Println("No migrations to apply")
 			return
 		}
-		log.Fatal("Migration failed:", err)
+		log.Fatal(err)
+	}
+}
+
+func run(m *migrate.Migrate, src fs.FS, cmd string, args []string) error {
+	switch cmd {
+	case "up":
+		n, err := optionalSteps(args, 0)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			err = m.Up()
+		} else {
+			err = m.Steps(n)
+		}
+		if err != nil {
+			return fmt.Errorf("migration failed: %w", err)
+		}
+		fmt.Println("Migrations applied successfully")
+	case "down":
+		n, err := optionalSteps(args, 1)
+		if err != nil {
+			return err
+		}
+		if err := m.Steps(-n); err != nil {
+			return fmt.Errorf("rollback failed: %w", err)
+		}
+		fmt.Printf("Rolled back %d migration(s)\n", n)
+	case "goto":
+		version, err := requiredVersion(cmd, args)
+		if err != nil {
+			return err
+		}
+		if err := m.Migrate(version); err != nil {
+			return fmt.Errorf("migration failed: %w", err)
+		}
+		fmt.Printf("Migrated to version %d\n", version)
+	case "force":
+		version, err := requiredVersion(cmd, args)
+		if err != nil {
+			return err
+		}
+		if err := m.Force(int(version)); err != nil {
+			return fmt.Errorf("force failed: %w", err)
+		}
+		fmt.Printf("Forced version %d\n", version)
+	case "version", "status":
+		version, dirty, err := m.Version()
+		if errors.Is(err, migrate.ErrNilVersion) {
+			fmt.Println("No migrations applied")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		latest, err := migrator.Latest(src)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Version: %d\nDirty: %t\nLatest available: %d\n", version, dirty, latest)
+		if dirty {
+			fmt.Println("Fix the schema by hand, then run `migrator force <version>`")
+		}
+	default:
+		return fmt.Errorf("unknown command %q, run migrator -h for usage", cmd)
+	}
+	return nil
+}
+
+func defaultMigrationsPath(driver string) string {
+	if driver == config.StorageDriverSQLite {
+		return "migrations/sqlite"
+	}
+	return "migrations"
+}
+
+func optionalSteps(args []string, def int) (int, error) {
+	switch len(args) {
+	case 0:
+		return def, nil
+	case 1:
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid step count %q", args[0])
+		}
+		return n, nil
 	}
+	return 0, errors.New("too many arguments")
+}
+
+func requiredVersion(cmd string, args []string) (uint, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("usage: migrator %s <version>", cmd)
+	}
+	version, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid version %q", args[0])
+	}
+	return uint(version), nil
+}
+
+var nonWord = regexp.MustCompile(`[^a-z0-9]+`)
 
-	fmt.Println("Migrations applied successfully")
+// create writes <next>_<name>.up.sql and <next>_<name>.down.sql, numbering
+// after the highest version already in dir.
+func create(dir, name string) error {
+	name = strings.Trim(nonWord.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if name == "" {
+		return errors.New("migration name must contain letters or digits")
+	}
+
+	last, err := migrator.Latest(os.DirFS(dir))
+	if err != nil {
+		return err
+	}
+
+	base := filepath.Join(dir, fmt.Sprintf("%d_%s", last+1, name))
+	for _, path := range []string{base + ".up.sql", base + ".down.sql"} {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		fmt.Println("Created", path)
+	}
+	return nil
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"sso/internal/app"
+	"sso/internal/config"
+	"sso/internal/services/scim"
+)
+
+const usage = `usage: scimtoken [-config path] <command> <app-id>
+
+commands:
+  issue    print a new bearer token for the SCIM client of the app
+  revoke   revoke every SCIM token of the app
+
+flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+
+	cfg := config.MustLoad()
+
+	args := flag.Args()
+	if len(args) != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmd := args[0]
+	appID, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || appID <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid app id %q\n", args[1])
+		os.Exit(2)
+	}
+
+	// logs go to stderr, stdout is for the token
+	log := app.NewLogger(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}), cfg.Env, cfg.Log)
+
+	storage, err := app.NewStorage(log, cfg.Storage.Driver, cfg.Storage.SQLitePath, cfg.PgDb)
+	if err != nil {
+		log.Error("failed to open storage", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	defer storage.Close()
+
+	// managing tokens hashes no passwords
+	service := scim.New(log, storage, storage, storage, nil, nil)
+
+	switch cmd {
+	case "issue":
+		var token string
+		token, err = service.IssueToken(context.Background(), appID)
+		if err == nil {
+			fmt.Println(token)
+		}
+	case "revoke":
+		_, err = service.RevokeTokens(context.Background(), appID)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q, run scimtoken -h for usage\n", cmd)
+		storage.Close()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Error(cmd+" failed", slog.String("error", err.Error()))
+		storage.Close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+
+	"sso/internal/app"
+	"sso/internal/config"
+	"sso/internal/lib/metrics"
+	"sso/internal/lib/passhash"
+	"sso/internal/seed"
+	"sso/internal/services/auth"
+)
+
+func main() {
+	fixturePath := flag.String("fixture", "config/seed.local.yaml", "Path to the YAML or JSON fixture")
+
+	cfg := config.MustLoad()
+
+	log := app.NewLogger(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}), cfg.Env, cfg.Log)
+
+	fixture, err := seed.Load(*fixturePath)
+	if err != nil {
+		log.Error("failed to load fixture", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	hasher, err := app.NewHasher(cfg.PasswordHash)
+	if err != nil {
+		log.Error("invalid password_hash config", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	policy, err := app.NewPasswordPolicy(cfg.PasswordPolicy)
+	if err != nil {
+		log.Error("invalid password_policy config", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	storage, err := app.NewStorage(log, cfg.Storage.Driver, cfg.Storage.SQLitePath, cfg.PgDb)
+	if err != nil {
+		log.Error("failed to open storage", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	defer storage.Close()
+
+	// seeding registers users and logs nobody in, nothing to throttle, and
+	// nobody scrapes its metrics
+	authService := auth.New(log, storage, storage, storage, passhash.Traced(hasher), policy, nil, nil, metrics.New(), cfg.TokenTTL)
+
+	if err := seed.Run(context.Background(), log, fixture, authService, storage); err != nil {
+		log.Error("seeding failed", slog.String("error", err.Error()))
+		storage.Close()
+		os.Exit(1)
+	}
+
+	log.Info("seeding finished",
+		slog.Int("apps", len(fixture.Apps)),
+		slog.Int("users", len(fixture.Users)),
+	)
+}
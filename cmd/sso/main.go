@@ -8,11 +8,7 @@ import (
 
 	"sso/internal/app"
 	"sso/internal/config"
-)
-
-const (
-	envLocal = "local"
-	envProd  = "prod"
+	"sso/internal/migrator"
 )
 
 func main() {
@@ -20,35 +16,42 @@ func main() {
 	cfg := config.MustLoad()
 
 	//logger init
-	log := setupLogger(cfg.Env)
+	log := setupLogger(cfg.Env, cfg.Log)
 	log.Info("starting application",
 		slog.String("env", cfg.Env),
 		slog.Any("cfg", cfg),
 		slog.Int("port", cfg.GRPC.Port),
 	)
 
+	if cfg.Migrate.Auto {
+		if err := migrator.Up(log, cfg, cfg.Migrate.Table); err != nil {
+			log.Error("failed to migrate database", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+	}
+
 	// start gRPC server
-	application := app.New(log,
-		cfg.GRPC.Port,
-		cfg.PgDb.Host,
-		cfg.PgDb.Port,
-		cfg.PgDb.Username,
-		cfg.PgDb.Password,
-		cfg.PgDb.Database,
-		cfg.HTTPConf.Address,
-		cfg.HTTPConf.Timeout,
-		cfg.HTTPConf.IdleTimeout,
-		cfg.TokenTTL)
+	application := app.New(log, cfg)
 
 	go func() {
 		if err := application.GRPCSrv.Run(); err != nil {
-			log.Error("gRPC server failed", err)
+			log.Error("gRPC server failed", slog.String("error", err.Error()))
 		}
 	}()
 
-	if err := application.HTTPSrv.Run(); err != nil {
-		log.Error("HTTP server failed", err)
-	}
+	go func() {
+		if err := application.MetricsSrv.Run(); err != nil {
+			log.Error("metrics server failed", slog.String("error", err.Error()))
+		}
+	}()
+
+	// served in the background too, so the shutdown below is reached and
+	// flushes the spans not exported yet
+	go func() {
+		if err := application.HTTPSrv.Run(); err != nil {
+			log.Error("HTTP server failed", slog.String("error", err.Error()))
+		}
+	}()
 
 	// Graceful shutdown
 	quit := make(chan os.Signal, 1)
@@ -73,18 +76,14 @@ func main() {
 
 }
 
-func setupLogger(env string) *slog.Logger {
-	var log *slog.Logger
+func setupLogger(env string, c config.LogConfig) *slog.Logger {
+	var handler slog.Handler
 
 	switch env {
-	case envLocal:
-		log = slog.New(
-			slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}),
-		)
-	case envProd:
-		log = slog.New(
-			slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}),
-		)
+	case config.EnvLocal:
+		handler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
+	case config.EnvProd:
+		handler = slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo})
 	}
-	return log
+	return app.NewLogger(handler, env, c)
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"sso/internal/app"
+	"sso/internal/config"
+	"sso/internal/lib/userfile"
+	"sso/internal/services/bulk"
+)
+
+const usage = `usage: users [-config path] [flags] <command> [file]
+
+commands:
+  import   import users from a CSV or JSONL file, - for stdin
+  export   write every user, password hashes included, to stdout or -out
+
+flags:
+`
+
+func main() {
+	format := flag.String("format", "", "File format, csv or jsonl; picked from the file extension when unset, csv for stdin and stdout")
+	dryRun := flag.Bool("dry-run", false, "Validate and insert every batch but commit none of them")
+	batchSize := flag.Int("batch-size", bulk.DefaultBatchSize, "Rows per import transaction")
+	outPath := flag.String("out", "", "Write the export to this file instead of stdout")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+
+	cfg := config.MustLoad()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmd := args[0]
+
+	// logs go to stderr, stdout is for the export
+	log := app.NewLogger(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}), cfg.Env, cfg.Log)
+
+	hasher, err := app.NewHasher(cfg.PasswordHash)
+	if err != nil {
+		log.Error("invalid password_hash config", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	storage, err := app.NewStorage(log, cfg.Storage.Driver, cfg.Storage.SQLitePath, cfg.PgDb)
+	if err != nil {
+		log.Error("failed to open storage", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	defer storage.Close()
+
+	service := bulk.New(log, storage, hasher)
+
+	switch {
+	case cmd == "import" && len(args) == 2:
+		err = importUsers(context.Background(), service, args[1], *format, bulk.ImportOptions{
+			DryRun:    *dryRun,
+			BatchSize: *batchSize,
+		})
+	case cmd == "export" && len(args) == 1:
+		err = exportUsers(context.Background(), service, *outPath, *format)
+	default:
+		fmt.Fprintln(os.Stderr, "run users -h for usage")
+		storage.Close()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Error(cmd+" failed", slog.String("error", err.Error()))
+		storage.Close()
+		os.Exit(1)
+	}
+}
+
+func importUsers(ctx context.Context, service *bulk.Bulk, path string, format string, opts bulk.ImportOptions) error {
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	if format == "" && path == "-" {
+		format = string(userfile.CSV)
+	}
+	f, err := userfile.ParseFormat(format, path)
+	if err != nil {
+		return err
+	}
+	reader, err := userfile.NewReader(in, f)
+	if err != nil {
+		return err
+	}
+
+	summary, err := service.Import(ctx, reader.Read, opts, func(r bulk.Result) error {
+		if r.Err != nil {
+			fmt.Fprintf(os.Stderr, "row %d %s: %s\n", r.Row, r.Email, r.Err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	verb := "imported"
+	if opts.DryRun {
+		verb = "would import"
+	}
+	fmt.Printf("%s %d, already existing %d, invalid %d\n", verb, summary.Imported, summary.Existing, summary.Invalid)
+	if summary.Invalid > 0 {
+		return errors.New("some rows were invalid")
+	}
+	return nil
+}
+
+func exportUsers(ctx context.Context, service *bulk.Bulk, outPath string, format string) error {
+	if format == "" && outPath == "" {
+		format = string(userfile.CSV)
+	}
+	f, err := userfile.ParseFormat(format, outPath)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if outPath != "" {
+		// the export carries password hashes, keep it private to the operator
+		file, err := os.OpenFile(outPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	writer, err := userfile.NewWriter(out, f)
+	if err != nil {
+		return err
+	}
+	if _, err := service.Export(ctx, writer.Write); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
@@ -1,63 +1,314 @@
 package app
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
+	"os"
 	grpcapp "sso/internal/app/grpc"
 	httpapp "sso/internal/app/http"
+	metricsapp "sso/internal/app/metrics"
+	"sso/internal/config"
+	adminhttp "sso/internal/http/admin"
 	authhttp "sso/internal/http/auth"
+	profilehttp "sso/internal/http/profile"
+	scimhttp "sso/internal/http/scim"
+	"sso/internal/lib/attempts"
+	"sso/internal/lib/metrics"
+	"sso/internal/lib/notify"
+	"sso/internal/lib/passhash"
+	"sso/internal/lib/passpolicy"
+	"sso/internal/lib/ratelimit"
+	"sso/internal/lib/redact"
+	"sso/internal/lib/tracing"
+	"sso/internal/seed"
+	"sso/internal/services/admin"
 	"sso/internal/services/auth"
+	"sso/internal/services/bulk"
+	"sso/internal/services/gdpr"
+	"sso/internal/services/profile"
+	"sso/internal/services/scim"
+	"sso/internal/storage"
 	"sso/internal/storage/postgres"
+	"sso/internal/storage/sqlite"
 	"time"
 )
 
 type App struct {
-	GRPCSrv *grpcapp.App
-	HTTPSrv *httpapp.Srv
+	GRPCSrv    *grpcapp.App
+	HTTPSrv    *httpapp.Srv
+	MetricsSrv *metricsapp.Srv
+	log        *slog.Logger
+	storage    Storage
+	auth       *auth.Auth
+	retention  *retentionJob
+	// stopTracing flushes the spans not exported yet.
+	stopTracing func(context.Context) error
 }
 
-func New(
-	log *slog.Logger,
-	grpcPort int,
-	dbHost string,
-	dbPort int,
-	dbUser string,
-	dbPassword string,
-	dbName string,
-	httpAddr int,
-	httpTimeout time.Duration,
-	httpIdle time.Duration,
-	tokenTTL time.Duration,
-) *App {
-
-	dsn := postgres.DSN(
-		dbHost,
-		dbPort,
-		dbUser,
-		dbPassword,
-		dbName,
-		"disable", // sslmode
-	)
-	//TODO: init storage
-
-	storage, err := postgres.New(dsn)
+// Storage is implemented by every storage backend the service can run on,
+// it is what the services and the seed command need of it together.
+type Storage interface {
+	auth.UserSaver
+	auth.UserProvider
+	auth.AppProvider
+	profile.UserProvider
+	profile.UserUpdater
+	admin.UserProvider
+	admin.UserUpdater
+	gdpr.Storage
+	bulk.Storage
+	scim.UserStore
+	scim.GroupStore
+	scim.TokenStore
+	seed.Storage
+	attempts.Store
+	ratelimit.Store
+	PoolStats() storage.PoolStats
+	Close() error
+}
+
+// New builds the service from its config, opening the storage and wiring
+// the servers. It panics when any part cannot be set up.
+func New(log *slog.Logger, cfg *config.Config) *App {
+	stopTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:    cfg.Tracing.Exporter,
+		Endpoint:    cfg.Tracing.Endpoint,
+		Insecure:    cfg.Tracing.Insecure,
+		SampleRatio: cfg.Tracing.SampleRatio,
+		ServiceName: cfg.Tracing.ServiceName,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	hasher, err := NewHasher(cfg.PasswordHash)
 	if err != nil {
 		panic(err)
 	}
-	//TODO: init auth service
 
-	authService := auth.New(log, storage, storage, storage, tokenTTL)
+	policy, err := NewPasswordPolicy(cfg.PasswordPolicy)
+	if err != nil {
+		panic(err)
+	}
+
+	m := metrics.New()
+	backend, err := NewStorage(log, cfg.Storage.Driver, cfg.Storage.SQLitePath, cfg.PgDb)
+	if err != nil {
+		panic(err)
+	}
+	m.RegisterPool(backend.PoolStats)
+	storage := &instrumentedStorage{Storage: backend, metrics: m}
 
-	grpcApp := grpcapp.New(log, authService, grpcPort)
+	notifier := notify.NewLogNotifier(log)
+	guard := NewLoginGuard(cfg.LoginThrottle, storage)
+	limiter := NewRateLimiter(cfg.RateLimit, storage)
 
-	httpHandlers := authhttp.NewHandler(storage, log, tokenTTL)
-	httpServ := httpapp.New(log, httpHandlers, httpAddr)
+	authService := auth.New(log, storage, storage, storage, passhash.Traced(hasher), policy, guard, notifier, m, cfg.TokenTTL)
+
+	profileService := profile.New(log, storage, storage, storage, cfg.Apps.Account, notifier, cfg.EmailVerificationTTL)
+
+	gdprService := gdpr.New(log, storage)
+	bulkService := bulk.New(log, storage, hasher)
+	adminService := admin.New(log, storage, storage, storage, cfg.Apps.Admin, gdprService, bulkService, cfg.DeletedUserRetention)
+	scimService := scim.New(log, storage, storage, storage, hasher, policy)
+
+	grpcApp := grpcapp.New(log, authService, profileService, adminService, limiter, RateLimitRules(cfg.RateLimit.GRPC), m, cfg.GRPC.Port, cfg.GRPC.Timeout, cfg.GRPC.StreamTimeout)
+
+	httpHandlers := authhttp.NewHandler(authService, log)
+	profileHandlers := profilehttp.NewHandler(profileService, log)
+	adminHandlers := adminhttp.NewHandler(adminService, log)
+	scimHandlers := scimhttp.NewHandler(scimService, log)
+	httpServ := httpapp.New(log, httpHandlers, profileHandlers, adminHandlers, scimHandlers, limiter, RateLimitRules(cfg.RateLimit.HTTP), m, cfg.HTTPConf.Address, httpapp.Limits{
+		RequestTimeout: cfg.HTTPConf.Timeout,
+		ReadTimeout:    cfg.HTTPConf.ReadTimeout,
+		WriteTimeout:   cfg.HTTPConf.WriteTimeout,
+		IdleTimeout:    cfg.HTTPConf.IdleTimeout,
+		MaxBodyBytes:   cfg.HTTPConf.MaxBodyBytes,
+	})
 	return &App{
-		GRPCSrv: grpcApp,
-		HTTPSrv: httpServ,
+		GRPCSrv:    grpcApp,
+		HTTPSrv:    httpServ,
+		MetricsSrv: metricsapp.New(log, m.Handler(), cfg.Metrics.Host, cfg.Metrics.Port),
+		log:        log,
+		storage:    storage,
+		auth:       authService,
+		retention:  startRetentionJob(log, adminService, guard, limiter),
+
+		stopTracing: stopTracing,
+	}
+}
+
+// NewStorage opens the storage backend selected by driver.
+func NewStorage(
+	log *slog.Logger,
+	driver string,
+	sqlitePath string,
+	db config.DBConfig,
+) (Storage, error) {
+	switch driver {
+	case config.StorageDriverSQLite:
+		return sqlite.New(sqlite.DSN(sqlitePath))
+	case config.StorageDriverPostgres:
+		conn := postgres.ConnConfigFrom(db)
+		dsn, err := postgres.DSN(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		replicaDSNs := make([]string, 0, len(db.Replicas))
+		for _, replicaURL := range db.Replicas {
+			// replicas inherit credentials, database and SSL settings
+			// of the primary unless their URL overrides them
+			replica := conn
+			replica.URL = replicaURL
+			replica.Host, replica.Port = "", 0
+			replicaDSN, err := postgres.DSN(replica)
+			if err != nil {
+				return nil, err
+			}
+			replicaDSNs = append(replicaDSNs, replicaDSN)
+		}
+
+		return postgres.New(dsn, postgres.PoolConfig{
+			MaxConns:           db.MaxConns,
+			MinConns:           db.MinConns,
+			MaxConnLifetime:    db.MaxConnLifetime,
+			MaxConnIdleTime:    db.MaxConnIdleTime,
+			StatementCacheMode: db.StatementCacheMode,
+		}, postgres.ReplicaConfig{
+			DSNs:          replicaDSNs,
+			MaxLag:        db.ReplicaMaxLag,
+			CheckInterval: db.ReplicaCheckInterval,
+			Log:           log,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", driver)
+	}
+}
+
+// NewLogger puts the redacting handler in front of handler, hashing email
+// addresses in prod as configured. Every binary logs through it.
+func NewLogger(handler slog.Handler, env string, c config.LogConfig) *slog.Logger {
+	var opts redact.Options
+	if env == config.EnvProd && c.HashEmails {
+		opts.EmailKey = []byte(c.EmailKey)
+	}
+	return slog.New(redact.NewHandler(handler, opts))
+}
+
+// NewHasher builds the hasher for new passwords from the config, reading
+// the peppers from the pepper file and the environment.
+func NewHasher(c config.PasswordHashConfig) (*passhash.Hasher, error) {
+	entries := c.Peppers
+	if c.PepperFile != "" {
+		file, err := os.ReadFile(c.PepperFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading pepper file: %w", err)
+		}
+		entries = string(file) + "\n" + entries
+	}
+	peppers, err := passhash.ParsePeppers(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return passhash.NewHasher(passhash.Params{
+		Algorithm: passhash.Algorithm(c.Algorithm),
+		Argon2: passhash.Argon2Params{
+			Memory:  c.Argon2Memory,
+			Time:    c.Argon2Time,
+			Threads: c.Argon2Threads,
+			SaltLen: c.Argon2SaltLen,
+			KeyLen:  c.Argon2KeyLen,
+		},
+		BcryptCost: c.BcryptCost,
+		Pepper:     c.Pepper,
+		Peppers:    peppers,
+	})
+}
+
+// NewLoginGuard builds the login throttle, counting failures in memory or
+// in storage as configured.
+func NewLoginGuard(c config.LoginThrottleConfig, storage Storage) *attempts.Guard {
+	var store attempts.Store = storage
+	if c.Store == config.ThrottleStoreMemory {
+		store = attempts.NewMemoryStore()
 	}
+	return attempts.NewGuard(store, attempts.Policy{
+		Account:         attempts.Limits{Free: c.AccountFreeAttempts, Lockout: c.AccountLockout},
+		IP:              attempts.Limits{Free: c.IPFreeAttempts, Lockout: c.IPLockout},
+		BaseDelay:       c.BaseDelay,
+		MaxDelay:        c.MaxDelay,
+		LockoutDuration: c.LockoutDuration,
+		Window:          c.Window,
+	})
+}
+
+// NewRateLimiter builds the request rate limiter, keeping the buckets in
+// memory or in storage as configured.
+func NewRateLimiter(c config.RateLimitConfig, storage Storage) *ratelimit.Limiter {
+	var store ratelimit.Store = storage
+	if c.Store == config.ThrottleStoreMemory {
+		store = ratelimit.NewMemoryStore()
+	}
+	return ratelimit.New(store)
+}
+
+// RateLimitRules converts the configured limits of one transport.
+func RateLimitRules(c config.EndpointLimits) ratelimit.Rules {
+	rule := func(l config.RateLimit) ratelimit.Rule {
+		by := ratelimit.ByIP
+		if l.By == string(ratelimit.ByApp) {
+			by = ratelimit.ByApp
+		}
+		return ratelimit.Rule{Limit: ratelimit.Limit{Rate: l.Rate, Burst: l.Burst}, By: by}
+	}
+
+	rules := ratelimit.Rules{Default: rule(c.Default), Endpoints: make(map[string]ratelimit.Rule, len(c.Endpoints))}
+	for endpoint, l := range c.Endpoints {
+		rules.Endpoints[endpoint] = rule(l)
+	}
+	return rules
+}
+
+// NewPasswordPolicy builds the policy new passwords are checked against,
+// loading the breached password filter if one is configured.
+func NewPasswordPolicy(c config.PasswordPolicyConfig) (*passpolicy.Policy, error) {
+	policy := &passpolicy.Policy{
+		MinLength:           c.MinLength,
+		MaxLength:           c.MaxLength,
+		MinCharacterClasses: c.MinCharacterClasses,
+		ForbidPersonalInfo:  c.ForbidPersonalInfo,
+		MinStrength:         c.MinStrength,
+	}
+	if c.CheckCommon {
+		policy.Breached = append(policy.Breached, passpolicy.Common)
+	}
+	if c.BreachedFilter != "" {
+		filter, err := passpolicy.LoadFilter(c.BreachedFilter)
+		if err != nil {
+			return nil, fmt.Errorf("loading breached password filter: %w", err)
+		}
+		policy.Breached = append(policy.Breached, filter)
+	}
+	return policy, nil
 }
 
 func (a *App) Stop() {
 	a.GRPCSrv.Stop()
 	a.HTTPSrv.Stop()
+	a.MetricsSrv.Stop()
+	a.retention.stop()
+	a.auth.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.stopTracing(ctx); err != nil {
+		a.log.Error("failed to flush traces", slog.String("error", err.Error()))
+	}
+
+	if err := a.storage.Close(); err != nil {
+		a.log.Error("failed to close storage", slog.String("error", err.Error()))
+	}
 }
@@ -4,10 +4,18 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"sso/internal/services/admin"
 	"sso/internal/services/auth"
+	"sso/internal/services/profile"
+	"time"
 
+	adminrpc "sso/internal/grpc/admin"
 	authrpc "sso/internal/grpc/auth"
+	"sso/internal/grpc/interceptor"
+	profilerpc "sso/internal/grpc/profile"
+	"sso/internal/lib/ratelimit"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 )
 
@@ -17,10 +25,33 @@ type App struct {
 	port       int
 }
 
-// New creates new gRPC server app
-func New(log *slog.Logger, authService *auth.Auth, port int) *App {
-	gRPCServer := grpc.NewServer()
+// New creates new gRPC server app. Calls are traced, logged, timed, get a
+// request ID, and get timeout as their deadline when the client set none,
+// streams streamTimeout.
+func New(log *slog.Logger, authService *auth.Auth, profileService *profile.Profile, adminService *admin.Admin, limiter *ratelimit.Limiter, limits ratelimit.Rules, metrics interceptor.Observer, port int, timeout time.Duration, streamTimeout time.Duration) *App {
+	gRPCServer := grpc.NewServer(
+		// spans continue the trace of the caller's traceparent metadata
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(
+			interceptor.RequestID(),
+			interceptor.Logging(log),
+			interceptor.Metrics(metrics),
+			interceptor.Recovery(log),
+			interceptor.Deadline(timeout),
+			interceptor.RateLimit(log, limiter, limits),
+		),
+		grpc.ChainStreamInterceptor(
+			interceptor.StreamRequestID(),
+			interceptor.StreamLogging(log),
+			interceptor.StreamMetrics(metrics),
+			interceptor.StreamRecovery(log),
+			interceptor.StreamDeadline(streamTimeout),
+			interceptor.StreamRateLimit(log, limiter, limits),
+		),
+	)
 	authrpc.Register(gRPCServer, authService)
+	profilerpc.Register(gRPCServer, profileService)
+	adminrpc.Register(gRPCServer, adminService)
 	return &App{log: log,
 		gRPCServer: gRPCServer,
 		port:       port}
@@ -52,13 +83,29 @@ func (a *App) Run() error {
 	return nil
 }
 
-// Stop stops gRPC server
+// stopTimeout is how long Stop waits for calls in flight. Streams may run
+// for as long as the stream timeout, so they are cut once it is over.
+const stopTimeout = 10 * time.Second
+
+// Stop stops gRPC server, letting calls in flight finish for up to
+// stopTimeout before closing their connections.
 func (a *App) Stop() {
 	const op = "grpcapp.Stop"
 
-	a.log.With(slog.String("op ", op)).
-		Info("gRPC server is stopping", slog.Int("port", a.port))
+	log := a.log.With(slog.String("op ", op))
+	log.Info("gRPC server is stopping", slog.Int("port", a.port))
 
-	a.gRPCServer.GracefulStop()
+	stopped := make(chan struct{})
+	go func() {
+		a.gRPCServer.GracefulStop()
+		close(stopped)
+	}()
 
+	select {
+	case <-stopped:
+	case <-time.After(stopTimeout):
+		log.Warn("gRPC calls still running, closing them", slog.Duration("waited", stopTimeout))
+		a.gRPCServer.Stop()
+		<-stopped
+	}
 }
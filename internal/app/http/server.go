@@ -5,16 +5,32 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	adminhttp "sso/internal/http/admin"
 	authhttp "sso/internal/http/auth"
+	"sso/internal/http/middleware"
+	profilehttp "sso/internal/http/profile"
+	scimhttp "sso/internal/http/scim"
+	"sso/internal/lib/ratelimit"
+	"time"
 )
 
+// Limits bound every request. RequestTimeout and MaxBodyBytes are applied
+// by middleware, the others are those of http.Server.
+type Limits struct {
+	RequestTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	IdleTimeout    time.Duration
+	MaxBodyBytes   int64
+}
+
 type Srv struct {
 	log        *slog.Logger
 	httpServer *http.Server
 	addr       int
 }
 
-func New(log *slog.Logger, handlers *authhttp.Handler, port int) *Srv {
+func New(log *slog.Logger, handlers *authhttp.Handler, profileHandlers *profilehttp.Handler, adminHandlers *adminhttp.Handler, scimHandlers *scimhttp.Handler, limiter *ratelimit.Limiter, rules ratelimit.Rules, metrics middleware.Observer, port int, limits Limits) *Srv {
 	log.Info("starting http server")
 
 	mux := http.NewServeMux()
@@ -24,7 +40,44 @@ func New(log *slog.Logger, handlers *authhttp.Handler, port int) *Srv {
 	mux.HandleFunc("/register", handlers.RegisterHandler)
 	mux.HandleFunc("/isadmin", handlers.IsAdminHandler)
 
-	return &Srv{log: log, httpServer: &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}, addr: port}
+	mux.HandleFunc("GET /users/{id}", profileHandlers.GetUserHandler)
+	mux.HandleFunc("GET /me", profileHandlers.GetMeHandler)
+	mux.HandleFunc("PATCH /me", profileHandlers.UpdateProfileHandler)
+	mux.HandleFunc("POST /verify-email", profileHandlers.VerifyEmailHandler)
+
+	mux.HandleFunc("GET /admin/users", adminHandlers.ListUsersHandler)
+	mux.HandleFunc("POST /admin/users/{id}/status", adminHandlers.SetUserStatusHandler)
+	mux.HandleFunc("GET /admin/users/{id}/export", adminHandlers.ExportUserHandler)
+	mux.HandleFunc("DELETE /admin/users/{id}", adminHandlers.EraseUserHandler)
+
+	mux.HandleFunc("POST /scim/v2/Users", scimHandlers.CreateUserHandler)
+	mux.HandleFunc("GET /scim/v2/Users", scimHandlers.ListUsersHandler)
+	mux.HandleFunc("GET /scim/v2/Users/{id}", scimHandlers.GetUserHandler)
+	mux.HandleFunc("PATCH /scim/v2/Users/{id}", scimHandlers.PatchUserHandler)
+	mux.HandleFunc("DELETE /scim/v2/Users/{id}", scimHandlers.DeleteUserHandler)
+	mux.HandleFunc("POST /scim/v2/Groups", scimHandlers.CreateGroupHandler)
+	mux.HandleFunc("GET /scim/v2/Groups", scimHandlers.ListGroupsHandler)
+	mux.HandleFunc("GET /scim/v2/Groups/{id}", scimHandlers.GetGroupHandler)
+	mux.HandleFunc("PATCH /scim/v2/Groups/{id}", scimHandlers.PatchGroupHandler)
+	mux.HandleFunc("DELETE /scim/v2/Groups/{id}", scimHandlers.DeleteGroupHandler)
+
+	var handler http.Handler = middleware.RateLimit(log, limiter, rules, mux)
+	handler = middleware.Timeout(limits.RequestTimeout, handler)
+	handler = middleware.BodyLimit(limits.MaxBodyBytes, handler)
+	handler = middleware.Recovery(log, handler)
+	handler = middleware.Metrics(metrics, mux, handler)
+	handler = middleware.Logging(log, handler)
+	handler = middleware.RequestID(handler)
+	handler = middleware.Tracing(mux, handler)
+
+	return &Srv{log: log, httpServer: &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           handler,
+		ReadHeaderTimeout: limits.ReadTimeout,
+		ReadTimeout:       limits.ReadTimeout,
+		WriteTimeout:      limits.WriteTimeout,
+		IdleTimeout:       limits.IdleTimeout,
+	}, addr: port}
 }
 
 func (s *Srv) MustRun() {
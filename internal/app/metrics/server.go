@@ -0,0 +1,61 @@
+package metricsapp
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// readTimeout bounds reading a scrape request, they have no body.
+const readTimeout = 5 * time.Second
+
+// Srv is the admin HTTP server serving /metrics.
+type Srv struct {
+	log        *slog.Logger
+	httpServer *http.Server
+	port       int
+}
+
+// New creates the admin server listening on host, port 0 makes one that
+// never listens.
+func New(log *slog.Logger, metrics http.Handler, host string, port int) *Srv {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics)
+
+	return &Srv{log: log, httpServer: &http.Server{
+		Addr:              net.JoinHostPort(host, strconv.Itoa(port)),
+		Handler:           mux,
+		ReadHeaderTimeout: readTimeout,
+	}, port: port}
+}
+
+func (s *Srv) Run() error {
+	const op = "metricsapp.Run"
+
+	if s.port == 0 {
+		return nil
+	}
+
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("address", s.httpServer.Addr),
+	)
+	log.Info("metrics server starting")
+
+	if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func (s *Srv) Stop() {
+	const op = "metricsapp.Stop"
+
+	if err := s.httpServer.Close(); err != nil {
+		s.log.Error("failed to stop metrics server", slog.String("op", op), slog.String("error", err.Error()))
+	}
+}
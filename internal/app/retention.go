@@ -0,0 +1,76 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// retentionInterval is how often emails of deleted users are checked for
+// release. The retention period itself is counted in days, there is no
+// point in checking more often.
+const retentionInterval = time.Hour
+
+type emailReleaser interface {
+	ReleaseDeletedEmails(ctx context.Context) (int64, error)
+}
+
+type failurePruner interface {
+	Prune(ctx context.Context) (int64, error)
+}
+
+type bucketPruner interface {
+	Prune(ctx context.Context) (int64, error)
+}
+
+// retentionJob periodically releases the emails of users deleted longer
+// than the retention period ago, drops login failure counters past their
+// window and rate limit buckets that filled up again.
+type retentionJob struct {
+	log      *slog.Logger
+	releaser emailReleaser
+	pruner   failurePruner
+	buckets  bucketPruner
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func startRetentionJob(log *slog.Logger, releaser emailReleaser, pruner failurePruner, buckets bucketPruner) *retentionJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &retentionJob{log: log, releaser: releaser, pruner: pruner, buckets: buckets, cancel: cancel}
+
+	j.wg.Add(1)
+	go j.run(ctx)
+
+	return j
+}
+
+func (j *retentionJob) run(ctx context.Context) {
+	defer j.wg.Done()
+
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		// failures are logged by the releaser and retried on the next tick
+		_, _ = j.releaser.ReleaseDeletedEmails(ctx)
+		if _, err := j.pruner.Prune(ctx); err != nil {
+			j.log.Error("failed to prune login failures", slog.String("error", err.Error()))
+		}
+		if _, err := j.buckets.Prune(ctx); err != nil {
+			j.log.Error("failed to prune rate limit buckets", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (j *retentionJob) stop() {
+	j.cancel()
+	j.wg.Wait()
+}
@@ -0,0 +1,285 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"sso/internal/domain/models"
+	"sso/internal/storage"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type storageObserver interface {
+	ObserveStorage(operation string, failed bool, d time.Duration)
+}
+
+// instrumentedStorage times and traces every operation of the storage it
+// wraps, naming them like the op of their errors.
+type instrumentedStorage struct {
+	Storage
+	metrics storageObserver
+}
+
+type storageOperation struct {
+	name    string
+	started time.Time
+	span    trace.Span
+	metrics storageObserver
+}
+
+func (s *instrumentedStorage) start(ctx context.Context, name string) (context.Context, storageOperation) {
+	ctx, span := otel.Tracer("sso/storage").Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, storageOperation{name: name, started: time.Now(), span: span, metrics: s.metrics}
+}
+
+func (op storageOperation) end(err *error) {
+	failed := *err != nil && !isOutcome(*err)
+	op.metrics.ObserveStorage(op.name, failed, time.Since(op.started))
+	if failed {
+		op.span.RecordError(*err)
+		op.span.SetStatus(codes.Error, (*err).Error())
+	}
+	op.span.End()
+}
+
+// outcomes are the errors storage answers with about the data, a user not
+// found or an app already there, rather than failures of the database.
+var outcomes = []error{
+	storage.ErrUserExists,
+	storage.ErrUserNotFound,
+	storage.ErrAppNotFound,
+	storage.ErrAppExists,
+	storage.ErrVerificationNotFound,
+	storage.ErrEmailReleased,
+	storage.ErrGroupNotFound,
+	storage.ErrGroupExists,
+	storage.ErrSCIMTokenNotFound,
+}
+
+func isOutcome(err error) bool {
+	for _, outcome := range outcomes {
+		if errors.Is(err, outcome) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *instrumentedStorage) SaveUser(ctx context.Context, email string, name string, passHash []byte, pepperVersion int) (_ int, err error) {
+	ctx, op := s.start(ctx, "storage.SaveUser")
+	defer op.end(&err)
+	return s.Storage.SaveUser(ctx, email, name, passHash, pepperVersion)
+}
+
+func (s *instrumentedStorage) User(ctx context.Context, email string) (_ models.User, err error) {
+	ctx, op := s.start(ctx, "storage.User")
+	defer op.end(&err)
+	return s.Storage.User(ctx, email)
+}
+
+func (s *instrumentedStorage) IsAdmin(ctx context.Context, userID int64) (_ bool, err error) {
+	ctx, op := s.start(ctx, "storage.IsAdmin")
+	defer op.end(&err)
+	return s.Storage.IsAdmin(ctx, userID)
+}
+
+func (s *instrumentedStorage) App(ctx context.Context, appID int64) (_ models.App, err error) {
+	ctx, op := s.start(ctx, "storage.App")
+	defer op.end(&err)
+	return s.Storage.App(ctx, appID)
+}
+
+func (s *instrumentedStorage) SetAdmin(ctx context.Context, userID int64, isAdmin bool) (err error) {
+	ctx, op := s.start(ctx, "storage.SetAdmin")
+	defer op.end(&err)
+	return s.Storage.SetAdmin(ctx, userID, isAdmin)
+}
+
+func (s *instrumentedStorage) SaveApp(ctx context.Context, app models.App) (err error) {
+	ctx, op := s.start(ctx, "storage.SaveApp")
+	defer op.end(&err)
+	return s.Storage.SaveApp(ctx, app)
+}
+
+func (s *instrumentedStorage) UserByID(ctx context.Context, userID int64) (_ models.User, err error) {
+	ctx, op := s.start(ctx, "storage.UserByID")
+	defer op.end(&err)
+	return s.Storage.UserByID(ctx, userID)
+}
+
+func (s *instrumentedStorage) UpdateProfile(ctx context.Context, userID int64, name string, verification *models.EmailVerification) (err error) {
+	ctx, op := s.start(ctx, "storage.UpdateProfile")
+	defer op.end(&err)
+	return s.Storage.UpdateProfile(ctx, userID, name, verification)
+}
+
+func (s *instrumentedStorage) VerifyEmail(ctx context.Context, tokenHash []byte, now time.Time) (_ int64, err error) {
+	ctx, op := s.start(ctx, "storage.VerifyEmail")
+	defer op.end(&err)
+	return s.Storage.VerifyEmail(ctx, tokenHash, now)
+}
+
+func (s *instrumentedStorage) ListUsers(ctx context.Context, filter models.UserFilter) (_ []models.UserInfo, err error) {
+	ctx, op := s.start(ctx, "storage.ListUsers")
+	defer op.end(&err)
+	return s.Storage.ListUsers(ctx, filter)
+}
+
+func (s *instrumentedStorage) CountUsers(ctx context.Context, filter models.UserFilter) (_ int, err error) {
+	ctx, op := s.start(ctx, "storage.CountUsers")
+	defer op.end(&err)
+	return s.Storage.CountUsers(ctx, filter)
+}
+
+func (s *instrumentedStorage) SetStatus(ctx context.Context, userID int64, status models.UserStatus, reason string, at time.Time) (err error) {
+	ctx, op := s.start(ctx, "storage.SetStatus")
+	defer op.end(&err)
+	return s.Storage.SetStatus(ctx, userID, status, reason, at)
+}
+
+func (s *instrumentedStorage) ReleaseDeletedEmails(ctx context.Context, deletedBefore time.Time, now time.Time) (_ int64, err error) {
+	ctx, op := s.start(ctx, "storage.ReleaseDeletedEmails")
+	defer op.end(&err)
+	return s.Storage.ReleaseDeletedEmails(ctx, deletedBefore, now)
+}
+
+func (s *instrumentedStorage) UserData(ctx context.Context, userID int64) (_ models.UserData, err error) {
+	ctx, op := s.start(ctx, "storage.UserData")
+	defer op.end(&err)
+	return s.Storage.UserData(ctx, userID)
+}
+
+func (s *instrumentedStorage) EraseUser(ctx context.Context, tombstone models.ErasedUser) (err error) {
+	ctx, op := s.start(ctx, "storage.EraseUser")
+	defer op.end(&err)
+	return s.Storage.EraseUser(ctx, tombstone)
+}
+
+func (s *instrumentedStorage) ErasedUser(ctx context.Context, userID int64) (_ models.ErasedUser, err error) {
+	ctx, op := s.start(ctx, "storage.ErasedUser")
+	defer op.end(&err)
+	return s.Storage.ErasedUser(ctx, userID)
+}
+
+func (s *instrumentedStorage) ImportUsers(ctx context.Context, users []models.PortableUser, dryRun bool) (_ []models.ImportResult, err error) {
+	ctx, op := s.start(ctx, "storage.ImportUsers")
+	defer op.end(&err)
+	return s.Storage.ImportUsers(ctx, users, dryRun)
+}
+
+func (s *instrumentedStorage) ExportUsers(ctx context.Context, afterID int64, limit int) (_ []models.PortableUser, err error) {
+	ctx, op := s.start(ctx, "storage.ExportUsers")
+	defer op.end(&err)
+	return s.Storage.ExportUsers(ctx, afterID, limit)
+}
+
+func (s *instrumentedStorage) SaveSCIMUser(ctx context.Context, appID int64, email string, name string, passHash []byte, pepperVersion int) (_ int, err error) {
+	ctx, op := s.start(ctx, "storage.SaveSCIMUser")
+	defer op.end(&err)
+	return s.Storage.SaveSCIMUser(ctx, appID, email, name, passHash, pepperVersion)
+}
+
+func (s *instrumentedStorage) SCIMUser(ctx context.Context, appID int64, userID int64) (_ models.UserInfo, err error) {
+	ctx, op := s.start(ctx, "storage.SCIMUser")
+	defer op.end(&err)
+	return s.Storage.SCIMUser(ctx, appID, userID)
+}
+
+func (s *instrumentedStorage) UpdateUser(ctx context.Context, userID int64, name string, email string) (err error) {
+	ctx, op := s.start(ctx, "storage.UpdateUser")
+	defer op.end(&err)
+	return s.Storage.UpdateUser(ctx, userID, name, email)
+}
+
+func (s *instrumentedStorage) SaveGroup(ctx context.Context, group models.Group) (_ int64, err error) {
+	ctx, op := s.start(ctx, "storage.SaveGroup")
+	defer op.end(&err)
+	return s.Storage.SaveGroup(ctx, group)
+}
+
+func (s *instrumentedStorage) Group(ctx context.Context, appID int64, groupID int64) (_ models.Group, err error) {
+	ctx, op := s.start(ctx, "storage.Group")
+	defer op.end(&err)
+	return s.Storage.Group(ctx, appID, groupID)
+}
+
+func (s *instrumentedStorage) Groups(ctx context.Context, appID int64) (_ []models.Group, err error) {
+	ctx, op := s.start(ctx, "storage.Groups")
+	defer op.end(&err)
+	return s.Storage.Groups(ctx, appID)
+}
+
+func (s *instrumentedStorage) UpdateGroup(ctx context.Context, group models.Group) (err error) {
+	ctx, op := s.start(ctx, "storage.UpdateGroup")
+	defer op.end(&err)
+	return s.Storage.UpdateGroup(ctx, group)
+}
+
+func (s *instrumentedStorage) DeleteGroup(ctx context.Context, appID int64, groupID int64) (err error) {
+	ctx, op := s.start(ctx, "storage.DeleteGroup")
+	defer op.end(&err)
+	return s.Storage.DeleteGroup(ctx, appID, groupID)
+}
+
+func (s *instrumentedStorage) SaveSCIMToken(ctx context.Context, token models.SCIMToken) (err error) {
+	ctx, op := s.start(ctx, "storage.SaveSCIMToken")
+	defer op.end(&err)
+	return s.Storage.SaveSCIMToken(ctx, token)
+}
+
+func (s *instrumentedStorage) SCIMTokenApp(ctx context.Context, tokenHash []byte) (_ int64, err error) {
+	ctx, op := s.start(ctx, "storage.SCIMTokenApp")
+	defer op.end(&err)
+	return s.Storage.SCIMTokenApp(ctx, tokenHash)
+}
+
+func (s *instrumentedStorage) RevokeSCIMTokens(ctx context.Context, appID int64) (_ int64, err error) {
+	ctx, op := s.start(ctx, "storage.RevokeSCIMTokens")
+	defer op.end(&err)
+	return s.Storage.RevokeSCIMTokens(ctx, appID)
+}
+
+func (s *instrumentedStorage) UpdatePassHash(ctx context.Context, userID int64, oldHash []byte, newHash []byte, pepperVersion int) (err error) {
+	ctx, op := s.start(ctx, "storage.UpdatePassHash")
+	defer op.end(&err)
+	return s.Storage.UpdatePassHash(ctx, userID, oldHash, newHash, pepperVersion)
+}
+
+func (s *instrumentedStorage) ReserveLoginAttempt(ctx context.Context, key string, at time.Time, since time.Time) (_ int, _ time.Time, err error) {
+	ctx, op := s.start(ctx, "storage.ReserveLoginAttempt")
+	defer op.end(&err)
+	return s.Storage.ReserveLoginAttempt(ctx, key, at, since)
+}
+
+func (s *instrumentedStorage) ReleaseLoginAttempt(ctx context.Context, key string, at time.Time, prev time.Time) (err error) {
+	ctx, op := s.start(ctx, "storage.ReleaseLoginAttempt")
+	defer op.end(&err)
+	return s.Storage.ReleaseLoginAttempt(ctx, key, at, prev)
+}
+
+func (s *instrumentedStorage) ResetLoginFailures(ctx context.Context, key string) (err error) {
+	ctx, op := s.start(ctx, "storage.ResetLoginFailures")
+	defer op.end(&err)
+	return s.Storage.ResetLoginFailures(ctx, key)
+}
+
+func (s *instrumentedStorage) PruneLoginFailures(ctx context.Context, before time.Time) (_ int64, err error) {
+	ctx, op := s.start(ctx, "storage.PruneLoginFailures")
+	defer op.end(&err)
+	return s.Storage.PruneLoginFailures(ctx, before)
+}
+
+func (s *instrumentedStorage) ConsumeRateLimit(ctx context.Context, key string, now time.Time, interval time.Duration, tolerance time.Duration) (_ bool, _ time.Time, err error) {
+	ctx, op := s.start(ctx, "storage.ConsumeRateLimit")
+	defer op.end(&err)
+	return s.Storage.ConsumeRateLimit(ctx, key, now, interval, tolerance)
+}
+
+func (s *instrumentedStorage) PruneRateLimits(ctx context.Context, before time.Time) (_ int64, err error) {
+	ctx, op := s.start(ctx, "storage.PruneRateLimits")
+	defer op.end(&err)
+	return s.Storage.PruneRateLimits(ctx, before)
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"sso/internal/domain/models"
+	"sso/internal/storage"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// failingStorage answers User with err, the rest of Storage is left out.
+type failingStorage struct {
+	Storage
+	err error
+}
+
+func (s failingStorage) User(context.Context, string) (models.User, error) {
+	return models.User{}, s.err
+}
+
+// storageObservations records the operations observed.
+type storageObservations struct {
+	names  []string
+	failed []bool
+}
+
+func (o *storageObservations) ObserveStorage(operation string, failed bool, _ time.Duration) {
+	o.names = append(o.names, operation)
+	o.failed = append(o.failed, failed)
+}
+
+func TestInstrumentedStorage(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	tests := []struct {
+		name       string
+		err        error
+		wantFailed bool
+	}{
+		{"found", nil, false},
+		{"not found", fmt.Errorf("storage.User: %w", storage.ErrUserNotFound), false},
+		{"database down", errors.New("connection refused"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder.Reset()
+			observed := &storageObservations{}
+			s := &instrumentedStorage{Storage: failingStorage{err: tt.err}, metrics: observed}
+
+			if _, err := s.User(context.Background(), "alice@example.com"); err != tt.err {
+				t.Fatalf("User = %v, want the error of the storage, %v", err, tt.err)
+			}
+			if len(observed.names) != 1 || observed.names[0] != "storage.User" || observed.failed[0] != tt.wantFailed {
+				t.Errorf("observed %v failed %v, want storage.User failed %v", observed.names, observed.failed, tt.wantFailed)
+			}
+
+			spans := recorder.Ended()
+			if len(spans) != 1 || spans[0].Name() != "storage.User" {
+				t.Fatalf("spans %v, want one storage.User", spans)
+			}
+			if got := spans[0].Status().Code == codes.Error; got != tt.wantFailed {
+				t.Errorf("span status %v, want error %v", spans[0].Status().Code, tt.wantFailed)
+			}
+		})
+	}
+}
@@ -1,42 +1,320 @@
 package config
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/ilyakaznacheev/cleanenv"
+	"log/slog"
+	"net/url"
 	"os"
 	"time"
 )
 
+const (
+	EnvLocal = "local"
+	EnvProd  = "prod"
+)
+
 type Config struct {
 	Env string `yaml:"env" env-default:"local"`
 	//StoragePath string        `yaml:"storage_path" env-required:"true"`
 	TokenTTL time.Duration `yaml:"token_ttl" env-required:"true"`
-	GRPC     GRPCConfig    `yaml:"grpc" env-required:"true"`
-	PgDb     DBConfig      `yaml:"postgres" env-required:"true"`
-	HTTPConf HTTPConfig    `yaml:"http_server" env-required:"true"`
+	// EmailVerificationTTL is how long a token confirming a changed email stays valid.
+	EmailVerificationTTL time.Duration `yaml:"email_verification_ttl" env-default:"24h"`
+	// DeletedUserRetention is how long a soft-deleted user can be restored
+	// before their email is released for new registrations.
+	DeletedUserRetention time.Duration        `yaml:"deleted_user_retention" env-default:"720h"`
+	Apps                 AppsConfig           `yaml:"apps"`
+	GRPC                 GRPCConfig           `yaml:"grpc" env-required:"true"`
+	Storage              StorageConfig        `yaml:"storage"`
+	PgDb                 DBConfig             `yaml:"postgres"`
+	Migrate              MigrateConfig        `yaml:"migrations"`
+	HTTPConf             HTTPConfig           `yaml:"http_server" env-required:"true"`
+	PasswordHash         PasswordHashConfig   `yaml:"password_hash"`
+	PasswordPolicy       PasswordPolicyConfig `yaml:"password_policy"`
+	LoginThrottle        LoginThrottleConfig  `yaml:"login_throttle"`
+	RateLimit            RateLimitConfig      `yaml:"rate_limit"`
+	Log                  LogConfig            `yaml:"log"`
+	Metrics              MetricsConfig        `yaml:"metrics"`
+	Tracing              TracingConfig        `yaml:"tracing"`
+}
+
+// AppsConfig pins the apps whose tokens the service's own endpoints accept.
+// Every relying app holds the secret of its own tokens, so a token of any
+// other app could claim any user. Account is the app of the profile
+// endpoints, Admin that of the admin ones.
+type AppsConfig struct {
+	Account int64 `yaml:"account" env:"SSO_ACCOUNT_APP_ID" env-default:"1"`
+	Admin   int64 `yaml:"admin" env:"SSO_ADMIN_APP_ID" env-default:"1"`
+}
+
+// MetricsConfig is the admin HTTP server serving /metrics, kept off the
+// public port. Host is the address it binds, localhost unless the
+// scraper runs elsewhere. Port 0 turns it off.
+type MetricsConfig struct {
+	Host string `yaml:"host" env:"SSO_METRICS_HOST" env-default:"localhost"`
+	Port int    `yaml:"port" env:"SSO_METRICS_PORT" env-default:"9090"`
+}
+
+// TracingConfig is the tracing section of the config, passed on to
+// tracing.Setup as it is. Exporter is otlp, stdout or none.
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter" env:"SSO_TRACING_EXPORTER" env-default:"none"`
+	Endpoint    string  `yaml:"endpoint" env:"SSO_TRACING_ENDPOINT"`
+	Insecure    bool    `yaml:"insecure" env:"SSO_TRACING_INSECURE"`
+	SampleRatio float64 `yaml:"sample_ratio" env:"SSO_TRACING_SAMPLE_RATIO" env-default:"1"`
+	ServiceName string  `yaml:"service_name" env:"SSO_TRACING_SERVICE_NAME" env-default:"sso"`
+}
+
+// LogConfig tunes what reaches the logs. HashEmails replaces email
+// addresses by an HMAC of them under EmailKey in prod. The key comes from
+// the environment only, like the peppers.
+type LogConfig struct {
+	HashEmails bool   `yaml:"hash_emails" env:"SSO_LOG_HASH_EMAILS" env-default:"true"`
+	EmailKey   string `yaml:"-" env:"SSO_LOG_EMAIL_KEY"`
+}
+
+// LogValue leaves the email key out of the logs.
+func (c LogConfig) LogValue() slog.Value {
+	return slog.GroupValue(slog.Bool("hash_emails", c.HashEmails))
+}
+
+const (
+	StorageDriverPostgres = "postgres"
+	StorageDriverSQLite   = "sqlite"
+)
+
+const (
+	ThrottleStoreMemory   = "memory"
+	ThrottleStoreDatabase = "database"
+)
+
+// StorageConfig selects the storage backend. The postgres section is only
+// required for the postgres driver, sqlite needs nothing but a file path.
+type StorageConfig struct {
+	Driver     string `yaml:"driver" env-default:"postgres"`
+	SQLitePath string `yaml:"sqlite_path" env-default:"sso.db"`
 }
 
+// GRPCConfig is the gRPC server. Timeout is the deadline of calls that
+// come without one, StreamTimeout that of streams, long enough for a bulk
+// import or export.
 type GRPCConfig struct {
-	Port    int           `yaml:"port"`
-	Timeout time.Duration `yaml:"timeout"`
+	Port          int           `yaml:"port"`
+	Timeout       time.Duration `yaml:"timeout"`
+	StreamTimeout time.Duration `yaml:"stream_timeout" env-default:"1h"`
 }
+
+// DBConfig describes the Postgres connection. URL, when set, is a full
+// postgres:// DSN, the discrete fields only fill in what it leaves out.
 type DBConfig struct {
-	Host     string `yaml:"dbHost" env-required:"true"`
-	Port     int    `yaml:"dbPort" env-required:"true"`
-	Username string `yaml:"dbUser" env-required:"true"`
-	Password string `yaml:"dbPassword" env-required:"true"`
-	Database string `yaml:"dbName" env-required:"true"`
-	SSLMode  string `yaml:"dbSSLMode" env-required:"true"`
+	URL      string `yaml:"dbURL"`
+	Host     string `yaml:"dbHost"`
+	Port     int    `yaml:"dbPort"`
+	Username string `yaml:"dbUser"`
+	Password string `yaml:"dbPassword"`
+	Database string `yaml:"dbName"`
+
+	// SSLMode empty keeps the sslmode of dbURL or PGSSLMODE, and disable
+	// when neither has one.
+	SSLMode     string `yaml:"dbSSLMode"`
+	SSLRootCert string `yaml:"dbSSLRootCert"`
+	SSLCert     string `yaml:"dbSSLCert"`
+	SSLKey      string `yaml:"dbSSLKey"`
+
+	MaxConns           int32         `yaml:"dbMaxConns" env-default:"10"`
+	MinConns           int32         `yaml:"dbMinConns" env-default:"2"`
+	MaxConnLifetime    time.Duration `yaml:"dbMaxConnLifetime" env-default:"1h"`
+	MaxConnIdleTime    time.Duration `yaml:"dbMaxConnIdleTime" env-default:"30m"`
+	StatementCacheMode string        `yaml:"dbStatementCacheMode" env-default:"cache_statement"`
+
+	// Replicas are DSNs of read replicas, SSL settings above apply to them too.
+	Replicas             []string      `yaml:"dbReplicas"`
+	ReplicaMaxLag        time.Duration `yaml:"dbReplicaMaxLag" env-default:"5s"`
+	ReplicaCheckInterval time.Duration `yaml:"dbReplicaCheckInterval" env-default:"5s"`
+}
+
+// LogValue leaves the password out of the logs, along with any
+// credentials in the URLs.
+func (c DBConfig) LogValue() slog.Value {
+	replicas := make([]string, 0, len(c.Replicas))
+	for _, r := range c.Replicas {
+		replicas = append(replicas, redactURL(r))
+	}
+	return slog.GroupValue(
+		slog.String("url", redactURL(c.URL)),
+		slog.String("host", c.Host),
+		slog.Int("port", c.Port),
+		slog.String("user", c.Username),
+		slog.String("database", c.Database),
+		slog.String("ssl_mode", c.SSLMode),
+		slog.Any("replicas", replicas),
+		slog.Int("max_conns", int(c.MaxConns)),
+		slog.Int("min_conns", int(c.MinConns)),
+	)
 }
 
+func redactURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "[REDACTED]"
+	}
+	return u.Redacted()
+}
+
+// MigrateConfig controls schema migrations on startup. With Auto set,
+// cmd/sso applies the embedded migrations before building the storage.
+type MigrateConfig struct {
+	Auto  bool   `yaml:"auto" env-default:"false"`
+	Table string `yaml:"table" env-default:"schema_migrations"`
+}
+
+// HTTPConfig is the HTTP server. Timeout bounds serving a request, the
+// client gets 503 past it, ReadTimeout reading it and WriteTimeout
+// everything from the end of its headers to the end of the response.
 type HTTPConfig struct {
-	Address     int           `yaml:"address" env-required:"true"`
-	Timeout     time.Duration `yaml:"timeout" env-required:"true"`
-	IdleTimeout time.Duration `yaml:"idle_timeout" env-required:"true"`
+	Address      int           `yaml:"address" env-required:"true"`
+	Timeout      time.Duration `yaml:"timeout" env-required:"true"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout" env-required:"true"`
+	ReadTimeout  time.Duration `yaml:"read_timeout" env-default:"10s"`
+	WriteTimeout time.Duration `yaml:"write_timeout" env-default:"15s"`
+	// MaxBodyBytes bounds request bodies, 0 for no bound.
+	MaxBodyBytes int64 `yaml:"max_body_bytes" env-default:"1048576"`
+}
+
+// PasswordHashConfig selects how new passwords are hashed. Stored hashes
+// made with other settings are upgraded on the next successful login.
+type PasswordHashConfig struct {
+	Algorithm string `yaml:"algorithm" env-default:"argon2id"`
+	// Argon2Memory is in KiB.
+	Argon2Memory  uint32 `yaml:"argon2_memory" env-default:"65536"`
+	Argon2Time    uint32 `yaml:"argon2_time" env-default:"3"`
+	Argon2Threads uint8  `yaml:"argon2_threads" env-default:"4"`
+	Argon2SaltLen uint32 `yaml:"argon2_salt_length" env-default:"16"`
+	Argon2KeyLen  uint32 `yaml:"argon2_key_length" env-default:"32"`
+	BcryptCost    int    `yaml:"bcrypt_cost" env-default:"10"`
+	// Pepper is the version of the pepper new hashes are made with, 0 for
+	// none. Hashes with another version are re-peppered on the next
+	// login, an old pepper can be dropped once no user has it left.
+	Pepper int `yaml:"pepper" env:"SSO_PEPPER"`
+	// PepperFile holds the peppers, one version:secret line each with the
+	// secret base64 encoded. Peppers takes the same entries separated by
+	// commas from the environment, so secrets never sit in the config.
+	PepperFile string `yaml:"pepper_file" env:"SSO_PEPPER_FILE"`
+	Peppers    string `yaml:"-" env:"SSO_PEPPERS"`
+}
+
+// LogValue leaves the peppers out of the logs.
+func (c PasswordHashConfig) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("algorithm", c.Algorithm),
+		slog.Any("argon2_memory", c.Argon2Memory),
+		slog.Any("argon2_time", c.Argon2Time),
+		slog.Any("argon2_threads", c.Argon2Threads),
+		slog.Int("bcrypt_cost", c.BcryptCost),
+		slog.Int("pepper_version", c.Pepper),
+		slog.String("pepper_file", c.PepperFile),
+	)
+}
+
+// PasswordPolicyConfig is what a new password must satisfy. Imported
+// users keep whatever password they had.
+type PasswordPolicyConfig struct {
+	MinLength           int  `yaml:"min_length" env-default:"8"`
+	MaxLength           int  `yaml:"max_length" env-default:"128"`
+	MinCharacterClasses int  `yaml:"min_character_classes" env-default:"1"`
+	ForbidPersonalInfo  bool `yaml:"forbid_personal_info" env-default:"true"`
+	// MinStrength is the lowest zxcvbn-style score accepted, 0 to 4.
+	MinStrength int `yaml:"min_strength" env-default:"2"`
+	// CheckCommon rejects the common passwords shipped with the service.
+	CheckCommon bool `yaml:"check_common" env-default:"true"`
+	// BreachedFilter is a filter built by cmd/breachfilter, for example
+	// from the Pwned Passwords corpus.
+	BreachedFilter string `yaml:"breached_filter"`
+}
+
+// LoginThrottleConfig slows down password guessing. Failed logins are
+// counted per account and per client address, after the free attempts
+// every attempt waits BaseDelay, doubled with each failure up to MaxDelay,
+// and at the lockout threshold the account or address is locked out for
+// LockoutDuration. A threshold of 0 never locks out.
+type LoginThrottleConfig struct {
+	// Store is memory, counting in each instance alone, or database,
+	// sharing the counters through the storage backend.
+	Store               string        `yaml:"store" env-default:"memory"`
+	AccountFreeAttempts int           `yaml:"account_free_attempts" env-default:"3"`
+	AccountLockout      int           `yaml:"account_lockout" env-default:"10"`
+	IPFreeAttempts      int           `yaml:"ip_free_attempts" env-default:"20"`
+	IPLockout           int           `yaml:"ip_lockout" env-default:"100"`
+	BaseDelay           time.Duration `yaml:"base_delay" env-default:"1s"`
+	MaxDelay            time.Duration `yaml:"max_delay" env-default:"1m"`
+	LockoutDuration     time.Duration `yaml:"lockout_duration" env-default:"15m"`
+	// Window is how long failures are remembered after the last one.
+	Window time.Duration `yaml:"window" env-default:"1h"`
 }
 
+// RateLimitConfig limits the requests to every endpoint with a token
+// bucket per endpoint and client. Store is memory or database like the
+// login throttle's.
+type RateLimitConfig struct {
+	Store string         `yaml:"store" env-default:"memory"`
+	GRPC  EndpointLimits `yaml:"grpc"`
+	HTTP  EndpointLimits `yaml:"http"`
+}
+
+// EndpointLimits are keyed by the full gRPC method name, such as
+// /auth.Auth/Register, or the HTTP route pattern, such as POST /me.
+// Default applies to the endpoints not listed, a zero one to none.
+type EndpointLimits struct {
+	Default   RateLimit            `yaml:"default"`
+	Endpoints map[string]RateLimit `yaml:"endpoints"`
+}
+
+// RateLimit lets through Rate requests a second and Burst at once. By is
+// ip, a bucket per client address, or app, one per client address and
+// app_id of the request, for gRPC methods that take one.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	By    string  `yaml:"by"`
+}
+
+// LogValue is the config as logged on startup, its secrets left out by the
+// LogValue of the sections holding them.
+func (c *Config) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("env", c.Env),
+		slog.Duration("token_ttl", c.TokenTTL),
+		slog.Duration("email_verification_ttl", c.EmailVerificationTTL),
+		slog.Duration("deleted_user_retention", c.DeletedUserRetention),
+		slog.Any("apps", c.Apps),
+		slog.Any("grpc", c.GRPC),
+		slog.Any("storage", c.Storage),
+		slog.Any("postgres", c.PgDb),
+		slog.Any("migrations", c.Migrate),
+		slog.Any("http_server", c.HTTPConf),
+		slog.Any("hashing", c.PasswordHash),
+		slog.Any("password_policy", c.PasswordPolicy),
+		slog.Any("login_throttle", c.LoginThrottle),
+		slog.Any("rate_limit", c.RateLimit),
+		slog.Any("log", c.Log),
+		slog.Any("metrics", c.Metrics),
+		slog.Any("tracing", c.Tracing),
+	)
+}
+
+// MustLoad reads the config file given by the -config flag or CONFIG_PATH.
 func MustLoad() *Config {
-	path := fetchConfigPath()
+	return MustLoadPath(fetchConfigPath())
+}
+
+// MustLoadPath reads the config file at path, for commands that parse
+// their flags themselves.
+func MustLoadPath(path string) *Config {
 	if path == "" {
 		panic("config file is empty")
 	}
@@ -51,9 +329,157 @@ func MustLoad() *Config {
 		panic("failed to read config " + err.Error())
 	}
 
+	if err := config.validate(); err != nil {
+		panic("invalid config " + err.Error())
+	}
+
 	return &config
 }
 
+func (c *Config) validate() error {
+	if c.DeletedUserRetention < 0 {
+		return errors.New("deleted_user_retention must not be negative")
+	}
+
+	if p := c.PasswordPolicy; p.MinLength < 1 || (p.MaxLength > 0 && p.MaxLength < p.MinLength) ||
+		p.MinCharacterClasses < 0 || p.MinCharacterClasses > 4 || p.MinStrength < 0 || p.MinStrength > 4 {
+		return errors.New("password_policy: min_length must be positive and at most max_length, " +
+			"min_character_classes between 0 and 4, min_strength between 0 and 4")
+	}
+
+	if c.Env == EnvProd && c.Log.HashEmails && c.Log.EmailKey == "" {
+		return errors.New("log: hash_emails needs a key in SSO_LOG_EMAIL_KEY")
+	}
+
+	if c.Apps.Account <= 0 || c.Apps.Admin <= 0 {
+		return errors.New("apps: account and admin must be positive app ids")
+	}
+
+	if c.PasswordHash.Pepper < 0 {
+		return errors.New("password_hash: pepper must not be negative")
+	}
+
+	if err := c.LoginThrottle.validate(); err != nil {
+		return err
+	}
+
+	if err := c.RateLimit.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Tracing.validate(); err != nil {
+		return err
+	}
+
+	if h := c.HTTPConf; h.Timeout <= 0 || h.ReadTimeout <= 0 || h.WriteTimeout <= h.Timeout || h.MaxBodyBytes < 0 {
+		// with less time to write than to serve, the 503 of a request
+		// timing out would never reach the client
+		return errors.New("http_server: timeout and read_timeout must be positive, write_timeout more than timeout, " +
+			"max_body_bytes not negative")
+	}
+
+	switch c.Storage.Driver {
+	case StorageDriverPostgres:
+		return c.PgDb.validate()
+	case StorageDriverSQLite:
+		if c.Storage.SQLitePath == "" {
+			return errors.New("storage: sqlite_path is required")
+		}
+	default:
+		return fmt.Errorf("storage: unknown driver %q", c.Storage.Driver)
+	}
+	return nil
+}
+
+func (c *LoginThrottleConfig) validate() error {
+	if c.Store != ThrottleStoreMemory && c.Store != ThrottleStoreDatabase {
+		return fmt.Errorf("login_throttle: unknown store %q, use %s or %s", c.Store, ThrottleStoreMemory, ThrottleStoreDatabase)
+	}
+	if c.AccountFreeAttempts < 0 || c.AccountLockout < 0 || c.IPFreeAttempts < 0 || c.IPLockout < 0 {
+		return errors.New("login_throttle: attempts and lockout thresholds must not be negative")
+	}
+	if c.BaseDelay <= 0 || c.MaxDelay < c.BaseDelay || c.LockoutDuration <= 0 {
+		return errors.New("login_throttle: base_delay and lockout_duration must be positive, max_delay at least base_delay")
+	}
+	// counters forgotten earlier would end delays and lockouts early
+	if c.Window < c.MaxDelay || c.Window < c.LockoutDuration {
+		return errors.New("login_throttle: window must be at least max_delay and lockout_duration")
+	}
+	return nil
+}
+
+func (c *TracingConfig) validate() error {
+	switch c.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		return fmt.Errorf("tracing: unknown exporter %q, use otlp, stdout or none", c.Exporter)
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return errors.New("tracing: sample_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+func (c *RateLimitConfig) validate() error {
+	if c.Store != ThrottleStoreMemory && c.Store != ThrottleStoreDatabase {
+		return fmt.Errorf("rate_limit: unknown store %q, use %s or %s", c.Store, ThrottleStoreMemory, ThrottleStoreDatabase)
+	}
+	for section, limits := range map[string]EndpointLimits{"grpc": c.GRPC, "http": c.HTTP} {
+		if err := limits.Default.validate(section == "grpc"); err != nil {
+			return fmt.Errorf("rate_limit: %s default: %w", section, err)
+		}
+		for endpoint, limit := range limits.Endpoints {
+			if err := limit.validate(section == "grpc"); err != nil {
+				return fmt.Errorf("rate_limit: %s %s: %w", section, endpoint, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (l RateLimit) validate(byApp bool) error {
+	if l.Rate < 0 || l.Burst < 0 || (l.Rate > 0) != (l.Burst > 0) {
+		return errors.New("rate and burst must both be positive, or both zero for no limit")
+	}
+	switch l.By {
+	case "", "ip":
+	case "app":
+		if !byApp {
+			return errors.New("only gRPC methods can be limited by app")
+		}
+	default:
+		return fmt.Errorf("unknown by %q, use ip or app", l.By)
+	}
+	return nil
+}
+
+func (c *DBConfig) validate() error {
+	if c.URL == "" && (c.Host == "" || c.Port == 0 || c.Username == "" || c.Database == "") {
+		return errors.New("postgres: either dbURL or dbHost, dbPort, dbUser and dbName are required")
+	}
+
+	switch c.SSLMode {
+	case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		return fmt.Errorf("postgres: unknown dbSSLMode %q", c.SSLMode)
+	}
+
+	if (c.SSLCert == "") != (c.SSLKey == "") {
+		return errors.New("postgres: dbSSLCert and dbSSLKey must be set together")
+	}
+
+	// zero keeps the pgxpool default, which a MinConns above MaxConns
+	// would be checked against only once the pool opens
+	if c.MaxConns < 0 || c.MinConns < 0 || (c.MaxConns > 0 && c.MinConns > c.MaxConns) {
+		return errors.New("postgres: dbMaxConns and dbMinConns must not be negative, dbMinConns at most dbMaxConns")
+	}
+
+	if len(c.Replicas) > 0 && c.ReplicaCheckInterval <= 0 {
+		return errors.New("postgres: dbReplicaCheckInterval must be positive")
+	}
+	return nil
+}
+
 func fetchConfigPath() string {
 	var res string
 
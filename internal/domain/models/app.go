@@ -1,7 +1,17 @@
 package models
 
+import "log/slog"
+
 type App struct {
 	ID     int
 	Name   string
 	Secret string
 }
+
+// LogValue leaves the signing secret out of the logs.
+func (a App) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("id", a.ID),
+		slog.String("name", a.Name),
+	)
+}
@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// Group is a named set of users within one app, provisioned over SCIM.
+type Group struct {
+	ID          int64
+	AppID       int64
+	DisplayName string
+	Members     []GroupMember
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// GroupMember is a user in a group. Name is filled in on reads and ignored
+// on writes.
+type GroupMember struct {
+	UserID int64
+	Name   string
+}
+
+// SCIMToken authenticates an app's SCIM client. Only the hash of the token
+// handed out is stored.
+type SCIMToken struct {
+	TokenHash []byte
+	AppID     int64
+	CreatedAt time.Time
+}
@@ -1,8 +1,154 @@
 package models
 
+import (
+	"log/slog"
+	"time"
+)
+
+// User is a stored user. PepperVersion is the version of the server-side
+// pepper PassHash was made with, 0 for none.
 type User struct {
-	ID       int64
-	Name     string
-	Email    string
-	PassHash []byte
+	ID            int64
+	Name          string
+	Email         string
+	PassHash      []byte
+	PepperVersion int
+	EmailVerified bool
+	Status        UserStatus
+}
+
+// LogValue leaves the password hash and name out of the logs.
+func (u User) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int64("id", u.ID),
+		slog.String("email", u.Email),
+		slog.Bool("email_verified", u.EmailVerified),
+		slog.String("status", string(u.Status)),
+	)
+}
+
+// EmailVerification is a pending confirmation of Email. Only the hash of the
+// token sent to the user is stored.
+type EmailVerification struct {
+	TokenHash []byte
+	UserID    int64
+	Email     string
+	ExpiresAt time.Time
+}
+
+type UserStatus string
+
+const (
+	UserStatusActive   UserStatus = "active"
+	UserStatusDisabled UserStatus = "disabled"
+	UserStatusLocked   UserStatus = "locked"
+	// UserStatusDeleted is a soft delete: the user can be restored until the
+	// retention period ends and their email is released.
+	UserStatusDeleted UserStatus = "deleted"
+)
+
+// Valid reports whether s is one of the known statuses.
+func (s UserStatus) Valid() bool {
+	switch s {
+	case UserStatusActive, UserStatusDisabled, UserStatusLocked, UserStatusDeleted:
+		return true
+	}
+	return false
+}
+
+// UserInfo is what admin tooling may see of a user, it never carries the
+// password hash.
+type UserInfo struct {
+	ID            int64
+	Name          string
+	Email         string
+	EmailVerified bool
+	IsAdmin       bool
+	Status        UserStatus
+	StatusReason  string
+	// StatusChangedAt is zero for users whose status never changed.
+	StatusChangedAt time.Time
+	CreatedAt       time.Time
+}
+
+// UserFilter selects users for the admin directory. Zero values do not
+// filter. Results are ordered by id, AfterID is the keyset cursor.
+type UserFilter struct {
+	// Email matches the whole address, case-insensitively.
+	Email         string
+	EmailPrefix   string
+	Name          string
+	IsAdmin       *bool
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Statuses      []UserStatus
+	// ProvisionedBy keeps the users the app provisioned over SCIM.
+	ProvisionedBy int64
+	AfterID       int64
+	// Offset skips that many users past AfterID.
+	Offset int
+	Limit  int
+}
+
+// UserData is everything stored about a user, for subject access requests.
+type UserData struct {
+	User          UserInfo
+	Verifications []EmailVerification
+	// Groups the user is a member of, without their members.
+	Groups []Group
+	// SCIMApps are the apps that provisioned the user over SCIM.
+	SCIMApps []int64
+	// LoginFailures are the failed logins counted against the account by
+	// the database login throttle, nil when there are none.
+	LoginFailures *LoginFailures
+}
+
+// LoginFailures is the count of failed logins to an account.
+type LoginFailures struct {
+	Failures      int
+	LastFailureAt time.Time
+}
+
+// ErasedUser is the tombstone left by a hard erase. It records that the
+// user existed and was erased, nothing that identifies them.
+type ErasedUser struct {
+	UserID int64
+	// ErasedBy is the admin who erased the user, zero when erased by an
+	// operator from the command line.
+	ErasedBy int64
+	Reason   string
+	ErasedAt time.Time
+}
+
+// PortableUser is a user as moved between systems by bulk import and
+// export, password hash included.
+type PortableUser struct {
+	// ID is set on export and ignored on import.
+	ID            int64
+	Email         string
+	Name          string
+	PassHash      []byte
+	PepperVersion int
+	EmailVerified bool
+	Status        UserStatus
+	CreatedAt     time.Time
+}
+
+// LogValue leaves the password hash and name out of the logs, like
+// User.LogValue.
+func (u PortableUser) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int64("id", u.ID),
+		slog.String("email", u.Email),
+		slog.Int("pepper_version", u.PepperVersion),
+		slog.Bool("email_verified", u.EmailVerified),
+		slog.String("status", string(u.Status)),
+	)
+}
+
+// ImportResult is the outcome of importing one PortableUser: the new id,
+// or the error the row was skipped with.
+type ImportResult struct {
+	ID  int64
+	Err error
 }
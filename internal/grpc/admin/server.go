@@ -0,0 +1,332 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	ssopb "sso/gen/go/sso"
+	"sso/internal/domain/models"
+	"sso/internal/lib/userfile"
+	"sso/internal/services/admin"
+	"sso/internal/services/bulk"
+	"sso/internal/services/gdpr"
+)
+
+type Admin interface {
+	ListUsers(
+		ctx context.Context,
+		token string,
+		filter models.UserFilter,
+		pageSize int,
+		pageToken string,
+	) (users []models.UserInfo, nextPageToken string, err error)
+	SetUserStatus(
+		ctx context.Context,
+		token string,
+		userID int64,
+		status models.UserStatus,
+		reason string,
+	) error
+	ExportUser(ctx context.Context, token string, userID int64) (gdpr.Archive, error)
+	EraseUser(ctx context.Context, token string, userID int64, reason string) error
+	ImportUsers(
+		ctx context.Context,
+		token string,
+		next func() (userfile.Record, error),
+		opts bulk.ImportOptions,
+		report func(bulk.Result) error,
+	) (bulk.Summary, error)
+	ExportUsers(ctx context.Context, token string, write func(userfile.Record) error) (int, error)
+}
+
+type serverAPI struct {
+	ssopb.UnimplementedAdminServer
+	admin Admin
+}
+
+func Register(gRPC *grpc.Server, admin *admin.Admin) {
+	ssopb.RegisterAdminServer(gRPC, &serverAPI{admin: admin})
+}
+
+func (s *serverAPI) ListUsers(ctx context.Context, in *ssopb.ListUsersRequest) (*ssopb.ListUsersResponse, error) {
+	if in.GetToken() == "" {
+		return nil, status.Error(codes.Unauthenticated, "token is required")
+	}
+	if in.GetPageSize() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid page size")
+	}
+
+	fields, err := admin.SelectFields(in.GetFields().GetPaths())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	filter := models.UserFilter{
+		EmailPrefix: in.GetEmailPrefix(),
+		Name:        in.GetName(),
+		IsAdmin:     in.IsAdmin,
+	}
+	if in.CreatedAfter != nil {
+		filter.CreatedAfter = in.GetCreatedAfter().AsTime()
+	}
+	if in.CreatedBefore != nil {
+		filter.CreatedBefore = in.GetCreatedBefore().AsTime()
+	}
+	for _, st := range in.GetStatuses() {
+		filter.Statuses = append(filter.Statuses, models.UserStatus(st))
+	}
+
+	users, next, err := s.admin.ListUsers(ctx, in.GetToken(), filter, int(in.GetPageSize()), in.GetPageToken())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	resp := &ssopb.ListUsersResponse{NextPageToken: next}
+	for _, user := range users {
+		resp.Users = append(resp.Users, toProto(user, fields))
+	}
+	return resp, nil
+}
+
+func (s *serverAPI) SetUserStatus(ctx context.Context, in *ssopb.SetUserStatusRequest) (*ssopb.SetUserStatusResponse, error) {
+	if in.GetToken() == "" {
+		return nil, status.Error(codes.Unauthenticated, "token is required")
+	}
+	if in.GetUserId() <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid user id")
+	}
+	if !models.UserStatus(in.GetStatus()).Valid() {
+		return nil, status.Error(codes.InvalidArgument, "invalid status")
+	}
+
+	err := s.admin.SetUserStatus(ctx, in.GetToken(), in.GetUserId(), models.UserStatus(in.GetStatus()), in.GetReason())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &ssopb.SetUserStatusResponse{}, nil
+}
+
+func (s *serverAPI) ExportUser(ctx context.Context, in *ssopb.ExportUserRequest) (*ssopb.ExportUserResponse, error) {
+	if in.GetToken() == "" {
+		return nil, status.Error(codes.Unauthenticated, "token is required")
+	}
+	if in.GetUserId() <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid user id")
+	}
+
+	archive, err := s.admin.ExportUser(ctx, in.GetToken(), in.GetUserId())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	raw, err := json.Marshal(archive)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+
+	return &ssopb.ExportUserResponse{Archive: raw}, nil
+}
+
+func (s *serverAPI) EraseUser(ctx context.Context, in *ssopb.EraseUserRequest) (*ssopb.EraseUserResponse, error) {
+	if in.GetToken() == "" {
+		return nil, status.Error(codes.Unauthenticated, "token is required")
+	}
+	if in.GetUserId() <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid user id")
+	}
+
+	if err := s.admin.EraseUser(ctx, in.GetToken(), in.GetUserId(), in.GetReason()); err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &ssopb.EraseUserResponse{}, nil
+}
+
+func (s *serverAPI) ImportUsers(stream grpc.BidiStreamingServer[ssopb.ImportUsersRequest, ssopb.ImportUsersResponse]) error {
+	first, err := stream.Recv()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return status.Error(codes.InvalidArgument, "options are required")
+		}
+		return err
+	}
+	opts := first.GetOptions()
+	if opts == nil {
+		return status.Error(codes.InvalidArgument, "the first message must carry options")
+	}
+	if opts.GetToken() == "" {
+		return status.Error(codes.Unauthenticated, "token is required")
+	}
+	if opts.GetBatchSize() < 0 {
+		return status.Error(codes.InvalidArgument, "invalid batch size")
+	}
+
+	// errors of the stream itself are returned as they are rather than
+	// through toStatus
+	var recvErr error
+	row := 0
+	next := func() (userfile.Record, error) {
+		in, err := stream.Recv()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				recvErr = err
+			}
+			return userfile.Record{}, err
+		}
+		row++
+		user := in.GetUser()
+		if user == nil {
+			return userfile.Record{}, &userfile.RowError{Line: row, Err: errors.New("message carries no user")}
+		}
+		return fromPortable(user), nil
+	}
+	report := func(r bulk.Result) error {
+		result := &ssopb.ImportUserResult{
+			Row:     int64(r.Row),
+			Email:   r.Email,
+			Outcome: ssopb.ImportOutcome_IMPORT_OUTCOME_IMPORTED,
+			UserId:  r.UserID,
+		}
+		switch {
+		case errors.Is(r.Err, bulk.ErrInvalidRow):
+			result.Outcome = ssopb.ImportOutcome_IMPORT_OUTCOME_INVALID
+			result.Error = r.Err.Error()
+		case errors.Is(r.Err, bulk.ErrUserExists):
+			result.Outcome = ssopb.ImportOutcome_IMPORT_OUTCOME_ALREADY_EXISTS
+			result.Error = r.Err.Error()
+		}
+		if err := stream.Send(&ssopb.ImportUsersResponse{
+			Payload: &ssopb.ImportUsersResponse_Result{Result: result},
+		}); err != nil {
+			recvErr = err
+			return err
+		}
+		return nil
+	}
+
+	summary, err := s.admin.ImportUsers(stream.Context(), opts.GetToken(), next, bulk.ImportOptions{
+		DryRun:    opts.GetDryRun(),
+		BatchSize: int(opts.GetBatchSize()),
+	}, report)
+	if err != nil {
+		if recvErr != nil {
+			return recvErr
+		}
+		return toStatus(err)
+	}
+
+	return stream.Send(&ssopb.ImportUsersResponse{
+		Payload: &ssopb.ImportUsersResponse_Summary{Summary: &ssopb.ImportUsersSummary{
+			Imported:      int64(summary.Imported),
+			AlreadyExists: int64(summary.Existing),
+			Invalid:       int64(summary.Invalid),
+		}},
+	})
+}
+
+func (s *serverAPI) ExportUsers(in *ssopb.ExportUsersRequest, stream grpc.ServerStreamingServer[ssopb.ExportUsersResponse]) error {
+	if in.GetToken() == "" {
+		return status.Error(codes.Unauthenticated, "token is required")
+	}
+
+	var sendErr error
+	_, err := s.admin.ExportUsers(stream.Context(), in.GetToken(), func(rec userfile.Record) error {
+		sendErr = stream.Send(&ssopb.ExportUsersResponse{User: toPortable(rec)})
+		return sendErr
+	})
+	if err != nil {
+		if sendErr != nil {
+			return sendErr
+		}
+		return toStatus(err)
+	}
+	return nil
+}
+
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, admin.ErrInvalidToken):
+		return status.Error(codes.Unauthenticated, "invalid token")
+	case errors.Is(err, admin.ErrPermissionDenied):
+		return status.Error(codes.PermissionDenied, "permission denied")
+	case errors.Is(err, admin.ErrInvalidPageToken):
+		return status.Error(codes.InvalidArgument, "invalid page token")
+	case errors.Is(err, admin.ErrInvalidField):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, admin.ErrInvalidStatus):
+		return status.Error(codes.InvalidArgument, "invalid status")
+	case errors.Is(err, admin.ErrUserNotFound):
+		return status.Error(codes.NotFound, "user not found")
+	case errors.Is(err, admin.ErrEmailReleased):
+		return status.Error(codes.FailedPrecondition, "user was deleted and their email released")
+	case errors.Is(err, admin.ErrUserErased):
+		return status.Error(codes.NotFound, "user was erased")
+	}
+	return status.Error(codes.Internal, "internal server error")
+}
+
+func toProto(user models.UserInfo, fields admin.FieldSet) *ssopb.UserRecord {
+	record := &ssopb.UserRecord{Id: user.ID}
+	if fields.Has("name") {
+		record.Name = user.Name
+	}
+	if fields.Has("email") {
+		record.Email = user.Email
+	}
+	if fields.Has("email_verified") {
+		record.EmailVerified = user.EmailVerified
+	}
+	if fields.Has("is_admin") {
+		record.IsAdmin = user.IsAdmin
+	}
+	if fields.Has("status") {
+		record.Status = string(user.Status)
+	}
+	if fields.Has("status_reason") {
+		record.StatusReason = user.StatusReason
+	}
+	if fields.Has("status_changed_at") && !user.StatusChangedAt.IsZero() {
+		record.StatusChangedAt = timestamppb.New(user.StatusChangedAt)
+	}
+	if fields.Has("created_at") {
+		record.CreatedAt = timestamppb.New(user.CreatedAt)
+	}
+	return record
+}
+
+func fromPortable(user *ssopb.PortableUser) userfile.Record {
+	rec := userfile.Record{
+		Email:         user.GetEmail(),
+		Name:          user.GetName(),
+		PasswordHash:  user.GetPasswordHash(),
+		Password:      user.GetPassword(),
+		EmailVerified: user.GetEmailVerified(),
+		Status:        user.GetStatus(),
+	}
+	if user.CreatedAt != nil {
+		createdAt := user.GetCreatedAt().AsTime()
+		rec.CreatedAt = &createdAt
+	}
+	return rec
+}
+
+func toPortable(rec userfile.Record) *ssopb.PortableUser {
+	user := &ssopb.PortableUser{
+		Id:            rec.ID,
+		Email:         rec.Email,
+		Name:          rec.Name,
+		PasswordHash:  rec.PasswordHash,
+		EmailVerified: rec.EmailVerified,
+		Status:        rec.Status,
+	}
+	if rec.CreatedAt != nil {
+		user.CreatedAt = timestamppb.New(*rec.CreatedAt)
+	}
+	return user
+}
@@ -4,12 +4,20 @@ import (
 	"context"
 	"errors"
 	ssov1 "github.com/dmitry-muffin/protos/gen/go/sso"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"net/mail"
+	"sso/internal/lib/netutil"
+	"sso/internal/lib/passpolicy"
 	"sso/internal/services/auth"
 	"sso/internal/storage"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Auth interface {
@@ -18,12 +26,13 @@ type Auth interface {
 		email string,
 		password string,
 		appID int32,
+		clientIP string,
 	) (token string, err error)
 
 	RegisterNewUser(
 		ctx context.Context,
-		name string,
 		email string,
+		name string,
 		password string,
 	) (userID int64, err error)
 
@@ -49,10 +58,21 @@ func (s *serverAPI) Login(ctx context.Context, in *ssov1.LoginRequest) (*ssov1.L
 	if err := validateLogin(in); err != nil {
 		return nil, err
 	}
-	token, err := s.auth.Login(ctx, in.GetEmail(), in.GetPassword(), in.GetAppId())
+	token, err := s.auth.Login(ctx, in.GetEmail(), in.GetPassword(), in.GetAppId(), netutil.PeerIP(ctx))
 	if err != nil {
-		if errors.Is(err, auth.ErrInvalidCredentials) {
-			return nil, status.Error(codes.InvalidArgument, err.Error())
+		var throttled *auth.ThrottledError
+		if errors.As(err, &throttled) {
+			return nil, throttledError(ctx, throttled)
+		}
+		switch {
+		case errors.Is(err, auth.ErrInvalidCredentials), errors.Is(err, auth.ErrUserDeleted):
+			// a deleted account is answered like a wrong password, so it is
+			// not told apart from an email nobody registered
+			return nil, status.Error(codes.InvalidArgument, auth.ErrInvalidCredentials.Error())
+		case errors.Is(err, auth.ErrAccountUnavailable):
+			return nil, status.Error(codes.PermissionDenied, auth.ErrAccountUnavailable.Error())
+		case errors.Is(err, storage.ErrAppNotFound):
+			return nil, status.Error(codes.InvalidArgument, "invalid app id")
 		}
 		return nil, status.Error(codes.Internal, "internal server error")
 	}
@@ -67,13 +87,17 @@ func (s *serverAPI) Register(ctx context.Context, in *ssov1.RegisterRequest) (*s
 		return nil, err
 	}
 
-	userID, err := s.auth.RegisterNewUser(ctx, in.GetName(), in.GetEmail(), in.GetPassword())
+	userID, err := s.auth.RegisterNewUser(ctx, in.GetEmail(), in.GetName(), in.GetPassword())
 	if err != nil {
 		if errors.Is(err, auth.ErrUserExists) {
 
 			return nil, status.Error(codes.AlreadyExists, "user already exists")
 
 		}
+		var policyErr *passpolicy.Error
+		if errors.As(err, &policyErr) {
+			return nil, weakPasswordError(policyErr)
+		}
 
 		return nil, status.Error(codes.Internal, "internal server error")
 	}
@@ -108,9 +132,6 @@ func validateLogin(request *ssov1.LoginRequest) error {
 	if request.GetPassword() == "" {
 		return status.Error(codes.InvalidArgument, "invalid password")
 	}
-	//if request.GetAppId() == emptyValue {
-	//	return status.Error(codes.InvalidArgument, "invalid app id")
-	//}
 	return nil
 }
 
@@ -129,6 +150,39 @@ func validateRegister(request *ssov1.RegisterRequest) error {
 	return nil
 }
 
+// weakPasswordError reports every broken rule as a field violation of the
+// password.
+func weakPasswordError(policyErr *passpolicy.Error) error {
+	st := status.New(codes.InvalidArgument, passpolicy.ErrWeakPassword.Error())
+
+	details := &errdetails.BadRequest{}
+	for _, v := range policyErr.Violations {
+		details.FieldViolations = append(details.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       "password",
+			Description: v.Description,
+			Reason:      strings.ToUpper(v.Rule),
+		})
+	}
+	if withDetails, err := st.WithDetails(details); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
+// throttledError tells the client when to try again, both as RetryInfo and
+// as a retry-after header in whole seconds, like its HTTP counterpart.
+func throttledError(ctx context.Context, throttled *auth.ThrottledError) error {
+	retryAfter := throttled.RetryAfterSeconds()
+	_ = grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(retryAfter)))
+
+	st := status.New(codes.ResourceExhausted, auth.ErrTooManyAttempts.Error())
+	details := &errdetails.RetryInfo{RetryDelay: durationpb.New(time.Duration(retryAfter) * time.Second)}
+	if withDetails, err := st.WithDetails(details); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
 func validateIsAdmin(request *ssov1.IsAdminRequest) error {
 	if request.GetUserId() == emptyValue {
 		return status.Error(codes.InvalidArgument, "invalid user id")
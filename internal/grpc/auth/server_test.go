@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	ssov1 "github.com/dmitry-muffin/protos/gen/go/sso"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"sso/internal/services/auth"
+	"sso/internal/storage"
+)
+
+// fakeAuth fails every login with err.
+type fakeAuth struct {
+	err error
+}
+
+func (f fakeAuth) Login(context.Context, string, string, int32, string) (string, error) {
+	return "", f.err
+}
+
+func (f fakeAuth) RegisterNewUser(context.Context, string, string, string) (int64, error) {
+	return 0, f.err
+}
+
+func (f fakeAuth) IsAdmin(context.Context, int64) (bool, error) { return false, f.err }
+
+// TestLoginStatus checks that a login refused for the status of the
+// account does not tell which status it is, and that one refused for a
+// deleted account is answered like a wrong password.
+func TestLoginStatus(t *testing.T) {
+	login := func(err error) *status.Status {
+		s := &serverAPI{auth: fakeAuth{err: err}}
+		_, err = s.Login(context.Background(), &ssov1.LoginRequest{Email: "alice@example.com", Password: "pw", AppId: 1})
+		st, _ := status.FromError(err)
+		return st
+	}
+
+	var messages []string
+	for _, statusErr := range []error{auth.ErrUserDisabled, auth.ErrUserLocked} {
+		st := login(fmt.Errorf("auth.Login: %w: %w", auth.ErrAccountUnavailable, statusErr))
+		if st.Code() != codes.PermissionDenied {
+			t.Errorf("%v: code %v, want PermissionDenied", statusErr, st.Code())
+		}
+		messages = append(messages, st.Message())
+	}
+	if messages[0] != messages[1] {
+		t.Errorf("messages differ by status: %q", messages)
+	}
+
+	deleted := login(fmt.Errorf("auth.Login: %w: %w", auth.ErrAccountUnavailable, auth.ErrUserDeleted))
+	wrongPassword := login(fmt.Errorf("auth.Login: %w", auth.ErrInvalidCredentials))
+	if deleted.Code() != codes.InvalidArgument || deleted.Message() != wrongPassword.Message() {
+		t.Errorf("deleted account: %v %q, want %v %q like a wrong password",
+			deleted.Code(), deleted.Message(), wrongPassword.Code(), wrongPassword.Message())
+	}
+
+	s := &serverAPI{auth: fakeAuth{err: errors.New("connection refused")}}
+	_, err := s.Login(context.Background(), &ssov1.LoginRequest{Email: "alice@example.com", Password: "pw", AppId: 1})
+	if status.Code(err) != codes.Internal {
+		t.Errorf("internal error: code %v, want Internal", status.Code(err))
+	}
+}
+
+// TestLoginUnknownApp checks that an unknown app id is the caller's
+// mistake, as it is over HTTP.
+func TestLoginUnknownApp(t *testing.T) {
+	s := &serverAPI{auth: fakeAuth{err: fmt.Errorf("auth.Login: %w", storage.ErrAppNotFound)}}
+
+	_, err := s.Login(context.Background(), &ssov1.LoginRequest{Email: "alice@example.com", Password: "pw", AppId: 42})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("code %v, want InvalidArgument", status.Code(err))
+	}
+}
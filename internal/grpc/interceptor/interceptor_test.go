@@ -0,0 +1,187 @@
+package interceptor
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"sso/internal/lib/requestid"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeHealth is a service to put interceptors in front of. Check and Watch
+// run check, Watch sends its one response.
+type fakeHealth struct {
+	healthpb.UnimplementedHealthServer
+	check func(ctx context.Context) error
+}
+
+func (h fakeHealth) Check(ctx context.Context, _ *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if err := h.check(ctx); err != nil {
+		return nil, err
+	}
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+}
+
+func (h fakeHealth) Watch(_ *healthpb.HealthCheckRequest, stream grpc.ServerStreamingServer[healthpb.HealthCheckResponse]) error {
+	if err := h.check(stream.Context()); err != nil {
+		return err
+	}
+	return stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING})
+}
+
+// dial serves health over an in-memory connection, with the interceptors
+// in opts, and returns a client of it.
+func dial(t *testing.T, health healthpb.HealthServer, opts ...grpc.ServerOption) healthpb.HealthClient {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(opts...)
+	healthpb.RegisterHealthServer(srv, health)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return healthpb.NewHealthClient(conn)
+}
+
+// watch calls Watch and returns the error of its first response.
+func watch(ctx context.Context, client healthpb.HealthClient) error {
+	_, err := watchHeader(ctx, client)
+	return err
+}
+
+// watchHeader calls Watch and returns the header and the error of its
+// first response.
+func watchHeader(ctx context.Context, client healthpb.HealthClient) (metadata.MD, error) {
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return nil, err
+	}
+	_, err = stream.Recv()
+	header, _ := stream.Header()
+	return header, err
+}
+
+func TestRecovery(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&buf, nil))
+	client := dial(t, fakeHealth{check: func(context.Context) error { panic("boom") }},
+		grpc.UnaryInterceptor(Recovery(log)),
+		grpc.StreamInterceptor(StreamRecovery(log)),
+	)
+	ctx := context.Background()
+
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); status.Code(err) != codes.Internal {
+		t.Errorf("Check = %v, want Internal", err)
+	}
+	if err := watch(ctx, client); status.Code(err) != codes.Internal {
+		t.Errorf("Watch = %v, want Internal", err)
+	}
+	if out := buf.String(); strings.Count(out, "panic in gRPC handler") != 2 || !strings.Contains(out, "boom") {
+		t.Errorf("panics not logged:\n%s", out)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var got string
+	client := dial(t, fakeHealth{check: func(ctx context.Context) error {
+		got = requestid.From(ctx)
+		return nil
+	}},
+		grpc.UnaryInterceptor(RequestID()),
+		grpc.StreamInterceptor(StreamRequestID()),
+	)
+
+	tests := []struct {
+		name string
+		sent string
+		want func(string) bool
+	}{
+		{"sent by the client", "req-1", func(id string) bool { return id == "req-1" }},
+		{"none", "", func(id string) bool { return len(id) == 32 }},
+		{"invalid", "req 1", func(id string) bool { return len(id) == 32 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.sent != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, requestIDKey, tt.sent)
+			}
+
+			var header metadata.MD
+			if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Header(&header)); err != nil {
+				t.Fatalf("Check: %v", err)
+			}
+			if ids := header.Get(requestIDKey); len(ids) != 1 || !tt.want(ids[0]) || ids[0] != got {
+				t.Errorf("Check: header %v, handler got %q", ids, got)
+			}
+
+			header, err := watchHeader(ctx, client)
+			if err != nil {
+				t.Fatalf("Watch: %v", err)
+			}
+			if ids := header.Get(requestIDKey); len(ids) != 1 || !tt.want(ids[0]) || ids[0] != got {
+				t.Errorf("Watch: header %v, handler got %q", ids, got)
+			}
+		})
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	var remaining time.Duration
+	client := dial(t, fakeHealth{check: func(ctx context.Context) error {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return status.Error(codes.FailedPrecondition, "no deadline")
+		}
+		remaining = time.Until(deadline)
+		return nil
+	}},
+		grpc.UnaryInterceptor(Deadline(time.Minute)),
+		grpc.StreamInterceptor(StreamDeadline(time.Hour)),
+	)
+
+	// within is a remaining time close below d
+	within := func(d time.Duration) bool { return remaining > d-10*time.Second && remaining <= d }
+
+	ctx := context.Background()
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil || !within(time.Minute) {
+		t.Errorf("Check without a deadline: %v, %v left, want a minute", err, remaining)
+	}
+	if err := watch(ctx, client); err != nil || !within(time.Hour) {
+		t.Errorf("Watch without a deadline: %v, %v left, want an hour", err, remaining)
+	}
+
+	// the client's deadline stands, whether shorter or longer
+	for _, d := range []time.Duration{20 * time.Second, 2 * time.Hour} {
+		ctx, cancel := context.WithTimeout(context.Background(), d)
+		if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil || !within(d) {
+			t.Errorf("Check with a %v deadline: %v, %v left", d, err, remaining)
+		}
+		if err := watch(ctx, client); err != nil || !within(d) {
+			t.Errorf("Watch with a %v deadline: %v, %v left", d, err, remaining)
+		}
+		cancel()
+	}
+}
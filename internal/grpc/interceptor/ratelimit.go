@@ -0,0 +1,118 @@
+package interceptor
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"sso/internal/lib/netutil"
+	"sso/internal/lib/ratelimit"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// RateLimit rejects calls with ResourceExhausted once the bucket of their
+// method and client is empty. The state of the bucket goes out in the
+// ratelimit-limit, ratelimit-remaining and ratelimit-reset headers. Calls
+// go through when the limiter fails, rather than failing them all.
+func RateLimit(log *slog.Logger, limiter *ratelimit.Limiter, rules ratelimit.Rules) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		setHeader := func(md metadata.MD) error { return grpc.SetHeader(ctx, md) }
+		if err := limit(ctx, log, limiter, rules, info.FullMethod, req, setHeader); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamRateLimit is RateLimit for streams, counting the opening of a
+// stream as one call. No message is read when it opens, so streams are
+// counted by client address whatever their rule.
+func StreamRateLimit(log *slog.Logger, limiter *ratelimit.Limiter, rules ratelimit.Rules) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := limit(ss.Context(), log, limiter, rules, info.FullMethod, nil, ss.SetHeader); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// limit takes a token for the call to method with req, nil for a stream,
+// and returns the ResourceExhausted status when there is none left.
+func limit(
+	ctx context.Context,
+	log *slog.Logger,
+	limiter *ratelimit.Limiter,
+	rules ratelimit.Rules,
+	method string,
+	req any,
+	setHeader func(metadata.MD) error,
+) error {
+	rule, ok := rules.For(method)
+	if !ok {
+		return nil
+	}
+
+	// the headers tell of the bucket closest to empty, the one that turned
+	// the call away when one did
+	var res ratelimit.Result
+	for i, subject := range subjects(ctx, req, rule.By) {
+		r, err := limiter.Allow(ctx, method+"|"+subject, rule.Limit)
+		if err != nil {
+			log.Error("failed to check rate limit",
+				slog.String("op", "interceptor.RateLimit"),
+				slog.String("method", method),
+				slog.String("error", err.Error()),
+			)
+			return nil
+		}
+		if i == 0 || !r.Allowed || r.Remaining < res.Remaining {
+			res = r
+		}
+		if !r.Allowed {
+			break
+		}
+	}
+
+	header := metadata.Pairs(
+		"ratelimit-limit", strconv.Itoa(res.Limit),
+		"ratelimit-remaining", strconv.Itoa(res.Remaining),
+		"ratelimit-reset", strconv.Itoa(ratelimit.Seconds(res.Reset)),
+	)
+	if res.Allowed {
+		_ = setHeader(header)
+		return nil
+	}
+
+	retryAfter := ratelimit.Seconds(res.RetryAfter)
+	header.Set("retry-after", strconv.Itoa(retryAfter))
+	_ = setHeader(header)
+
+	st := status.New(codes.ResourceExhausted, "rate limit exceeded")
+	details := &errdetails.RetryInfo{RetryDelay: durationpb.New(time.Duration(retryAfter) * time.Second)}
+	if withDetails, err := st.WithDetails(details); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
+// subjects are the buckets the call is counted against: the client
+// address, and when limited by app and the request names one, the app for
+// that client as well. The app_id is not authenticated, so the bucket of
+// the address is always charged too, a client rotating app_id cannot
+// multiply its quota, nor use up the bucket another client has for an app.
+func subjects(ctx context.Context, req any, by ratelimit.KeyBy) []string {
+	ip := "ip:" + netutil.PeerIP(ctx)
+	if by == ratelimit.ByApp {
+		if r, ok := req.(interface{ GetAppId() int32 }); ok && r.GetAppId() != 0 {
+			return []string{ip, ip + "|app:" + strconv.Itoa(int(r.GetAppId()))}
+		}
+	}
+	return []string{ip}
+}
@@ -0,0 +1,135 @@
+package interceptor
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"testing"
+
+	"sso/internal/lib/ratelimit"
+
+	ssov1 "github.com/dmitry-muffin/protos/gen/go/sso"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestRateLimit(t *testing.T) {
+	rules := ratelimit.Rules{Endpoints: map[string]ratelimit.Rule{
+		healthpb.Health_Check_FullMethodName: {Limit: ratelimit.Limit{Rate: 0.01, Burst: 2}, By: ratelimit.ByIP},
+	}}
+	client := dial(t, fakeHealth{check: func(context.Context) error { return nil }},
+		grpc.UnaryInterceptor(RateLimit(slog.New(slog.DiscardHandler), ratelimit.New(ratelimit.NewMemoryStore()), rules)),
+	)
+	ctx := context.Background()
+
+	for i := range 2 {
+		var header metadata.MD
+		if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Header(&header)); err != nil {
+			t.Fatalf("call %d: %v", i+1, err)
+		}
+		if got := header.Get("ratelimit-remaining"); len(got) != 1 || got[0] != []string{"1", "0"}[i] {
+			t.Errorf("call %d: ratelimit-remaining = %v", i+1, got)
+		}
+	}
+
+	var header metadata.MD
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("call over the burst = %v, want ResourceExhausted", err)
+	}
+	if got := header.Get("retry-after"); len(got) != 1 || got[0] != "100" {
+		t.Errorf("retry-after = %v, want 100", got)
+	}
+	var retry *errdetails.RetryInfo
+	for _, d := range st.Details() {
+		if r, ok := d.(*errdetails.RetryInfo); ok {
+			retry = r
+		}
+	}
+	if retry == nil || retry.GetRetryDelay().GetSeconds() != 100 {
+		t.Errorf("details = %v, want a RetryInfo of 100s", st.Details())
+	}
+
+	// methods without a rule are not limited
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Watch Recv: %v", err)
+	}
+}
+
+// TestRateLimitByApp checks that buckets by app are per client as well,
+// and that a client rotating app_id still runs out of calls, the app_id
+// of a request being the client's word only.
+func TestRateLimitByApp(t *testing.T) {
+	from := func(ip string) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 4242}})
+	}
+	rules := ratelimit.Rules{Endpoints: map[string]ratelimit.Rule{
+		ssov1.Auth_Login_FullMethodName: {Limit: ratelimit.Limit{Rate: 0.01, Burst: 2}, By: ratelimit.ByApp},
+	}}
+	intercept := RateLimit(slog.New(slog.DiscardHandler), ratelimit.New(ratelimit.NewMemoryStore()), rules)
+	info := &grpc.UnaryServerInfo{FullMethod: ssov1.Auth_Login_FullMethodName}
+	handler := func(context.Context, any) (any, error) { return nil, nil }
+	login := func(ip string, appID int32) error {
+		_, err := intercept(from(ip), &ssov1.LoginRequest{AppId: appID}, info, handler)
+		return err
+	}
+
+	for appID := range int32(2) {
+		if err := login("192.0.2.1", appID+1); err != nil {
+			t.Fatalf("app %d: %v", appID+1, err)
+		}
+	}
+	if err := login("192.0.2.1", 3); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("call for another app over the burst = %v, want ResourceExhausted", err)
+	}
+
+	// another client is not held back by the first
+	if err := login("192.0.2.2", 1); err != nil {
+		t.Errorf("call from another client: %v", err)
+	}
+	if err := login("192.0.2.2", 1); err != nil {
+		t.Errorf("second call from another client: %v", err)
+	}
+	if err := login("192.0.2.2", 1); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("call for the same app over the burst = %v, want ResourceExhausted", err)
+	}
+}
+
+func TestStreamRateLimit(t *testing.T) {
+	rules := ratelimit.Rules{Endpoints: map[string]ratelimit.Rule{
+		healthpb.Health_Watch_FullMethodName: {Limit: ratelimit.Limit{Rate: 0.01, Burst: 1}, By: ratelimit.ByApp},
+	}}
+	client := dial(t, fakeHealth{check: func(context.Context) error { return nil }},
+		grpc.StreamInterceptor(StreamRateLimit(slog.New(slog.DiscardHandler), ratelimit.New(ratelimit.NewMemoryStore()), rules)),
+	)
+	ctx := context.Background()
+
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("first stream: %v", err)
+	}
+	if header, _ := stream.Header(); len(header.Get("ratelimit-remaining")) != 1 {
+		t.Errorf("first stream header = %v, want ratelimit-remaining", header)
+	}
+
+	stream, err = client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("stream over the burst = %v, want ResourceExhausted", err)
+	}
+}
@@ -0,0 +1,146 @@
+package profile
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/mail"
+	ssopb "sso/gen/go/sso"
+	"sso/internal/domain/models"
+	"sso/internal/services/profile"
+)
+
+type Profile interface {
+	GetUser(ctx context.Context, token string, userID int64) (models.User, error)
+	GetMe(ctx context.Context, token string) (models.User, error)
+	UpdateProfile(
+		ctx context.Context,
+		token string,
+		name *string,
+		email *string,
+	) (user models.User, verificationSent bool, err error)
+	VerifyEmail(ctx context.Context, verificationToken string) error
+}
+
+type serverAPI struct {
+	ssopb.UnimplementedProfileServer
+	profile Profile
+}
+
+func Register(gRPC *grpc.Server, profile *profile.Profile) {
+	ssopb.RegisterProfileServer(gRPC, &serverAPI{profile: profile})
+}
+
+const (
+	emptyValue = 0
+)
+
+func (s *serverAPI) GetUser(ctx context.Context, in *ssopb.GetUserRequest) (*ssopb.GetUserResponse, error) {
+	if err := validateGetUser(in); err != nil {
+		return nil, err
+	}
+
+	user, err := s.profile.GetUser(ctx, in.GetToken(), in.GetUserId())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &ssopb.GetUserResponse{
+		User: toProto(user),
+	}, nil
+}
+
+func (s *serverAPI) GetMe(ctx context.Context, in *ssopb.GetMeRequest) (*ssopb.GetMeResponse, error) {
+	if in.GetToken() == "" {
+		return nil, status.Error(codes.Unauthenticated, "token is required")
+	}
+
+	user, err := s.profile.GetMe(ctx, in.GetToken())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &ssopb.GetMeResponse{
+		User: toProto(user),
+	}, nil
+}
+
+func (s *serverAPI) UpdateProfile(ctx context.Context, in *ssopb.UpdateProfileRequest) (*ssopb.UpdateProfileResponse, error) {
+	if err := validateUpdateProfile(in); err != nil {
+		return nil, err
+	}
+
+	user, sent, err := s.profile.UpdateProfile(ctx, in.GetToken(), in.Name, in.Email)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &ssopb.UpdateProfileResponse{
+		User:             toProto(user),
+		VerificationSent: sent,
+	}, nil
+}
+
+func (s *serverAPI) VerifyEmail(ctx context.Context, in *ssopb.VerifyEmailRequest) (*ssopb.VerifyEmailResponse, error) {
+	if in.GetVerificationToken() == "" {
+		return nil, status.Error(codes.InvalidArgument, "verification token is required")
+	}
+
+	if err := s.profile.VerifyEmail(ctx, in.GetVerificationToken()); err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &ssopb.VerifyEmailResponse{}, nil
+}
+
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, profile.ErrInvalidToken):
+		return status.Error(codes.Unauthenticated, "invalid token")
+	case errors.Is(err, profile.ErrPermissionDenied):
+		return status.Error(codes.PermissionDenied, "permission denied")
+	case errors.Is(err, profile.ErrUserNotFound):
+		return status.Error(codes.NotFound, "user not found")
+	case errors.Is(err, profile.ErrUserExists):
+		return status.Error(codes.AlreadyExists, "email already taken")
+	case errors.Is(err, profile.ErrInvalidVerification):
+		return status.Error(codes.InvalidArgument, "invalid or expired verification token")
+	}
+	return status.Error(codes.Internal, "internal server error")
+}
+
+func toProto(user models.User) *ssopb.User {
+	return &ssopb.User{
+		Id:            user.ID,
+		Name:          user.Name,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+	}
+}
+
+func validateGetUser(request *ssopb.GetUserRequest) error {
+	if request.GetToken() == "" {
+		return status.Error(codes.Unauthenticated, "token is required")
+	}
+	if request.GetUserId() == emptyValue {
+		return status.Error(codes.InvalidArgument, "invalid user id")
+	}
+	return nil
+}
+
+func validateUpdateProfile(request *ssopb.UpdateProfileRequest) error {
+	if request.GetToken() == "" {
+		return status.Error(codes.Unauthenticated, "token is required")
+	}
+	if request.Name != nil && request.GetName() == "" {
+		return status.Error(codes.InvalidArgument, "invalid name")
+	}
+	if request.Email != nil {
+		if _, err := mail.ParseAddress(request.GetEmail()); err != nil {
+			return status.Error(codes.InvalidArgument, "invalid email")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package adminhttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sso/internal/domain/models"
+	"sso/internal/http/bearer"
+	"sso/internal/services/admin"
+	"sso/internal/services/gdpr"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Admin interface {
+	ListUsers(
+		ctx context.Context,
+		token string,
+		filter models.UserFilter,
+		pageSize int,
+		pageToken string,
+	) (users []models.UserInfo, nextPageToken string, err error)
+	SetUserStatus(
+		ctx context.Context,
+		token string,
+		userID int64,
+		status models.UserStatus,
+		reason string,
+	) error
+	ExportUser(ctx context.Context, token string, userID int64) (gdpr.Archive, error)
+	EraseUser(ctx context.Context, token string, userID int64, reason string) error
+}
+
+type Handler struct {
+	admin Admin
+	log   *slog.Logger
+}
+
+// UserRecord holds only the fields the caller selected, the rest are
+// omitted from the JSON.
+type UserRecord struct {
+	ID              int64      `json:"id"`
+	Name            *string    `json:"name,omitempty"`
+	Email           *string    `json:"email,omitempty"`
+	EmailVerified   *bool      `json:"email_verified,omitempty"`
+	IsAdmin         *bool      `json:"is_admin,omitempty"`
+	Status          *string    `json:"status,omitempty"`
+	StatusReason    *string    `json:"status_reason,omitempty"`
+	StatusChangedAt *time.Time `json:"status_changed_at,omitempty"`
+	CreatedAt       *time.Time `json:"created_at,omitempty"`
+}
+
+type ListUsersResponse struct {
+	Users         []UserRecord `json:"users"`
+	NextPageToken string       `json:"next_page_token,omitempty"`
+}
+
+type SetUserStatusRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+type EraseUserRequest struct {
+	Reason string `json:"reason"`
+}
+
+func NewHandler(admin Admin, log *slog.Logger) *Handler {
+	return &Handler{admin: admin, log: log}
+}
+
+// ListUsersHandler serves GET /admin/users. Filters are query parameters:
+// email_prefix, name, is_admin, created_after and created_before (RFC 3339),
+// status (comma-separated), page_size, page_token and fields
+// (comma-separated).
+func (h *Handler) ListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter, err := parseFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var pageSize int
+	if v := query.Get("page_size"); v != "" {
+		pageSize, err = strconv.Atoi(v)
+		if err != nil || pageSize < 0 {
+			http.Error(w, "invalid page_size", http.StatusBadRequest)
+			return
+		}
+	}
+
+	fields, err := admin.SelectFields(splitList(query.Get("fields")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	users, next, err := h.admin.ListUsers(r.Context(), bearer.Token(r), filter, pageSize, query.Get("page_token"))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	resp := ListUsersResponse{Users: make([]UserRecord, 0, len(users)), NextPageToken: next}
+	for _, user := range users {
+		resp.Users = append(resp.Users, toRecord(user, fields))
+	}
+	h.writeJSON(w, resp)
+}
+
+// SetUserStatusHandler serves POST /admin/users/{id}/status.
+func (h *Handler) SetUserStatusHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || userID <= 0 {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	var req SetUserStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !models.UserStatus(req.Status).Valid() {
+		http.Error(w, "invalid status", http.StatusBadRequest)
+		return
+	}
+
+	err = h.admin.SetUserStatus(r.Context(), bearer.Token(r), userID, models.UserStatus(req.Status), req.Reason)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ExportUserHandler serves GET /admin/users/{id}/export.
+func (h *Handler) ExportUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || userID <= 0 {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	archive, err := h.admin.ExportUser(r.Context(), bearer.Token(r), userID)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%d.json"`, userID))
+	h.writeJSON(w, archive)
+}
+
+// EraseUserHandler serves DELETE /admin/users/{id}. The body with the
+// reason is optional.
+func (h *Handler) EraseUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || userID <= 0 {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	var req EraseUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.admin.EraseUser(r.Context(), bearer.Token(r), userID, req.Reason); err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func parseFilter(query url.Values) (models.UserFilter, error) {
+	filter := models.UserFilter{
+		EmailPrefix: query.Get("email_prefix"),
+		Name:        query.Get("name"),
+	}
+
+	if v := query.Get("is_admin"); v != "" {
+		isAdmin, err := strconv.ParseBool(v)
+		if err != nil {
+			return models.UserFilter{}, errors.New("invalid is_admin")
+		}
+		filter.IsAdmin = &isAdmin
+	}
+
+	var err error
+	if v := query.Get("created_after"); v != "" {
+		if filter.CreatedAfter, err = time.Parse(time.RFC3339, v); err != nil {
+			return models.UserFilter{}, errors.New("invalid created_after")
+		}
+	}
+	if v := query.Get("created_before"); v != "" {
+		if filter.CreatedBefore, err = time.Parse(time.RFC3339, v); err != nil {
+			return models.UserFilter{}, errors.New("invalid created_before")
+		}
+	}
+
+	for _, st := range splitList(query.Get("status")) {
+		filter.Statuses = append(filter.Statuses, models.UserStatus(st))
+	}
+
+	return filter, nil
+}
+
+func (h *Handler) writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, admin.ErrInvalidToken):
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+	case errors.Is(err, admin.ErrPermissionDenied):
+		http.Error(w, "permission denied", http.StatusForbidden)
+	case errors.Is(err, admin.ErrInvalidPageToken):
+		http.Error(w, "invalid page token", http.StatusBadRequest)
+	case errors.Is(err, admin.ErrInvalidStatus):
+		http.Error(w, "invalid status", http.StatusBadRequest)
+	case errors.Is(err, admin.ErrUserNotFound):
+		http.Error(w, "user not found", http.StatusNotFound)
+	case errors.Is(err, admin.ErrEmailReleased):
+		http.Error(w, "user was deleted and their email released", http.StatusConflict)
+	case errors.Is(err, admin.ErrUserErased):
+		http.Error(w, "user was erased", http.StatusGone)
+	default:
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
+
+func (h *Handler) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.log.Error("failed to encode response", slog.String("error", err.Error()))
+	}
+}
+
+func toRecord(user models.UserInfo, fields admin.FieldSet) UserRecord {
+	record := UserRecord{ID: user.ID}
+	if fields.Has("name") {
+		record.Name = &user.Name
+	}
+	if fields.Has("email") {
+		record.Email = &user.Email
+	}
+	if fields.Has("email_verified") {
+		record.EmailVerified = &user.EmailVerified
+	}
+	if fields.Has("is_admin") {
+		record.IsAdmin = &user.IsAdmin
+	}
+	if fields.Has("status") {
+		status := string(user.Status)
+		record.Status = &status
+	}
+	if fields.Has("status_reason") {
+		record.StatusReason = &user.StatusReason
+	}
+	if fields.Has("status_changed_at") && !user.StatusChangedAt.IsZero() {
+		record.StatusChangedAt = &user.StatusChangedAt
+	}
+	if fields.Has("created_at") {
+		record.CreatedAt = &user.CreatedAt
+	}
+	return record
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -1,83 +1,112 @@
 package authhttp
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"golang.org/x/crypto/bcrypt"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 	"log/slog"
 	"net/http"
-	"net/mail"
-	"sso/internal/lib/jwt"
+	"sso/internal/lib/netutil"
+	"sso/internal/lib/passpolicy"
+	"sso/internal/services/auth"
 	"sso/internal/storage"
-	"sso/internal/storage/postgres"
-	"time"
+	"strconv"
 )
 
+// Auth logs users in and registers them, the HTTP handlers only translate
+// requests and errors.
+type Auth interface {
+	Login(ctx context.Context, email string, password string, appID int32, clientIP string) (token string, err error)
+	RegisterNewUser(ctx context.Context, email string, name string, password string) (userID int64, err error)
+	IsAdmin(ctx context.Context, userID int64) (isAdmin bool, err error)
+}
+
 type Handler struct {
-	storage  *postgres.Storage
-	log      *slog.Logger
-	tokenTTL time.Duration
+	auth Auth
+	log  *slog.Logger
 }
 
+// LoginRequest is the body of a login. AppID is optional, logins without
+// one go to DefaultAppID as they did before they could name an app.
 type LoginRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	AppID    int32  `json:"app_id"`
 }
+
+// DefaultAppID is the app of logins that name none.
+const DefaultAppID = 1
+
 type RegisterRequest struct {
 	Name     string
 	Email    string
 	Password string
 }
 
-func NewHandler(storage *postgres.Storage, log *slog.Logger, ttl time.Duration) *Handler {
-	return &Handler{storage: storage, log: log, tokenTTL: ttl}
+// LogValue leaves the password out of the logs.
+func (r LoginRequest) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("email", r.Email))
+}
+
+// LogValue leaves the password out of the logs.
+func (r RegisterRequest) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("email", r.Email), slog.String("name", r.Name))
+}
+
+// ErrorResponse is the body of a rejected registration, with every rule
+// the password breaks.
+type ErrorResponse struct {
+	Error      string           `json:"error"`
+	Violations []FieldViolation `json:"violations,omitempty"`
+}
+
+type FieldViolation struct {
+	Field       string `json:"field"`
+	Rule        string `json:"rule"`
+	Description string `json:"description"`
+}
+
+func NewHandler(auth Auth, log *slog.Logger) *Handler {
+	return &Handler{auth: auth, log: log}
 }
 
 func (h *Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
 	var logreq LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&logreq); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	h.log.Info("request body decoded",
-		slog.String("email", logreq.Email),
-		slog.String("password", logreq.Password),
-	)
-
-	user, err := h.storage.User(ctx, logreq.Email)
-
-	if err != nil {
-		h.log.Warn("user not found", err.Error())
-		http.Error(w, "user not found", http.StatusNotFound)
-		return
-	}
-
-	if err := bcrypt.CompareHashAndPassword(user.PassHash, []byte(logreq.Password)); err != nil {
-		h.log.Info("invalid credentials", err.Error())
-		http.Error(w, "invalid credentials", http.StatusUnauthorized)
-		return
-	}
-	h.log.Info("user successfully logged in")
-
-	app, errr := h.storage.App(ctx, 1)
-	if errr != nil {
-		http.Error(w, errr.Error(), http.StatusInternalServerError)
-		return
+	h.log.Info("request body decoded", slog.Any("request", logreq))
+	if logreq.AppID == 0 {
+		logreq.AppID = DefaultAppID
 	}
 
-	token, err := jwt.NewToken(user, app, h.tokenTTL)
+	token, err := h.auth.Login(r.Context(), logreq.Email, logreq.Password, logreq.AppID, netutil.RequestIP(r))
 	if err != nil {
-		h.log.Error("failed to create token", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		var throttled *auth.ThrottledError
+		if errors.As(err, &throttled) {
+			w.Header().Set("Retry-After", strconv.Itoa(throttled.RetryAfterSeconds()))
+			http.Error(w, auth.ErrTooManyAttempts.Error(), http.StatusTooManyRequests)
+			return
+		}
+		switch {
+		case errors.Is(err, auth.ErrInvalidCredentials), errors.Is(err, auth.ErrUserDeleted):
+			// a deleted account is answered like a wrong password, so it is
+			// not told apart from an email nobody registered
+			http.Error(w, auth.ErrInvalidCredentials.Error(), http.StatusUnauthorized)
+		case errors.Is(err, auth.ErrAccountUnavailable):
+			http.Error(w, auth.ErrAccountUnavailable.Error(), http.StatusForbidden)
+		case errors.Is(err, storage.ErrAppNotFound):
+			http.Error(w, "invalid app id", http.StatusBadRequest)
+		default:
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}
 		return
 	}
 
 	err = json.NewEncoder(w).Encode(token)
 	if err != nil {
-		h.log.Error("failed to encode token", err.Error())
+		h.log.Error("failed to encode token", slog.String("error", err.Error()))
 	}
 }
 
@@ -87,38 +116,42 @@ func (h *Handler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	h.log.Info("request body decoded", slog.Any("request", regReq))
 
-	h.log.Info("registering new user")
-
-	h.log.Info("request body decoded",
-		slog.String("email", regReq.Email),
-		slog.String("name", regReq.Name),
-	)
-
-	passHash, err := bcrypt.GenerateFromPassword([]byte(regReq.Password), bcrypt.DefaultCost)
-	if err != nil {
-		h.log.Error("failed to hash password", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	h.log.Info(string(passHash))
-
-	id, err := h.storage.SaveUser(r.Context(), regReq.Email, regReq.Name, passHash)
+	id, err := h.auth.RegisterNewUser(r.Context(), regReq.Email, regReq.Name, regReq.Password)
 	if err != nil {
-		if errors.Is(err, storage.ErrUserExists) {
-			h.log.Warn("user already exists", err.Error())
+		var policyErr *passpolicy.Error
+		switch {
+		case errors.Is(err, auth.ErrUserExists):
 			http.Error(w, "user already exists", http.StatusConflict)
+		case errors.As(err, &policyErr):
+			h.writeWeakPassword(w, policyErr)
+		default:
+			http.Error(w, "internal server error", http.StatusInternalServerError)
 		}
-		h.log.Error("failed to save user", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	h.log.Info("successfully registred user")
-
 	err = json.NewEncoder(w).Encode(id)
 	if err != nil {
-		h.log.Error("failed to encode id", err.Error())
+		h.log.Error("failed to encode id", slog.String("error", err.Error()))
+	}
+}
+
+func (h *Handler) writeWeakPassword(w http.ResponseWriter, policyErr *passpolicy.Error) {
+	resp := ErrorResponse{Error: passpolicy.ErrWeakPassword.Error()}
+	for _, v := range policyErr.Violations {
+		resp.Violations = append(resp.Violations, FieldViolation{
+			Field:       "password",
+			Rule:        v.Rule,
+			Description: v.Description,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		h.log.Error("failed to encode response", slog.String("error", err.Error()))
 	}
 }
 
@@ -130,7 +163,7 @@ func (h *Handler) IsAdminHandler(w http.ResponseWriter, r *http.Request) {
 
 	h.log.Info("checking if user is admin")
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		h.log.Error("failed to decode request", err.Error())
+		h.log.Error("failed to decode request", slog.String("error", err.Error()))
 		http.Error(w, "invalid JSON", http.StatusBadRequest)
 		return
 	}
@@ -141,10 +174,14 @@ func (h *Handler) IsAdminHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "user_id is required", http.StatusBadRequest)
 		return
 	}
-	res, err := h.storage.IsAdmin(r.Context(), int64(request.UserID))
+	res, err := h.auth.IsAdmin(r.Context(), int64(request.UserID))
 	if err != nil {
-		h.log.Warn("user not found", err.Error())
-		http.Error(w, "user not found", http.StatusNotFound)
+		if errors.Is(err, storage.ErrUserNotFound) {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
 	}
 
 	h.log.Info(
@@ -154,7 +191,7 @@ func (h *Handler) IsAdminHandler(w http.ResponseWriter, r *http.Request) {
 	)
 	err = json.NewEncoder(w).Encode(res)
 	if err != nil {
-		h.log.Error("failed to encode user", err.Error())
+		h.log.Error("failed to encode user", slog.String("error", err.Error()))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -174,17 +211,3 @@ func (h *Handler) HealthHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Barabara"))
 }
-
-func validateLogin(email string, password string) error {
-	_, err := mail.ParseAddress(email)
-	if err != nil {
-		return status.Error(codes.InvalidArgument, "invalid email")
-	}
-	if password == "" {
-		return status.Error(codes.InvalidArgument, "invalid password")
-	}
-	//if request.GetAppId() == emptyValue {
-	//	return status.Error(codes.InvalidArgument, "invalid app id")
-	//}
-	return nil
-}
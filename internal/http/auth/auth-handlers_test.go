@@ -0,0 +1,186 @@
+package authhttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"sso/internal/lib/passhash/passhashtest"
+	"sso/internal/lib/passpolicy"
+	"sso/internal/services/auth"
+	"sso/internal/storage"
+)
+
+// fakeAuth answers with err, or a token, and records the login it got.
+type fakeAuth struct {
+	err error
+
+	email    string
+	appID    int32
+	clientIP string
+}
+
+func (f *fakeAuth) Login(_ context.Context, email string, _ string, appID int32, clientIP string) (string, error) {
+	f.email, f.appID, f.clientIP = email, appID, clientIP
+	if f.err != nil {
+		return "", f.err
+	}
+	return "token", nil
+}
+
+func (f *fakeAuth) RegisterNewUser(context.Context, string, string, string) (int64, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	return 7, nil
+}
+
+func (f *fakeAuth) IsAdmin(context.Context, int64) (bool, error) {
+	if f.err != nil {
+		return false, f.err
+	}
+	return true, nil
+}
+
+func serve(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.RemoteAddr = "192.0.2.1:4242"
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestLogin(t *testing.T) {
+	a := &fakeAuth{}
+	h := NewHandler(a, slog.New(slog.DiscardHandler))
+
+	rec := serve(h.LoginHandler, `{"email":"alice@example.com","password":"pw","app_id":3}`)
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `"token"` {
+		t.Fatalf("login: %d %s", rec.Code, rec.Body)
+	}
+	if a.email != "alice@example.com" || a.appID != 3 || a.clientIP != "192.0.2.1" {
+		t.Errorf("Login got %s to app %d from %s", a.email, a.appID, a.clientIP)
+	}
+
+	// clients from before app_id keep logging in to the default app
+	if rec := serve(h.LoginHandler, `{"email":"alice@example.com","password":"pw"}`); rec.Code != http.StatusOK {
+		t.Fatalf("login without app_id: %d %s", rec.Code, rec.Body)
+	}
+	if a.appID != DefaultAppID {
+		t.Errorf("login without app_id went to app %d, want %d", a.appID, DefaultAppID)
+	}
+
+	if rec := serve(h.LoginHandler, `{"email":`); rec.Code != http.StatusBadRequest {
+		t.Errorf("malformed body: status %d, want 400", rec.Code)
+	}
+}
+
+func TestLoginErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantCode       int
+		wantRetryAfter string
+	}{
+		{"invalid credentials", fmt.Errorf("auth.Login: %w", auth.ErrInvalidCredentials), http.StatusUnauthorized, ""},
+		{"throttled", fmt.Errorf("auth.Login: %w", &auth.ThrottledError{RetryAfter: 1500 * time.Millisecond}), http.StatusTooManyRequests, "2"},
+		{"unknown app", fmt.Errorf("auth.Login: %w", storage.ErrAppNotFound), http.StatusBadRequest, ""},
+		{"internal", errors.New("connection refused"), http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(&fakeAuth{err: tt.err}, slog.New(slog.DiscardHandler))
+
+			rec := serve(h.LoginHandler, `{"email":"alice@example.com","password":"pw","app_id":1}`)
+			if rec.Code != tt.wantCode {
+				t.Errorf("status %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+			if strings.Contains(rec.Body.String(), "connection refused") {
+				t.Errorf("internal error leaked: %s", rec.Body)
+			}
+		})
+	}
+}
+
+// TestLoginStatus checks that a login refused for the status of the
+// account does not tell which status it is, and that one refused for a
+// deleted account is answered like a wrong password.
+func TestLoginStatus(t *testing.T) {
+	login := func(err error) *httptest.ResponseRecorder {
+		h := NewHandler(&fakeAuth{err: err}, slog.New(slog.DiscardHandler))
+		return serve(h.LoginHandler, `{"email":"alice@example.com","password":"pw","app_id":1}`)
+	}
+
+	var bodies []string
+	for _, statusErr := range []error{auth.ErrUserDisabled, auth.ErrUserLocked} {
+		rec := login(fmt.Errorf("auth.Login: %w: %w", auth.ErrAccountUnavailable, statusErr))
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%v: status %d, want 403", statusErr, rec.Code)
+		}
+		bodies = append(bodies, rec.Body.String())
+	}
+	if bodies[0] != bodies[1] {
+		t.Errorf("bodies differ by status: %q", bodies)
+	}
+
+	deleted := login(fmt.Errorf("auth.Login: %w: %w", auth.ErrAccountUnavailable, auth.ErrUserDeleted))
+	wrongPassword := login(fmt.Errorf("auth.Login: %w", auth.ErrInvalidCredentials))
+	if deleted.Code != http.StatusUnauthorized || deleted.Body.String() != wrongPassword.Body.String() {
+		t.Errorf("deleted account: %d %q, want %d %q like a wrong password",
+			deleted.Code, deleted.Body.String(), wrongPassword.Code, wrongPassword.Body.String())
+	}
+}
+
+func TestRegisterErrors(t *testing.T) {
+	weak := &passpolicy.Error{Violations: []passpolicy.Violation{{Rule: "min_length", Description: "too short"}}}
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int
+		wantBody string
+	}{
+		{"registered", nil, http.StatusOK, "7"},
+		{"exists", fmt.Errorf("auth.RegisterNewUser: %w", auth.ErrUserExists), http.StatusConflict, "user already exists"},
+		{"weak password", fmt.Errorf("auth.RegisterNewUser: %w", weak), http.StatusBadRequest, `"rule":"min_length"`},
+		{"internal", errors.New("connection refused"), http.StatusInternalServerError, "internal server error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(&fakeAuth{err: tt.err}, slog.New(slog.DiscardHandler))
+
+			rec := serve(h.RegisterHandler, `{"email":"bob@example.com","name":"Bob","password":"pw"}`)
+			if rec.Code != tt.wantCode || !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("got %d %s, want %d with %s", rec.Code, rec.Body, tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+}
+
+// TestHandlersLogNoSecrets scans the log of a registration and a login for
+// the password, with no redaction in front of the log.
+func TestHandlersLogNoSecrets(t *testing.T) {
+	const password = passhashtest.Password
+
+	var buf bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	h := NewHandler(&fakeAuth{}, log)
+
+	body, _ := json.Marshal(map[string]string{"email": "bob@example.com", "name": "Bob", "password": password})
+	serve(h.RegisterHandler, string(body))
+	serve(h.LoginHandler, string(body))
+
+	if out := buf.String(); strings.Contains(out, password) {
+		t.Errorf("log contains the password:\n%s", out)
+	}
+}
@@ -0,0 +1,19 @@
+// Package bearer reads bearer tokens off HTTP requests.
+package bearer
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Token extracts the token from the Authorization header, empty when there
+// is none.
+func Token(r *http.Request) string {
+	const prefix = "Bearer "
+
+	header := r.Header.Get("Authorization")
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(prefix):])
+}
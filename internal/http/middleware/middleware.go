@@ -0,0 +1,210 @@
+// Package middleware holds the handlers wrapping every HTTP request.
+package middleware
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"sso/internal/lib/netutil"
+	"sso/internal/lib/requestid"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// RequestIDHeader carries the request ID, both ways.
+const RequestIDHeader = "X-Request-ID"
+
+// RequestID takes the request ID from the request header, or makes one up,
+// puts it in the context and sends it back in the response header.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !requestid.Valid(id) {
+			id = requestid.New()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(requestid.With(r.Context(), id)))
+	})
+}
+
+// Logging logs every request once it is served, with its method, path,
+// status, size, duration, client address and request ID. The query is
+// left out, it may carry tokens.
+func Logging(log *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		log.LogAttrs(r.Context(), level, "HTTP request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("peer", netutil.RequestIP(r)),
+			slog.String("request_id", requestid.From(r.Context())),
+		)
+	})
+}
+
+// statusRecorder remembers the status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status, r.wroteHeader = status, true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Recovery answers 500 to a request whose handler panicked, logging the
+// panic with its stack, instead of dropping the connection.
+func Recovery(log *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if err, ok := p.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				// the handler asked for the connection to be dropped
+				panic(p)
+			}
+			log.ErrorContext(r.Context(), "panic in HTTP handler",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Any("panic", p),
+				slog.String("stack", string(debug.Stack())),
+				slog.String("request_id", requestid.From(r.Context())),
+			)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// BodyLimit answers 413 to requests with a body over limit bytes: up front
+// when their Content-Length says so, or else in place of the 400 the
+// handler answers once reading the body failed at the limit. A zero limit
+// leaves bodies unbounded.
+func BodyLimit(limit int64, next http.Handler) http.Handler {
+	if limit <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body := &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, limit)}
+		r.Body = body
+		next.ServeHTTP(&tooLargeWriter{ResponseWriter: w, body: body}, r)
+	})
+}
+
+// limitedBody remembers whether reading it failed at the limit.
+type limitedBody struct {
+	io.ReadCloser
+	tooLarge bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		b.tooLarge = true
+	}
+	return n, err
+}
+
+// tooLargeWriter turns a 400 into a 413 once the body was over the limit.
+type tooLargeWriter struct {
+	http.ResponseWriter
+	body *limitedBody
+}
+
+func (w *tooLargeWriter) WriteHeader(status int) {
+	if status == http.StatusBadRequest && w.body.tooLarge {
+		status = http.StatusRequestEntityTooLarge
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *tooLargeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Timeout answers 503 to requests not served within timeout and cancels
+// their context. A zero timeout leaves them unbounded.
+func Timeout(timeout time.Duration, next http.Handler) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+	return http.TimeoutHandler(next, timeout, "request timed out")
+}
+
+// Observer records how long requests take.
+type Observer interface {
+	ObserveHTTP(method string, route string, status int, d time.Duration)
+}
+
+// Tracing starts a span for every request, continuing the trace of the
+// caller's traceparent header. Spans are named by the route the request
+// matches in mux.
+func Tracing(mux *http.ServeMux, next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			_, route := mux.Handler(r)
+			switch {
+			case route == "":
+				return r.Method + " unmatched"
+			case strings.Contains(route, " "):
+				return route
+			default:
+				return r.Method + " " + route
+			}
+		}),
+	)
+}
+
+// Metrics times every request by the route it matches in mux and its
+// status. Requests matching no route count as unmatched.
+func Metrics(observer Observer, mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		observer.ObserveHTTP(r.Method, route, rec.status, time.Since(start))
+	})
+}
@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecovery(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&buf, nil))
+	h := Recovery(log, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("nil map")
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/boom", nil))
+	if rec.Code != http.StatusInternalServerError || strings.Contains(rec.Body.String(), "nil map") {
+		t.Errorf("got %d %q, want a bare 500", rec.Code, rec.Body)
+	}
+	if out := buf.String(); !strings.Contains(out, "panic in HTTP handler") || !strings.Contains(out, "nil map") {
+		t.Errorf("panic not logged:\n%s", out)
+	}
+
+	// the handler asked for the connection to be dropped
+	abort := Recovery(log, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler passed on", p)
+		}
+	}()
+	abort.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/abort", nil))
+}
+
+func TestBodyLimit(t *testing.T) {
+	// decode answers 400 to a body it cannot read, like the handlers do
+	decode := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	})
+	h := BodyLimit(32, decode)
+
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		want          int
+	}{
+		{"within the limit", `{"email":"a@example.com"}`, -1, http.StatusOK},
+		{"declared too long", `{"email":"alice@example.com","name":"Alice"}`, 0, http.StatusRequestEntityTooLarge},
+		{"chunked too long", `{"email":"alice@example.com","name":"Alice"}`, -1, http.StatusRequestEntityTooLarge},
+		{"malformed", `{"email":`, -1, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			if tt.contentLength != 0 {
+				req.ContentLength = tt.contentLength
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	canceled := make(chan struct{})
+	h := Timeout(20*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(canceled)
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/slow", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", rec.Code)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	if string(body) != "request timed out" {
+		t.Errorf("body %q", body)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("the context of the timed out request was not canceled")
+	}
+}
+
+// httpObservations records the requests observed.
+type httpObservations []string
+
+func (o *httpObservations) ObserveHTTP(method string, route string, status int, _ time.Duration) {
+	*o = append(*o, fmt.Sprintf("%s %s %d", method, route, status))
+}
+
+func TestMetrics(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") == "0" {
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	})
+	observed := &httpObservations{}
+	h := Metrics(observed, mux, mux)
+
+	for _, target := range []string{"/users/7", "/users/0", "/nowhere"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+
+	// routes, not paths, so the IDs do not blow up the label values
+	want := []string{"GET GET /users/{id} 200", "GET GET /users/{id} 404", "GET unmatched 404"}
+	if !slices.Equal(*observed, want) {
+		t.Errorf("observed %q, want %q", *observed, want)
+	}
+}
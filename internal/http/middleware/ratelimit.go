@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"sso/internal/lib/netutil"
+	"sso/internal/lib/ratelimit"
+)
+
+// RateLimit rejects requests with 429 once the bucket of their route and
+// client address is empty. Routes are the patterns they match in mux. The
+// state of the bucket goes out in the RateLimit-Limit, RateLimit-Remaining
+// and RateLimit-Reset headers. Requests go through when the limiter fails,
+// rather than failing them all.
+func RateLimit(log *slog.Logger, limiter *ratelimit.Limiter, rules ratelimit.Rules, mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		rule, ok := rules.For(route)
+		if !ok {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		res, err := limiter.Allow(r.Context(), route+"|ip:"+netutil.RequestIP(r), rule.Limit)
+		if err != nil {
+			log.Error("failed to check rate limit",
+				slog.String("op", "middleware.RateLimit"),
+				slog.String("route", route),
+				slog.String("error", err.Error()),
+			)
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(ratelimit.Seconds(res.Reset)))
+		if !res.Allowed {
+			h.Set("Retry-After", strconv.Itoa(ratelimit.Seconds(res.RetryAfter)))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
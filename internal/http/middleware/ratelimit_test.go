@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"sso/internal/lib/ratelimit"
+)
+
+func TestRateLimit(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {})
+	rules := ratelimit.Rules{Endpoints: map[string]ratelimit.Rule{
+		"POST /login": {Limit: ratelimit.Limit{Rate: 0.01, Burst: 2}, By: ratelimit.ByIP},
+	}}
+	h := RateLimit(slog.New(slog.DiscardHandler), ratelimit.New(ratelimit.NewMemoryStore()), rules, mux)
+
+	serve := func(method, path, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i, want := range []string{"1", "0"} {
+		rec := serve("POST", "/login", "192.0.2.1:1000")
+		if rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Remaining") != want {
+			t.Fatalf("request %d: %d with RateLimit-Remaining %q", i+1, rec.Code, rec.Header().Get("RateLimit-Remaining"))
+		}
+	}
+
+	rec := serve("POST", "/login", "192.0.2.1:1001")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the burst: status %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "100" {
+		t.Errorf("Retry-After = %q, want 100", got)
+	}
+
+	// another client address has a bucket of its own
+	if rec := serve("POST", "/login", "198.51.100.7:1000"); rec.Code != http.StatusOK {
+		t.Errorf("another address: status %d, want 200", rec.Code)
+	}
+	// routes without a rule are not limited
+	if rec := serve("GET", "/health", "192.0.2.1:1000"); rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("unlimited route: status %d with RateLimit-Limit %q", rec.Code, rec.Header().Get("RateLimit-Limit"))
+	}
+}
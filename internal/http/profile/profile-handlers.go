@@ -0,0 +1,165 @@
+package profilehttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"sso/internal/domain/models"
+	"sso/internal/http/bearer"
+	"sso/internal/services/profile"
+	"strconv"
+)
+
+type Profile interface {
+	GetUser(ctx context.Context, token string, userID int64) (models.User, error)
+	GetMe(ctx context.Context, token string) (models.User, error)
+	UpdateProfile(
+		ctx context.Context,
+		token string,
+		name *string,
+		email *string,
+	) (user models.User, verificationSent bool, err error)
+	VerifyEmail(ctx context.Context, verificationToken string) error
+}
+
+type Handler struct {
+	profile Profile
+	log     *slog.Logger
+}
+
+type UserResponse struct {
+	ID            int64  `json:"id"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+type UpdateProfileRequest struct {
+	Name  *string `json:"name"`
+	Email *string `json:"email"`
+}
+
+type UpdateProfileResponse struct {
+	User             UserResponse `json:"user"`
+	VerificationSent bool         `json:"verification_sent"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+func NewHandler(profile Profile, log *slog.Logger) *Handler {
+	return &Handler{profile: profile, log: log}
+}
+
+// GetUserHandler serves GET /users/{id}.
+func (h *Handler) GetUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || userID <= 0 {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.profile.GetUser(r.Context(), bearer.Token(r), userID)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, toResponse(user))
+}
+
+// GetMeHandler serves GET /me.
+func (h *Handler) GetMeHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := h.profile.GetMe(r.Context(), bearer.Token(r))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, toResponse(user))
+}
+
+// UpdateProfileHandler serves PATCH /me.
+func (h *Handler) UpdateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	var req UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name != nil && *req.Name == "" {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+	if req.Email != nil {
+		if _, err := mail.ParseAddress(*req.Email); err != nil {
+			http.Error(w, "invalid email", http.StatusBadRequest)
+			return
+		}
+	}
+
+	user, sent, err := h.profile.UpdateProfile(r.Context(), bearer.Token(r), req.Name, req.Email)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeJSON(w, UpdateProfileResponse{
+		User:             toResponse(user),
+		VerificationSent: sent,
+	})
+}
+
+// VerifyEmailHandler serves POST /verify-email.
+func (h *Handler) VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "token is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.profile.VerifyEmail(r.Context(), req.Token); err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, profile.ErrInvalidToken):
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+	case errors.Is(err, profile.ErrPermissionDenied):
+		http.Error(w, "permission denied", http.StatusForbidden)
+	case errors.Is(err, profile.ErrUserNotFound):
+		http.Error(w, "user not found", http.StatusNotFound)
+	case errors.Is(err, profile.ErrUserExists):
+		http.Error(w, "email already taken", http.StatusConflict)
+	case errors.Is(err, profile.ErrInvalidVerification):
+		http.Error(w, "invalid or expired verification token", http.StatusBadRequest)
+	default:
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
+
+func (h *Handler) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.log.Error("failed to encode response", slog.String("error", err.Error()))
+	}
+}
+
+func toResponse(user models.User) UserResponse {
+	return UserResponse{
+		ID:            user.ID,
+		Name:          user.Name,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+	}
+}
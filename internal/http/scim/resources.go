@@ -0,0 +1,219 @@
+package scimhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sso/internal/domain/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	userSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	groupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	listSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	patchSchema = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	errorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// User is the SCIM User resource. userName is the email, the single name
+// of models.User is both displayName and name.formatted. Password is only
+// ever read from requests.
+type User struct {
+	Schemas     []string `json:"schemas"`
+	ID          string   `json:"id,omitempty"`
+	UserName    string   `json:"userName"`
+	Name        *Name    `json:"name,omitempty"`
+	DisplayName string   `json:"displayName,omitempty"`
+	Emails      []Email  `json:"emails,omitempty"`
+	Active      *bool    `json:"active,omitempty"`
+	Password    string   `json:"password,omitempty"`
+	Groups      []Ref    `json:"groups,omitempty"`
+	Meta        *Meta    `json:"meta,omitempty"`
+}
+
+// LogValue leaves the password out of the logs.
+func (u User) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("id", u.ID), slog.String("user_name", u.UserName))
+}
+
+type Name struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type Email struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// Ref points at another resource: a group of a user or a member of a
+// group.
+type Ref struct {
+	Value   string `json:"value"`
+	Ref     string `json:"$ref,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type Meta struct {
+	ResourceType string     `json:"resourceType"`
+	Created      time.Time  `json:"created"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	Location     string     `json:"location"`
+}
+
+type Group struct {
+	Schemas     []string `json:"schemas"`
+	ID          string   `json:"id,omitempty"`
+	DisplayName string   `json:"displayName"`
+	Members     []Ref    `json:"members,omitempty"`
+	Meta        *Meta    `json:"meta,omitempty"`
+}
+
+type ListResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    []any    `json:"Resources"`
+}
+
+type PatchRequest struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []PatchOperation `json:"Operations"`
+}
+
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type Error struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+// nameOf picks the single name to store from what the client sent.
+func (u User) nameOf() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	if u.Name != nil {
+		if u.Name.Formatted != "" {
+			return u.Name.Formatted
+		}
+		if n := strings.TrimSpace(u.Name.GivenName + " " + u.Name.FamilyName); n != "" {
+			return n
+		}
+	}
+	return u.UserName
+}
+
+func toUser(user models.UserInfo, groups []models.Group, base string) User {
+	active := user.Status == models.UserStatusActive
+	out := User{
+		Schemas:     []string{userSchema},
+		ID:          strconv.FormatInt(user.ID, 10),
+		UserName:    user.Email,
+		Name:        &Name{Formatted: user.Name},
+		DisplayName: user.Name,
+		Emails:      []Email{{Value: user.Email, Type: "work", Primary: true}},
+		Active:      &active,
+		Meta: &Meta{
+			ResourceType: "User",
+			Created:      user.CreatedAt.UTC(),
+			Location:     fmt.Sprintf("%s/Users/%d", base, user.ID),
+		},
+	}
+	for _, g := range groups {
+		for _, m := range g.Members {
+			if m.UserID == user.ID {
+				out.Groups = append(out.Groups, Ref{
+					Value:   strconv.FormatInt(g.ID, 10),
+					Ref:     fmt.Sprintf("%s/Groups/%d", base, g.ID),
+					Display: g.DisplayName,
+				})
+				break
+			}
+		}
+	}
+	return out
+}
+
+func toGroup(group models.Group, base string) Group {
+	updated := group.UpdatedAt.UTC()
+	out := Group{
+		Schemas:     []string{groupSchema},
+		ID:          strconv.FormatInt(group.ID, 10),
+		DisplayName: group.DisplayName,
+		Meta: &Meta{
+			ResourceType: "Group",
+			Created:      group.CreatedAt.UTC(),
+			LastModified: &updated,
+			Location:     fmt.Sprintf("%s/Groups/%d", base, group.ID),
+		},
+	}
+	for _, m := range group.Members {
+		out.Members = append(out.Members, Ref{
+			Value:   strconv.FormatInt(m.UserID, 10),
+			Ref:     fmt.Sprintf("%s/Users/%d", base, m.UserID),
+			Display: m.Name,
+		})
+	}
+	return out
+}
+
+// toMap turns a resource into the generic form filters and attribute
+// selection work on.
+func toMap(resource any) (map[string]any, error) {
+	raw, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// project applies the attributes and excludedAttributes parameters to the
+// top-level attributes. schemas and id are always returned.
+func project(resource map[string]any, attributes []string, excluded []string) map[string]any {
+	top := func(names []string) map[string]bool {
+		set := make(map[string]bool, len(names))
+		for _, n := range names {
+			if i := strings.LastIndex(n, ":"); i >= 0 {
+				n = n[i+1:]
+			}
+			n, _, _ = strings.Cut(n, ".")
+			set[strings.ToLower(n)] = true
+		}
+		return set
+	}
+
+	if len(attributes) > 0 {
+		keep := top(attributes)
+		for k := range resource {
+			if k != "schemas" && k != "id" && !keep[strings.ToLower(k)] {
+				delete(resource, k)
+			}
+		}
+		return resource
+	}
+
+	drop := top(excluded)
+	for k := range resource {
+		if k != "schemas" && k != "id" && drop[strings.ToLower(k)] {
+			delete(resource, k)
+		}
+	}
+	return resource
+}
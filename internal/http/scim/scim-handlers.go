@@ -0,0 +1,859 @@
+package scimhttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sso/internal/domain/models"
+	"sso/internal/http/bearer"
+	"sso/internal/lib/scimfilter"
+	"sso/internal/services/scim"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SCIM interface {
+	Authenticate(ctx context.Context, token string) (int64, error)
+	CreateUser(ctx context.Context, appID int64, email string, name string, password string, active bool) (models.UserInfo, error)
+	User(ctx context.Context, appID int64, userID int64) (models.UserInfo, error)
+	ListUsers(ctx context.Context, appID int64, filter models.UserFilter) ([]models.UserInfo, error)
+	CountUsers(ctx context.Context, appID int64, filter models.UserFilter) (int, error)
+	UpdateUser(ctx context.Context, appID int64, userID int64, email string, name string, active bool) (models.UserInfo, error)
+	DeleteUser(ctx context.Context, appID int64, userID int64) error
+	CreateGroup(ctx context.Context, appID int64, name string, memberIDs []int64) (models.Group, error)
+	Group(ctx context.Context, appID int64, groupID int64) (models.Group, error)
+	Groups(ctx context.Context, appID int64) ([]models.Group, error)
+	UpdateGroup(ctx context.Context, appID int64, groupID int64, name string, memberIDs []int64) (models.Group, error)
+	DeleteGroup(ctx context.Context, appID int64, groupID int64) error
+}
+
+type Handler struct {
+	scim SCIM
+	log  *slog.Logger
+}
+
+const (
+	DefaultCount = 100
+	MaxCount     = 1000
+
+	// listPageSize is how many users are read from storage at a time while
+	// filtering a list the storage query cannot express.
+	listPageSize = 500
+)
+
+// requestError is a SCIM error raised while reading a request.
+type requestError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func (e *requestError) Error() string {
+	return e.detail
+}
+
+func badRequest(scimType string, format string, args ...any) error {
+	return &requestError{status: http.StatusBadRequest, scimType: scimType, detail: fmt.Sprintf(format, args...)}
+}
+
+func NewHandler(scim SCIM, log *slog.Logger) *Handler {
+	return &Handler{scim: scim, log: log}
+}
+
+// CreateUserHandler serves POST /scim/v2/Users.
+func (h *Handler) CreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	appID, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	var req User
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, badRequest("invalidSyntax", "invalid JSON"))
+		return
+	}
+	active := req.Active == nil || *req.Active
+
+	user, err := h.scim.CreateUser(r.Context(), appID, req.UserName, req.nameOf(), req.Password, active)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	resource := toUser(user, nil, baseURL(r))
+	w.Header().Set("Location", resource.Meta.Location)
+	h.writeResource(w, http.StatusCreated, resource)
+}
+
+// GetUserHandler serves GET /scim/v2/Users/{id}.
+func (h *Handler) GetUserHandler(w http.ResponseWriter, r *http.Request) {
+	appID, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := h.scim.User(r.Context(), appID, pathID(r))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	groups, err := h.scim.Groups(r.Context(), appID)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeProjected(w, r, toUser(user, groups, baseURL(r)))
+}
+
+// ListUsersHandler serves GET /scim/v2/Users with the filter, startIndex,
+// count, attributes and excludedAttributes parameters. Sorting is not
+// supported, users are ordered by id. Filters the storage query expresses
+// whole are counted and paged there, the rest are run on every user.
+func (h *Handler) ListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	appID, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := parseListParams(r)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	groups, err := h.scim.Groups(r.Context(), appID)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	base := baseURL(r)
+	filter, exact := pushDown(page.filter)
+	if exact {
+		total, err := h.scim.CountUsers(r.Context(), appID, filter)
+		if err != nil {
+			h.writeError(w, err)
+			return
+		}
+		page.total = total
+
+		if page.count > 0 && page.startIndex <= total {
+			filter.Offset, filter.Limit = page.startIndex-1, page.count
+			users, err := h.scim.ListUsers(r.Context(), appID, filter)
+			if err != nil {
+				h.writeError(w, err)
+				return
+			}
+			for _, user := range users {
+				if err := page.addMatched(toUser(user, groups, base)); err != nil {
+					h.writeError(w, err)
+					return
+				}
+			}
+		}
+
+		h.writeResource(w, http.StatusOK, page.response())
+		return
+	}
+
+	filter.Limit = listPageSize
+	for {
+		users, err := h.scim.ListUsers(r.Context(), appID, filter)
+		if err != nil {
+			h.writeError(w, err)
+			return
+		}
+		for _, user := range users {
+			if err := page.add(toUser(user, groups, base)); err != nil {
+				h.writeError(w, err)
+				return
+			}
+		}
+		if len(users) < filter.Limit {
+			break
+		}
+		filter.AfterID = users[len(users)-1].ID
+	}
+
+	h.writeResource(w, http.StatusOK, page.response())
+}
+
+// PatchUserHandler serves PATCH /scim/v2/Users/{id}. userName, emails,
+// displayName, name and active can be changed.
+func (h *Handler) PatchUserHandler(w http.ResponseWriter, r *http.Request) {
+	appID, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+	userID := pathID(r)
+
+	ops, err := decodePatch(r)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	user, err := h.scim.User(r.Context(), appID, userID)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	state := userState{
+		email:  user.Email,
+		name:   user.Name,
+		active: user.Status == models.UserStatusActive,
+	}
+	if err := applyPatch(ops, state.apply); err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	user, err = h.scim.UpdateUser(r.Context(), appID, userID, state.email, state.name, state.active)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	groups, err := h.scim.Groups(r.Context(), appID)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeResource(w, http.StatusOK, toUser(user, groups, baseURL(r)))
+}
+
+// DeleteUserHandler serves DELETE /scim/v2/Users/{id}. The user is soft
+// deleted and no longer visible over SCIM.
+func (h *Handler) DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	appID, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.scim.DeleteUser(r.Context(), appID, pathID(r)); err != nil {
+		h.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateGroupHandler serves POST /scim/v2/Groups.
+func (h *Handler) CreateGroupHandler(w http.ResponseWriter, r *http.Request) {
+	appID, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	var req Group
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeError(w, badRequest("invalidSyntax", "invalid JSON"))
+		return
+	}
+	members, err := memberIDs(req.Members)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	group, err := h.scim.CreateGroup(r.Context(), appID, req.DisplayName, members)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	resource := toGroup(group, baseURL(r))
+	w.Header().Set("Location", resource.Meta.Location)
+	h.writeResource(w, http.StatusCreated, resource)
+}
+
+// GetGroupHandler serves GET /scim/v2/Groups/{id}.
+func (h *Handler) GetGroupHandler(w http.ResponseWriter, r *http.Request) {
+	appID, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	group, err := h.scim.Group(r.Context(), appID, pathID(r))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeProjected(w, r, toGroup(group, baseURL(r)))
+}
+
+// ListGroupsHandler serves GET /scim/v2/Groups, with the same parameters
+// as ListUsersHandler.
+func (h *Handler) ListGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	appID, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	page, err := parseListParams(r)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	groups, err := h.scim.Groups(r.Context(), appID)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	base := baseURL(r)
+	for _, group := range groups {
+		if err := page.add(toGroup(group, base)); err != nil {
+			h.writeError(w, err)
+			return
+		}
+	}
+
+	h.writeResource(w, http.StatusOK, page.response())
+}
+
+// PatchGroupHandler serves PATCH /scim/v2/Groups/{id}. displayName can be
+// replaced and members added, removed or replaced.
+func (h *Handler) PatchGroupHandler(w http.ResponseWriter, r *http.Request) {
+	appID, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+	groupID := pathID(r)
+
+	ops, err := decodePatch(r)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	group, err := h.scim.Group(r.Context(), appID, groupID)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	state := groupState{name: group.DisplayName}
+	for _, m := range group.Members {
+		state.members = append(state.members, Ref{Value: strconv.FormatInt(m.UserID, 10), Display: m.Name})
+	}
+	if err := applyPatch(ops, state.apply); err != nil {
+		h.writeError(w, err)
+		return
+	}
+	members, err := memberIDs(state.members)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	group, err = h.scim.UpdateGroup(r.Context(), appID, groupID, state.name, members)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	h.writeResource(w, http.StatusOK, toGroup(group, baseURL(r)))
+}
+
+// DeleteGroupHandler serves DELETE /scim/v2/Groups/{id}.
+func (h *Handler) DeleteGroupHandler(w http.ResponseWriter, r *http.Request) {
+	appID, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.scim.DeleteGroup(r.Context(), appID, pathID(r)); err != nil {
+		h.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listPage collects the window of matching resources a list asked for and
+// counts the rest.
+type listPage struct {
+	filter     scimfilter.Expr
+	startIndex int
+	count      int
+	attributes []string
+	excluded   []string
+
+	total     int
+	resources []any
+}
+
+func parseListParams(r *http.Request) (*listPage, error) {
+	query := r.URL.Query()
+	page := &listPage{
+		startIndex: 1,
+		count:      DefaultCount,
+		attributes: splitList(query.Get("attributes")),
+		excluded:   splitList(query.Get("excludedAttributes")),
+	}
+
+	if v := query.Get("filter"); v != "" {
+		filter, err := scimfilter.Parse(v)
+		if err != nil {
+			return nil, badRequest("invalidFilter", "%s", err)
+		}
+		page.filter = filter
+	}
+	// out of range values are clamped, as RFC 7644 asks
+	if v := query.Get("startIndex"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, badRequest("invalidValue", "invalid startIndex")
+		}
+		page.startIndex = max(n, 1)
+	}
+	if v := query.Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, badRequest("invalidValue", "invalid count")
+		}
+		page.count = min(max(n, 0), MaxCount)
+	}
+	return page, nil
+}
+
+func (p *listPage) add(resource any) error {
+	m, err := toMap(resource)
+	if err != nil {
+		return err
+	}
+	if p.filter != nil && !p.filter.Match(m) {
+		return nil
+	}
+
+	p.total++
+	if p.total >= p.startIndex && len(p.resources) < p.count {
+		p.resources = append(p.resources, project(m, p.attributes, p.excluded))
+	}
+	return nil
+}
+
+// addMatched adds a resource the storage query already matched and paged.
+func (p *listPage) addMatched(resource any) error {
+	m, err := toMap(resource)
+	if err != nil {
+		return err
+	}
+	p.resources = append(p.resources, project(m, p.attributes, p.excluded))
+	return nil
+}
+
+func (p *listPage) response() ListResponse {
+	resources := p.resources
+	if resources == nil {
+		resources = []any{}
+	}
+	return ListResponse{
+		Schemas:      []string{listSchema},
+		TotalResults: p.total,
+		StartIndex:   p.startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	}
+}
+
+// pushDown narrows the storage query with the parts of the filter it can
+// express, joined by and at the top. When it expresses all of the filter
+// it returns true, otherwise the result may match more users than the
+// filter, which must still run on every one of them.
+func pushDown(expr scimfilter.Expr) (models.UserFilter, bool) {
+	var filter models.UserFilter
+	exact := true
+
+	var walk func(scimfilter.Expr)
+	walk = func(expr scimfilter.Expr) {
+		switch e := expr.(type) {
+		case scimfilter.And:
+			walk(e.Left)
+			walk(e.Right)
+		case scimfilter.Compare:
+			exact = pushCompare(&filter, e) && exact
+		default:
+			exact = false
+		}
+	}
+	if expr != nil {
+		walk(expr)
+	}
+	return filter, exact
+}
+
+// pushCompare narrows filter with e and reports whether filter now matches
+// exactly what e does. Strings compare case-insensitively on both sides.
+func pushCompare(filter *models.UserFilter, e scimfilter.Compare) bool {
+	value, isString := e.Value.(string)
+	attr := strings.ToLower(e.Path.String())
+
+	switch {
+	case (attr == "username" || attr == "emails.value") && isString:
+		switch {
+		case e.Op == "eq" && filter.Email == "":
+			filter.Email = value
+			return true
+		case e.Op == "sw" && filter.EmailPrefix == "":
+			filter.EmailPrefix = value
+			return true
+		}
+	case (attr == "displayname" || attr == "name.formatted") && isString && filter.Name == "":
+		switch e.Op {
+		case "co":
+			filter.Name = value
+			return true
+		case "eq", "sw":
+			// storage only has contains, the filter narrows further
+			filter.Name = value
+		}
+	case attr == "active" && e.Op == "eq" && filter.Statuses == nil:
+		if active, ok := e.Value.(bool); ok {
+			if active {
+				filter.Statuses = []models.UserStatus{models.UserStatusActive}
+			} else {
+				filter.Statuses = []models.UserStatus{models.UserStatusDisabled, models.UserStatusLocked}
+			}
+			return true
+		}
+	case attr == "meta.created" && isString:
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			break
+		}
+		switch {
+		case e.Op == "ge" && filter.CreatedAfter.IsZero():
+			filter.CreatedAfter = t
+			return true
+		case e.Op == "gt" && filter.CreatedAfter.IsZero():
+			filter.CreatedAfter = t.Add(time.Nanosecond)
+			return true
+		case e.Op == "lt" && filter.CreatedBefore.IsZero():
+			filter.CreatedBefore = t
+			return true
+		case e.Op == "le" && filter.CreatedBefore.IsZero():
+			filter.CreatedBefore = t.Add(time.Nanosecond)
+			return true
+		}
+	}
+	return false
+}
+
+func decodePatch(r *http.Request) ([]PatchOperation, error) {
+	var req PatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest("invalidSyntax", "invalid JSON")
+	}
+	if !slices.Contains(req.Schemas, patchSchema) {
+		return nil, badRequest("invalidSyntax", "schemas must contain %s", patchSchema)
+	}
+	if len(req.Operations) == 0 {
+		return nil, badRequest("invalidSyntax", "no Operations")
+	}
+	return req.Operations, nil
+}
+
+// applyPatch runs every operation through apply. An operation without a
+// path carries an object whose attributes are each applied in turn.
+func applyPatch(ops []PatchOperation, apply func(op string, path scimfilter.Path, value json.RawMessage) error) error {
+	for _, o := range ops {
+		op := strings.ToLower(o.Op)
+		if op != "add" && op != "replace" && op != "remove" {
+			return badRequest("invalidSyntax", "unknown op %q", o.Op)
+		}
+
+		if o.Path != "" {
+			path, err := scimfilter.ParsePath(o.Path)
+			if err != nil {
+				return badRequest("invalidPath", "%s", err)
+			}
+			if err := apply(op, path, o.Value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if op == "remove" {
+			return badRequest("noTarget", "remove needs a path")
+		}
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(o.Value, &values); err != nil {
+			return badRequest("invalidValue", "an operation without a path needs an object value")
+		}
+		for name, value := range values {
+			path, err := scimfilter.ParsePath(name)
+			if err != nil {
+				return badRequest("invalidPath", "%s", err)
+			}
+			if err := apply(op, path, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type userState struct {
+	email  string
+	name   string
+	active bool
+}
+
+func (s *userState) apply(op string, path scimfilter.Path, value json.RawMessage) error {
+	attr := strings.ToLower(path.Attr.Attr)
+	sub := strings.ToLower(path.Attr.Sub)
+	if op == "remove" {
+		return badRequest("mutability", "%s cannot be removed", path.Attr)
+	}
+
+	switch {
+	case attr == "username" && sub == "":
+		return decodeValue(value, &s.email)
+	case attr == "displayname" && sub == "":
+		return decodeValue(value, &s.name)
+	case attr == "name" && sub == "":
+		var name Name
+		if err := decodeValue(value, &name); err != nil {
+			return err
+		}
+		if n := (User{Name: &name}).nameOf(); n != "" {
+			s.name = n
+		}
+		return nil
+	case attr == "name" && sub == "formatted":
+		return decodeValue(value, &s.name)
+	case attr == "name" && (sub == "givenname" || sub == "familyname"):
+		// the name is stored whole, given and family name are its first
+		// word and the rest
+		var part string
+		if err := decodeValue(value, &part); err != nil {
+			return err
+		}
+		given, family, _ := strings.Cut(s.name, " ")
+		if sub == "givenname" {
+			given = part
+		} else {
+			family = part
+		}
+		s.name = strings.TrimSpace(given + " " + family)
+		return nil
+	case attr == "emails" && sub == "value":
+		return decodeValue(value, &s.email)
+	case attr == "emails" && sub == "" && path.Filter == nil:
+		var emails []Email
+		if err := decodeValue(value, &emails); err != nil {
+			return err
+		}
+		for i, e := range emails {
+			if e.Primary || i == 0 {
+				s.email = e.Value
+			}
+			if e.Primary {
+				break
+			}
+		}
+		return nil
+	case attr == "active" && sub == "":
+		// some clients send booleans as strings
+		var active any
+		if err := decodeValue(value, &active); err != nil {
+			return err
+		}
+		switch v := active.(type) {
+		case bool:
+			s.active = v
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return badRequest("invalidValue", "active must be a boolean")
+			}
+			s.active = b
+		default:
+			return badRequest("invalidValue", "active must be a boolean")
+		}
+		return nil
+	}
+	return badRequest("invalidPath", "%s cannot be changed", path.Attr)
+}
+
+type groupState struct {
+	name    string
+	members []Ref
+}
+
+func (s *groupState) apply(op string, path scimfilter.Path, value json.RawMessage) error {
+	attr := strings.ToLower(path.Attr.Attr)
+	if path.Attr.Sub != "" {
+		return badRequest("invalidPath", "%s cannot be changed", path.Attr)
+	}
+
+	switch attr {
+	case "displayname":
+		if op == "remove" {
+			return badRequest("mutability", "displayName cannot be removed")
+		}
+		return decodeValue(value, &s.name)
+	case "members":
+	default:
+		return badRequest("invalidPath", "%s cannot be changed", path.Attr)
+	}
+
+	var refs []Ref
+	if len(value) > 0 {
+		if err := decodeValue(value, &refs); err != nil {
+			return err
+		}
+	}
+
+	switch op {
+	case "add":
+		s.members = append(s.members, refs...)
+	case "replace":
+		if path.Filter != nil {
+			return badRequest("invalidPath", "replace members with remove and add")
+		}
+		s.members = refs
+	case "remove":
+		switch {
+		case path.Filter != nil:
+			s.members = slices.DeleteFunc(s.members, func(m Ref) bool {
+				return path.Filter.Match(map[string]any{"value": m.Value, "display": m.Display})
+			})
+		case len(refs) > 0:
+			s.members = slices.DeleteFunc(s.members, func(m Ref) bool {
+				return slices.ContainsFunc(refs, func(r Ref) bool { return r.Value == m.Value })
+			})
+		default:
+			s.members = nil
+		}
+	}
+	return nil
+}
+
+func decodeValue(value json.RawMessage, v any) error {
+	if len(value) == 0 {
+		return badRequest("invalidValue", "value is required")
+	}
+	if err := json.Unmarshal(value, v); err != nil {
+		return badRequest("invalidValue", "invalid value %s", value)
+	}
+	return nil
+}
+
+func memberIDs(refs []Ref) ([]int64, error) {
+	ids := make([]int64, 0, len(refs))
+	for _, ref := range refs {
+		id, err := strconv.ParseInt(ref.Value, 10, 64)
+		if err != nil || id <= 0 {
+			return nil, badRequest("invalidValue", "invalid member %q", ref.Value)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (h *Handler) authenticate(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	appID, err := h.scim.Authenticate(r.Context(), bearer.Token(r))
+	if err != nil {
+		h.writeError(w, err)
+		return 0, false
+	}
+	return appID, true
+}
+
+// pathID parses the id in the path. Ids that are not numbers are simply
+// not found.
+func pathID(r *http.Request) int64 {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// baseURL is where the SCIM endpoints are served, for resource locations.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + "/scim/v2"
+}
+
+func (h *Handler) writeError(w http.ResponseWriter, err error) {
+	resp := Error{Schemas: []string{errorSchema}}
+	status := http.StatusInternalServerError
+
+	var reqErr *requestError
+	switch {
+	case errors.As(err, &reqErr):
+		status, resp.ScimType, resp.Detail = reqErr.status, reqErr.scimType, reqErr.detail
+	case errors.Is(err, scim.ErrInvalidToken):
+		w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+		status, resp.Detail = http.StatusUnauthorized, "invalid token"
+	case errors.Is(err, scim.ErrUserNotFound):
+		status, resp.Detail = http.StatusNotFound, "user not found"
+	case errors.Is(err, scim.ErrGroupNotFound):
+		status, resp.Detail = http.StatusNotFound, "group not found"
+	case errors.Is(err, scim.ErrAdminUser):
+		status, resp.Detail = http.StatusForbidden, "admin users are not managed over SCIM"
+	case errors.Is(err, scim.ErrUserExists):
+		status, resp.ScimType, resp.Detail = http.StatusConflict, "uniqueness", "userName is taken"
+	case errors.Is(err, scim.ErrGroupExists):
+		status, resp.ScimType, resp.Detail = http.StatusConflict, "uniqueness", "displayName is taken"
+	case errors.Is(err, scim.ErrInvalidUser), errors.Is(err, scim.ErrInvalidGroup), errors.Is(err, scim.ErrInvalidMember):
+		status, resp.ScimType, resp.Detail = http.StatusBadRequest, "invalidValue", unwrapDetail(err)
+	default:
+		resp.Detail = "internal server error"
+	}
+
+	resp.Status = strconv.Itoa(status)
+	h.writeResource(w, status, resp)
+}
+
+// unwrapDetail drops the op prefixes from a service error.
+func unwrapDetail(err error) string {
+	msg := err.Error()
+	for _, sentinel := range []error{scim.ErrInvalidUser, scim.ErrInvalidGroup, scim.ErrInvalidMember} {
+		if i := strings.Index(msg, sentinel.Error()); i >= 0 {
+			return msg[i:]
+		}
+	}
+	return msg
+}
+
+func (h *Handler) writeProjected(w http.ResponseWriter, r *http.Request, resource any) {
+	query := r.URL.Query()
+	m, err := toMap(resource)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	h.writeResource(w, http.StatusOK, project(m, splitList(query.Get("attributes")), splitList(query.Get("excludedAttributes"))))
+}
+
+func (h *Handler) writeResource(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.log.Error("failed to encode response", slog.String("error", err.Error()))
+	}
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
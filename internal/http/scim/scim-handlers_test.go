@@ -0,0 +1,286 @@
+package scimhttp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"sso/internal/config"
+	"sso/internal/domain/models"
+	"sso/internal/lib/passhash/passhashtest"
+	"sso/internal/lib/passpolicy"
+	"sso/internal/lib/scimfilter"
+	"sso/internal/migrator"
+	"sso/internal/services/scim"
+	"sso/internal/storage/sqlite"
+)
+
+// testServer serves the SCIM routes over a migrated SQLite database with
+// two apps, each holding a token.
+type testServer struct {
+	t       *testing.T
+	mux     *http.ServeMux
+	storage *sqlite.Storage
+	tokens  map[int64]string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	log := slog.New(slog.DiscardHandler)
+	ctx := context.Background()
+
+	cfg := &config.Config{Storage: config.StorageConfig{
+		Driver:     config.StorageDriverSQLite,
+		SQLitePath: filepath.Join(t.TempDir(), "sso.db"),
+	}}
+	if err := migrator.Up(log, cfg, "schema_migrations"); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	storage, err := sqlite.New(sqlite.DSN(cfg.Storage.SQLitePath))
+	if err != nil {
+		t.Fatalf("sqlite.New: %v", err)
+	}
+	t.Cleanup(func() { storage.Close() })
+
+	service := scim.New(log, storage, storage, storage, passhashtest.Hasher{}, &passpolicy.Policy{})
+	srv := &testServer{t: t, mux: http.NewServeMux(), storage: storage, tokens: make(map[int64]string)}
+	for _, app := range []models.App{{ID: 1, Name: "first", Secret: "s1"}, {ID: 2, Name: "second", Secret: "s2"}} {
+		if err := storage.SaveApp(ctx, app); err != nil {
+			t.Fatalf("SaveApp: %v", err)
+		}
+		token, err := service.IssueToken(ctx, int64(app.ID))
+		if err != nil {
+			t.Fatalf("IssueToken: %v", err)
+		}
+		srv.tokens[int64(app.ID)] = token
+	}
+
+	h := NewHandler(service, log)
+	srv.mux.HandleFunc("POST /scim/v2/Users", h.CreateUserHandler)
+	srv.mux.HandleFunc("GET /scim/v2/Users", h.ListUsersHandler)
+	srv.mux.HandleFunc("GET /scim/v2/Users/{id}", h.GetUserHandler)
+	srv.mux.HandleFunc("PATCH /scim/v2/Users/{id}", h.PatchUserHandler)
+	srv.mux.HandleFunc("DELETE /scim/v2/Users/{id}", h.DeleteUserHandler)
+	srv.mux.HandleFunc("POST /scim/v2/Groups", h.CreateGroupHandler)
+	srv.mux.HandleFunc("GET /scim/v2/Groups/{id}", h.GetGroupHandler)
+	return srv
+}
+
+func (s *testServer) do(method string, path string, token string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, req)
+	return rec
+}
+
+// createUser provisions a user through app and returns its id.
+func (s *testServer) createUser(appID int64, email string, name string) string {
+	s.t.Helper()
+	rec := s.do("POST", "/scim/v2/Users", s.tokens[appID], fmt.Sprintf(`{"userName":%q,"displayName":%q}`, email, name))
+	if rec.Code != http.StatusCreated {
+		s.t.Fatalf("create %s: %d %s", email, rec.Code, rec.Body)
+	}
+	var user User
+	if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+		s.t.Fatalf("decode user: %v", err)
+	}
+	return user.ID
+}
+
+func (s *testServer) list(appID int64, query url.Values) ListResponse {
+	s.t.Helper()
+	rec := s.do("GET", "/scim/v2/Users?"+query.Encode(), s.tokens[appID], "")
+	if rec.Code != http.StatusOK {
+		s.t.Fatalf("list %v: %d %s", query, rec.Code, rec.Body)
+	}
+	var resp ListResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		s.t.Fatalf("decode list: %v", err)
+	}
+	return resp
+}
+
+func userNames(resp ListResponse) []string {
+	var names []string
+	for _, r := range resp.Resources {
+		names = append(names, r.(map[string]any)["userName"].(string))
+	}
+	return names
+}
+
+func TestTokenAuth(t *testing.T) {
+	srv := newTestServer(t)
+
+	for _, token := range []string{"", "not-a-token"} {
+		rec := srv.do("GET", "/scim/v2/Users", token, "")
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: status %d, want 401", token, rec.Code)
+		}
+		if rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("token %q: no WWW-Authenticate challenge", token)
+		}
+	}
+	if rec := srv.do("GET", "/scim/v2/Users", srv.tokens[1], ""); rec.Code != http.StatusOK {
+		t.Errorf("valid token: status %d, want 200", rec.Code)
+	}
+}
+
+func TestCrossAppIsolation(t *testing.T) {
+	srv := newTestServer(t)
+
+	id := srv.createUser(1, "alice@example.com", "Alice")
+	if _, err := srv.storage.SaveUser(context.Background(), "registered@example.com", "Registered", []byte("hash"), 0); err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+	path := "/scim/v2/Users/" + id
+	patch := `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","path":"active","value":false}]}`
+
+	for _, req := range []struct{ method, body string }{{"GET", ""}, {"PATCH", patch}, {"DELETE", ""}} {
+		if rec := srv.do(req.method, path, srv.tokens[2], req.body); rec.Code != http.StatusNotFound {
+			t.Errorf("%s from app 2: status %d, want 404", req.method, rec.Code)
+		}
+	}
+	if resp := srv.list(2, nil); resp.TotalResults != 0 {
+		t.Errorf("app 2 lists %v", userNames(resp))
+	}
+	// users registered on their own belong to no app
+	if resp := srv.list(1, nil); strings.Join(userNames(resp), ",") != "alice@example.com" {
+		t.Errorf("app 1 lists %v", userNames(resp))
+	}
+
+	rec := srv.do("GET", path, srv.tokens[1], "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"active":true`) {
+		t.Errorf("GET from app 1: %d %s", rec.Code, rec.Body)
+	}
+
+	// a group of app 2 cannot pull in app 1's user
+	rec = srv.do("POST", "/scim/v2/Groups", srv.tokens[2], fmt.Sprintf(`{"displayName":"Team","members":[{"value":%q}]}`, id))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("group with another app's member: status %d, want 400", rec.Code)
+	}
+}
+
+func TestAdminUserRefused(t *testing.T) {
+	srv := newTestServer(t)
+
+	id := srv.createUser(1, "bob@example.com", "Bob")
+	userID, _ := strconv.ParseInt(id, 10, 64)
+	if err := srv.storage.SetAdmin(context.Background(), userID, true); err != nil {
+		t.Fatalf("SetAdmin: %v", err)
+	}
+
+	for _, method := range []string{"GET", "DELETE"} {
+		if rec := srv.do(method, "/scim/v2/Users/"+id, srv.tokens[1], ""); rec.Code != http.StatusForbidden {
+			t.Errorf("%s of an admin: status %d, want 403", method, rec.Code)
+		}
+	}
+	if resp := srv.list(1, nil); resp.TotalResults != 0 {
+		t.Errorf("admins are listed: %v", userNames(resp))
+	}
+	user, err := srv.storage.UserByID(context.Background(), userID)
+	if err != nil || user.Status != models.UserStatusActive {
+		t.Errorf("admin after DELETE = %+v, %v", user, err)
+	}
+}
+
+func TestListUsersFilter(t *testing.T) {
+	srv := newTestServer(t)
+
+	srv.createUser(1, "anna@example.com", "Anna Lee")
+	andy := srv.createUser(1, "andy@example.com", "Andy Lee")
+	srv.createUser(1, "beth@example.com", "Beth Moss")
+	srv.createUser(2, "anton@example.com", "Anton Lee")
+	patch := `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","path":"active","value":false}]}`
+	if rec := srv.do("PATCH", "/scim/v2/Users/"+andy, srv.tokens[1], patch); rec.Code != http.StatusOK {
+		t.Fatalf("deactivate: %d %s", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		name      string
+		query     url.Values
+		wantTotal int
+		wantUsers string
+	}{
+		{
+			name:      "userName eq",
+			query:     url.Values{"filter": {`userName eq "ANNA@example.com"`}},
+			wantTotal: 1, wantUsers: "anna@example.com",
+		},
+		{
+			name:      "paged in storage",
+			query:     url.Values{"filter": {`userName sw "an"`}, "startIndex": {"2"}, "count": {"1"}},
+			wantTotal: 2, wantUsers: "andy@example.com",
+		},
+		{
+			name:      "past the last",
+			query:     url.Values{"startIndex": {"10"}},
+			wantTotal: 3,
+		},
+		{
+			name:      "active",
+			query:     url.Values{"filter": {`active eq false`}},
+			wantTotal: 1, wantUsers: "andy@example.com",
+		},
+		{
+			name:      "displayName eq runs on every user",
+			query:     url.Values{"filter": {`displayName eq "anna lee"`}},
+			wantTotal: 1, wantUsers: "anna@example.com",
+		},
+		{
+			name:      "or runs on every user",
+			query:     url.Values{"filter": {`userName eq "beth@example.com" or displayName co "andy"`}, "count": {"1"}},
+			wantTotal: 2, wantUsers: "andy@example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.list(1, tt.query)
+			if resp.TotalResults != tt.wantTotal {
+				t.Errorf("totalResults = %d, want %d", resp.TotalResults, tt.wantTotal)
+			}
+			if got := strings.Join(userNames(resp), ","); got != tt.wantUsers {
+				t.Errorf("users = %s, want %s", got, tt.wantUsers)
+			}
+			if resp.ItemsPerPage != len(resp.Resources) {
+				t.Errorf("itemsPerPage = %d for %d resources", resp.ItemsPerPage, len(resp.Resources))
+			}
+		})
+	}
+}
+
+func TestPushDown(t *testing.T) {
+	tests := []struct {
+		filter string
+		exact  bool
+	}{
+		{`userName eq "a@example.com"`, true},
+		{`userName sw "a" and active eq true`, true},
+		{`meta.created gt "2024-01-01T00:00:00Z" and meta.created le "2025-01-01T00:00:00Z"`, true},
+		{`displayName co "lee"`, true},
+		{`displayName eq "Anna Lee"`, false},
+		{`userName eq "a@example.com" and userName eq "b@example.com"`, false},
+		{`userName eq "a@example.com" or active eq true`, false},
+		{`not (active eq true)`, false},
+		{`emails[type eq "work"]`, false},
+	}
+	for _, tt := range tests {
+		expr, err := scimfilter.Parse(tt.filter)
+		if err != nil {
+			t.Fatalf("Parse(%s): %v", tt.filter, err)
+		}
+		if _, exact := pushDown(expr); exact != tt.exact {
+			t.Errorf("pushDown(%s) exact = %v, want %v", tt.filter, exact, tt.exact)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Package attempts counts failed logins per account and per client address
+// and tells how long the next attempt has to wait: nothing for the first
+// few failures, then an exponentially growing delay, then a temporary
+// lockout.
+package attempts
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Store keeps failure counters by key. Counters whose last failure is
+// older than a window start over, PruneLoginFailures drops them for good.
+type Store interface {
+	// ReserveLoginAttempt counts an attempt at the given time as a failure,
+	// starting over if the last one was before since. It returns the new
+	// count and the time of the failure before, zero if there was none.
+	ReserveLoginAttempt(ctx context.Context, key string, at time.Time, since time.Time) (int, time.Time, error)
+	// ReleaseLoginAttempt takes back the attempt reserved at the given
+	// time, putting the last failure back to prev unless a later attempt
+	// moved it.
+	ReleaseLoginAttempt(ctx context.Context, key string, at time.Time, prev time.Time) error
+	ResetLoginFailures(ctx context.Context, key string) error
+	PruneLoginFailures(ctx context.Context, before time.Time) (int64, error)
+}
+
+// Limits are the failures tolerated on one key. After Free failures every
+// attempt waits, Lockout failures lock the key out, 0 never does.
+type Limits struct {
+	Free    int
+	Lockout int
+}
+
+// Policy is how failures turn into waiting. The delay starts at BaseDelay
+// and doubles with every failure up to MaxDelay. Failures are forgotten
+// Window after the last one.
+type Policy struct {
+	Account         Limits
+	IP              Limits
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutDuration time.Duration
+	Window          time.Duration
+}
+
+type Guard struct {
+	store  Store
+	policy Policy
+	now    func() time.Time
+}
+
+func NewGuard(store Store, policy Policy) *Guard {
+	return &Guard{store: store, policy: policy, now: time.Now}
+}
+
+// Attempt is a login let through by Begin. It is counted as a failed one
+// from the start, so concurrent attempts cannot all pass before any of
+// them failed, until Succeed or Cancel takes it back.
+type Attempt struct {
+	at       time.Time
+	email    string
+	reserved []reservation
+	done     bool
+}
+
+// reservation is an attempt counted on one key, failures counting it.
+type reservation struct {
+	key      string
+	limits   Limits
+	failures int
+	prev     time.Time
+}
+
+// Begin reserves a login to the account from clientIP. When it has to wait
+// the reservation is taken back and Begin returns how long, with no
+// Attempt.
+func (g *Guard) Begin(ctx context.Context, email string, clientIP string) (*Attempt, time.Duration, error) {
+	now := g.now()
+	since := now.Add(-g.policy.Window)
+
+	a := &Attempt{at: now, email: email}
+	var wait time.Duration
+	for _, k := range g.keys(email, clientIP) {
+		failures, prev, err := g.store.ReserveLoginAttempt(ctx, k.key, now, since)
+		if err != nil {
+			g.release(ctx, a)
+			return nil, 0, err
+		}
+		a.reserved = append(a.reserved, reservation{key: k.key, limits: k.limits, failures: failures, prev: prev})
+
+		// the failures before this attempt decide whether it may go ahead
+		if until := g.until(k.limits, failures-1, prev); until.After(now) {
+			wait = max(wait, until.Sub(now))
+		}
+	}
+	if wait > 0 {
+		if err := g.release(ctx, a); err != nil {
+			return nil, 0, err
+		}
+		return nil, wait, nil
+	}
+	return a, 0, nil
+}
+
+// Fail leaves the attempt counted as a failed login. It reports whether
+// the failure locked the account out.
+func (g *Guard) Fail(a *Attempt) bool {
+	if a == nil || a.done {
+		return false
+	}
+	a.done = true
+
+	// keys start with the account
+	acc := a.reserved[0]
+	return acc.limits.Lockout > 0 && acc.failures == acc.limits.Lockout
+}
+
+// Succeed forgets the failures on the account and takes the attempt back
+// from the client address. The other failures of the address stay, or
+// logging in to an own account would reset them.
+func (g *Guard) Succeed(ctx context.Context, a *Attempt) error {
+	if a == nil || a.done {
+		return nil
+	}
+	a.done = true
+
+	if err := g.store.ResetLoginFailures(ctx, AccountKey(a.email)); err != nil {
+		return err
+	}
+	for _, r := range a.reserved[1:] {
+		if err := g.store.ReleaseLoginAttempt(ctx, r.key, a.at, r.prev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cancel takes back an attempt that neither failed nor succeeded, like a
+// login cut short by an error. It does nothing after Fail or Succeed.
+func (g *Guard) Cancel(ctx context.Context, a *Attempt) error {
+	if a == nil || a.done {
+		return nil
+	}
+	return g.release(ctx, a)
+}
+
+func (g *Guard) release(ctx context.Context, a *Attempt) error {
+	a.done = true
+
+	var errs []error
+	for _, r := range a.reserved {
+		errs = append(errs, g.store.ReleaseLoginAttempt(ctx, r.key, a.at, r.prev))
+	}
+	return errors.Join(errs...)
+}
+
+// Prune drops counters that are past the window.
+func (g *Guard) Prune(ctx context.Context) (int64, error) {
+	return g.store.PruneLoginFailures(ctx, g.now().Add(-g.policy.Window))
+}
+
+// until is when the next attempt is allowed after failures, the last of
+// them at last.
+func (g *Guard) until(limits Limits, failures int, last time.Time) time.Time {
+	switch {
+	case limits.Lockout > 0 && failures >= limits.Lockout:
+		return last.Add(g.policy.LockoutDuration)
+	case failures > limits.Free:
+		delay := g.policy.BaseDelay
+		for i := limits.Free + 1; i < failures && delay < g.policy.MaxDelay; i++ {
+			delay *= 2
+		}
+		return last.Add(min(delay, g.policy.MaxDelay))
+	}
+	return time.Time{}
+}
+
+type key struct {
+	key    string
+	limits Limits
+}
+
+func (g *Guard) keys(email string, clientIP string) []key {
+	keys := []key{{AccountKey(email), g.policy.Account}}
+	if clientIP != "" {
+		keys = append(keys, key{ipKey(clientIP), g.policy.IP})
+	}
+	return keys
+}
+
+// AccountKey is the key the failures on the account with email are counted
+// under.
+func AccountKey(email string) string {
+	return "account:" + strings.ToLower(email)
+}
+
+// ipKey counts IPv6 clients by their /64, which a single host usually
+// has all of.
+func ipKey(clientIP string) string {
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return "ip:" + clientIP
+	}
+	addr = addr.Unmap()
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		return "ip:" + prefix.String()
+	}
+	return "ip:" + addr.String()
+}
@@ -0,0 +1,148 @@
+package attempts
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGuard(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	g := NewGuard(NewMemoryStore(), Policy{
+		Account:         Limits{Free: 2, Lockout: 6},
+		IP:              Limits{Free: 10, Lockout: 0},
+		BaseDelay:       time.Second,
+		MaxDelay:        4 * time.Second,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	})
+	g.now = func() time.Time { return now }
+
+	// begin starts an attempt that may go ahead now
+	begin := func(email, ip string) *Attempt {
+		t.Helper()
+		a, wait, err := g.Begin(ctx, email, ip)
+		if err != nil {
+			t.Fatalf("Begin: %v", err)
+		}
+		if a == nil {
+			t.Fatalf("Begin(%s, %s) has to wait %v", email, ip, wait)
+		}
+		return a
+	}
+	wantWait := func(email, ip string, want time.Duration) {
+		t.Helper()
+		a, wait, err := g.Begin(ctx, email, ip)
+		if err != nil {
+			t.Fatalf("Begin: %v", err)
+		}
+		if err := g.Cancel(ctx, a); err != nil {
+			t.Fatalf("Cancel: %v", err)
+		}
+		if wait != want {
+			t.Fatalf("Begin(%s, %s) waits %v, want %v", email, ip, wait, want)
+		}
+	}
+
+	// free attempts, then 1s, 2s, 4s and 4s again, capped, then the lockout
+	waits := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second, 15 * time.Minute}
+	for i, want := range waits {
+		locked := g.Fail(begin("Alice@example.com", "192.0.2.1"))
+		if locked != (i == 5) {
+			t.Fatalf("failure %d locked = %v", i+1, locked)
+		}
+		wantWait("alice@example.com", "198.51.100.7", want)
+		// a refused attempt does not push the wait further out
+		wantWait("alice@example.com", "198.51.100.7", want)
+		if i < len(waits)-1 {
+			now = now.Add(want)
+		}
+	}
+
+	// the address only counted six of its ten free failures
+	wantWait("bob@example.com", "192.0.2.1", 0)
+
+	now = now.Add(15 * time.Minute)
+	wantWait("alice@example.com", "", 0)
+
+	if err := g.Succeed(ctx, begin("alice@example.com", "")); err != nil {
+		t.Fatalf("Succeed: %v", err)
+	}
+	if g.Fail(begin("alice@example.com", "")) {
+		t.Fatal("first failure after a success locked the account")
+	}
+	wantWait("alice@example.com", "", 0)
+
+	// an IPv6 client counts by its /64
+	for i := range 11 {
+		g.Fail(begin(fmt.Sprintf("user%d@example.com", i), "2001:db8:1:2::1"))
+	}
+	wantWait("dave@example.com", "2001:db8:1:2:ffff::9", time.Second)
+	wantWait("dave@example.com", "2001:db8:1:3::1", 0)
+
+	now = now.Add(2 * time.Hour)
+	pruned, err := g.Prune(ctx)
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	// counters taken back to nothing stay until they are pruned too
+	if pruned != 18 {
+		t.Fatalf("Prune = %d, want 18", pruned)
+	}
+}
+
+// TestGuardConcurrent starts many attempts on one account at once, no more
+// of them may go ahead than the lockout allows.
+func TestGuardConcurrent(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	g := NewGuard(NewMemoryStore(), Policy{
+		Account:         Limits{Free: 5, Lockout: 5},
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Second,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	})
+	g.now = func() time.Time { return now }
+
+	var (
+		mu             sync.Mutex
+		passed, locked int
+		wg             sync.WaitGroup
+	)
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a, _, err := g.Begin(ctx, "alice@example.com", "")
+			if err != nil {
+				t.Errorf("Begin: %v", err)
+				return
+			}
+			if a == nil {
+				return
+			}
+			l := g.Fail(a)
+
+			mu.Lock()
+			defer mu.Unlock()
+			passed++
+			if l {
+				locked++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if passed != 5 || locked != 1 {
+		t.Fatalf("%d attempts went ahead and %d locked the account, want 5 and 1", passed, locked)
+	}
+	if a, wait, _ := g.Begin(ctx, "alice@example.com", ""); a != nil || wait != 15*time.Minute {
+		t.Fatalf("Begin after the lockout waits %v", wait)
+	}
+}
@@ -0,0 +1,76 @@
+package attempts
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the counters in the process. Every instance of the
+// service counts on its own, use the database store to share them.
+type MemoryStore struct {
+	mu       sync.Mutex
+	counters map[string]counter
+}
+
+type counter struct {
+	failures int
+	last     time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{counters: make(map[string]counter)}
+}
+
+func (s *MemoryStore) ReserveLoginAttempt(_ context.Context, key string, at time.Time, since time.Time) (int, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.counters[key]
+	prev := c.last
+	if c.last.Before(since) {
+		c.failures = 0
+	}
+	c.failures++
+	c.last = at
+	s.counters[key] = c
+	return c.failures, prev, nil
+}
+
+func (s *MemoryStore) ReleaseLoginAttempt(_ context.Context, key string, at time.Time, prev time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.counters[key]
+	if !ok {
+		return nil
+	}
+	c.failures = max(c.failures-1, 0)
+	if c.last.Equal(at) && !prev.IsZero() {
+		c.last = prev
+	}
+	s.counters[key] = c
+	return nil
+}
+
+func (s *MemoryStore) ResetLoginFailures(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.counters, key)
+	return nil
+}
+
+func (s *MemoryStore) PruneLoginFailures(_ context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pruned int64
+	for key, c := range s.counters {
+		if c.last.Before(before) {
+			delete(s.counters, key)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
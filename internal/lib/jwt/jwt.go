@@ -1,11 +1,22 @@
 package jwt
 
 import (
+	"errors"
+	"fmt"
 	"github.com/golang-jwt/jwt"
 	"sso/internal/domain/models"
 	"time"
 )
 
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims are the claims NewToken puts into a token.
+type Claims struct {
+	UserID int64
+	Email  string
+	AppID  int
+}
+
 func NewToken(user models.User, app models.App, duration time.Duration) (string, error) {
 	token := jwt.New(jwt.SigningMethodHS256)
 
@@ -21,3 +32,49 @@ func NewToken(user models.User, app models.App, duration time.Duration) (string,
 	}
 	return tokenString, nil
 }
+
+// ParseToken verifies a token issued by NewToken. Tokens are signed with the
+// secret of the app they were issued for, appSecret looks it up by app_id.
+// It refuses an app with an error wrapping ErrInvalidToken, any other error
+// of it, a lookup that failed, is returned as it is. Every other
+// verification failure is reported as ErrInvalidToken.
+func ParseToken(tokenString string, appSecret func(appID int) (string, error)) (Claims, error) {
+	var claims Claims
+	var lookupErr error
+
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+
+		mapClaims, ok := token.Claims.(jwt.MapClaims)
+		if !ok {
+			return nil, errors.New("unexpected claims type")
+		}
+
+		uid, okUID := mapClaims["uid"].(float64)
+		appID, okApp := mapClaims["app_id"].(float64)
+		if !okUID || !okApp {
+			return nil, errors.New("uid and app_id claims are required")
+		}
+		email, _ := mapClaims["email"].(string)
+		claims = Claims{UserID: int64(uid), Email: email, AppID: int(appID)}
+
+		secret, err := appSecret(claims.AppID)
+		if err != nil {
+			lookupErr = err
+			return nil, err
+		}
+		return []byte(secret), nil
+	})
+	if lookupErr != nil {
+		return Claims{}, lookupErr
+	}
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+	if !token.Valid {
+		return Claims{}, ErrInvalidToken
+	}
+	return claims, nil
+}
@@ -0,0 +1,139 @@
+// Package metrics collects the Prometheus metrics of the service.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"sso/internal/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "sso"
+
+// Login outcomes besides the failure reasons.
+const (
+	LoginSuccess = "success"
+)
+
+// Metrics holds every metric on its own registry, so tests and tools can
+// make as many as they like.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	grpcDuration    *prometheus.HistogramVec
+	httpDuration    *prometheus.HistogramVec
+	storageDuration *prometheus.HistogramVec
+	logins          *prometheus.CounterVec
+	registrations   prometheus.Counter
+	tokens          *prometheus.CounterVec
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		grpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "grpc_request_duration_seconds",
+			Help:      "Duration of gRPC calls by method and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "code"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration of HTTP requests by route and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "code"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "storage_operation_duration_seconds",
+			Help:      "Duration of storage operations by operation and whether they failed.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"operation", "error"}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "logins_total",
+			Help:      "Login attempts by result and, for failures, reason.",
+		}, []string{"result", "reason"}),
+		registrations: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "registrations_total",
+			Help:      "Users registered.",
+		}),
+		tokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tokens_issued_total",
+			Help:      "Tokens issued by app.",
+		}, []string{"app"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.grpcDuration, m.httpDuration, m.storageDuration,
+		m.logins, m.registrations, m.tokens,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+func (m *Metrics) ObserveGRPC(method string, code string, d time.Duration) {
+	m.grpcDuration.WithLabelValues(method, code).Observe(d.Seconds())
+}
+
+// ObserveHTTP records a request to route, the pattern it matched, so
+// scanning for paths does not grow a series for each.
+func (m *Metrics) ObserveHTTP(method string, route string, status int, d time.Duration) {
+	m.httpDuration.WithLabelValues(method, route, strconv.Itoa(status)).Observe(d.Seconds())
+}
+
+// ObserveStorage records an operation named like the op of its errors,
+// storage.SaveUser for example.
+func (m *Metrics) ObserveStorage(operation string, failed bool, d time.Duration) {
+	m.storageDuration.WithLabelValues(operation, strconv.FormatBool(failed)).Observe(d.Seconds())
+}
+
+// LoginAttempt counts a login by outcome, LoginSuccess or the reason it
+// failed.
+func (m *Metrics) LoginAttempt(outcome string) {
+	if outcome == LoginSuccess {
+		m.logins.WithLabelValues("success", "").Inc()
+		return
+	}
+	m.logins.WithLabelValues("failure", outcome).Inc()
+}
+
+func (m *Metrics) UserRegistered() {
+	m.registrations.Inc()
+}
+
+func (m *Metrics) TokenIssued(appID int) {
+	m.tokens.WithLabelValues(strconv.Itoa(appID)).Inc()
+}
+
+// RegisterPool exports the statistics of the database pool read by stats
+// at every scrape.
+func (m *Metrics) RegisterPool(stats func() storage.PoolStats) {
+	gauge := func(name, help string, value func(storage.PoolStats) int) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "db_pool",
+			Name:      name,
+			Help:      help,
+		}, func() float64 { return float64(value(stats())) })
+	}
+	m.registry.MustRegister(
+		gauge("max_connections", "Most connections the pool opens.", func(s storage.PoolStats) int { return s.Max }),
+		gauge("open_connections", "Connections open.", func(s storage.PoolStats) int { return s.Open }),
+		gauge("in_use_connections", "Connections in use.", func(s storage.PoolStats) int { return s.InUse }),
+		gauge("idle_connections", "Connections idle.", func(s storage.PoolStats) int { return s.Idle }),
+	)
+}
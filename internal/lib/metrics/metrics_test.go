@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"sso/internal/storage"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	m.LoginAttempt(LoginSuccess)
+	m.LoginAttempt("invalid_credentials")
+	m.LoginAttempt("invalid_credentials")
+	m.TokenIssued(1)
+	m.ObserveStorage("storage.User", false, time.Millisecond)
+	m.RegisterPool(func() storage.PoolStats { return storage.PoolStats{Max: 10, Open: 3, InUse: 1, Idle: 2} })
+
+	if got := testutil.ToFloat64(m.logins.WithLabelValues("failure", "invalid_credentials")); got != 2 {
+		t.Fatalf("failed logins = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(m.logins.WithLabelValues("success", "")); got != 1 {
+		t.Fatalf("successful logins = %v, want 1", got)
+	}
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`sso_tokens_issued_total{app="1"} 1`,
+		`sso_storage_operation_duration_seconds_count{error="false",operation="storage.User"} 1`,
+		`sso_db_pool_in_use_connections 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("/metrics lacks %s", want)
+		}
+	}
+}
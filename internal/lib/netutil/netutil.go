@@ -0,0 +1,40 @@
+// Package netutil finds the address a client connects from, the same way for
+// gRPC calls and HTTP requests, so rate limits, login throttling and logs
+// agree on who the client is.
+package netutil
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"google.golang.org/grpc/peer"
+)
+
+// PeerIP is the address the gRPC call came from, empty when unknown.
+func PeerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	return hostIP(p.Addr.String())
+}
+
+// RequestIP is the address of the HTTP peer. Forwarding headers are not
+// trusted, a client could set them to anything.
+func RequestIP(r *http.Request) string {
+	return hostIP(r.RemoteAddr)
+}
+
+// hostIP is the IP of a host:port address, IPv4-mapped IPv6 addresses
+// unmapped. Addresses that are not host:port are returned as they are.
+func hostIP(addr string) string {
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return ap.Addr().Unmap().String()
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
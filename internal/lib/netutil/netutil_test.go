@@ -0,0 +1,47 @@
+package netutil
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc/peer"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{addr: "192.0.2.1:1234", want: "192.0.2.1"},
+		{addr: "[::ffff:192.0.2.1]:1234", want: "192.0.2.1"},
+		{addr: "[2001:db8::1]:1234", want: "2001:db8::1"},
+		{addr: "@", want: "@"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.addr
+			if got := RequestIP(r); got != tt.want {
+				t.Errorf("RequestIP = %q, want %q", got, tt.want)
+			}
+
+			ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: fakeAddr(tt.addr)})
+			if got := PeerIP(ctx); got != tt.want {
+				t.Errorf("PeerIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := PeerIP(context.Background()); got != "" {
+		t.Errorf("PeerIP without a peer = %q, want empty", got)
+	}
+}
+
+type fakeAddr string
+
+func (a fakeAddr) Network() string { return "tcp" }
+func (a fakeAddr) String() string  { return string(a) }
+
+var _ net.Addr = fakeAddr("")
@@ -0,0 +1,36 @@
+// Package notify delivers messages to users.
+package notify
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Notifier sends a message to the given email address.
+type Notifier interface {
+	Notify(ctx context.Context, to string, subject string, body string) error
+}
+
+// LogNotifier writes messages to the log instead of delivering them. It is
+// meant for local setups, the body is logged at debug level only since it
+// may carry one-time tokens.
+type LogNotifier struct {
+	log *slog.Logger
+}
+
+func NewLogNotifier(log *slog.Logger) *LogNotifier {
+	return &LogNotifier{log: log}
+}
+
+func (n *LogNotifier) Notify(ctx context.Context, to string, subject string, body string) error {
+	const op = "notify.Log"
+
+	log := n.log.With(
+		slog.String("op", op),
+		slog.String("to", to),
+		slog.String("subject", subject),
+	)
+	log.Info("notification sent")
+	log.Debug("notification body", slog.String("body", body))
+	return nil
+}
@@ -0,0 +1,164 @@
+package passhash
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Params selects how new passwords are hashed. Hashes of any algorithm
+// Verify knows are still accepted. Peppers holds every pepper stored
+// hashes may have been made with, Pepper is the version new hashes use, 0
+// for none.
+type Params struct {
+	Algorithm  Algorithm
+	Argon2     Argon2Params
+	BcryptCost int
+	Pepper     int
+	Peppers    map[int][]byte
+}
+
+// Argon2Params are the argon2id cost parameters. Memory is in KiB.
+type Argon2Params struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// DefaultParams hash with argon2id using the second recommended option of
+// RFC 9106 (64 MiB, 3 passes, 4 lanes).
+var DefaultParams = Params{
+	Algorithm: Argon2id,
+	Argon2: Argon2Params{
+		Memory:  64 * 1024,
+		Time:    3,
+		Threads: 4,
+		SaltLen: 16,
+		KeyLen:  32,
+	},
+	BcryptCost: bcrypt.DefaultCost,
+}
+
+// Hasher hashes new passwords and tells which stored hashes are due for
+// an upgrade.
+type Hasher struct {
+	params Params
+	// dummy is a hash of a random password made like Hash makes them now,
+	// for VerifyDummy.
+	dummy []byte
+}
+
+func NewHasher(p Params) (*Hasher, error) {
+	switch p.Algorithm {
+	case Argon2id:
+		a := p.Argon2
+		if a.Memory < 8*uint32(a.Threads) || a.Memory > maxArgon2Memory ||
+			a.Time == 0 || a.Time > maxArgon2Time || a.Threads == 0 ||
+			a.SaltLen < 8 || a.KeyLen < 16 || a.KeyLen > maxDerivedKeyLen {
+			return nil, errors.New("argon2id parameters out of range")
+		}
+	case Bcrypt:
+		if p.BcryptCost < bcrypt.MinCost || p.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return nil, fmt.Errorf("cannot hash new passwords with %q, use %s or %s", p.Algorithm, Argon2id, Bcrypt)
+	}
+
+	for version, key := range p.Peppers {
+		if version <= 0 || len(key) < minPepperLen {
+			return nil, fmt.Errorf("pepper version %d must be positive and at least %d bytes", version, minPepperLen)
+		}
+	}
+	if _, ok := p.Peppers[p.Pepper]; p.Pepper != 0 && !ok {
+		return nil, fmt.Errorf("%w %d", ErrUnknownPepper, p.Pepper)
+	}
+
+	h := &Hasher{params: p}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	dummy, _, err := h.Hash(base64.RawStdEncoding.EncodeToString(secret))
+	if err != nil {
+		return nil, fmt.Errorf("hashing the dummy password: %w", err)
+	}
+	h.dummy = dummy
+	return h, nil
+}
+
+// Hash peppers and hashes password, argon2id hashes in the PHC string
+// format. It returns the pepper version to store with the hash.
+func (h *Hasher) Hash(password string) ([]byte, int, error) {
+	version := h.params.Pepper
+	if version != 0 {
+		password = pepper(h.params.Peppers[version], password)
+	}
+
+	if h.params.Algorithm == Bcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.params.BcryptCost)
+		return hash, version, err
+	}
+
+	a := h.params.Argon2
+	salt := make([]byte, a.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, 0, err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, a.KeyLen)
+
+	return fmt.Appendf(nil, "$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), version, nil
+}
+
+// Verify checks password against a hash of any known algorithm made with
+// the pepper pepperVersion. A pepper no longer configured is
+// ErrUnknownPepper.
+func (h *Hasher) Verify(hash []byte, pepperVersion int, password string) error {
+	if pepperVersion != 0 {
+		key, ok := h.params.Peppers[pepperVersion]
+		if !ok {
+			return fmt.Errorf("%w %d", ErrUnknownPepper, pepperVersion)
+		}
+		password = pepper(key, password)
+	}
+	return Verify(hash, password)
+}
+
+// VerifyDummy checks password against a hash nobody knows the password
+// of, taking as long as Verify takes on a current hash. Logins to unknown
+// accounts call it so they cannot be told apart by their response time.
+func (h *Hasher) VerifyDummy(password string) {
+	_ = h.Verify(h.dummy, h.params.Pepper, password)
+}
+
+// NeedsRehash reports whether hash was made with another pepper, another
+// algorithm or other parameters than Hash uses now.
+func (h *Hasher) NeedsRehash(hash []byte, pepperVersion int) bool {
+	if pepperVersion != h.params.Pepper {
+		return true
+	}
+
+	p, err := parse(hash)
+	if err != nil || p.alg != h.params.Algorithm {
+		return true
+	}
+
+	if p.alg == Bcrypt {
+		cost, err := bcrypt.Cost(hash)
+		return err != nil || cost != h.params.BcryptCost
+	}
+
+	a := h.params.Argon2
+	return p.memory != a.Memory || p.time != a.Time || p.threads != a.Threads ||
+		uint32(len(p.salt)) != a.SaltLen || uint32(len(p.key)) != a.KeyLen
+}
@@ -0,0 +1,173 @@
+package passhash
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// cheap keeps the tests fast, production parameters are far higher.
+var cheap = Argon2Params{Memory: 64, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32}
+
+func TestHasherArgon2id(t *testing.T) {
+	h, err := NewHasher(Params{Algorithm: Argon2id, Argon2: cheap})
+	if err != nil {
+		t.Fatalf("NewHasher: %v", err)
+	}
+
+	hash, _, err := h.Hash("password")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if !strings.HasPrefix(string(hash), "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("Hash = %s, want a PHC argon2id string", hash)
+	}
+	if err := h.Verify(hash, 0, "password"); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if err := h.Verify(hash, 0, "passwordx"); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("Verify with a wrong password = %v, want ErrMismatch", err)
+	}
+	if h.NeedsRehash(hash, 0) {
+		t.Fatal("NeedsRehash of a fresh hash = true")
+	}
+
+	again, _, _ := h.Hash("password")
+	if string(again) == string(hash) {
+		t.Fatal("two hashes of the same password are equal, salt is not random")
+	}
+}
+
+func TestHasherNeedsRehash(t *testing.T) {
+	h, err := NewHasher(Params{Algorithm: Argon2id, Argon2: cheap})
+	if err != nil {
+		t.Fatalf("NewHasher: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		hash string
+		want bool
+	}{
+		{"bcrypt", "$2a$04$Gm.DkSaCtVkMFEsrQzDK9OSV7CRwtUjMbn.XLscZCqu.Bu6m15Gta", true},
+		{"pbkdf2", "$pbkdf2-sha256$i=1000,l=32$c2FsdHNhbHRzYWx0c2FsdA$BBs+1+PaslLtBPULUr8/lQicvVuHiEPMz0i8MjLCbzM", true},
+		{"argon2i", "$argon2i$v=19$m=64,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$RdescudvJCsgt3ub+b+dWRWJTmaaJObGRdescudvJCs", true},
+		{"argon2id other memory", "$argon2id$v=19$m=65536,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$RdescudvJCsgt3ub+b+dWRWJTmaaJObGRdescudvJCs", true},
+		{"argon2id short salt", "$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObGRdescudvJCs", true},
+		{"argon2id current", "$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$RdescudvJCsgt3ub+b+dWRWJTmaaJObGRdescudvJCs", false},
+		{"garbage", "hunter2", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := h.NeedsRehash([]byte(tt.hash), 0); got != tt.want {
+				t.Fatalf("NeedsRehash = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasherBcrypt(t *testing.T) {
+	h, err := NewHasher(Params{Algorithm: Bcrypt, BcryptCost: 4})
+	if err != nil {
+		t.Fatalf("NewHasher: %v", err)
+	}
+	hash, _, err := h.Hash("password")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if err := h.Verify(hash, 0, "password"); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if h.NeedsRehash(hash, 0) {
+		t.Fatal("NeedsRehash of a fresh hash = true")
+	}
+	if !h.NeedsRehash([]byte("$2a$05$Gm.DkSaCtVkMFEsrQzDK9OSV7CRwtUjMbn.XLscZCqu.Bu6m15Gta"), 0) {
+		t.Fatal("NeedsRehash of a hash with another cost = false")
+	}
+}
+
+func TestNewHasherRejects(t *testing.T) {
+	for name, p := range map[string]Params{
+		"pbkdf2":         {Algorithm: PBKDF2SHA256},
+		"no memory":      {Algorithm: Argon2id, Argon2: Argon2Params{Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32}},
+		"short salt":     {Algorithm: Argon2id, Argon2: Argon2Params{Memory: 64, Time: 1, Threads: 1, SaltLen: 4, KeyLen: 32}},
+		"bcrypt cost 40": {Algorithm: Bcrypt, BcryptCost: 40},
+		"unknown pepper": {Algorithm: Bcrypt, BcryptCost: 4, Pepper: 2, Peppers: map[int][]byte{1: []byte("0123456789abcdef")}},
+		"short pepper":   {Algorithm: Bcrypt, BcryptCost: 4, Pepper: 1, Peppers: map[int][]byte{1: []byte("short")}},
+	} {
+		if _, err := NewHasher(p); err == nil {
+			t.Errorf("NewHasher(%s) = nil error", name)
+		}
+	}
+}
+
+func TestHasherPepper(t *testing.T) {
+	peppers := map[int][]byte{1: []byte("first pepper, 32 bytes of secret"), 2: []byte("second pepper, 32 bytes secret!!")}
+	old, err := NewHasher(Params{Algorithm: Argon2id, Argon2: cheap, Pepper: 1, Peppers: peppers})
+	if err != nil {
+		t.Fatalf("NewHasher: %v", err)
+	}
+	rotated, err := NewHasher(Params{Algorithm: Argon2id, Argon2: cheap, Pepper: 2, Peppers: peppers})
+	if err != nil {
+		t.Fatalf("NewHasher: %v", err)
+	}
+
+	hash, version, err := old.Hash("password")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if version != 1 {
+		t.Fatalf("pepper version = %d, want 1", version)
+	}
+	if err := Verify(hash, "password"); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("Verify without the pepper = %v, want ErrMismatch", err)
+	}
+	if err := rotated.Verify(hash, version, "password"); err != nil {
+		t.Fatalf("Verify after rotation: %v", err)
+	}
+	if err := rotated.Verify(hash, version, "passwordx"); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("Verify with a wrong password = %v, want ErrMismatch", err)
+	}
+	if old.NeedsRehash(hash, version) {
+		t.Fatal("NeedsRehash with the current pepper = true")
+	}
+	if !rotated.NeedsRehash(hash, version) {
+		t.Fatal("NeedsRehash with an old pepper = false")
+	}
+
+	// hashes from before peppering still verify and get peppered
+	plain, _ := NewHasher(Params{Algorithm: Argon2id, Argon2: cheap})
+	unpeppered, _, _ := plain.Hash("password")
+	if err := rotated.Verify(unpeppered, 0, "password"); err != nil {
+		t.Fatalf("Verify of an unpeppered hash: %v", err)
+	}
+	if !rotated.NeedsRehash(unpeppered, 0) {
+		t.Fatal("NeedsRehash of an unpeppered hash = false")
+	}
+
+	if err := rotated.Verify(hash, 3, "password"); !errors.Is(err, ErrUnknownPepper) {
+		t.Fatalf("Verify with a retired pepper = %v, want ErrUnknownPepper", err)
+	}
+}
+
+func TestParsePeppers(t *testing.T) {
+	peppers, err := ParsePeppers("# rotated 2026-10\n1: MDEyMzQ1Njc4OWFiY2RlZg==\n\n2:ZmVkY2JhOTg3NjU0MzIxMA==")
+	if err != nil {
+		t.Fatalf("ParsePeppers: %v", err)
+	}
+	if string(peppers[1]) != "0123456789abcdef" || string(peppers[2]) != "fedcba9876543210" || len(peppers) != 2 {
+		t.Fatalf("ParsePeppers = %q", peppers)
+	}
+
+	for _, s := range []string{
+		"MDEyMzQ1Njc4OWFiY2RlZg==",
+		"0:MDEyMzQ1Njc4OWFiY2RlZg==",
+		"1:c2hvcnQ=",
+		"1:not base64!",
+		"1:MDEyMzQ1Njc4OWFiY2RlZg==,1:ZmVkY2JhOTg3NjU0MzIxMA==",
+	} {
+		if _, err := ParsePeppers(s); err == nil {
+			t.Errorf("ParsePeppers(%q) = nil error", s)
+		}
+	}
+}
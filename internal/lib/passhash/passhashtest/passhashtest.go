@@ -0,0 +1,56 @@
+// Package passhashtest has the hashers and the user tests log in with.
+package passhashtest
+
+import (
+	"testing"
+
+	"sso/internal/domain/models"
+	"sso/internal/lib/passhash"
+)
+
+// Password is the password of User.
+const Password = "vivid-Orbit-71-lantern"
+
+// Params are argon2id parameters cheap enough to hash with in every test.
+var Params = passhash.Params{
+	Algorithm: passhash.Argon2id,
+	Argon2:    passhash.Argon2Params{Memory: 64, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32},
+}
+
+// NewHasher returns a hasher with params, failing t when they are invalid.
+func NewHasher(t testing.TB, params passhash.Params) *passhash.Hasher {
+	t.Helper()
+	hasher, err := passhash.NewHasher(params)
+	if err != nil {
+		t.Fatalf("NewHasher: %v", err)
+	}
+	return hasher
+}
+
+// User returns the active user alice@example.com with Password hashed by
+// hasher.
+func User(t testing.TB, hasher *passhash.Hasher) models.User {
+	t.Helper()
+	hash, pepperVersion, err := hasher.Hash(Password)
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	return models.User{
+		ID:            1,
+		Email:         "alice@example.com",
+		Name:          "Alice",
+		PassHash:      hash,
+		PepperVersion: pepperVersion,
+		Status:        models.UserStatusActive,
+	}
+}
+
+// Hasher hashes a password to itself behind a "hashed:" prefix, for tests
+// that only store hashes.
+type Hasher struct {
+	PepperVersion int
+}
+
+func (h Hasher) Hash(password string) ([]byte, int, error) {
+	return []byte("hashed:" + password), h.PepperVersion, nil
+}
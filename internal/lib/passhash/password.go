@@ -0,0 +1,271 @@
+// Package passhash hashes passwords and verifies hashes in the formats
+// users can be imported with: bcrypt, argon2 in the PHC string format and
+// PBKDF2 in the PHC, passlib or Django formats.
+package passhash
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Algorithm string
+
+const (
+	Bcrypt       Algorithm = "bcrypt"
+	Argon2id     Algorithm = "argon2id"
+	Argon2i      Algorithm = "argon2i"
+	PBKDF2SHA1   Algorithm = "pbkdf2-sha1"
+	PBKDF2SHA256 Algorithm = "pbkdf2-sha256"
+	PBKDF2SHA512 Algorithm = "pbkdf2-sha512"
+)
+
+var (
+	ErrMismatch      = errors.New("password does not match")
+	ErrUnknownHash   = errors.New("unknown password hash format")
+	ErrMalformedHash = errors.New("malformed password hash")
+)
+
+// Limits on the cost parameters of imported hashes, so that a crafted hash
+// cannot make a single login take minutes or gigabytes.
+const (
+	maxArgon2Memory  = 1 << 20 // KiB
+	maxArgon2Time    = 100
+	maxPBKDF2Rounds  = 10_000_000
+	maxDerivedKeyLen = 1024
+)
+
+// Identify parses the hash and returns its algorithm. It fails for hashes
+// Verify could not check.
+func Identify(hash []byte) (Algorithm, error) {
+	p, err := parse(hash)
+	if err != nil {
+		return "", err
+	}
+	return p.alg, nil
+}
+
+// Verify checks password against hash. It returns ErrMismatch when the
+// password is wrong.
+func Verify(hash []byte, password string) error {
+	p, err := parse(hash)
+	if err != nil {
+		return err
+	}
+
+	if p.alg == Bcrypt {
+		if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+			if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+				return ErrMismatch
+			}
+			return err
+		}
+		return nil
+	}
+
+	var key []byte
+	switch p.alg {
+	case Argon2id:
+		key = argon2.IDKey([]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	case Argon2i:
+		key = argon2.Key([]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	default:
+		key, err = pbkdf2.Key(p.digest, password, p.salt, p.rounds, len(p.key))
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrMalformedHash, err)
+		}
+	}
+
+	if subtle.ConstantTimeCompare(key, p.key) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+type params struct {
+	alg  Algorithm
+	salt []byte
+	key  []byte
+
+	// argon2
+	time    uint32
+	memory  uint32
+	threads uint8
+
+	// pbkdf2
+	rounds int
+	digest func() hash.Hash
+}
+
+func parse(hash []byte) (params, error) {
+	s := string(hash)
+	switch {
+	case strings.HasPrefix(s, "$2a$"), strings.HasPrefix(s, "$2b$"), strings.HasPrefix(s, "$2y$"):
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return params{}, fmt.Errorf("%w: %s", ErrMalformedHash, err)
+		}
+		return params{alg: Bcrypt}, nil
+	case strings.HasPrefix(s, "$argon2"):
+		return parseArgon2(s)
+	case strings.HasPrefix(s, "$pbkdf2-"):
+		return parsePBKDF2(s)
+	case strings.HasPrefix(s, "pbkdf2_"):
+		return parseDjangoPBKDF2(s)
+	}
+	return params{}, ErrUnknownHash
+}
+
+// parseArgon2 parses $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>.
+func parseArgon2(s string) (params, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 || parts[0] != "" {
+		return params{}, ErrMalformedHash
+	}
+
+	var p params
+	switch parts[1] {
+	case "argon2id":
+		p.alg = Argon2id
+	case "argon2i":
+		p.alg = Argon2i
+	default:
+		return params{}, fmt.Errorf("%w: %s", ErrUnknownHash, parts[1])
+	}
+
+	if parts[2] != "v=19" {
+		return params{}, fmt.Errorf("%w: unsupported argon2 version %s", ErrMalformedHash, parts[2])
+	}
+
+	var m, t, threads uint64
+	for _, kv := range strings.Split(parts[3], ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return params{}, ErrMalformedHash
+		}
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return params{}, ErrMalformedHash
+		}
+		switch k {
+		case "m":
+			m = n
+		case "t":
+			t = n
+		case "p":
+			threads = n
+		default:
+			return params{}, ErrMalformedHash
+		}
+	}
+	if m == 0 || m > maxArgon2Memory || t == 0 || t > maxArgon2Time || threads == 0 || threads > 255 {
+		return params{}, fmt.Errorf("%w: argon2 parameters out of range", ErrMalformedHash)
+	}
+	p.memory, p.time, p.threads = uint32(m), uint32(t), uint8(threads)
+
+	var err error
+	if p.salt, err = decodePHC(parts[4]); err != nil {
+		return params{}, err
+	}
+	if p.key, err = decodePHC(parts[5]); err != nil {
+		return params{}, err
+	}
+	if len(p.key) == 0 || len(p.key) > maxDerivedKeyLen {
+		return params{}, ErrMalformedHash
+	}
+	return p, nil
+}
+
+// parsePBKDF2 parses the PHC form $pbkdf2-sha256$i=600000,l=32$<salt>$<key>
+// and the passlib form $pbkdf2-sha256$29000$<salt>$<key>.
+func parsePBKDF2(s string) (params, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 5 || parts[0] != "" {
+		return params{}, ErrMalformedHash
+	}
+
+	p, err := pbkdf2Params(strings.TrimPrefix(parts[1], "pbkdf2-"))
+	if err != nil {
+		return params{}, err
+	}
+
+	rounds := parts[2]
+	for _, kv := range strings.Split(parts[2], ",") {
+		if v, ok := strings.CutPrefix(kv, "i="); ok {
+			rounds = v
+		}
+		// l= is implied by the length of the key
+	}
+	if p.rounds, err = strconv.Atoi(rounds); err != nil {
+		return params{}, ErrMalformedHash
+	}
+
+	if p.salt, err = decodePHC(parts[3]); err != nil {
+		return params{}, err
+	}
+	if p.key, err = decodePHC(parts[4]); err != nil {
+		return params{}, err
+	}
+	return p, checkPBKDF2(p)
+}
+
+// parseDjangoPBKDF2 parses pbkdf2_sha256$<rounds>$<salt>$<base64 key>,
+// where the salt is used as is.
+func parseDjangoPBKDF2(s string) (params, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 4 {
+		return params{}, ErrMalformedHash
+	}
+
+	p, err := pbkdf2Params(strings.TrimPrefix(parts[0], "pbkdf2_"))
+	if err != nil {
+		return params{}, err
+	}
+	if p.rounds, err = strconv.Atoi(parts[1]); err != nil {
+		return params{}, ErrMalformedHash
+	}
+	p.salt = []byte(parts[2])
+	if p.key, err = base64.StdEncoding.DecodeString(parts[3]); err != nil {
+		return params{}, ErrMalformedHash
+	}
+	return p, checkPBKDF2(p)
+}
+
+func pbkdf2Params(digest string) (params, error) {
+	switch digest {
+	case "sha1":
+		return params{alg: PBKDF2SHA1, digest: sha1.New}, nil
+	case "sha256":
+		return params{alg: PBKDF2SHA256, digest: sha256.New}, nil
+	case "sha512":
+		return params{alg: PBKDF2SHA512, digest: sha512.New}, nil
+	}
+	return params{}, fmt.Errorf("%w: pbkdf2 with %s", ErrUnknownHash, digest)
+}
+
+func checkPBKDF2(p params) error {
+	if p.rounds <= 0 || p.rounds > maxPBKDF2Rounds || len(p.key) == 0 || len(p.key) > maxDerivedKeyLen {
+		return fmt.Errorf("%w: pbkdf2 parameters out of range", ErrMalformedHash)
+	}
+	return nil
+}
+
+// decodePHC decodes the unpadded base64 of PHC strings. passlib writes the
+// same alphabet with '.' instead of '+'.
+func decodePHC(s string) ([]byte, error) {
+	b, err := base64.RawStdEncoding.DecodeString(strings.ReplaceAll(strings.TrimRight(s, "="), ".", "+"))
+	if err != nil {
+		return nil, ErrMalformedHash
+	}
+	return b, nil
+}
@@ -0,0 +1,97 @@
+package passhash
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		alg      Algorithm
+	}{
+		{
+			name:     "bcrypt",
+			hash:     "$2a$04$Gm.DkSaCtVkMFEsrQzDK9OSV7CRwtUjMbn.XLscZCqu.Bu6m15Gta",
+			password: "password",
+			alg:      Bcrypt,
+		},
+		{
+			// from the reference implementation README
+			name:     "argon2i",
+			hash:     "$argon2i$v=19$m=65536,t=2,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG",
+			password: "password",
+			alg:      Argon2i,
+		},
+		{
+			name:     "argon2id",
+			hash:     "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$2mzTAI85jwP6+k/mHDeH3OgNt7E86G5W",
+			password: "password",
+			alg:      Argon2id,
+		},
+		{
+			name:     "pbkdf2 PHC",
+			hash:     "$pbkdf2-sha256$i=1000,l=32$c2FsdHNhbHRzYWx0c2FsdA$BBs+1+PaslLtBPULUr8/lQicvVuHiEPMz0i8MjLCbzM",
+			password: "correct horse",
+			alg:      PBKDF2SHA256,
+		},
+		{
+			name:     "pbkdf2 passlib",
+			hash:     "$pbkdf2-sha512$1000$c2FsdHNhbHRzYWx0c2FsdA$EHLBej.uEvxlmr0QnHnceg1vM6h1wbwSP5XErh3SmizNDWZsIi28RPGARe0EssjGRoiACzxgHjNvqwJY1zxKig",
+			password: "correct horse",
+			alg:      PBKDF2SHA512,
+		},
+		{
+			name:     "pbkdf2 django",
+			hash:     "pbkdf2_sha256$1000$plainsalt$7mxrq6yM+WMfQM+vXXXu+JjPCER9dWYMauNWnwgQSGQ=",
+			password: "correct horse",
+			alg:      PBKDF2SHA256,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alg, err := Identify([]byte(tt.hash))
+			if err != nil {
+				t.Fatalf("Identify: %v", err)
+			}
+			if alg != tt.alg {
+				t.Fatalf("Identify = %q, want %q", alg, tt.alg)
+			}
+
+			if err := Verify([]byte(tt.hash), tt.password); err != nil {
+				t.Fatalf("Verify with the right password: %v", err)
+			}
+			if err := Verify([]byte(tt.hash), tt.password+"x"); !errors.Is(err, ErrMismatch) {
+				t.Fatalf("Verify with a wrong password = %v, want ErrMismatch", err)
+			}
+		})
+	}
+}
+
+func TestIdentifyRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		hash string
+		want error
+	}{
+		{"plaintext", "hunter2", ErrUnknownHash},
+		{"md5 crypt", "$1$saltsalt$2vnaRpHa6Jxjz5n83ok8Z0", ErrUnknownHash},
+		{"argon2d", "$argon2d$v=19$m=65536,t=2,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG", ErrUnknownHash},
+		{"bcrypt truncated", "$2a$10$N9qo8uLOickgx2ZMRZoMy", ErrMalformedHash},
+		{"argon2 huge memory", "$argon2id$v=19$m=4194304,t=2,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG", ErrMalformedHash},
+		{"argon2 bad base64", "$argon2id$v=19$m=65536,t=2,p=4$!!!$RdescudvJCsgt3ub", ErrMalformedHash},
+		{"pbkdf2 zero rounds", "$pbkdf2-sha256$i=0$c2FsdA$BBs+1+PaslLtBPULUr8/lQ", ErrMalformedHash},
+		{"pbkdf2 md5", "$pbkdf2-md5$1000$c2FsdA$BBs+1+PaslLtBPULUr8/lQ", ErrUnknownHash},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Identify([]byte(tt.hash)); !errors.Is(err, tt.want) {
+				t.Fatalf("Identify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package passhash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A pepper is a server-side secret kept out of the database. Passwords are
+// run through HMAC-SHA256 keyed with it before they are hashed, so a dump
+// of the hashes alone cannot be brute-forced. Peppers are numbered, each
+// hash is stored with the version it was made with, 0 for none.
+
+var ErrUnknownPepper = errors.New("unknown pepper version")
+
+const minPepperLen = 16
+
+// ParsePeppers parses version:secret entries, one per line or separated by
+// commas, with the secrets base64 encoded. Blank lines and lines starting
+// with # are skipped.
+func ParsePeppers(s string) (map[int][]byte, error) {
+	peppers := make(map[int][]byte)
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		v, secret, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, errors.New("pepper entries are version:secret")
+		}
+		version, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("pepper version %q is not a positive number", v)
+		}
+		if _, ok := peppers[version]; ok {
+			return nil, fmt.Errorf("pepper version %d is given twice", version)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(secret))
+		if err != nil {
+			return nil, fmt.Errorf("pepper version %d is not base64", version)
+		}
+		if len(key) < minPepperLen {
+			return nil, fmt.Errorf("pepper version %d is shorter than %d bytes", version, minPepperLen)
+		}
+		peppers[version] = key
+	}
+	return peppers, nil
+}
+
+// pepper returns the password to hash in place of password. The MAC is
+// base64 encoded, bcrypt would otherwise choke on NUL bytes.
+func pepper(key []byte, password string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(password))
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,55 @@
+package passhash
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("sso/passhash")
+
+// TracedHasher is a Hasher whose hashes and checks each get a span under
+// the span of their context.
+type TracedHasher struct {
+	hasher *Hasher
+}
+
+func Traced(h *Hasher) *TracedHasher {
+	return &TracedHasher{hasher: h}
+}
+
+func (h *TracedHasher) Hash(ctx context.Context, password string) (_ []byte, _ int, err error) {
+	_, span := tracer.Start(ctx, "passhash.Hash")
+	defer func() { endSpan(span, err) }()
+	return h.hasher.Hash(password)
+}
+
+func (h *TracedHasher) Verify(ctx context.Context, hash []byte, pepperVersion int, password string) (err error) {
+	_, span := tracer.Start(ctx, "passhash.Verify")
+	defer func() { endSpan(span, err) }()
+	return h.hasher.Verify(hash, pepperVersion, password)
+}
+
+func (h *TracedHasher) VerifyDummy(ctx context.Context, password string) {
+	_, span := tracer.Start(ctx, "passhash.VerifyDummy")
+	defer span.End()
+	h.hasher.VerifyDummy(password)
+}
+
+// NeedsRehash only reads the hash, it gets no span.
+func (h *TracedHasher) NeedsRehash(hash []byte, pepperVersion int) bool {
+	return h.hasher.NeedsRehash(hash, pepperVersion)
+}
+
+// endSpan marks the span failed with err, unless the password merely did
+// not match, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, ErrMismatch) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,51 @@
+package passpolicy
+
+import (
+	_ "embed"
+	"strings"
+	"unicode/utf8"
+)
+
+// passwords.txt lists the most common passwords of public breach corpora,
+// words.txt common English words and first names, both most frequent
+// first.
+var (
+	//go:embed data/passwords.txt
+	passwordsList string
+	//go:embed data/words.txt
+	wordsList string
+)
+
+var (
+	// dictionary maps a lowercase word to its rank, the lowest of its
+	// ranks in the lists.
+	dictionary = make(map[string]int)
+	maxWordLen int
+
+	common = make(map[string]bool)
+)
+
+func init() {
+	for _, list := range []string{passwordsList, wordsList} {
+		for i, word := range strings.Fields(list) {
+			word = strings.ToLower(word)
+			if r, ok := dictionary[word]; !ok || i+1 < r {
+				dictionary[word] = i + 1
+			}
+			maxWordLen = max(maxWordLen, utf8.RuneCountInString(word))
+		}
+	}
+	for _, password := range strings.Fields(passwordsList) {
+		common[password] = true
+	}
+}
+
+// Common is the list of the most common passwords shipped with the
+// service. Larger lists are loaded as a Filter.
+var Common BreachedList = commonList{}
+
+type commonList struct{}
+
+func (commonList) Contains(password string) bool {
+	return common[password]
+}
@@ -0,0 +1,158 @@
+package passpolicy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Filter is a bloom filter of the SHA-1 hashes of breached passwords, the
+// form the Pwned Passwords corpus is published in. It never misses a
+// listed password and wrongly flags others at the rate it was built for.
+type Filter struct {
+	bits   []uint64
+	hashes uint32
+}
+
+var filterMagic = [8]byte{'s', 's', 'o', 'b', 'l', 'o', 'o', 'm'}
+
+const filterVersion = 1
+
+var ErrInvalidFilter = errors.New("invalid breached password filter")
+
+// NewFilter returns an empty filter sized for n passwords at the false
+// positive rate fpRate.
+func NewFilter(n int, fpRate float64) (*Filter, error) {
+	if n <= 0 || fpRate <= 0 || fpRate >= 1 {
+		return nil, fmt.Errorf("filter needs a positive size and a false positive rate in (0, 1)")
+	}
+
+	// optimal sizes for a bloom filter, m bits and k hash functions
+	m := math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(n)*math.Ln2))
+	return &Filter{bits: make([]uint64, (uint64(m)+63)/64), hashes: uint32(k)}, nil
+}
+
+// Add adds the SHA-1 hash of a password.
+func (f *Filter) Add(sum [sha1.Size]byte) {
+	h1, h2 := split(sum)
+	m := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		bit := (h1 + i*h2) % m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Contains reports whether password is, most likely, in the filter.
+func (f *Filter) Contains(password string) bool {
+	h1, h2 := split(sha1.Sum([]byte(password)))
+	m := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		bit := (h1 + i*h2) % m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// split derives the two hashes of double hashing from the digest, which
+// is uniform enough to be used directly.
+func split(sum [sha1.Size]byte) (uint64, uint64) {
+	return binary.BigEndian.Uint64(sum[0:8]), binary.BigEndian.Uint64(sum[8:16]) | 1
+}
+
+// WriteTo writes the filter as a header of magic, version, hash count and
+// word count followed by the bit words, all big endian.
+func (f *Filter) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	header := make([]byte, 0, 24)
+	header = append(header, filterMagic[:]...)
+	header = binary.BigEndian.AppendUint32(header, filterVersion)
+	header = binary.BigEndian.AppendUint32(header, f.hashes)
+	header = binary.BigEndian.AppendUint64(header, uint64(len(f.bits)))
+	if _, err := bw.Write(header); err != nil {
+		return 0, err
+	}
+
+	var word [8]byte
+	for _, b := range f.bits {
+		binary.BigEndian.PutUint64(word[:], b)
+		if _, err := bw.Write(word[:]); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(header) + 8*len(f.bits)), bw.Flush()
+}
+
+// maxFilterWords bounds the filter a file can declare, 4 GiB of bits. The
+// whole Pwned Passwords corpus at a 0.1% false positive rate takes less
+// than half of it.
+const maxFilterWords = 1 << 29
+
+// ReadFilter reads a filter written by WriteTo.
+func ReadFilter(r io.Reader) (*Filter, error) {
+	return readFilter(r, -1)
+}
+
+// readFilter reads a filter from r holding size bytes, -1 when unknown.
+// With the size unknown the bits grow as they are read, so a truncated or
+// hostile header cannot make it allocate what it claims up front.
+func readFilter(r io.Reader, size int64) (*Filter, error) {
+	br := bufio.NewReader(r)
+
+	var header [24]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidFilter, err)
+	}
+	if [8]byte(header[:8]) != filterMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidFilter)
+	}
+	if v := binary.BigEndian.Uint32(header[8:12]); v != filterVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidFilter, v)
+	}
+	hashes := binary.BigEndian.Uint32(header[12:16])
+	words := binary.BigEndian.Uint64(header[16:24])
+	if hashes == 0 || hashes > 64 || words == 0 || words > maxFilterWords {
+		return nil, fmt.Errorf("%w: sizes out of range", ErrInvalidFilter)
+	}
+
+	capacity := min(words, 1<<16)
+	if size >= 0 {
+		if uint64(size) != uint64(len(header))+8*words {
+			return nil, fmt.Errorf("%w: %d bytes for %d words", ErrInvalidFilter, size, words)
+		}
+		capacity = words
+	}
+
+	f := &Filter{bits: make([]uint64, 0, capacity), hashes: hashes}
+	var word [8]byte
+	for range words {
+		if _, err := io.ReadFull(br, word[:]); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidFilter, err)
+		}
+		f.bits = append(f.bits, binary.BigEndian.Uint64(word[:]))
+	}
+	return f, nil
+}
+
+// LoadFilter reads the filter at path, checking the size its header
+// declares against the length of the file first.
+func LoadFilter(path string) (*Filter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return readFilter(file, info.Size())
+}
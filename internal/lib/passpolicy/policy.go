@@ -0,0 +1,168 @@
+// Package passpolicy decides whether a password is good enough to be set:
+// length, character classes, no email or name inside, an estimated
+// strength and absence from lists of breached passwords.
+package passpolicy
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var ErrWeakPassword = errors.New("password does not meet the policy")
+
+// Rules reported in violations.
+const (
+	RuleMinLength        = "min_length"
+	RuleMaxLength        = "max_length"
+	RuleCharacterClasses = "character_classes"
+	RulePersonalInfo     = "personal_info"
+	RuleStrength         = "strength"
+	RuleBreached         = "breached"
+)
+
+// Violation is one rule a password breaks.
+type Violation struct {
+	Rule        string `json:"rule"`
+	Description string `json:"description"`
+}
+
+// Error lists every rule a password breaks. It matches ErrWeakPassword.
+type Error struct {
+	Violations []Violation
+}
+
+func (e *Error) Error() string {
+	descriptions := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		descriptions[i] = v.Description
+	}
+	return fmt.Sprintf("%s: %s", ErrWeakPassword, strings.Join(descriptions, "; "))
+}
+
+func (e *Error) Is(target error) bool {
+	return target == ErrWeakPassword
+}
+
+// BreachedList tells whether a password is known from a breach.
+type BreachedList interface {
+	Contains(password string) bool
+}
+
+// Policy holds the rules. Zero values turn a rule off.
+type Policy struct {
+	MinLength int
+	MaxLength int
+	// MinCharacterClasses is how many of lowercase, uppercase, digits and
+	// other characters the password must mix.
+	MinCharacterClasses int
+	// ForbidPersonalInfo rejects passwords containing the email, its local
+	// part or a word of the name.
+	ForbidPersonalInfo bool
+	// MinStrength is the lowest Strength score accepted, 0 to 4.
+	MinStrength int
+	Breached    []BreachedList
+}
+
+// Check returns an *Error listing every rule password breaks, nil if it
+// breaks none. email and name are those of the user the password is for.
+func (p *Policy) Check(password string, email string, name string) error {
+	var violations []Violation
+	add := func(rule string, format string, args ...any) {
+		violations = append(violations, Violation{Rule: rule, Description: fmt.Sprintf(format, args...)})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		add(RuleMinLength, "must be at least %d characters long", p.MinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		// nothing else is worth checking, and the strength estimate is
+		// quadratic in the length
+		add(RuleMaxLength, "must be at most %d characters long", p.MaxLength)
+		return &Error{Violations: violations}
+	}
+
+	if classes := characterClasses(password); classes < p.MinCharacterClasses {
+		add(RuleCharacterClasses,
+			"must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinCharacterClasses)
+	}
+
+	inputs := personalInfo(email, name)
+	if p.ForbidPersonalInfo {
+		lower := strings.ToLower(password)
+		for _, in := range inputs {
+			if strings.Contains(lower, in) {
+				add(RulePersonalInfo, "must not contain your email or name")
+				break
+			}
+		}
+	}
+
+	if p.MinStrength > 0 {
+		if score := Strength(password, inputs...); score < p.MinStrength {
+			add(RuleStrength, "is too easy to guess, scored %d of 4, at least %d is required", score, p.MinStrength)
+		}
+	}
+
+	for _, list := range p.Breached {
+		if list.Contains(password) {
+			add(RuleBreached, "appeared in a data breach, choose another one")
+			break
+		}
+	}
+
+	if len(violations) > 0 {
+		return &Error{Violations: violations}
+	}
+	return nil
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// personalInfo returns the lowercased email, its local part and the words
+// of the name, leaving out parts too short to matter.
+func personalInfo(email string, name string) []string {
+	var out []string
+	add := func(s string) {
+		if s = strings.ToLower(s); utf8.RuneCountInString(s) >= 3 {
+			out = append(out, s)
+		}
+	}
+
+	if addr, err := mail.ParseAddress(email); err == nil {
+		email = addr.Address
+	}
+	if email != "" {
+		add(email)
+		local, _, _ := strings.Cut(email, "@")
+		add(local)
+		for _, part := range strings.FieldsFunc(local, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			add(part)
+		}
+	}
+	for _, word := range strings.Fields(name) {
+		add(word)
+	}
+	return out
+}
@@ -0,0 +1,160 @@
+package passpolicy
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	policy := &Policy{
+		MinLength:           8,
+		MaxLength:           64,
+		MinCharacterClasses: 2,
+		ForbidPersonalInfo:  true,
+		MinStrength:         2,
+		Breached:            []BreachedList{Common},
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		want     []string
+	}{
+		{"one digit", "1", []string{RuleMinLength, RuleCharacterClasses, RuleStrength}},
+		{"common", "password1", []string{RuleStrength, RuleBreached}},
+		{"email local part", "alice.w-Xq93#kd", []string{RulePersonalInfo}},
+		{"name", "zz9Wonderland#Q", []string{RulePersonalInfo}},
+		{"keyboard walk", "1qaz2wsx3edc", []string{RuleStrength}},
+		{"too long", string(bytes.Repeat([]byte("a"), 65)), []string{RuleMaxLength}},
+		{"strong", "kG9#vQ2!pL7@xZ", nil},
+		{"passphrase", "violet tram ledger cactus", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Check(tt.password, "alice.w@example.com", "Alice Wonderland")
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("Check = %v, want nil", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrWeakPassword) {
+				t.Fatalf("Check = %v, want ErrWeakPassword", err)
+			}
+			var policyErr *Error
+			if !errors.As(err, &policyErr) {
+				t.Fatalf("Check = %T, want *Error", err)
+			}
+			var rules []string
+			for _, v := range policyErr.Violations {
+				rules = append(rules, v.Rule)
+			}
+			if !slices.Equal(rules, tt.want) {
+				t.Fatalf("violated rules = %v, want %v", rules, tt.want)
+			}
+		})
+	}
+}
+
+func TestStrength(t *testing.T) {
+	tests := []struct {
+		password string
+		max      int
+		min      int
+	}{
+		{"password", 0, 0},
+		{"P@ssw0rd", 0, 0},
+		{"qwerty123", 0, 0},
+		{"aaaaaaaaaaaa", 0, 0},
+		{"abcabcabcabc", 0, 0},
+		{"25061987", 1, 0},
+		{"Summer2024!", 2, 1},
+		{"correct horse battery staple", 4, 3},
+		{"kG9#vQ2!pL7@xZ", 4, 4},
+	}
+	for _, tt := range tests {
+		if got := Strength(tt.password); got < tt.min || got > tt.max {
+			t.Errorf("Strength(%q) = %d, want %d to %d", tt.password, got, tt.min, tt.max)
+		}
+	}
+
+	// user inputs count as dictionary words
+	if plain, personal := Strength("marmaduke1987"), Strength("marmaduke1987", "marmaduke"); personal >= plain {
+		t.Errorf("Strength with the user input = %d, without = %d, want lower", personal, plain)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	filter, err := NewFilter(1000, 0.001)
+	if err != nil {
+		t.Fatalf("NewFilter: %v", err)
+	}
+	for i := range 1000 {
+		filter.Add(sha1.Sum(fmt.Appendf(nil, "breached-%d", i)))
+	}
+
+	var buf bytes.Buffer
+	if _, err := filter.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	loaded, err := ReadFilter(&buf)
+	if err != nil {
+		t.Fatalf("ReadFilter: %v", err)
+	}
+
+	for i := range 1000 {
+		if !loaded.Contains(fmt.Sprintf("breached-%d", i)) {
+			t.Fatalf("Contains(breached-%d) = false", i)
+		}
+	}
+	falsePositives := 0
+	for i := range 10000 {
+		if loaded.Contains(fmt.Sprintf("fine-%d", i)) {
+			falsePositives++
+		}
+	}
+	// 0.1% expected, leave room for chance
+	if falsePositives > 50 {
+		t.Fatalf("%d false positives in 10000, want about 10", falsePositives)
+	}
+
+	if _, err := ReadFilter(bytes.NewReader([]byte("not a filter at all, clearly"))); !errors.Is(err, ErrInvalidFilter) {
+		t.Fatalf("ReadFilter of garbage = %v, want ErrInvalidFilter", err)
+	}
+}
+
+// TestFilterHostileHeader checks that a header declaring more words than
+// follow is refused before the bits are allocated.
+func TestFilterHostileHeader(t *testing.T) {
+	header := func(words uint64) []byte {
+		h := append([]byte{}, filterMagic[:]...)
+		h = binary.BigEndian.AppendUint32(h, filterVersion)
+		h = binary.BigEndian.AppendUint32(h, 7)
+		return binary.BigEndian.AppendUint64(h, words)
+	}
+
+	if _, err := ReadFilter(bytes.NewReader(header(1 << 34))); !errors.Is(err, ErrInvalidFilter) {
+		t.Errorf("ReadFilter of an oversized filter = %v, want ErrInvalidFilter", err)
+	}
+	// within bounds, but the data is missing
+	if _, err := ReadFilter(bytes.NewReader(header(maxFilterWords))); !errors.Is(err, ErrInvalidFilter) {
+		t.Errorf("ReadFilter of a truncated filter = %v, want ErrInvalidFilter", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "truncated.bloom")
+	if err := os.WriteFile(path, append(header(maxFilterWords), make([]byte, 64)...), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := LoadFilter(path); !errors.Is(err, ErrInvalidFilter) {
+		t.Errorf("LoadFilter of a truncated file = %v, want ErrInvalidFilter", err)
+	}
+}
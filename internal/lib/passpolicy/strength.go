@@ -0,0 +1,467 @@
+package passpolicy
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Strength scores how hard password is to guess, from 0 (too guessable)
+// to 4 (very unguessable) on the zxcvbn scale. Like zxcvbn it estimates
+// the guesses of an attacker who tries common passwords, dictionary words,
+// userInputs and patterns such as sequences, repeats, keyboard rows and
+// dates before falling back to brute force.
+func Strength(password string, userInputs ...string) int {
+	e := &estimator{inputs: make(map[string]int, len(userInputs)), memo: make(map[string]float64)}
+	for i, in := range userInputs {
+		in = strings.ToLower(in)
+		if _, ok := e.inputs[in]; !ok {
+			e.inputs[in] = i + 1
+		}
+	}
+
+	// thresholds of zxcvbn, in log10 of the guesses
+	switch g := e.guesses(password); {
+	case g < 3:
+		return 0
+	case g < 6:
+		return 1
+	case g < 8:
+		return 2
+	case g < 10:
+		return 3
+	}
+	return 4
+}
+
+const (
+	// minMatchGuesses stops a short pattern inside a longer password from
+	// being counted as almost free.
+	minMatchGuesses = 50
+	// sequenceGrowth is the zxcvbn penalty for each extra pattern: a
+	// password of many patterns takes more guesses than their product.
+	sequenceGrowth = 10000
+	// keyboardGuesses approximates the ways to start and go on along a
+	// keyboard line, 94 keys with 4.6 neighbours on average.
+	keyboardGuesses = 94 * 4.6
+	referenceYear   = 2026
+	minYearSpace    = 20
+)
+
+// match is a pattern spanning runes [i, j) that takes 10^log guesses.
+type match struct {
+	i, j int
+	log  float64
+}
+
+type estimator struct {
+	inputs map[string]int
+	memo   map[string]float64
+}
+
+// guesses returns log10 of the guesses needed for password: the cheapest
+// way to cover it with patterns, brute forcing what no pattern covers.
+func (e *estimator) guesses(password string) float64 {
+	if g, ok := e.memo[password]; ok {
+		return g
+	}
+
+	runes := []rune(password)
+	n := len(runes)
+	if n == 0 {
+		return 0
+	}
+
+	ending := make([][]match, n+1)
+	for _, m := range e.matches(runes) {
+		if m.j-m.i < n {
+			m.log = math.Max(m.log, math.Log10(minMatchGuesses))
+		}
+		ending[m.j] = append(ending[m.j], m)
+	}
+	for j := 1; j <= n; j++ {
+		for i := 0; i < j; i++ {
+			ending[j] = append(ending[j], match{i: i, j: j, log: bruteforce(j - i)})
+		}
+	}
+
+	// best[k][l] is the least log10 product of l patterns covering runes[:k]
+	best := make([][]float64, n+1)
+	for k := range best {
+		best[k] = make([]float64, n+1)
+		for l := range best[k] {
+			best[k][l] = math.Inf(1)
+		}
+	}
+	best[0][0] = 0
+	for k := 1; k <= n; k++ {
+		for _, m := range ending[k] {
+			for l := 1; l <= k; l++ {
+				if prev := best[m.i][l-1]; prev+m.log < best[k][l] {
+					best[k][l] = prev + m.log
+				}
+			}
+		}
+	}
+
+	total := math.Inf(1)
+	for l := 1; l <= n; l++ {
+		if math.IsInf(best[n][l], 1) {
+			continue
+		}
+		lf, _ := math.Lgamma(float64(l + 1))
+		g := addLog10(lf/math.Ln10+best[n][l], float64(l-1)*math.Log10(sequenceGrowth))
+		total = math.Min(total, g)
+	}
+
+	e.memo[password] = total
+	return total
+}
+
+func (e *estimator) matches(runes []rune) []match {
+	var out []match
+	out = append(out, e.dictionaryMatches(runes)...)
+	out = append(out, sequenceMatches(runes)...)
+	out = append(out, e.repeatMatches(runes)...)
+	out = append(out, keyboardMatches(runes)...)
+	out = append(out, dateMatches(runes)...)
+	return out
+}
+
+// rank returns the position of word in the dictionaries or user inputs,
+// zero if it is in none.
+func (e *estimator) rank(word string) int {
+	rank := dictionary[word]
+	if r, ok := e.inputs[word]; ok && (rank == 0 || r < rank) {
+		rank = r
+	}
+	return rank
+}
+
+func (e *estimator) dictionaryMatches(runes []rune) []match {
+	var out []match
+	for i := range runes {
+		for j := i + 3; j <= len(runes) && j-i <= maxWordLen; j++ {
+			token := runes[i:j]
+			word := strings.ToLower(string(token))
+			upper := math.Log10(upperVariations(token))
+
+			if r := e.rank(word); r > 0 {
+				out = append(out, match{i: i, j: j, log: math.Log10(float64(r)) + upper})
+			}
+			if r := e.rank(reverse(word)); r > 0 {
+				out = append(out, match{i: i, j: j, log: math.Log10(float64(2*r)) + upper})
+			}
+			if plain, subs := unleet(word); subs > 0 {
+				if r := e.rank(plain); r > 0 {
+					out = append(out, match{i: i, j: j, log: math.Log10(float64(r)) + upper + float64(subs)*math.Log10(2)})
+				}
+			}
+		}
+	}
+	return out
+}
+
+// upperVariations counts the ways the word could be capitalized the way
+// it is, common ones such as Title or ALL CAPS counting as two.
+func upperVariations(token []rune) float64 {
+	var upper, lower int
+	for _, r := range token {
+		switch {
+		case unicode.IsUpper(r):
+			upper++
+		case unicode.IsLower(r):
+			lower++
+		}
+	}
+	switch {
+	case upper == 0:
+		return 1
+	case lower == 0,
+		upper == 1 && unicode.IsUpper(token[0]),
+		upper == 1 && unicode.IsUpper(token[len(token)-1]):
+		return 2
+	}
+
+	var variations float64
+	for k := 1; k <= min(upper, lower); k++ {
+		variations += binomial(upper+lower, k)
+	}
+	return variations
+}
+
+var leet = map[rune]rune{
+	'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '1': 'i', '!': 'i',
+	'|': 'l', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't', '2': 'z',
+}
+
+// unleet undoes l33t substitutions and returns how many there were.
+func unleet(word string) (string, int) {
+	subs := 0
+	plain := strings.Map(func(r rune) rune {
+		if p, ok := leet[r]; ok {
+			subs++
+			return p
+		}
+		return r
+	}, word)
+	return plain, subs
+}
+
+// sequenceMatches finds runs like abcd, 9876 or 13579.
+func sequenceMatches(runes []rune) []match {
+	var out []match
+	for i := 0; i+2 < len(runes); i++ {
+		delta := runes[i+1] - runes[i]
+		if delta == 0 || delta > 5 || delta < -5 || !sameClass(runes[i], runes[i+1]) {
+			continue
+		}
+		j := i + 2
+		for j < len(runes) && runes[j]-runes[j-1] == delta && sameClass(runes[j], runes[j-1]) {
+			j++
+		}
+		if j-i < 3 {
+			continue
+		}
+
+		base := 26.0
+		switch first := runes[i]; {
+		case strings.ContainsRune("aAzZ019", first):
+			base = 4
+		case unicode.IsDigit(first):
+			base = 10
+		}
+		if delta < 0 {
+			base *= 2
+		}
+		for end := i + 3; end <= j; end++ {
+			out = append(out, match{i: i, j: end, log: math.Log10(base * float64(end-i))})
+		}
+	}
+	return out
+}
+
+func sameClass(a, b rune) bool {
+	switch {
+	case unicode.IsDigit(a):
+		return unicode.IsDigit(b)
+	case unicode.IsLower(a):
+		return unicode.IsLower(b)
+	case unicode.IsUpper(a):
+		return unicode.IsUpper(b)
+	}
+	return false
+}
+
+// repeatMatches finds a block repeated back to back, like aaaa or
+// abcabcabc, which takes the guesses of the block times the repeats.
+func (e *estimator) repeatMatches(runes []rune) []match {
+	var out []match
+	for i := range runes {
+		for size := 1; i+2*size <= len(runes); size++ {
+			block := runes[i : i+size]
+			j := i + size
+			for j+size <= len(runes) && equalRunes(runes[j:j+size], block) {
+				j += size
+			}
+			repeats := (j - i) / size
+			if repeats < 2 || (size == 1 && repeats < 3) {
+				continue
+			}
+			g := e.guesses(string(block))
+			out = append(out, match{i: i, j: j, log: g + math.Log10(float64(repeats))})
+		}
+	}
+	return out
+}
+
+func equalRunes(a, b []rune) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// keyboardLines are straight runs of keys on a US keyboard, including the
+// columns walked by patterns such as 1qaz2wsx.
+var keyboardLines = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+	"1qaz2wsx3edc4rfv5tgb6yhn7ujm8ik,9ol.0p;/-['=]",
+	"qazwsxedcrfvtgbyhnujmikolp",
+	"7894561230",
+}
+
+// keyboardMatches finds at least four keys in a row along a keyboard line,
+// either way.
+func keyboardMatches(runes []rune) []match {
+	lower := []rune(strings.ToLower(string(runes)))
+
+	var out []match
+	for i := range lower {
+		for j := i + 4; j <= len(lower); j++ {
+			token := string(lower[i:j])
+			if !onKeyboardLine(token) {
+				break
+			}
+			g := keyboardGuesses * float64(j-i-1)
+			if string(runes[i:j]) != token {
+				// shifted keys
+				g *= 2
+			}
+			out = append(out, match{i: i, j: j, log: math.Log10(g)})
+		}
+	}
+	return out
+}
+
+func onKeyboardLine(token string) bool {
+	reversed := reverse(token)
+	for _, line := range keyboardLines {
+		if strings.Contains(line, token) || strings.Contains(line, reversed) {
+			return true
+		}
+	}
+	return false
+}
+
+// dateMatches finds years and dates written as digits, optionally with
+// separators, like 1987, 250687 or 25.06.1987.
+func dateMatches(runes []rune) []match {
+	var out []match
+	for i := range runes {
+		for j := i + 4; j <= len(runes) && j-i <= 10; j++ {
+			token := string(runes[i:j])
+			if year, ok := parseYear(token); ok {
+				out = append(out, match{i: i, j: j, log: math.Log10(yearSpace(year))})
+				continue
+			}
+			if year, ok := parseDate(token); ok {
+				out = append(out, match{i: i, j: j, log: math.Log10(365 * yearSpace(year))})
+			}
+		}
+	}
+	return out
+}
+
+func yearSpace(year int) float64 {
+	return math.Max(math.Abs(float64(year-referenceYear)), minYearSpace)
+}
+
+func parseYear(s string) (int, bool) {
+	if len(s) != 4 || !allDigits(s) {
+		return 0, false
+	}
+	year := atoi(s)
+	return year, year >= 1900 && year <= 2099
+}
+
+// parseDate accepts day, month and year in any of the usual orders with a
+// two or four digit year.
+func parseDate(s string) (int, bool) {
+	for _, sep := range []string{"/", "-", ".", "_", " "} {
+		if parts := strings.Split(s, sep); len(parts) == 3 {
+			return dateOf(parts)
+		}
+	}
+	if !allDigits(s) {
+		return 0, false
+	}
+	switch len(s) {
+	case 6:
+		return dateOf([]string{s[:2], s[2:4], s[4:]})
+	case 8:
+		if year, ok := dateOf([]string{s[:2], s[2:4], s[4:]}); ok {
+			return year, true
+		}
+		return dateOf([]string{s[:4], s[4:6], s[6:]})
+	}
+	return 0, false
+}
+
+func dateOf(parts []string) (int, bool) {
+	for _, p := range parts {
+		if p == "" || len(p) > 4 || !allDigits(p) {
+			return 0, false
+		}
+	}
+
+	// year first or last, the other two are day and month either way
+	for _, order := range [][3]int{{2, 0, 1}, {0, 1, 2}} {
+		y, a, b := parts[order[0]], atoi(parts[order[1]]), atoi(parts[order[2]])
+		if len(parts[order[1]]) > 2 || len(parts[order[2]]) > 2 {
+			continue
+		}
+		year := atoi(y)
+		switch len(y) {
+		case 2:
+			if year > referenceYear%100 {
+				year += 1900
+			} else {
+				year += 2000
+			}
+		case 4:
+			if year < 1900 || year > 2099 {
+				continue
+			}
+		default:
+			continue
+		}
+		if (a >= 1 && a <= 31 && b >= 1 && b <= 12) || (a >= 1 && a <= 12 && b >= 1 && b <= 31) {
+			return year, true
+		}
+	}
+	return 0, false
+}
+
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func atoi(s string) int {
+	n := 0
+	for _, r := range s {
+		n = n*10 + int(r-'0')
+	}
+	return n
+}
+
+// bruteforce is log10 of the guesses for length characters nothing else
+// explains, ten per character as in zxcvbn.
+func bruteforce(length int) float64 {
+	if length == 1 {
+		return math.Log10(11)
+	}
+	return math.Max(float64(length), math.Log10(minMatchGuesses+1))
+}
+
+func binomial(n, k int) float64 {
+	r := 1.0
+	for i := 1; i <= k; i++ {
+		r = r * float64(n-k+i) / float64(i)
+	}
+	return r
+}
+
+// addLog10 returns log10(10^a + 10^b).
+func addLog10(a, b float64) float64 {
+	hi, lo := math.Max(a, b), math.Min(a, b)
+	return hi + math.Log10(1+math.Pow(10, lo-hi))
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the buckets in the process, every instance of the
+// service limits on its own.
+type MemoryStore struct {
+	mu   sync.Mutex
+	tats map[string]time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tats: make(map[string]time.Time)}
+}
+
+func (s *MemoryStore) ConsumeRateLimit(_ context.Context, key string, now time.Time, interval time.Duration, tolerance time.Duration) (bool, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tat := s.tats[key]
+	next := tat
+	if next.Before(now) {
+		next = now
+	}
+	next = next.Add(interval)
+	if next.Sub(now) > tolerance {
+		return false, tat, nil
+	}
+	s.tats[key] = next
+	return true, next, nil
+}
+
+func (s *MemoryStore) PruneRateLimits(_ context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pruned int64
+	for key, tat := range s.tats {
+		if tat.Before(before) {
+			delete(s.tats, key)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
@@ -0,0 +1,110 @@
+// Package ratelimit limits requests with token buckets. Buckets are kept
+// the way GCRA does, as the theoretical arrival time of the next request,
+// so a store updates a bucket in a single write.
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Store keeps the buckets by key.
+type Store interface {
+	// ConsumeRateLimit moves the theoretical arrival time of the bucket at
+	// key to max(tat, now) + interval unless that is more than tolerance
+	// ahead of now. It reports whether it did and returns the time it
+	// stores afterwards, the zero time for an empty bucket.
+	ConsumeRateLimit(ctx context.Context, key string, now time.Time, interval time.Duration, tolerance time.Duration) (bool, time.Time, error)
+	// PruneRateLimits drops buckets that were full before the given time.
+	PruneRateLimits(ctx context.Context, before time.Time) (int64, error)
+}
+
+// Limit lets through Rate requests a second on average and Burst at once.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Unlimited reports whether the limit lets everything through.
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0 || l.Burst <= 0
+}
+
+// KeyBy is what requests share a bucket by, besides the endpoint.
+type KeyBy string
+
+const (
+	ByIP  KeyBy = "ip"
+	ByApp KeyBy = "app"
+)
+
+type Rule struct {
+	Limit
+	By KeyBy
+}
+
+// Rules are the limits by endpoint, Default applies to the unlisted ones.
+type Rules struct {
+	Default   Rule
+	Endpoints map[string]Rule
+}
+
+// For returns the rule of endpoint, false when it is not limited.
+func (r Rules) For(endpoint string) (Rule, bool) {
+	rule, ok := r.Endpoints[endpoint]
+	if !ok {
+		rule = r.Default
+	}
+	return rule, !rule.Unlimited()
+}
+
+// Result is the state of a bucket after a request. Reset is how long until
+// the bucket is full again, RetryAfter how long a rejected request has to
+// wait for a token.
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+type Limiter struct {
+	store Store
+	now   func() time.Time
+}
+
+func New(store Store) *Limiter {
+	return &Limiter{store: store, now: time.Now}
+}
+
+// Allow takes a token from the bucket at key.
+func (l *Limiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	now := l.now()
+	interval := time.Duration(float64(time.Second) / limit.Rate)
+	tolerance := interval * time.Duration(limit.Burst)
+
+	allowed, tat, err := l.store.ConsumeRateLimit(ctx, key, now, interval, tolerance)
+	if err != nil {
+		return Result{}, err
+	}
+
+	res := Result{Allowed: allowed, Limit: limit.Burst, Reset: max(tat.Sub(now), 0)}
+	if allowed {
+		res.Remaining = int((tolerance - res.Reset) / interval)
+	} else {
+		res.RetryAfter = max(res.Reset+interval-tolerance, 0)
+	}
+	return res, nil
+}
+
+// Prune drops the buckets that are full by now.
+func (l *Limiter) Prune(ctx context.Context) (int64, error) {
+	return l.store.PruneRateLimits(ctx, l.now())
+}
+
+// Seconds rounds d up to whole seconds, the unit of the rate limit
+// headers, so a client waiting that long is not turned away again.
+func Seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
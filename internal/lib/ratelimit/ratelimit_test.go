@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	l := New(NewMemoryStore())
+	l.now = func() time.Time { return now }
+	limit := Limit{Rate: 0.5, Burst: 3}
+
+	allow := func(key string) Result {
+		t.Helper()
+		res, err := l.Allow(ctx, key, limit)
+		if err != nil {
+			t.Fatalf("Allow: %v", err)
+		}
+		return res
+	}
+
+	// the burst goes through at once, a token every two seconds after
+	for i, want := range []int{2, 1, 0} {
+		res := allow("register|ip:192.0.2.1")
+		if !res.Allowed || res.Remaining != want || res.Reset != time.Duration(i+1)*2*time.Second {
+			t.Fatalf("request %d = %+v, want allowed with %d remaining", i+1, res, want)
+		}
+	}
+	res := allow("register|ip:192.0.2.1")
+	if res.Allowed || res.Remaining != 0 || res.RetryAfter != 2*time.Second || res.Limit != 3 {
+		t.Fatalf("request past the burst = %+v, want rejected for 2s", res)
+	}
+
+	now = now.Add(time.Second)
+	if res := allow("register|ip:192.0.2.1"); res.Allowed || res.RetryAfter != time.Second {
+		t.Fatalf("request a second later = %+v, want rejected for 1s", res)
+	}
+	if res := allow("register|ip:192.0.2.2"); !res.Allowed {
+		t.Fatalf("another client = %+v, want allowed", res)
+	}
+
+	now = now.Add(time.Second)
+	if res := allow("register|ip:192.0.2.1"); !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("request after a refill = %+v, want allowed with none remaining", res)
+	}
+
+	now = now.Add(time.Minute)
+	pruned, err := l.Prune(ctx)
+	if err != nil || pruned != 2 {
+		t.Fatalf("Prune = %d, %v, want 2", pruned, err)
+	}
+}
+
+func TestRules(t *testing.T) {
+	rules := Rules{
+		Default: Rule{Limit: Limit{Rate: 10, Burst: 20}},
+		Endpoints: map[string]Rule{
+			"/register": {Limit: Limit{Rate: 0.2, Burst: 5}},
+			"/health":   {},
+		},
+	}
+
+	if rule, ok := rules.For("/register"); !ok || rule.Burst != 5 {
+		t.Fatalf("For(/register) = %+v, %v", rule, ok)
+	}
+	if rule, ok := rules.For("/me"); !ok || rule.Burst != 20 {
+		t.Fatalf("For(/me) = %+v, %v, want the default", rule, ok)
+	}
+	if _, ok := rules.For("/health"); ok {
+		t.Fatal("For(/health) is limited, a zero rule should lift the limit")
+	}
+}
@@ -0,0 +1,135 @@
+// Package redact keeps secrets and personal data out of the logs. Types
+// carrying them implement slog.LogValuer to leave them out, Handler is the
+// net under that for whatever is logged by mistake.
+package redact
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// Mask replaces a redacted value.
+const Mask = "[REDACTED]"
+
+// sensitiveKeys end the keys values are never logged under, so
+// dbPassword, pass_hash or access_token are masked but password_policy or
+// token_ttl are not.
+var sensitiveKeys = []string{
+	"password", "passwd", "hash", "secret", "secrets", "token", "tokens",
+	"pepper", "peppers", "authorization", "cookie", "api_key", "private_key", "dsn",
+}
+
+// secretValues are password hashes and JWTs, wherever they turn up.
+// Django writes its pbkdf2 hashes without the leading $.
+var secretValues = regexp.MustCompile(
+	`\$(argon2id|argon2i|2[aby])\$[^\s"]+` +
+		`|\$?pbkdf2[\w-]*\$[^\s"]+` +
+		`|eyJ[\w-]+\.[\w-]+\.[\w-]+`,
+)
+
+// Options tune the Handler. EmailKey, when set, replaces email addresses
+// by a keyed hash of them, which still tells the log lines of one user
+// apart but cannot be reversed by hashing guessed addresses.
+type Options struct {
+	EmailKey []byte
+}
+
+// Handler masks attributes with a sensitive key and hashes and tokens in
+// any message or value before passing records to the next handler.
+type Handler struct {
+	next slog.Handler
+	opts Options
+}
+
+func NewHandler(next slog.Handler, opts Options) *Handler {
+	return &Handler{next: next, opts: opts}
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, String(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(h.attr(a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		redacted = append(redacted, h.attr(a))
+	}
+	return &Handler{next: h.next.WithAttrs(redacted), opts: h.opts}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{next: h.next.WithGroup(name), opts: h.opts}
+}
+
+func (h *Handler) attr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	if Sensitive(a.Key) {
+		return slog.String(a.Key, Mask)
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindGroup:
+		group := a.Value.Group()
+		redacted := make([]slog.Attr, 0, len(group))
+		for _, ga := range group {
+			redacted = append(redacted, h.attr(ga))
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	case slog.KindString:
+		if len(h.opts.EmailKey) > 0 && isEmailKey(a.Key) {
+			return slog.String(a.Key, Email(h.opts.EmailKey, a.Value.String()))
+		}
+		return slog.String(a.Key, String(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, String(err.Error()))
+		}
+	}
+	return a
+}
+
+// Sensitive reports whether values logged under key are secrets.
+func Sensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.HasSuffix(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func isEmailKey(key string) bool {
+	key = strings.ToLower(key)
+	return key == "to" || strings.Contains(key, "email")
+}
+
+// String masks the password hashes and tokens in s.
+func String(s string) string {
+	return secretValues.ReplaceAllString(s, Mask)
+}
+
+// Email is an HMAC-SHA256 of the address under key, the same for every
+// spelling of it.
+func Email(key []byte, email string) string {
+	if email == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
@@ -0,0 +1,76 @@
+package redact
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"sso/internal/domain/models"
+	"sso/internal/lib/passhash/passhashtest"
+)
+
+const (
+	password   = passhashtest.Password
+	argonHash  = "$argon2id$v=19$m=65536,t=3,p=4$c2FsdHNhbHRzYWx0$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5"
+	djangoHash = "pbkdf2_sha256$260000$c2FsdHNhbHQ$aGFzaGhhc2hoYXNo"
+	jwt        = "eyJhbGciOiJIUzI1NiJ9.eyJ1aWQiOjF9.c2lnbmF0dXJl"
+)
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(NewHandler(slog.NewJSONHandler(&buf, nil), Options{}))
+
+	log.With(slog.String("dbPassword", "hunter2hunter2")).Info("logging in",
+		slog.String("password", password),
+		slog.Any("pass_hash", []byte(argonHash)),
+		slog.Group("request", slog.String("access_token", jwt), slog.String("email", "alice@example.com")),
+		slog.String("note", "stored "+argonHash),
+		slog.String("source", "imported "+djangoHash),
+		slog.Any("error", errors.New("bad token "+jwt)),
+		slog.Any("user", models.User{ID: 7, Email: "alice@example.com", PassHash: []byte(argonHash)}),
+		slog.Any("imported", models.PortableUser{Email: "bob@example.com", PassHash: []byte(argonHash)}),
+		slog.Duration("token_ttl", 0),
+		slog.Int("password_policy_min_length", 8),
+	)
+	log.Info(argonHash)
+
+	out := buf.String()
+	// a struct without LogValue would carry its []byte hash as base64
+	hashB64 := base64.StdEncoding.EncodeToString([]byte(argonHash))
+	for _, secret := range []string{password, argonHash, hashB64, "c2lnbmF0dXJl", "hunter2", "$argon2id$", djangoHash, "aGFzaGhhc2hoYXNo"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log output contains %q:\n%s", secret, out)
+		}
+	}
+	for _, kept := range []string{"alice@example.com", "bob@example.com", `"id":7`, `"token_ttl":0`, `"password_policy_min_length":8`} {
+		if !strings.Contains(out, kept) {
+			t.Errorf("log output lost %q:\n%s", kept, out)
+		}
+	}
+}
+
+func TestHandlerHashEmails(t *testing.T) {
+	key := []byte("email-key")
+	var buf bytes.Buffer
+	log := slog.New(NewHandler(slog.NewJSONHandler(&buf, nil), Options{EmailKey: key}))
+
+	log.Info("notification sent",
+		slog.String("to", "Alice@Example.com"),
+		slog.Any("user", models.User{ID: 7, Email: "alice@example.com"}),
+	)
+
+	out := buf.String()
+	if strings.Contains(strings.ToLower(out), "alice@example.com") {
+		t.Fatalf("log output contains the email:\n%s", out)
+	}
+	if strings.Count(out, Email(key, "alice@example.com")) != 2 {
+		t.Fatalf("log output does not hash both spellings of the email alike:\n%s", out)
+	}
+	// without the key, hashing a guessed address does not find it
+	if strings.Contains(out, Email([]byte("other-key"), "alice@example.com")) {
+		t.Fatalf("the email hash does not depend on the key:\n%s", out)
+	}
+}
@@ -0,0 +1,45 @@
+// Package requestid carries the ID of the request being served through its
+// context, to tie the log lines of one request together.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// maxLen bounds the IDs taken from clients, longer ones are replaced.
+const maxLen = 128
+
+type ctxKey struct{}
+
+// New returns a random ID.
+func New() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Valid reports whether an ID sent by a client can be used as it is: not
+// empty, not too long and only printable ASCII.
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func With(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// From returns the ID of the request ctx belongs to, empty if none.
+func From(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}
@@ -0,0 +1,517 @@
+// Package scimfilter parses SCIM 2.0 filters (RFC 7644, section 3.4.2.2)
+// and PATCH paths, and matches them against resources decoded from JSON
+// into map[string]any.
+package scimfilter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// Expr is a parsed filter.
+type Expr interface {
+	// Match reports whether the resource satisfies the filter.
+	Match(resource map[string]any) bool
+}
+
+// AttrPath names an attribute, with the schema URI prefix removed.
+type AttrPath struct {
+	Attr string
+	// Sub is the sub-attribute, "formatted" in name.formatted.
+	Sub string
+}
+
+func (p AttrPath) String() string {
+	if p.Sub == "" {
+		return p.Attr
+	}
+	return p.Attr + "." + p.Sub
+}
+
+type And struct{ Left, Right Expr }
+
+type Or struct{ Left, Right Expr }
+
+type Not struct{ Expr Expr }
+
+// Compare is attrPath op value. Value is a string, float64, bool or nil
+// for null. Strings that are both DateTimes compare chronologically.
+type Compare struct {
+	Path  AttrPath
+	Op    string
+	Value any
+}
+
+type Present struct{ Path AttrPath }
+
+// ValuePath matches when any value of a multi-valued attribute satisfies
+// Filter, as in emails[type eq "work"].
+type ValuePath struct {
+	Path   AttrPath
+	Filter Expr
+}
+
+// Path is the target of a PATCH operation, as in members[value eq "2"] or
+// emails[type eq "work"].value. Filter is nil when there is none.
+type Path struct {
+	Attr   AttrPath
+	Filter Expr
+}
+
+var compareOps = map[string]bool{
+	"eq": true, "ne": true, "co": true, "sw": true, "ew": true,
+	"gt": true, "ge": true, "lt": true, "le": true,
+}
+
+// Parse parses a filter.
+func Parse(filter string) (Expr, error) {
+	p, err := newParser(filter)
+	if err != nil {
+		return nil, err
+	}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, p.errorf("unexpected %q", p.peek().text)
+	}
+	return expr, nil
+}
+
+// ParsePath parses a PATCH path.
+func ParsePath(path string) (Path, error) {
+	p, err := newParser(path)
+	if err != nil {
+		return Path{}, err
+	}
+	tok := p.next()
+	if tok.kind != tokWord {
+		return Path{}, p.errorf("expected attribute, got %q", tok.text)
+	}
+	attr, err := parseAttrPath(tok.text)
+	if err != nil {
+		return Path{}, err
+	}
+	out := Path{Attr: attr}
+
+	if p.peek().kind == tokLBracket {
+		if attr.Sub != "" {
+			return Path{}, p.errorf("filter on sub-attribute %s", attr)
+		}
+		p.next()
+		if out.Filter, err = p.parseOr(); err != nil {
+			return Path{}, err
+		}
+		if p.next().kind != tokRBracket {
+			return Path{}, p.errorf("missing ]")
+		}
+		// emails[type eq "work"].value
+		if tok := p.peek(); tok.kind == tokWord && strings.HasPrefix(tok.text, ".") {
+			p.next()
+			out.Attr.Sub = tok.text[1:]
+		}
+	}
+	if !p.done() {
+		return Path{}, p.errorf("unexpected %q", p.peek().text)
+	}
+	return out, nil
+}
+
+// parseAttrPath splits urn:...:User:name.formatted into name and formatted.
+func parseAttrPath(s string) (AttrPath, error) {
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		s = s[i+1:]
+	}
+	attr, sub, _ := strings.Cut(s, ".")
+	if attr == "" || strings.Contains(sub, ".") || (sub == "" && strings.HasSuffix(s, ".")) {
+		return AttrPath{}, fmt.Errorf("%w: invalid attribute %q", ErrInvalidFilter, s)
+	}
+	return AttrPath{Attr: attr, Sub: sub}, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+type parser struct {
+	input  string
+	tokens []token
+	pos    int
+}
+
+func newParser(input string) (*parser, error) {
+	p := &parser{input: input}
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(':
+			p.tokens = append(p.tokens, token{tokLParen, "("})
+			i++
+		case c == ')':
+			p.tokens = append(p.tokens, token{tokRParen, ")"})
+			i++
+		case c == '[':
+			p.tokens = append(p.tokens, token{tokLBracket, "["})
+			i++
+		case c == ']':
+			p.tokens = append(p.tokens, token{tokRBracket, "]"})
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(input) && input[j] != '"'; j++ {
+				if input[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(input) {
+				return nil, fmt.Errorf("%w: unterminated string", ErrInvalidFilter)
+			}
+			var s string
+			if err := json.Unmarshal([]byte(input[i:j+1]), &s); err != nil {
+				return nil, fmt.Errorf("%w: invalid string %s", ErrInvalidFilter, input[i:j+1])
+			}
+			p.tokens = append(p.tokens, token{tokString, s})
+			i = j + 1
+		default:
+			j := i
+			for j < len(input) && !strings.ContainsRune(" \t()[]\"", rune(input[j])) {
+				j++
+			}
+			p.tokens = append(p.tokens, token{tokWord, input[i:j]})
+			i = j
+		}
+	}
+	return p, nil
+}
+
+func (p *parser) peek() token {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return token{kind: tokEOF}
+}
+
+func (p *parser) next() token {
+	tok := p.peek()
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) done() bool {
+	return p.peek().kind == tokEOF
+}
+
+func (p *parser) keyword(word string) bool {
+	tok := p.peek()
+	return tok.kind == tokWord && strings.EqualFold(tok.text, word)
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s in %q", ErrInvalidFilter, fmt.Sprintf(format, args...), p.input)
+}
+
+// or binds loosest, then and, then not.
+func (p *parser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = Or{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = And{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if p.keyword("not") {
+		p.next()
+		if p.peek().kind != tokLParen {
+			return nil, p.errorf("expected ( after not")
+		}
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not{expr}, nil
+	}
+
+	if p.peek().kind == tokLParen {
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next().kind != tokRParen {
+			return nil, p.errorf("missing )")
+		}
+		return expr, nil
+	}
+
+	tok := p.next()
+	if tok.kind != tokWord {
+		return nil, p.errorf("expected attribute, got %q", tok.text)
+	}
+	path, err := parseAttrPath(tok.text)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().kind == tokLBracket {
+		p.next()
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next().kind != tokRBracket {
+			return nil, p.errorf("missing ]")
+		}
+		return ValuePath{Path: path, Filter: filter}, nil
+	}
+
+	opTok := p.next()
+	op := strings.ToLower(opTok.text)
+	if opTok.kind != tokWord || (op != "pr" && !compareOps[op]) {
+		return nil, p.errorf("expected operator after %s, got %q", path, opTok.text)
+	}
+	if op == "pr" {
+		return Present{Path: path}, nil
+	}
+
+	valTok := p.next()
+	switch {
+	case valTok.kind == tokString:
+		return Compare{Path: path, Op: op, Value: valTok.text}, nil
+	case valTok.kind != tokWord:
+		return nil, p.errorf("expected value after %s %s", path, op)
+	}
+	switch strings.ToLower(valTok.text) {
+	case "true":
+		return Compare{Path: path, Op: op, Value: true}, nil
+	case "false":
+		return Compare{Path: path, Op: op, Value: false}, nil
+	case "null":
+		return Compare{Path: path, Op: op, Value: nil}, nil
+	}
+	n, err := strconv.ParseFloat(valTok.text, 64)
+	if err != nil {
+		return nil, p.errorf("invalid value %q", valTok.text)
+	}
+	return Compare{Path: path, Op: op, Value: n}, nil
+}
+
+func (e And) Match(r map[string]any) bool { return e.Left.Match(r) && e.Right.Match(r) }
+
+func (e Or) Match(r map[string]any) bool { return e.Left.Match(r) || e.Right.Match(r) }
+
+func (e Not) Match(r map[string]any) bool { return !e.Expr.Match(r) }
+
+func (e Present) Match(r map[string]any) bool {
+	for _, v := range Values(r, e.Path) {
+		if present(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e ValuePath) Match(r map[string]any) bool {
+	for _, v := range Values(r, AttrPath{Attr: e.Path.Attr}) {
+		if m, ok := v.(map[string]any); ok && e.Filter.Match(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match compares every value of the attribute, a multi-valued attribute
+// matches when any value does. ne matches when eq does not.
+func (e Compare) Match(r map[string]any) bool {
+	values := Values(r, e.Path)
+	if e.Value == nil {
+		hasValue := false
+		for _, v := range values {
+			hasValue = hasValue || present(v)
+		}
+		return hasValue == (e.Op == "ne")
+	}
+
+	if e.Op == "ne" {
+		return !Compare{Path: e.Path, Op: "eq", Value: e.Value}.Match(r)
+	}
+	for _, v := range values {
+		if compare(e.Op, v, e.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Values returns the values of the attribute at path, attribute names
+// matching case-insensitively. Multi-valued attributes are flattened.
+func Values(r map[string]any, path AttrPath) []any {
+	v, ok := lookup(r, path.Attr)
+	if !ok {
+		return nil
+	}
+	values := flatten(v)
+	if path.Sub == "" {
+		return values
+	}
+
+	var subs []any
+	for _, v := range values {
+		m, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		if sub, ok := lookup(m, path.Sub); ok {
+			subs = append(subs, flatten(sub)...)
+		}
+	}
+	return subs
+}
+
+func lookup(m map[string]any, name string) (any, bool) {
+	if v, ok := m[name]; ok {
+		return v, true
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func flatten(v any) []any {
+	if list, ok := v.([]any); ok {
+		return list
+	}
+	return []any{v}
+}
+
+func present(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case string:
+		return v != ""
+	case []any:
+		return len(v) > 0
+	case map[string]any:
+		return len(v) > 0
+	}
+	return true
+}
+
+// compare applies op to a resource value and a filter value. Strings
+// compare case-insensitively, DateTime strings chronologically.
+func compare(op string, have any, want any) bool {
+	switch want := want.(type) {
+	case bool:
+		h, ok := have.(bool)
+		return ok && op == "eq" && h == want
+	case float64:
+		h, ok := have.(float64)
+		return ok && ordered(op, cmpFloat(h, want))
+	case string:
+		h, ok := have.(string)
+		return ok && compareStrings(op, h, want)
+	}
+	return false
+}
+
+func compareStrings(op string, have, want string) bool {
+	h, w := foldCase(have), foldCase(want)
+	switch op {
+	case "co":
+		return strings.Contains(h, w)
+	case "sw":
+		return strings.HasPrefix(h, w)
+	case "ew":
+		return strings.HasSuffix(h, w)
+	}
+
+	ht, herr := time.Parse(time.RFC3339Nano, have)
+	wt, werr := time.Parse(time.RFC3339Nano, want)
+	if herr == nil && werr == nil {
+		return ordered(op, ht.Compare(wt))
+	}
+	return ordered(op, strings.Compare(h, w))
+}
+
+func ordered(op string, c int) bool {
+	switch op {
+	case "eq":
+		return c == 0
+	case "gt":
+		return c > 0
+	case "ge":
+		return c >= 0
+	case "lt":
+		return c < 0
+	case "le":
+		return c <= 0
+	}
+	return false
+}
+
+func cmpFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func foldCase(s string) string {
+	return strings.Map(unicode.ToLower, s)
+}
@@ -0,0 +1,96 @@
+package scimfilter
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+const user = `{
+	"id": "7",
+	"userName": "Alice@Example.com",
+	"name": {"formatted": "Alice Smith"},
+	"active": true,
+	"emails": [
+		{"value": "alice@example.com", "type": "work", "primary": true},
+		{"value": "alice@home.example", "type": "home"}
+	],
+	"meta": {"created": "2024-03-01T10:00:00Z"}
+}`
+
+func TestMatch(t *testing.T) {
+	var resource map[string]any
+	if err := json.Unmarshal([]byte(user), &resource); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{`userName eq "alice@example.com"`, true},
+		{`USERNAME Eq "alice@example.com"`, true},
+		{`userName ne "alice@example.com"`, false},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName sw "alice"`, true},
+		{`name.formatted co "smi"`, true},
+		{`emails.value ew "@home.example"`, true},
+		{`emails[type eq "work" and value co "example.com"]`, true},
+		{`emails[type eq "other"]`, false},
+		{`active eq true`, true},
+		{`active eq false`, false},
+		{`title pr`, false},
+		{`title eq null`, true},
+		{`meta.created gt "2024-01-01T00:00:00Z"`, true},
+		{`meta.created lt "2024-03-01T11:00:00+01:00"`, false},
+		{`not (active eq true) or userName eq "bob@example.com"`, false},
+		{`userName eq "bob@example.com" or (active eq true and id eq "7")`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			expr, err := Parse(tt.filter)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if got := expr.Match(resource); got != tt.want {
+				t.Fatalf("Match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, filter := range []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName xx "a"`,
+		`userName eq "a" and`,
+		`(userName eq "a"`,
+		`emails[type eq "work"`,
+		`userName eq "unterminated`,
+		`not userName eq "a"`,
+	} {
+		if _, err := Parse(filter); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("Parse(%q) = %v, want ErrInvalidFilter", filter, err)
+		}
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	path, err := ParsePath(`emails[type eq "work"].value`)
+	if err != nil {
+		t.Fatalf("ParsePath: %v", err)
+	}
+	if path.Attr != (AttrPath{Attr: "emails", Sub: "value"}) || path.Filter == nil {
+		t.Fatalf("ParsePath = %+v", path)
+	}
+
+	path, err = ParsePath(`members[value eq "2"]`)
+	if err != nil {
+		t.Fatalf("ParsePath: %v", err)
+	}
+	if !path.Filter.Match(map[string]any{"value": "2"}) || path.Filter.Match(map[string]any{"value": "3"}) {
+		t.Fatalf("members filter matches the wrong member")
+	}
+}
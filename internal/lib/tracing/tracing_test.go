@@ -0,0 +1,44 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSetup(t *testing.T) {
+	if _, err := Setup(context.Background(), Config{Exporter: "zipkin"}); err == nil {
+		t.Fatal("Setup with an unknown exporter succeeded")
+	}
+
+	prev := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	for _, exporter := range []string{ExporterStdout, ExporterOTLP} {
+		shutdown, err := Setup(context.Background(), Config{Exporter: exporter, SampleRatio: 1, ServiceName: "sso"})
+		if err != nil {
+			t.Fatalf("Setup(%s): %v", exporter, err)
+		}
+		if err := shutdown(context.Background()); err != nil {
+			t.Errorf("shutdown(%s): %v", exporter, err)
+		}
+	}
+
+	shutdown, err := Setup(context.Background(), Config{Exporter: ExporterNone})
+	if err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	defer shutdown(context.Background())
+
+	// even with no exporter the caller's trace context is taken up
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(header))
+	sc := trace.SpanContextFromContext(ctx)
+	if got := sc.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("extracted trace ID = %q", got)
+	}
+}
@@ -0,0 +1,270 @@
+// Package userfile reads and writes users for bulk import and export, as
+// CSV with a header row or as JSON Lines. Both carry the same fields under
+// the same names.
+package userfile
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Format string
+
+const (
+	CSV   Format = "csv"
+	JSONL Format = "jsonl"
+)
+
+// ParseFormat returns the format named s. An empty s picks the format from
+// the extension of path.
+func ParseFormat(s string, path string) (Format, error) {
+	if s == "" {
+		s = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+	switch s {
+	case "csv":
+		return CSV, nil
+	case "jsonl", "ndjson":
+		return JSONL, nil
+	}
+	return "", fmt.Errorf("unknown format %q, use csv or jsonl", s)
+}
+
+// Record is one user in a file. Exactly one of PasswordHash and Password
+// is set on import, exports always carry the hash. PepperVersion goes with
+// PasswordHash, a peppered hash only verifies where its pepper is
+// configured.
+type Record struct {
+	// ID is written on export and ignored on import.
+	ID            int64      `json:"id,omitempty"`
+	Email         string     `json:"email"`
+	Name          string     `json:"name"`
+	PasswordHash  string     `json:"password_hash,omitempty"`
+	PepperVersion int        `json:"pepper_version,omitempty"`
+	Password      string     `json:"password,omitempty"`
+	EmailVerified bool       `json:"email_verified"`
+	Status        string     `json:"status,omitempty"`
+	CreatedAt     *time.Time `json:"created_at,omitempty"`
+}
+
+// columns are the CSV header names, in the order Writer writes them.
+var columns = []string{"id", "email", "name", "password_hash", "pepper_version", "password", "email_verified", "status", "created_at"}
+
+// RowError is a row that could not be decoded. Reading can go on past it.
+// Line is the line in the file, or the message number on a stream.
+type RowError struct {
+	Line int
+	Err  error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// Reader decodes records one at a time, so files of any size can be
+// streamed.
+type Reader struct {
+	format Format
+
+	csv    *csv.Reader
+	header map[string]int
+
+	lines *bufio.Scanner
+	line  int
+}
+
+// NewReader returns a reader of f formatted records. For CSV it reads the
+// header row right away.
+func NewReader(r io.Reader, f Format) (*Reader, error) {
+	switch f {
+	case CSV:
+		cr := csv.NewReader(r)
+		cr.ReuseRecord = true
+		header, err := cr.Read()
+		if err != nil {
+			return nil, fmt.Errorf("reading csv header: %w", err)
+		}
+		index := make(map[string]int, len(header))
+		for i, name := range header {
+			name = strings.TrimSpace(strings.ToLower(name))
+			if !knownColumn(name) {
+				return nil, fmt.Errorf("unknown csv column %q", name)
+			}
+			index[name] = i
+		}
+		if _, ok := index["email"]; !ok {
+			return nil, errors.New("csv header has no email column")
+		}
+		return &Reader{format: f, csv: cr, header: index}, nil
+	case JSONL:
+		lines := bufio.NewScanner(r)
+		lines.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		return &Reader{format: f, lines: lines}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", f)
+}
+
+// Read returns the next record, io.EOF after the last one. A *RowError
+// means just that row is bad, any other error ends the file.
+func (r *Reader) Read() (Record, error) {
+	if r.format == CSV {
+		return r.readCSV()
+	}
+	return r.readJSONL()
+}
+
+func (r *Reader) readCSV() (Record, error) {
+	fields, err := r.csv.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) && errors.Is(err, csv.ErrFieldCount) {
+			return Record{}, &RowError{Line: parseErr.Line, Err: parseErr.Err}
+		}
+		return Record{}, err
+	}
+	line, _ := r.csv.FieldPos(0)
+
+	get := func(name string) string {
+		if i, ok := r.header[name]; ok {
+			return strings.TrimSpace(fields[i])
+		}
+		return ""
+	}
+
+	rec := Record{
+		Email:        get("email"),
+		Name:         get("name"),
+		PasswordHash: get("password_hash"),
+		Password:     get("password"),
+		Status:       get("status"),
+	}
+	if v := get("id"); v != "" {
+		if rec.ID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return Record{}, &RowError{Line: line, Err: fmt.Errorf("invalid id %q", v)}
+		}
+	}
+	if v := get("pepper_version"); v != "" {
+		if rec.PepperVersion, err = strconv.Atoi(v); err != nil {
+			return Record{}, &RowError{Line: line, Err: fmt.Errorf("invalid pepper_version %q", v)}
+		}
+	}
+	if v := get("email_verified"); v != "" {
+		if rec.EmailVerified, err = strconv.ParseBool(v); err != nil {
+			return Record{}, &RowError{Line: line, Err: fmt.Errorf("invalid email_verified %q", v)}
+		}
+	}
+	if v := get("created_at"); v != "" {
+		createdAt, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return Record{}, &RowError{Line: line, Err: fmt.Errorf("invalid created_at %q", v)}
+		}
+		rec.CreatedAt = &createdAt
+	}
+	return rec, nil
+}
+
+func (r *Reader) readJSONL() (Record, error) {
+	for r.lines.Scan() {
+		r.line++
+		line := strings.TrimSpace(r.lines.Text())
+		if line == "" {
+			continue
+		}
+
+		dec := json.NewDecoder(strings.NewReader(line))
+		dec.DisallowUnknownFields()
+		var rec Record
+		if err := dec.Decode(&rec); err != nil {
+			return Record{}, &RowError{Line: r.line, Err: err}
+		}
+		return rec, nil
+	}
+	if err := r.lines.Err(); err != nil {
+		return Record{}, err
+	}
+	return Record{}, io.EOF
+}
+
+func knownColumn(name string) bool {
+	for _, c := range columns {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Writer encodes records. Call Flush when done.
+type Writer struct {
+	format      Format
+	csv         *csv.Writer
+	json        *json.Encoder
+	buf         *bufio.Writer
+	wroteHeader bool
+}
+
+func NewWriter(w io.Writer, f Format) (*Writer, error) {
+	switch f {
+	case CSV:
+		return &Writer{format: f, csv: csv.NewWriter(w)}, nil
+	case JSONL:
+		buf := bufio.NewWriter(w)
+		return &Writer{format: f, json: json.NewEncoder(buf), buf: buf}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", f)
+}
+
+func (w *Writer) Write(rec Record) error {
+	if w.format == JSONL {
+		return w.json.Encode(rec)
+	}
+
+	if !w.wroteHeader {
+		if err := w.csv.Write(columns); err != nil {
+			return err
+		}
+		w.wroteHeader = true
+	}
+
+	var createdAt string
+	if rec.CreatedAt != nil {
+		createdAt = rec.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return w.csv.Write([]string{
+		strconv.FormatInt(rec.ID, 10),
+		rec.Email,
+		rec.Name,
+		rec.PasswordHash,
+		strconv.Itoa(rec.PepperVersion),
+		rec.Password,
+		strconv.FormatBool(rec.EmailVerified),
+		rec.Status,
+		createdAt,
+	})
+}
+
+func (w *Writer) Flush() error {
+	if w.format == JSONL {
+		return w.buf.Flush()
+	}
+	if !w.wroteHeader {
+		// an empty export is still a valid file
+		if err := w.csv.Write(columns); err != nil {
+			return err
+		}
+	}
+	w.csv.Flush()
+	return w.csv.Error()
+}
@@ -0,0 +1,185 @@
+package userfile
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	createdAt := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	records := []Record{
+		{
+			ID:            1,
+			Email:         "alice@example.com",
+			Name:          "Alice, \"the first\"",
+			PasswordHash:  "$2a$04$Gm.DkSaCtVkMFEsrQzDK9OSV7CRwtUjMbn.XLscZCqu.Bu6m15Gta",
+			PepperVersion: 2,
+			EmailVerified: true,
+			Status:        "locked",
+			CreatedAt:     &createdAt,
+		},
+		{ID: 2, Email: "bob@example.com", Name: "Bob", PasswordHash: "pbkdf2_sha256$1000$plainsalt$7mxrq6yM+WMfQM+vXXXu+JjPCER9dWYMauNWnwgQSGQ="},
+	}
+
+	for _, f := range []Format{CSV, JSONL} {
+		t.Run(string(f), func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, f)
+			if err != nil {
+				t.Fatalf("NewWriter: %v", err)
+			}
+			for _, rec := range records {
+				if err := w.Write(rec); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+
+			r, err := NewReader(&buf, f)
+			if err != nil {
+				t.Fatalf("NewReader: %v", err)
+			}
+			for i, want := range records {
+				got, err := r.Read()
+				if err != nil {
+					t.Fatalf("Read %d: %v", i, err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("Read %d = %+v, want %+v", i, got, want)
+				}
+			}
+			if _, err := r.Read(); !errors.Is(err, io.EOF) {
+				t.Errorf("Read past the last record = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestEmptyExport(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, CSV)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	r, err := NewReader(&buf, CSV)
+	if err != nil {
+		t.Fatalf("NewReader of an empty export: %v", err)
+	}
+	if _, err := r.Read(); !errors.Is(err, io.EOF) {
+		t.Errorf("Read = %v, want io.EOF", err)
+	}
+}
+
+func TestRowErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   Format
+		input    string
+		wantLine int
+	}{
+		{
+			name:     "csv bad bool",
+			format:   CSV,
+			input:    "email,name,email_verified\na@example.com,A,true\nb@example.com,B,maybe\n",
+			wantLine: 3,
+		},
+		{
+			name:     "csv bad created_at",
+			format:   CSV,
+			input:    "email,name,created_at\nb@example.com,B,yesterday\n",
+			wantLine: 2,
+		},
+		{
+			name:     "csv field count",
+			format:   CSV,
+			input:    "email,name\nb@example.com,B,extra\n",
+			wantLine: 2,
+		},
+		{
+			name:     "jsonl unknown field",
+			format:   JSONL,
+			input:    "{\"email\":\"a@example.com\",\"name\":\"A\"}\n\n{\"email\":\"b@example.com\",\"role\":\"admin\"}\n",
+			wantLine: 3,
+		},
+		{
+			name:     "jsonl malformed",
+			format:   JSONL,
+			input:    "{\"email\":\n",
+			wantLine: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(strings.NewReader(tt.input), tt.format)
+			if err != nil {
+				t.Fatalf("NewReader: %v", err)
+			}
+
+			var rowErr *RowError
+			for {
+				_, err := r.Read()
+				if errors.Is(err, io.EOF) {
+					t.Fatal("no row error before io.EOF")
+				}
+				if errors.As(err, &rowErr) {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Read = %v, want a *RowError", err)
+				}
+			}
+			if rowErr.Line != tt.wantLine {
+				t.Errorf("row error on line %d, want %d", rowErr.Line, tt.wantLine)
+			}
+
+			// reading goes on past a bad row
+			if _, err := r.Read(); !errors.Is(err, io.EOF) {
+				t.Errorf("Read after the bad row = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestBadHeader(t *testing.T) {
+	for _, input := range []string{
+		"email,name,role\n",
+		"name,password\n",
+		"",
+	} {
+		if _, err := NewReader(strings.NewReader(input), CSV); err == nil {
+			t.Errorf("NewReader(%q) succeeded", input)
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	tests := []struct {
+		name, path string
+		want       Format
+		wantErr    bool
+	}{
+		{name: "", path: "users.CSV", want: CSV},
+		{name: "", path: "users.ndjson", want: JSONL},
+		{name: "jsonl", path: "users.csv", want: JSONL},
+		{name: "", path: "users.txt", wantErr: true},
+		{name: "xml", path: "users.csv", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFormat(tt.name, tt.path)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseFormat(%q, %q) = %q, %v", tt.name, tt.path, got, err)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Package migrator applies schema migrations for the configured storage
+// driver. It is shared by cmd/migrator and the startup auto-migration of
+// cmd/sso.
+package migrator
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/database/sqlite"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	_ "github.com/lib/pq"
+
+	"sso/internal/config"
+	ssopostgres "sso/internal/storage/postgres"
+	ssosqlite "sso/internal/storage/sqlite"
+	"sso/migrations"
+)
+
+// ErrSchemaAhead is returned when the database has migrations this binary
+// does not know about, i.e. a newer release already migrated it.
+var ErrSchemaAhead = errors.New("database schema is ahead of the binary")
+
+// Embedded returns the migrations compiled into the binary for the driver.
+func Embedded(driver string) (fs.FS, error) {
+	return migrations.FS(driver)
+}
+
+// New returns a migrate instance for the configured storage driver that reads
+// migrations from src. On Postgres every run takes the driver's advisory lock,
+// so concurrent instances apply migrations one at a time.
+func New(cfg *config.Config, src fs.FS, table string) (*migrate.Migrate, error) {
+	m, _, err := open(cfg, src, table)
+	return m, err
+}
+
+// lockFunc holds a lock across migrator runs until the returned func is
+// called.
+type lockFunc func(ctx context.Context) (unlock func(), err error)
+
+func open(cfg *config.Config, src fs.FS, table string) (*migrate.Migrate, lockFunc, error) {
+	const op = "migrator.New"
+
+	srcDriver, err := iofs.New(src, ".")
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var (
+		db     *sql.DB
+		driver database.Driver
+		lock   lockFunc
+	)
+
+	switch cfg.Storage.Driver {
+	case config.StorageDriverPostgres:
+		// Формирование строки подключения
+		var dsn string
+		dsn, err = ssopostgres.DSN(ssopostgres.ConnConfigFrom(cfg.PgDb))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		db, err = sql.Open("postgres", dsn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		if err = db.Ping(); err != nil {
+			db.Close()
+			return nil, nil, fmt.Errorf("%s: connection test failed: %w", op, err)
+		}
+
+		driver, err = postgres.WithInstance(db, &postgres.Config{
+			MigrationsTable: table,
+		})
+		lock = advisoryLock(db, table)
+	case config.StorageDriverSQLite:
+		db, err = sql.Open("sqlite", ssosqlite.DSN(cfg.Storage.SQLitePath))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		driver, err = sqlite.WithInstance(db, &sqlite.Config{
+			MigrationsTable: table,
+		})
+		// the sqlite driver locks within the process only, there is
+		// nothing to hold across processes
+		lock = func(context.Context) (func(), error) { return func() {}, nil }
+	default:
+		return nil, nil, fmt.Errorf("%s: unknown driver %q", op, cfg.Storage.Driver)
+	}
+	if err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	m, err := migrate.NewWithInstance("iofs", srcDriver, cfg.Storage.Driver, driver)
+	if err != nil {
+		driver.Close()
+		return nil, nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return m, lock, nil
+}
+
+// advisoryLock takes a session-level advisory lock of its own on a
+// connection kept for it. migrate takes its lock only inside each run, so
+// this one covers what Up reads before running.
+func advisoryLock(db *sql.DB, table string) lockFunc {
+	return func(ctx context.Context) (func(), error) {
+		id, err := database.GenerateAdvisoryLockId("sso-migrator-up", table)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1::bigint)", id); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return func() {
+			conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1::bigint)", id)
+			conn.Close()
+		}, nil
+	}
+}
+
+// Latest returns the highest migration version in src.
+func Latest(src fs.FS) (uint, error) {
+	entries, err := fs.ReadDir(src, ".")
+	if err != nil {
+		return 0, err
+	}
+
+	var last uint
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		m, err := source.DefaultParse(e.Name())
+		if err != nil {
+			continue
+		}
+		last = max(last, m.Version)
+	}
+	return last, nil
+}
+
+// Up applies the embedded migrations that are still pending. It refuses to
+// touch a database whose schema is newer than the binary or left dirty by a
+// failed migration.
+func Up(log *slog.Logger, cfg *config.Config, table string) error {
+	const op = "migrator.Up"
+
+	log = log.With(slog.String("op", op))
+
+	src, err := Embedded(cfg.Storage.Driver)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	latest, err := Latest(src)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	m, lock, err := open(cfg, src, table)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer m.Close()
+
+	// read the version under the lock, a concurrent instance may be
+	// migrating past it
+	unlock, err := lock(context.Background())
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer unlock()
+
+	version, dirty, err := m.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if dirty {
+		return fmt.Errorf("%s: database is dirty at version %d, fix it with `migrator force`", op, version)
+	}
+	if version > latest {
+		return fmt.Errorf("%s: %w: database at version %d, binary knows up to %d", op, ErrSchemaAhead, version, latest)
+	}
+
+	if err := m.Up(); err != nil {
+		if errors.Is(err, migrate.ErrNoChange) {
+			log.Info("database schema is up to date", slog.Uint64("version", uint64(version)))
+			return nil
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("migrations applied",
+		slog.Uint64("from", uint64(version)),
+		slog.Uint64("to", uint64(latest)),
+	)
+	return nil
+}
@@ -0,0 +1,123 @@
+// Package seed loads fixtures of apps and users into a fresh environment.
+// Seeding is idempotent: apps are upserted by id, users that already exist
+// keep their password and only get their admin flag brought in line.
+package seed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"sso/internal/domain/models"
+	"sso/internal/services/auth"
+	"sso/internal/storage"
+)
+
+// Fixture is the seed file layout. JSON works as well, it is valid YAML.
+// Values may reference environment variables as $VAR or ${VAR}, so secrets
+// do not have to be committed along with the fixture.
+type Fixture struct {
+	Apps  []App  `yaml:"apps"`
+	Users []User `yaml:"users"`
+}
+
+type App struct {
+	ID     int    `yaml:"id"`
+	Name   string `yaml:"name"`
+	Secret string `yaml:"secret"`
+}
+
+type User struct {
+	Email    string `yaml:"email"`
+	Name     string `yaml:"name"`
+	Password string `yaml:"password"`
+	Admin    bool   `yaml:"admin"`
+}
+
+// Registrar creates users the same way the Register RPC does, so seeded
+// passwords are hashed with the service settings.
+type Registrar interface {
+	RegisterNewUser(ctx context.Context, email string, name string, password string) (int64, error)
+}
+
+type Storage interface {
+	User(ctx context.Context, email string) (models.User, error)
+	SetAdmin(ctx context.Context, userID int64, isAdmin bool) error
+	SaveApp(ctx context.Context, app models.App) error
+}
+
+// Load reads and validates the fixture at path.
+func Load(path string) (Fixture, error) {
+	const op = "seed.Load"
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return Fixture{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var f Fixture
+	if err := yaml.Unmarshal([]byte(os.ExpandEnv(string(raw))), &f); err != nil {
+		return Fixture{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := f.validate(); err != nil {
+		return Fixture{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return f, nil
+}
+
+func (f Fixture) validate() error {
+	for i, app := range f.Apps {
+		if app.ID <= 0 || app.Name == "" || app.Secret == "" {
+			return fmt.Errorf("apps[%d]: id, name and secret are required", i)
+		}
+	}
+	for i, user := range f.Users {
+		if user.Email == "" || user.Name == "" || user.Password == "" {
+			return fmt.Errorf("users[%d]: email, name and password are required", i)
+		}
+	}
+	return nil
+}
+
+// Run applies the fixture.
+func Run(ctx context.Context, log *slog.Logger, f Fixture, registrar Registrar, s Storage) error {
+	const op = "seed.Run"
+
+	log = log.With(slog.String("op", op))
+
+	for _, app := range f.Apps {
+		if err := s.SaveApp(ctx, models.App{ID: app.ID, Name: app.Name, Secret: app.Secret}); err != nil {
+			return fmt.Errorf("%s: app %d: %w", op, app.ID, err)
+		}
+		log.Info("app seeded", slog.Int("app_id", app.ID), slog.String("name", app.Name))
+	}
+
+	for _, user := range f.Users {
+		id, err := registrar.RegisterNewUser(ctx, user.Email, user.Name, user.Password)
+		switch {
+		case errors.Is(err, auth.ErrUserExists):
+			// the user may have been created a moment ago, read from the primary
+			existing, err := s.User(storage.WithPrimary(ctx), user.Email)
+			if err != nil {
+				return fmt.Errorf("%s: user %s: %w", op, user.Email, err)
+			}
+			id = existing.ID
+			log.Info("user already exists, password left unchanged", slog.Int64("user_id", id))
+		case err != nil:
+			return fmt.Errorf("%s: user %s: %w", op, user.Email, err)
+		default:
+			log.Info("user created", slog.Int64("user_id", id))
+		}
+
+		if err := s.SetAdmin(ctx, id, user.Admin); err != nil {
+			return fmt.Errorf("%s: user %s: %w", op, user.Email, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,413 @@
+package admin
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sso/internal/domain/models"
+	"sso/internal/lib/jwt"
+	"sso/internal/lib/userfile"
+	"sso/internal/services/bulk"
+	"sso/internal/services/gdpr"
+	"sso/internal/storage"
+	"strconv"
+	"time"
+)
+
+type Admin struct {
+	log              *slog.Logger
+	usrProvider      UserProvider
+	usrUpdater       UserUpdater
+	appProvider      AppProvider
+	appID            int64
+	dataSubjects     DataSubjects
+	transfer         UserTransfer
+	deletedRetention time.Duration
+}
+
+type UserProvider interface {
+	UserByID(ctx context.Context, userID int64) (models.User, error)
+	IsAdmin(ctx context.Context, userID int64) (bool, error)
+	ListUsers(ctx context.Context, filter models.UserFilter) ([]models.UserInfo, error)
+}
+
+type UserUpdater interface {
+	SetStatus(ctx context.Context, userID int64, status models.UserStatus, reason string, at time.Time) error
+	ReleaseDeletedEmails(ctx context.Context, deletedBefore time.Time, now time.Time) (int64, error)
+}
+
+// DataSubjects handles data subject requests, see gdpr.GDPR.
+type DataSubjects interface {
+	Export(ctx context.Context, userID int64) (gdpr.Archive, error)
+	Erase(ctx context.Context, userID int64, erasedBy int64, reason string) error
+}
+
+// UserTransfer moves users in and out in bulk, see bulk.Bulk.
+type UserTransfer interface {
+	Import(
+		ctx context.Context,
+		next func() (userfile.Record, error),
+		opts bulk.ImportOptions,
+		report func(bulk.Result) error,
+	) (bulk.Summary, error)
+	Export(ctx context.Context, write func(userfile.Record) error) (int, error)
+}
+
+type AppProvider interface {
+	App(ctx context.Context, appID int64) (models.App, error)
+}
+
+var (
+	ErrInvalidToken     = errors.New("invalid token")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrInvalidPageToken = errors.New("invalid page token")
+	ErrInvalidField     = errors.New("invalid field")
+	ErrUserNotFound     = errors.New("user not found")
+	ErrInvalidStatus    = errors.New("invalid status")
+	ErrEmailReleased    = errors.New("user was deleted and their email released")
+	ErrUserErased       = errors.New("user was erased")
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// UserFields are the names of the models.UserInfo fields a caller can
+// select, as they appear on the wire.
+var UserFields = []string{
+	"id", "name", "email", "email_verified", "is_admin",
+	"status", "status_reason", "status_changed_at", "created_at",
+}
+
+// FieldSet is a selection of UserFields.
+type FieldSet map[string]bool
+
+// Has reports whether field is selected.
+func (f FieldSet) Has(field string) bool {
+	return f[field]
+}
+
+// SelectFields validates the requested field names. No names select every
+// field, id is always selected so the result can be paged through.
+func SelectFields(fields []string) (FieldSet, error) {
+	known := make(FieldSet, len(UserFields))
+	for _, f := range UserFields {
+		known[f] = true
+	}
+	if len(fields) == 0 {
+		return known, nil
+	}
+
+	set := FieldSet{"id": true}
+	for _, f := range fields {
+		if !known[f] {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidField, f)
+		}
+		set[f] = true
+	}
+	return set, nil
+}
+
+// New creates the admin service. It accepts the tokens of the admin app
+// with appID only, any other app could sign a token for an admin. Users
+// deleted longer than deletedRetention ago get their email released by
+// ReleaseDeletedEmails.
+func New(
+	log *slog.Logger,
+	userProvider UserProvider,
+	userUpdater UserUpdater,
+	appProvider AppProvider,
+	appID int64,
+	dataSubjects DataSubjects,
+	transfer UserTransfer,
+	deletedRetention time.Duration,
+) *Admin {
+	return &Admin{
+		log:              log,
+		usrProvider:      userProvider,
+		usrUpdater:       userUpdater,
+		appProvider:      appProvider,
+		appID:            appID,
+		dataSubjects:     dataSubjects,
+		transfer:         transfer,
+		deletedRetention: deletedRetention,
+	}
+}
+
+// ListUsers returns one page of the users matching filter, ordered by id.
+// filter.AfterID and filter.Limit are taken from pageToken and pageSize.
+// nextPageToken is empty on the last page.
+func (a *Admin) ListUsers(
+	ctx context.Context,
+	token string,
+	filter models.UserFilter,
+	pageSize int,
+	pageToken string,
+) (users []models.UserInfo, nextPageToken string, err error) {
+	const op = "admin.ListUsers"
+	log := a.log.With(slog.String("op", op))
+
+	callerID, err := a.authorize(ctx, token)
+	if err != nil {
+		log.Warn("failed to authorize", slog.String("error", err.Error()))
+		return nil, "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	filter.AfterID, err = decodePageToken(pageToken)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	switch {
+	case pageSize <= 0:
+		pageSize = DefaultPageSize
+	case pageSize > MaxPageSize:
+		pageSize = MaxPageSize
+	}
+	// one extra row tells whether there is a next page
+	filter.Limit = pageSize + 1
+
+	users, err = a.usrProvider.ListUsers(ctx, filter)
+	if err != nil {
+		log.Error("failed to list users", slog.String("error", err.Error()))
+		return nil, "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	if len(users) > pageSize {
+		users = users[:pageSize]
+		nextPageToken = encodePageToken(users[pageSize-1].ID)
+	}
+
+	log.Info("users listed", slog.Int64("caller_id", callerID), slog.Int("count", len(users)))
+	return users, nextPageToken, nil
+}
+
+// SetUserStatus disables, locks, deletes or restores (sets active) a user.
+// Admins cannot change their own status.
+func (a *Admin) SetUserStatus(
+	ctx context.Context,
+	token string,
+	userID int64,
+	status models.UserStatus,
+	reason string,
+) error {
+	const op = "admin.SetUserStatus"
+	log := a.log.With(
+		slog.String("op", op),
+		slog.Int64("user_id", userID),
+		slog.String("status", string(status)),
+	)
+
+	callerID, err := a.authorize(ctx, token)
+	if err != nil {
+		log.Warn("failed to authorize", slog.String("error", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	log = log.With(slog.Int64("caller_id", callerID))
+
+	if !status.Valid() {
+		return fmt.Errorf("%s: %w", op, ErrInvalidStatus)
+	}
+	if callerID == userID {
+		log.Warn("admin tried to change their own status")
+		return fmt.Errorf("%s: %w", op, ErrPermissionDenied)
+	}
+
+	if err := a.usrUpdater.SetStatus(ctx, userID, status, reason, time.Now()); err != nil {
+		switch {
+		case errors.Is(err, storage.ErrUserNotFound):
+			return fmt.Errorf("%s: %w", op, ErrUserNotFound)
+		case errors.Is(err, storage.ErrEmailReleased):
+			return fmt.Errorf("%s: %w", op, ErrEmailReleased)
+		}
+		log.Error("failed to set status", slog.String("error", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("user status changed", slog.String("reason", reason))
+	return nil
+}
+
+// ExportUser returns the archive of everything stored about the user, for
+// subject access requests.
+func (a *Admin) ExportUser(ctx context.Context, token string, userID int64) (gdpr.Archive, error) {
+	const op = "admin.ExportUser"
+	log := a.log.With(slog.String("op", op), slog.Int64("user_id", userID))
+
+	callerID, err := a.authorize(ctx, token)
+	if err != nil {
+		log.Warn("failed to authorize", slog.String("error", err.Error()))
+		return gdpr.Archive{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	archive, err := a.dataSubjects.Export(ctx, userID)
+	if err != nil {
+		return gdpr.Archive{}, fmt.Errorf("%s: %w", op, dataSubjectError(err))
+	}
+
+	log.Info("user data exported", slog.Int64("caller_id", callerID))
+	return archive, nil
+}
+
+// EraseUser deletes the user and all their data for good, leaving only a
+// tombstone. Admins cannot erase themselves.
+func (a *Admin) EraseUser(ctx context.Context, token string, userID int64, reason string) error {
+	const op = "admin.EraseUser"
+	log := a.log.With(slog.String("op", op), slog.Int64("user_id", userID))
+
+	callerID, err := a.authorize(ctx, token)
+	if err != nil {
+		log.Warn("failed to authorize", slog.String("error", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if callerID == userID {
+		log.Warn("admin tried to erase themselves")
+		return fmt.Errorf("%s: %w", op, ErrPermissionDenied)
+	}
+
+	if err := a.dataSubjects.Erase(ctx, userID, callerID, reason); err != nil {
+		return fmt.Errorf("%s: %w", op, dataSubjectError(err))
+	}
+	return nil
+}
+
+// ImportUsers imports users in bulk, see bulk.Bulk.Import.
+func (a *Admin) ImportUsers(
+	ctx context.Context,
+	token string,
+	next func() (userfile.Record, error),
+	opts bulk.ImportOptions,
+	report func(bulk.Result) error,
+) (bulk.Summary, error) {
+	const op = "admin.ImportUsers"
+	log := a.log.With(slog.String("op", op))
+
+	callerID, err := a.authorize(ctx, token)
+	if err != nil {
+		log.Warn("failed to authorize", slog.String("error", err.Error()))
+		return bulk.Summary{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("importing users", slog.Int64("caller_id", callerID), slog.Bool("dry_run", opts.DryRun))
+	summary, err := a.transfer.Import(ctx, next, opts, report)
+	if err != nil {
+		return summary, fmt.Errorf("%s: %w", op, err)
+	}
+	return summary, nil
+}
+
+// ExportUsers writes every user, password hashes included, see
+// bulk.Bulk.Export.
+func (a *Admin) ExportUsers(ctx context.Context, token string, write func(userfile.Record) error) (int, error) {
+	const op = "admin.ExportUsers"
+	log := a.log.With(slog.String("op", op))
+
+	callerID, err := a.authorize(ctx, token)
+	if err != nil {
+		log.Warn("failed to authorize", slog.String("error", err.Error()))
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("exporting users", slog.Int64("caller_id", callerID))
+	count, err := a.transfer.Export(ctx, write)
+	if err != nil {
+		return count, fmt.Errorf("%s: %w", op, err)
+	}
+	return count, nil
+}
+
+func dataSubjectError(err error) error {
+	switch {
+	case errors.Is(err, gdpr.ErrUserNotFound):
+		return ErrUserNotFound
+	case errors.Is(err, gdpr.ErrUserErased):
+		return ErrUserErased
+	}
+	return err
+}
+
+// ReleaseDeletedEmails frees the emails of users deleted longer than the
+// retention period ago. After that they can no longer be restored.
+func (a *Admin) ReleaseDeletedEmails(ctx context.Context) (int64, error) {
+	const op = "admin.ReleaseDeletedEmails"
+	log := a.log.With(slog.String("op", op))
+
+	now := time.Now()
+	n, err := a.usrUpdater.ReleaseDeletedEmails(ctx, now.Add(-a.deletedRetention), now)
+	if err != nil {
+		log.Error("failed to release emails", slog.String("error", err.Error()))
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if n > 0 {
+		log.Info("released emails of deleted users", slog.Int64("count", n))
+	}
+	return n, nil
+}
+
+// authorize verifies that the token was issued for the admin app and
+// belongs to an active admin.
+func (a *Admin) authorize(ctx context.Context, token string) (int64, error) {
+	claims, err := jwt.ParseToken(token, func(appID int) (string, error) {
+		if int64(appID) != a.appID {
+			return "", fmt.Errorf("%w: issued for app %d", jwt.ErrInvalidToken, appID)
+		}
+		app, err := a.appProvider.App(ctx, a.appID)
+		if err != nil {
+			return "", err
+		}
+		return app.Secret, nil
+	})
+	if err != nil {
+		if errors.Is(err, jwt.ErrInvalidToken) {
+			return 0, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+		}
+		return 0, err
+	}
+
+	user, err := a.usrProvider.UserByID(ctx, claims.UserID)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			// the token outlived its user
+			return 0, ErrInvalidToken
+		}
+		return 0, err
+	}
+	if user.Status != models.UserStatusActive {
+		return 0, ErrPermissionDenied
+	}
+
+	isAdmin, err := a.usrProvider.IsAdmin(ctx, claims.UserID)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return 0, ErrInvalidToken
+		}
+		return 0, err
+	}
+	if !isAdmin {
+		return 0, ErrPermissionDenied
+	}
+	return claims.UserID, nil
+}
+
+// Page tokens are opaque to callers, they carry the last id of the page.
+func encodePageToken(lastID int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(lastID, 10)))
+}
+
+func decodePageToken(token string) (int64, error) {
+	if token == "" {
+		return 0, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, ErrInvalidPageToken
+	}
+	id, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil || id < 0 {
+		return 0, ErrInvalidPageToken
+	}
+	return id, nil
+}
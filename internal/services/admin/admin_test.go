@@ -0,0 +1,95 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"sso/internal/domain/models"
+	"sso/internal/lib/jwt"
+	"sso/internal/storage"
+)
+
+var (
+	adminApp   = models.App{ID: 1, Name: "admin", Secret: "admin-secret"}
+	relyingApp = models.App{ID: 2, Name: "relying", Secret: "relying-secret"}
+)
+
+// fakeStorage knows both apps, so only the pinned admin app keeps the
+// relying one out.
+type fakeStorage struct {
+	users  map[int64]models.User
+	admins map[int64]bool
+}
+
+func (s *fakeStorage) UserByID(_ context.Context, userID int64) (models.User, error) {
+	user, ok := s.users[userID]
+	if !ok {
+		return models.User{}, storage.ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *fakeStorage) IsAdmin(_ context.Context, userID int64) (bool, error) {
+	if _, ok := s.users[userID]; !ok {
+		return false, storage.ErrUserNotFound
+	}
+	return s.admins[userID], nil
+}
+
+func (s *fakeStorage) ListUsers(_ context.Context, _ models.UserFilter) ([]models.UserInfo, error) {
+	return nil, nil
+}
+
+func (s *fakeStorage) App(_ context.Context, appID int64) (models.App, error) {
+	for _, app := range []models.App{adminApp, relyingApp} {
+		if int64(app.ID) == appID {
+			return app, nil
+		}
+	}
+	return models.App{}, storage.ErrAppNotFound
+}
+
+func TestAuthorize(t *testing.T) {
+	root := models.User{ID: 1, Email: "root@example.com", Status: models.UserStatusActive}
+	locked := models.User{ID: 2, Email: "locked@example.com", Status: models.UserStatusLocked}
+	alice := models.User{ID: 3, Email: "alice@example.com", Status: models.UserStatusActive}
+	s := &fakeStorage{
+		users:  map[int64]models.User{root.ID: root, locked.ID: locked, alice.ID: alice},
+		admins: map[int64]bool{root.ID: true, locked.ID: true},
+	}
+	log := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	a := New(log, s, nil, s, int64(adminApp.ID), nil, nil, time.Hour)
+
+	token := func(user models.User, app models.App) string {
+		t.Helper()
+		token, err := jwt.NewToken(user, app, time.Hour)
+		if err != nil {
+			t.Fatalf("NewToken: %v", err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{name: "admin", token: token(root, adminApp)},
+		// any relying app can sign a token with the uid of an admin
+		{name: "admin, token of a relying app", token: token(root, relyingApp), wantErr: ErrInvalidToken},
+		{name: "locked admin", token: token(locked, adminApp), wantErr: ErrPermissionDenied},
+		{name: "not an admin", token: token(alice, adminApp), wantErr: ErrPermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := a.ListUsers(context.Background(), tt.token, models.UserFilter{}, 0, "")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ListUsers = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -5,20 +5,37 @@ import (
 	"errors"
 	"fmt"
 	//"github.com/golang-jwt/jwt"
-	"golang.org/x/crypto/bcrypt"
 	"log/slog"
 	"sso/internal/domain/models"
+	"sso/internal/lib/attempts"
 	"sso/internal/lib/jwt"
+	"sso/internal/lib/notify"
+	"sso/internal/lib/passhash"
 	"sso/internal/storage"
+	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("sso/auth")
+
 type Auth struct {
 	log         *slog.Logger
 	usrSaver    UserSaver
 	usrProvider UserProvider
 	appProvider AppProvider
+	hasher      PasswordHasher
+	policy      PasswordPolicy
+	throttle    LoginThrottle
+	notifier    notify.Notifier
+	metrics     Metrics
 	tokenTTL    time.Duration
+
+	// upgrades tracks the background hash upgrades started by UpgradeHash.
+	upgrades sync.WaitGroup
 }
 
 type UserSaver interface {
@@ -27,7 +44,9 @@ type UserSaver interface {
 		email string,
 		name string,
 		passHash []byte,
+		pepperVersion int,
 	) (uid int, err error)
+	UpdatePassHash(ctx context.Context, userID int64, oldHash []byte, newHash []byte, pepperVersion int) error
 }
 
 type UserProvider interface {
@@ -39,17 +58,127 @@ type AppProvider interface {
 	App(ctx context.Context, appId int64) (models.App, error)
 }
 
+type PasswordHasher interface {
+	Hash(ctx context.Context, password string) (hash []byte, pepperVersion int, err error)
+	Verify(ctx context.Context, hash []byte, pepperVersion int, password string) error
+	VerifyDummy(ctx context.Context, password string)
+	NeedsRehash(hash []byte, pepperVersion int) bool
+}
+
+// PasswordPolicy checks a new password, returning a *passpolicy.Error
+// listing what is wrong with it.
+type PasswordPolicy interface {
+	Check(password string, email string, name string) error
+}
+
+// LoginThrottle counts failed logins per account and client address. Begin
+// reserves an attempt, counted as a failure until Succeed or Cancel takes
+// it back, or tells how long it has to wait.
+type LoginThrottle interface {
+	Begin(ctx context.Context, email string, clientIP string) (*attempts.Attempt, time.Duration, error)
+	Fail(attempt *attempts.Attempt) (locked bool)
+	Succeed(ctx context.Context, attempt *attempts.Attempt) error
+	Cancel(ctx context.Context, attempt *attempts.Attempt) error
+}
+
+// Metrics counts logins by outcome, LoginOutcome of their error,
+// registrations and tokens issued.
+type Metrics interface {
+	LoginAttempt(outcome string)
+	UserRegistered()
+	TokenIssued(appID int)
+}
+
+// rehashTimeout bounds a background hash upgrade after login.
+const rehashTimeout = 30 * time.Second
+
 var (
 	ErrInvalidCredentials = errors.New("invalid credentials")
 	ErrInvalidAppId       = errors.New("invalid app id")
 	ErrUserExists         = errors.New("user already exists")
+	ErrUserDisabled       = errors.New("user is disabled")
+	ErrUserLocked         = errors.New("user is locked")
+	ErrUserDeleted        = errors.New("user is deleted")
+	// ErrAccountUnavailable is all a caller learns of a login refused for
+	// a disabled or locked account, one refused for a deleted account is
+	// answered like a wrong password. The status error, ErrUserDisabled and
+	// the like, is wrapped along with it for logs and metrics.
+	ErrAccountUnavailable = errors.New("account is not available")
+	ErrTooManyAttempts    = errors.New("too many login attempts")
 )
 
+// ThrottledError is a login refused after too many failures, before the
+// password was even checked. It may be tried again after RetryAfter.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrTooManyAttempts, e.RetryAfter)
+}
+
+func (e *ThrottledError) Is(target error) bool {
+	return target == ErrTooManyAttempts
+}
+
+// RetryAfterSeconds is RetryAfter in whole seconds, rounded up so a client
+// waiting that long is not turned away again.
+func (e *ThrottledError) RetryAfterSeconds() int {
+	return int((e.RetryAfter + time.Second - 1) / time.Second)
+}
+
+// LoginOutcome names what came of a login that returned err for metrics:
+// success, or the reason it failed.
+func LoginOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case errors.Is(err, ErrTooManyAttempts):
+		return "throttled"
+	case errors.Is(err, ErrInvalidCredentials):
+		return "invalid_credentials"
+	case errors.Is(err, ErrUserDisabled):
+		return "disabled"
+	case errors.Is(err, ErrUserLocked):
+		return "locked"
+	case errors.Is(err, ErrUserDeleted):
+		return "deleted"
+	case errors.Is(err, storage.ErrAppNotFound):
+		return "invalid_app"
+	}
+	return "error"
+}
+
+// checkStatus returns the error a login by a user with status fails with,
+// nil for active users. Every status error matches ErrAccountUnavailable,
+// so transports answer them alike but for ErrUserDeleted.
+func checkStatus(status models.UserStatus) error {
+	var err error
+	switch status {
+	case models.UserStatusActive:
+		return nil
+	case models.UserStatusDisabled:
+		err = ErrUserDisabled
+	case models.UserStatusLocked:
+		err = ErrUserLocked
+	case models.UserStatusDeleted:
+		err = ErrUserDeleted
+	default:
+		err = fmt.Errorf("unknown user status %q", status)
+	}
+	return fmt.Errorf("%w: %w", ErrAccountUnavailable, err)
+}
+
 func New(
 	log *slog.Logger,
 	userProvider UserProvider,
 	appProvider AppProvider,
 	userSaver UserSaver,
+	hasher PasswordHasher,
+	policy PasswordPolicy,
+	throttle LoginThrottle,
+	notifier notify.Notifier,
+	metrics Metrics,
 	tokenTTL time.Duration,
 ) *Auth {
 	return &Auth{
@@ -57,6 +186,11 @@ func New(
 		usrProvider: userProvider,
 		log:         log,
 		appProvider: appProvider,
+		hasher:      hasher,
+		policy:      policy,
+		throttle:    throttle,
+		notifier:    notifier,
+		metrics:     metrics,
 		tokenTTL:    tokenTTL,
 	}
 }
@@ -65,79 +199,253 @@ func (a *Auth) Login(
 	ctx context.Context,
 	email string,
 	password string,
-	appID int32) (string, error) {
+	appID int32,
+	clientIP string,
+) (_ string, err error) {
 
 	const op = "auth.Login"
+	ctx, span := tracer.Start(ctx, op)
+	defer func() { endSpan(span, err) }()
+	defer func() { a.metrics.LoginAttempt(LoginOutcome(err)) }()
+
 	log := a.log.With(
 		slog.String("op", op),
 		slog.String("email", email),
 	)
 	log.Info("attempting to login user")
+
+	// an unknown app is the caller's mistake, it neither costs a hash
+	// nor counts as a failed login
+	app, err := a.appProvider.App(ctx, int64(appID))
+	if err != nil {
+		if !errors.Is(err, storage.ErrAppNotFound) {
+			log.Error("failed to get app", slog.String("error", err.Error()))
+		}
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	attempt, err := a.CheckAttempt(ctx, email, clientIP)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	// a login cut short by anything but the password is not counted
+	defer a.cancelAttempt(ctx, attempt)
+
 	user, err := a.usrProvider.User(ctx, email)
 	if err != nil {
 		if errors.Is(err, storage.ErrUserNotFound) {
-			a.log.Warn("user not found", err.Error())
+			a.log.Warn("user not found", slog.String("error", err.Error()))
+			// spend the time a wrong password would, so the response does
+			// not tell whether the email is registered
+			a.hasher.VerifyDummy(ctx, password)
+			a.LoginFailed(ctx, attempt, email, clientIP, false)
 			return "", fmt.Errorf("%s: %w", op, ErrInvalidCredentials)
 		}
-		a.log.Error("failed to login", err.Error())
+		a.log.Error("failed to login", slog.String("error", err.Error()))
 		return "", fmt.Errorf("%s: %w", op, err)
 	}
 
-	if err := bcrypt.CompareHashAndPassword(user.PassHash, []byte(password)); err != nil {
-		a.log.Info("invalid credentials", err.Error())
+	if err := a.hasher.Verify(ctx, user.PassHash, user.PepperVersion, password); err != nil {
+		if errors.Is(err, passhash.ErrUnknownPepper) {
+			// the pepper was retired while this user still had it
+			log.Error("password hash made with an unknown pepper", slog.String("error", err.Error()))
+		} else {
+			a.log.Info("invalid credentials", slog.String("error", err.Error()))
+		}
+		a.LoginFailed(ctx, attempt, email, clientIP, true)
 		return "", fmt.Errorf("%s: %w", op, ErrInvalidCredentials)
 	}
 
-	app, errr := a.appProvider.App(ctx, int64(appID))
-	if errr != nil {
+	// checked after the password, so the status is not revealed to anyone
+	// who does not know it
+	if err := checkStatus(user.Status); err != nil {
+		log.Warn("login rejected", slog.String("status", string(user.Status)))
 		return "", fmt.Errorf("%s: %w", op, err)
 	}
 
 	log.Info("user successfully logged in")
+	a.LoginSucceeded(ctx, attempt)
+	a.UpgradeHash(ctx, user, password)
 
 	token, err := jwt.NewToken(user, app, a.tokenTTL)
 	if err != nil {
-		a.log.Error("failed to create token", err.Error())
+		a.log.Error("failed to create token", slog.String("error", err.Error()))
 		return "", fmt.Errorf("%s: %w", op, err)
 	}
+	a.metrics.TokenIssued(app.ID)
 	return token, nil
 }
 
+// CheckAttempt reserves a login to the account from clientIP, or returns a
+// *ThrottledError when it has to wait. Logins go through uncounted when
+// the counters cannot be reached, rather than locking everybody out.
+func (a *Auth) CheckAttempt(ctx context.Context, email string, clientIP string) (*attempts.Attempt, error) {
+	const op = "auth.CheckAttempt"
+	ctx, span := tracer.Start(ctx, op)
+	defer span.End()
+
+	attempt, wait, err := a.throttle.Begin(ctx, email, clientIP)
+	if err != nil {
+		a.log.Error("failed to count login attempt", slog.String("op", op), slog.String("error", err.Error()))
+		return nil, nil
+	}
+	if wait > 0 {
+		a.log.Warn("login throttled",
+			slog.String("op", op),
+			slog.String("email", email),
+			slog.String("client_ip", clientIP),
+			slog.Duration("retry_after", wait),
+		)
+		return nil, &ThrottledError{RetryAfter: wait}
+	}
+	return attempt, nil
+}
+
+// LoginFailed keeps the attempt counted as a failed login and tells the
+// user when it locked their account. exists is false for an email no
+// account has, nobody is told then.
+func (a *Auth) LoginFailed(ctx context.Context, attempt *attempts.Attempt, email string, clientIP string, exists bool) {
+	const op = "auth.LoginFailed"
+	ctx, span := tracer.Start(ctx, op)
+	defer span.End()
+	log := a.log.With(slog.String("op", op), slog.String("email", email))
+
+	if !a.throttle.Fail(attempt) {
+		return
+	}
+
+	log.Warn("account locked out after failed logins", slog.String("client_ip", clientIP))
+	if !exists {
+		return
+	}
+	err := a.notifier.Notify(ctx, email,
+		"Your account is temporarily locked",
+		"Signing in to your account was locked for a while after repeated failed attempts. "+
+			"If these were not you, someone may be guessing your password, consider changing it.",
+	)
+	if err != nil {
+		log.Error("failed to send lockout notice", slog.String("error", err.Error()))
+	}
+}
+
+// LoginSucceeded forgets the failed logins to the account.
+func (a *Auth) LoginSucceeded(ctx context.Context, attempt *attempts.Attempt) {
+	ctx, span := tracer.Start(ctx, "auth.LoginSucceeded")
+	defer span.End()
+
+	if err := a.throttle.Succeed(context.WithoutCancel(ctx), attempt); err != nil {
+		a.log.Error("failed to reset login failures",
+			slog.String("op", "auth.LoginSucceeded"),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// cancelAttempt takes back an attempt that neither failed nor succeeded.
+// It runs even when the caller went away, or the attempt would stay
+// counted as a failure.
+func (a *Auth) cancelAttempt(ctx context.Context, attempt *attempts.Attempt) {
+	if err := a.throttle.Cancel(context.WithoutCancel(ctx), attempt); err != nil {
+		a.log.Error("failed to take back login attempt",
+			slog.String("op", "auth.Login"),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// UpgradeHash rehashes the password of a user who just logged in when
+// their hash was made with an outdated algorithm, parameters or pepper. It
+// runs in the background, the login does not wait for it, in a trace of
+// its own linked to the span of ctx.
+func (a *Auth) UpgradeHash(ctx context.Context, user models.User, password string) {
+	if !a.hasher.NeedsRehash(user.PassHash, user.PepperVersion) {
+		return
+	}
+
+	link := trace.LinkFromContext(ctx)
+	a.upgrades.Add(1)
+	go func() {
+		defer a.upgrades.Done()
+
+		const op = "auth.UpgradeHash"
+		log := a.log.With(slog.String("op", op), slog.Int64("user_id", user.ID))
+
+		ctx, cancel := context.WithTimeout(context.Background(), rehashTimeout)
+		defer cancel()
+
+		ctx, span := tracer.Start(ctx, op, trace.WithLinks(link))
+		defer span.End()
+
+		newHash, pepperVersion, err := a.hasher.Hash(ctx, password)
+		if err != nil {
+			log.Error("failed to hash password", slog.String("error", err.Error()))
+			return
+		}
+		if err := a.usrSaver.UpdatePassHash(ctx, user.ID, user.PassHash, newHash, pepperVersion); err != nil {
+			if errors.Is(err, storage.ErrUserNotFound) {
+				// the password changed meanwhile, its new hash is current
+				return
+			}
+			log.Error("failed to save upgraded hash", slog.String("error", err.Error()))
+			return
+		}
+		log.Info("password hash upgraded")
+	}()
+}
+
+// Wait blocks until the hash upgrades running in the background are done,
+// so they are not cut off by closing the storage on shutdown.
+func (a *Auth) Wait() {
+	a.upgrades.Wait()
+}
+
 func (a *Auth) RegisterNewUser(
 	ctx context.Context,
 	email string,
 	name string,
 	password string,
-) (int64, error) {
+) (_ int64, err error) {
 	const op = "auth.RegisterNewUser"
+	ctx, span := tracer.Start(ctx, op)
+	defer func() { endSpan(span, err) }()
+
 	log := a.log.With(
 		slog.String("op", op),
 		slog.String("email", email),
 	)
 	log.Info("registering new user")
 
-	passHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err := a.policy.Check(password, email, name); err != nil {
+		log.Info("password rejected by policy", slog.String("error", err.Error()))
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	passHash, pepperVersion, err := a.hasher.Hash(ctx, password)
 	if err != nil {
-		log.Error("failed to hash password", err.Error())
-		return 0, fmt.Errorf("%w: %s", op, err)
+		log.Error("failed to hash password", slog.String("error", err.Error()))
+		return 0, fmt.Errorf("%s: %w", op, err)
 	}
-	log.Info(string(passHash))
-	id, err := a.usrSaver.SaveUser(ctx, email, name, passHash)
+
+	id, err := a.usrSaver.SaveUser(ctx, email, name, passHash, pepperVersion)
 	if err != nil {
 		if errors.Is(err, storage.ErrUserExists) {
-			log.Warn("user already exists", err.Error())
+			log.Warn("user already exists", slog.String("error", err.Error()))
 			return 0, fmt.Errorf("%s: %w", op, ErrUserExists)
 		}
-		log.Error("failed to save user", err.Error())
-		return 0, fmt.Errorf("%w: %s", op, err)
+		log.Error("failed to save user", slog.String("error", err.Error()))
+		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 
 	log.Info("successfully registred user")
+	a.metrics.UserRegistered()
 	return int64(id), nil
 }
 
-func (a *Auth) IsAdmin(ctx context.Context, userID int64) (bool, error) {
+func (a *Auth) IsAdmin(ctx context.Context, userID int64) (_ bool, err error) {
 	const op = "auth.IsAdmin"
+	ctx, span := tracer.Start(ctx, op)
+	defer func() { endSpan(span, err) }()
+
 	log := a.log.With(
 		slog.String("op", op),
 		slog.String("userID", fmt.Sprint(userID)))
@@ -146,7 +454,7 @@ func (a *Auth) IsAdmin(ctx context.Context, userID int64) (bool, error) {
 	isAdmin, err := a.usrProvider.IsAdmin(ctx, userID)
 	if err != nil {
 		if errors.Is(err, storage.ErrUserNotFound) {
-			log.Warn("user not found", ErrInvalidAppId)
+			log.Warn("user not found", slog.String("error", err.Error()))
 		}
 		return false, fmt.Errorf("%s: %w", op, err)
 	}
@@ -154,3 +462,12 @@ func (a *Auth) IsAdmin(ctx context.Context, userID int64) (bool, error) {
 
 	return isAdmin, nil
 }
+
+// endSpan marks the span failed with err, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
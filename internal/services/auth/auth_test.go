@@ -0,0 +1,437 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sso/internal/domain/models"
+	"sso/internal/lib/attempts"
+	"sso/internal/lib/metrics"
+	"sso/internal/lib/passhash"
+	"sso/internal/lib/passhash/passhashtest"
+	"sso/internal/lib/passpolicy"
+	"sso/internal/storage"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type fakeUsers struct {
+	users map[string]models.User
+}
+
+// usersOf returns a store holding users.
+func usersOf(users ...models.User) fakeUsers {
+	f := fakeUsers{users: make(map[string]models.User)}
+	for _, user := range users {
+		f.users[user.Email] = user
+	}
+	return f
+}
+
+func (f fakeUsers) User(_ context.Context, email string) (models.User, error) {
+	user, ok := f.users[email]
+	if !ok {
+		return models.User{}, storage.ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (f fakeUsers) IsAdmin(context.Context, int64) (bool, error) { return false, nil }
+
+func (f fakeUsers) App(_ context.Context, appID int64) (models.App, error) {
+	return models.App{ID: int(appID), Name: "test", Secret: "secret"}, nil
+}
+
+func (f fakeUsers) SaveUser(context.Context, string, string, []byte, int) (int, error) { return 0, nil }
+
+func (f fakeUsers) UpdatePassHash(context.Context, int64, []byte, []byte, int) error { return nil }
+
+type noThrottle struct{}
+
+func (noThrottle) Begin(context.Context, string, string) (*attempts.Attempt, time.Duration, error) {
+	return nil, 0, nil
+}
+func (noThrottle) Fail(*attempts.Attempt) bool                      { return false }
+func (noThrottle) Succeed(context.Context, *attempts.Attempt) error { return nil }
+func (noThrottle) Cancel(context.Context, *attempts.Attempt) error  { return nil }
+
+type noNotifier struct{}
+
+func (noNotifier) Notify(context.Context, string, string, string) error { return nil }
+
+// TestLoginTiming checks that a login to an email nobody registered takes
+// as long as one with a wrong password, comparing the medians of
+// interleaved samples.
+func TestLoginTiming(t *testing.T) {
+	if testing.Short() {
+		t.Skip("timing test")
+	}
+
+	params := passhashtest.Params
+	params.Argon2.Memory, params.Argon2.Time = 4*1024, 2
+	hasher := passhashtest.NewHasher(t, params)
+	users := usersOf(passhashtest.User(t, hasher))
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	a := New(log, users, users, users, passhash.Traced(hasher), nil, noThrottle{}, noNotifier{}, metrics.New(), time.Hour)
+
+	login := func(email string) time.Duration {
+		start := time.Now()
+		_, err := a.Login(context.Background(), email, "wrong-password", 1, "192.0.2.1")
+		elapsed := time.Since(start)
+		if !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("Login(%s) = %v, want ErrInvalidCredentials", email, err)
+		}
+		return elapsed
+	}
+
+	const samples = 30
+	var known, unknown []time.Duration
+	for range samples {
+		known = append(known, login("alice@example.com"))
+		unknown = append(unknown, login("nobody@example.com"))
+	}
+
+	ratio := float64(median(unknown)) / float64(median(known))
+	if ratio < 0.75 || ratio > 1.33 {
+		t.Fatalf("median login to an unknown email took %v, with a wrong password %v", median(unknown), median(known))
+	}
+}
+
+func median(d []time.Duration) time.Duration {
+	sorted := slices.Clone(d)
+	slices.Sort(sorted)
+	return sorted[len(sorted)/2]
+}
+
+// TestLogNoSecrets scans the log of a registration and of logins for the
+// password, its hash and the token, with no redaction in front of the log.
+func TestLogNoSecrets(t *testing.T) {
+	const password = passhashtest.Password
+
+	hasher := passhashtest.NewHasher(t, passhashtest.Params)
+	alice := passhashtest.User(t, hasher)
+	users := usersOf(alice)
+
+	var buf bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	a := New(log, users, users, users, passhash.Traced(hasher), &passpolicy.Policy{}, noThrottle{}, noNotifier{}, metrics.New(), time.Hour)
+
+	ctx := context.Background()
+	if _, err := a.RegisterNewUser(ctx, "bob@example.com", "Bob", password); err != nil {
+		t.Fatalf("RegisterNewUser: %v", err)
+	}
+	_, _ = a.Login(ctx, "alice@example.com", password+"x", 1, "192.0.2.1")
+	_, _ = a.Login(ctx, "nobody@example.com", password, 1, "192.0.2.1")
+	token, err := a.Login(ctx, "alice@example.com", password, 1, "192.0.2.1")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	out := buf.String()
+	for _, secret := range []string{password, string(alice.PassHash), "$argon2id$", token} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log contains %q:\n%s", secret, out)
+		}
+	}
+}
+
+var (
+	spanRecorder = tracetest.NewSpanRecorder()
+	installTrace sync.Once
+)
+
+// recordSpans returns the recorder of the spans started from now on. The
+// tracers of the packages under test are bound to the first provider set,
+// so one is set for all tests.
+func recordSpans(*testing.T) *tracetest.SpanRecorder {
+	installTrace.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	})
+	spanRecorder.Reset()
+	return spanRecorder
+}
+
+// endedSpans are the spans recorder saw end, by name.
+func endedSpans(recorder *tracetest.SpanRecorder) map[string]sdktrace.ReadOnlySpan {
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	return spans
+}
+
+// TestLoginSpans checks that a login continues the caller's trace, with
+// the password check in a span of its own.
+func TestLoginSpans(t *testing.T) {
+	recorder := recordSpans(t)
+
+	hasher := passhashtest.NewHasher(t, passhashtest.Params)
+	users := usersOf(passhashtest.User(t, hasher))
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	a := New(log, users, users, users, passhash.Traced(hasher), nil, noThrottle{}, noNotifier{}, metrics.New(), time.Hour)
+
+	caller := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{1},
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), caller)
+	if _, err := a.Login(ctx, "alice@example.com", "wrong-password", 1, "192.0.2.1"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Login = %v, want ErrInvalidCredentials", err)
+	}
+
+	spans := endedSpans(recorder)
+	login, ok := spans["auth.Login"]
+	if !ok {
+		t.Fatalf("no auth.Login span among %v", slices.Collect(maps.Keys(spans)))
+	}
+	if login.Parent().SpanID() != caller.SpanID() || login.SpanContext().TraceID() != caller.TraceID() {
+		t.Errorf("auth.Login span is not a child of the caller's span")
+	}
+	if login.Status().Code != codes.Error {
+		t.Errorf("auth.Login span status = %v, want Error", login.Status().Code)
+	}
+	for _, name := range []string{"auth.CheckAttempt", "passhash.Verify", "auth.LoginFailed"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if span.Parent().SpanID() != login.SpanContext().SpanID() {
+			t.Errorf("%s span is not a child of auth.Login", name)
+		}
+	}
+}
+
+// slowSaver records the upgraded hash after a delay, standing in for a
+// slow database.
+type slowSaver struct {
+	fakeUsers
+	saved []byte
+}
+
+func (s *slowSaver) UpdatePassHash(_ context.Context, _ int64, _ []byte, newHash []byte, _ int) error {
+	time.Sleep(50 * time.Millisecond)
+	s.saved = newHash
+	return nil
+}
+
+func TestWaitForHashUpgrade(t *testing.T) {
+	alice := passhashtest.User(t, passhashtest.NewHasher(t, passhashtest.Params))
+	params := passhashtest.Params
+	params.Argon2.Time = 2
+	hasher := passhashtest.NewHasher(t, params)
+
+	users := &slowSaver{fakeUsers: usersOf(alice)}
+	a := New(slog.New(slog.DiscardHandler), users, users, users, passhash.Traced(hasher), nil, noThrottle{}, noNotifier{}, metrics.New(), time.Hour)
+
+	if _, err := a.Login(context.Background(), "alice@example.com", passhashtest.Password, 1, "192.0.2.1"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	a.Wait()
+	if users.saved == nil {
+		t.Fatal("Wait returned before the hash upgrade was saved")
+	}
+	if hasher.NeedsRehash(users.saved, alice.PepperVersion) {
+		t.Errorf("the saved hash still needs a rehash")
+	}
+}
+
+// TestUpgradeHashSpan checks that a hash upgrade, outliving the login,
+// is traced on its own but linked to the login.
+func TestUpgradeHashSpan(t *testing.T) {
+	recorder := recordSpans(t)
+
+	alice := passhashtest.User(t, passhashtest.NewHasher(t, passhashtest.Params))
+	params := passhashtest.Params
+	params.Argon2.Time = 2
+	hasher := passhashtest.NewHasher(t, params)
+	users := usersOf(alice)
+	a := New(slog.New(slog.DiscardHandler), users, users, users, passhash.Traced(hasher), nil, noThrottle{}, noNotifier{}, metrics.New(), time.Hour)
+
+	if _, err := a.Login(context.Background(), "alice@example.com", passhashtest.Password, 1, ""); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	a.Wait()
+
+	spans := endedSpans(recorder)
+	login, upgrade, hash := spans["auth.Login"], spans["auth.UpgradeHash"], spans["passhash.Hash"]
+	if login == nil || upgrade == nil || hash == nil {
+		t.Fatalf("spans %v, want auth.Login, auth.UpgradeHash and passhash.Hash", slices.Collect(maps.Keys(spans)))
+	}
+	if upgrade.Parent().IsValid() || upgrade.SpanContext().TraceID() == login.SpanContext().TraceID() {
+		t.Errorf("auth.UpgradeHash span is in the trace of the login")
+	}
+	if links := upgrade.Links(); len(links) != 1 || !links[0].SpanContext.Equal(login.SpanContext()) {
+		t.Errorf("auth.UpgradeHash links %v, want the auth.Login span", links)
+	}
+	if hash.Parent().SpanID() != upgrade.SpanContext().SpanID() {
+		t.Errorf("passhash.Hash span is not a child of auth.UpgradeHash")
+	}
+}
+
+// countingNotifier counts the notices sent.
+type countingNotifier struct {
+	mu   sync.Mutex
+	sent int
+}
+
+func (n *countingNotifier) Notify(context.Context, string, string, string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent++
+	return nil
+}
+
+// TestConcurrentFailedLogins fires wrong passwords at one account at once.
+// No more of them may be checked than the lockout allows, however they
+// interleave.
+func TestConcurrentFailedLogins(t *testing.T) {
+	hasher := passhashtest.NewHasher(t, passhashtest.Params)
+	users := usersOf(passhashtest.User(t, hasher))
+	guard := attempts.NewGuard(attempts.NewMemoryStore(), attempts.Policy{
+		Account:         attempts.Limits{Free: 3, Lockout: 3},
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Second,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	})
+	notifier := &countingNotifier{}
+	a := New(slog.New(slog.DiscardHandler), users, users, users, passhash.Traced(hasher), nil, guard, notifier, metrics.New(), time.Hour)
+
+	const logins = 20
+	errs := make(chan error, logins)
+	var wg sync.WaitGroup
+	for range logins {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := a.Login(context.Background(), "alice@example.com", "wrong-password", 1, "")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	var invalid, throttled int
+	for err := range errs {
+		switch {
+		case errors.Is(err, ErrInvalidCredentials):
+			invalid++
+		case errors.Is(err, ErrTooManyAttempts):
+			throttled++
+		default:
+			t.Errorf("Login = %v", err)
+		}
+	}
+	if invalid != 3 || throttled != logins-3 {
+		t.Fatalf("%d wrong passwords checked and %d throttled, want 3 and %d", invalid, throttled, logins-3)
+	}
+	if notifier.sent != 1 {
+		t.Errorf("sent %d lockout notices, want 1", notifier.sent)
+	}
+
+	// the right password does not get through the lockout either
+	_, err := a.Login(context.Background(), "alice@example.com", passhashtest.Password, 1, "")
+	var te *ThrottledError
+	if !errors.As(err, &te) || te.RetryAfter <= 14*time.Minute {
+		t.Fatalf("Login with the right password = %v, want the lockout", err)
+	}
+}
+
+// TestLoginStatus logs in to accounts of every status. The right password
+// gets a refusal that matches ErrAccountUnavailable and, for logs and
+// metrics, the status, a wrong one the usual ErrInvalidCredentials.
+func TestLoginStatus(t *testing.T) {
+	hasher := passhashtest.NewHasher(t, passhashtest.Params)
+
+	tests := []struct {
+		status      models.UserStatus
+		wantErr     error
+		wantOutcome string
+	}{
+		{models.UserStatusActive, nil, "success"},
+		{models.UserStatusDisabled, ErrUserDisabled, "disabled"},
+		{models.UserStatusLocked, ErrUserLocked, "locked"},
+		{models.UserStatusDeleted, ErrUserDeleted, "deleted"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.status), func(t *testing.T) {
+			alice := passhashtest.User(t, hasher)
+			alice.Status = tt.status
+			users := usersOf(alice)
+			a := New(slog.New(slog.DiscardHandler), users, users, users, passhash.Traced(hasher), nil, noThrottle{}, noNotifier{}, metrics.New(), time.Hour)
+
+			_, err := a.Login(context.Background(), "alice@example.com", passhashtest.Password, 1, "")
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Login = %v", err)
+				}
+			} else if !errors.Is(err, ErrAccountUnavailable) || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Login = %v, want ErrAccountUnavailable and %v", err, tt.wantErr)
+			}
+			if got := LoginOutcome(err); got != tt.wantOutcome {
+				t.Errorf("LoginOutcome = %s, want %s", got, tt.wantOutcome)
+			}
+
+			_, err = a.Login(context.Background(), "alice@example.com", "wrong-password", 1, "")
+			if !errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrAccountUnavailable) {
+				t.Errorf("Login with a wrong password = %v, want ErrInvalidCredentials only", err)
+			}
+		})
+	}
+}
+
+// noApps knows the users but no app.
+type noApps struct {
+	fakeUsers
+}
+
+func (noApps) App(context.Context, int64) (models.App, error) {
+	return models.App{}, storage.ErrAppNotFound
+}
+
+// TestLoginUnknownApp checks that a login to an unknown app is refused
+// before the password is checked, so it does not count as a failed login.
+func TestLoginUnknownApp(t *testing.T) {
+	hasher := passhashtest.NewHasher(t, passhashtest.Params)
+	users := usersOf(passhashtest.User(t, hasher))
+	store := attempts.NewMemoryStore()
+	policy := attempts.Policy{
+		Account:         attempts.Limits{Free: 1, Lockout: 1},
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Second,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	}
+	a := New(slog.New(slog.DiscardHandler), users, noApps{users}, users, passhash.Traced(hasher), nil,
+		attempts.NewGuard(store, policy), noNotifier{}, metrics.New(), time.Hour)
+
+	for range 3 {
+		_, err := a.Login(context.Background(), "alice@example.com", "wrong-password", 42, "")
+		if !errors.Is(err, storage.ErrAppNotFound) {
+			t.Fatalf("Login to an unknown app = %v, want ErrAppNotFound", err)
+		}
+	}
+
+	// one counted failure would have locked the account out
+	a = New(slog.New(slog.DiscardHandler), users, users, users, passhash.Traced(hasher), nil,
+		attempts.NewGuard(store, policy), noNotifier{}, metrics.New(), time.Hour)
+	if _, err := a.Login(context.Background(), "alice@example.com", passhashtest.Password, 1, ""); err != nil {
+		t.Fatalf("Login after logins to an unknown app = %v", err)
+	}
+}
@@ -0,0 +1,286 @@
+// Package bulk imports and exports users in batches, password hashes
+// included, for migrating users in from another system. Callers are
+// trusted, authorization is up to the admin service or the operator
+// running the CLI.
+package bulk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/mail"
+	"sso/internal/domain/models"
+	"sso/internal/lib/passhash"
+	"sso/internal/lib/userfile"
+	"sso/internal/storage"
+	"time"
+)
+
+type Bulk struct {
+	log     *slog.Logger
+	storage Storage
+	hasher  PasswordHasher
+}
+
+type PasswordHasher interface {
+	Hash(password string) (hash []byte, pepperVersion int, err error)
+}
+
+type Storage interface {
+	ImportUsers(ctx context.Context, users []models.PortableUser, dryRun bool) ([]models.ImportResult, error)
+	ExportUsers(ctx context.Context, afterID int64, limit int) ([]models.PortableUser, error)
+}
+
+var (
+	ErrInvalidRow = errors.New("invalid row")
+	ErrUserExists = errors.New("user already exists")
+)
+
+const (
+	DefaultBatchSize = 500
+	MaxBatchSize     = 5000
+
+	exportPageSize = 1000
+)
+
+type ImportOptions struct {
+	// DryRun validates and inserts every batch but commits none of them.
+	// Duplicates are only caught within a batch and against users already
+	// stored, not across batches.
+	DryRun    bool
+	BatchSize int
+}
+
+// Result is the outcome of one row. Row counts from 1 in input order, UserID
+// is zero when Err is set and on dry runs.
+type Result struct {
+	Row    int
+	Email  string
+	UserID int64
+	Err    error
+}
+
+type Summary struct {
+	Imported int
+	Existing int
+	Invalid  int
+}
+
+func New(log *slog.Logger, storage Storage, hasher PasswordHasher) *Bulk {
+	return &Bulk{log: log, storage: storage, hasher: hasher}
+}
+
+// Import reads rows from next until it returns io.EOF and inserts them in
+// batches, one transaction each. A *userfile.RowError from next marks that
+// row invalid, any other error stops the import. report is called for every
+// row, in order, once its batch is written; an error from it stops the
+// import too. Batches written before a stop stay committed.
+func (b *Bulk) Import(
+	ctx context.Context,
+	next func() (userfile.Record, error),
+	opts ImportOptions,
+	report func(Result) error,
+) (Summary, error) {
+	const op = "bulk.Import"
+	log := b.log.With(slog.String("op", op), slog.Bool("dry_run", opts.DryRun))
+
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	batchSize = min(batchSize, MaxBatchSize)
+
+	var (
+		summary Summary
+		// pending holds the results of the batch in input order, rows
+		// refer to users by index
+		pending []Result
+		users   []models.PortableUser
+		rows    []int
+	)
+
+	flush := func() error {
+		if len(users) > 0 {
+			results, err := b.storage.ImportUsers(ctx, users, opts.DryRun)
+			if err != nil {
+				return err
+			}
+			for i, res := range results {
+				r := &pending[rows[i]]
+				switch {
+				case errors.Is(res.Err, storage.ErrUserExists):
+					r.Err = ErrUserExists
+				case res.Err != nil:
+					r.Err = res.Err
+				case !opts.DryRun:
+					r.UserID = res.ID
+				}
+			}
+		}
+
+		for _, r := range pending {
+			switch {
+			case errors.Is(r.Err, ErrInvalidRow):
+				summary.Invalid++
+			case errors.Is(r.Err, ErrUserExists):
+				summary.Existing++
+			default:
+				summary.Imported++
+			}
+			if err := report(r); err != nil {
+				return err
+			}
+		}
+		pending, users, rows = pending[:0], users[:0], rows[:0]
+		return nil
+	}
+
+	now := time.Now()
+	for row := 1; ; row++ {
+		if err := ctx.Err(); err != nil {
+			return summary, fmt.Errorf("%s: %w", op, err)
+		}
+
+		rec, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var rowErr *userfile.RowError
+		switch {
+		case errors.As(err, &rowErr):
+			pending = append(pending, Result{Row: row, Err: fmt.Errorf("%w: %s", ErrInvalidRow, rowErr)})
+		case err != nil:
+			return summary, fmt.Errorf("%s: %w", op, err)
+		default:
+			user, err := b.toPortable(rec, now)
+			if err != nil {
+				pending = append(pending, Result{Row: row, Email: rec.Email, Err: err})
+				break
+			}
+			rows = append(rows, len(pending))
+			pending = append(pending, Result{Row: row, Email: user.Email})
+			users = append(users, user)
+		}
+
+		if len(pending) == batchSize {
+			if err := flush(); err != nil {
+				return summary, fmt.Errorf("%s: %w", op, err)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return summary, fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("users imported",
+		slog.Int("imported", summary.Imported),
+		slog.Int("existing", summary.Existing),
+		slog.Int("invalid", summary.Invalid),
+	)
+	return summary, nil
+}
+
+// toPortable validates a row. A known password hash is stored as is, a
+// plaintext password is hashed the way Register does.
+func (b *Bulk) toPortable(rec userfile.Record, now time.Time) (models.PortableUser, error) {
+	addr, err := mail.ParseAddress(rec.Email)
+	if err != nil || addr.Address != rec.Email {
+		return models.PortableUser{}, fmt.Errorf("%w: invalid email %q", ErrInvalidRow, rec.Email)
+	}
+	if rec.Name == "" {
+		return models.PortableUser{}, fmt.Errorf("%w: name is required", ErrInvalidRow)
+	}
+
+	var (
+		passHash      []byte
+		pepperVersion int
+	)
+	switch {
+	case rec.Password != "" && (rec.PasswordHash != "" || rec.PepperVersion != 0):
+		return models.PortableUser{}, fmt.Errorf("%w: set either password_hash, with its pepper_version, or password, not both", ErrInvalidRow)
+	case rec.PasswordHash != "":
+		passHash = []byte(rec.PasswordHash)
+		if _, err := passhash.Identify(passHash); err != nil {
+			return models.PortableUser{}, fmt.Errorf("%w: password_hash: %s", ErrInvalidRow, err)
+		}
+		if rec.PepperVersion < 0 {
+			return models.PortableUser{}, fmt.Errorf("%w: invalid pepper_version %d", ErrInvalidRow, rec.PepperVersion)
+		}
+		pepperVersion = rec.PepperVersion
+	case rec.Password != "":
+		passHash, pepperVersion, err = b.hasher.Hash(rec.Password)
+		if err != nil {
+			return models.PortableUser{}, fmt.Errorf("%w: password: %s", ErrInvalidRow, err)
+		}
+	default:
+		return models.PortableUser{}, fmt.Errorf("%w: password_hash or password is required", ErrInvalidRow)
+	}
+
+	status := models.UserStatusActive
+	if rec.Status != "" {
+		status = models.UserStatus(rec.Status)
+		if !status.Valid() {
+			return models.PortableUser{}, fmt.Errorf("%w: invalid status %q", ErrInvalidRow, rec.Status)
+		}
+	}
+
+	createdAt := now
+	if rec.CreatedAt != nil {
+		createdAt = *rec.CreatedAt
+	}
+
+	return models.PortableUser{
+		Email:         rec.Email,
+		Name:          rec.Name,
+		PassHash:      passHash,
+		PepperVersion: pepperVersion,
+		EmailVerified: rec.EmailVerified,
+		Status:        status,
+		CreatedAt:     createdAt,
+	}, nil
+}
+
+// Export calls write for every user, ordered by id, and returns how many
+// were written.
+func (b *Bulk) Export(ctx context.Context, write func(userfile.Record) error) (int, error) {
+	const op = "bulk.Export"
+	log := b.log.With(slog.String("op", op))
+
+	var (
+		count  int
+		lastID int64
+	)
+	for {
+		users, err := b.storage.ExportUsers(ctx, lastID, exportPageSize)
+		if err != nil {
+			log.Error("failed to export users", slog.String("error", err.Error()))
+			return count, fmt.Errorf("%s: %w", op, err)
+		}
+		for _, u := range users {
+			createdAt := u.CreatedAt.UTC()
+			err := write(userfile.Record{
+				ID:            u.ID,
+				Email:         u.Email,
+				Name:          u.Name,
+				PasswordHash:  string(u.PassHash),
+				PepperVersion: u.PepperVersion,
+				EmailVerified: u.EmailVerified,
+				Status:        string(u.Status),
+				CreatedAt:     &createdAt,
+			})
+			if err != nil {
+				return count, fmt.Errorf("%s: %w", op, err)
+			}
+			count++
+		}
+		if len(users) < exportPageSize {
+			break
+		}
+		lastID = users[len(users)-1].ID
+	}
+
+	log.Info("users exported", slog.Int("count", count))
+	return count, nil
+}
@@ -0,0 +1,246 @@
+package bulk
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"sso/internal/domain/models"
+	"sso/internal/lib/passhash/passhashtest"
+	"sso/internal/lib/userfile"
+	"sso/internal/storage"
+)
+
+const bcryptHash = "$2a$04$Gm.DkSaCtVkMFEsrQzDK9OSV7CRwtUjMbn.XLscZCqu.Bu6m15Gta"
+
+// fakeStorage imports a batch all or nothing the way the storage backends
+// do, a dry run is rolled back.
+type fakeStorage struct {
+	users   []models.PortableUser
+	batches int
+}
+
+func (s *fakeStorage) ImportUsers(_ context.Context, users []models.PortableUser, dryRun bool) ([]models.ImportResult, error) {
+	s.batches++
+	stored := s.users
+	results := make([]models.ImportResult, len(users))
+	for i, u := range users {
+		if s.exists(stored, u.Email) {
+			results[i].Err = storage.ErrUserExists
+			continue
+		}
+		u.ID = int64(len(stored) + 1)
+		stored = append(stored, u)
+		results[i].ID = u.ID
+	}
+	if !dryRun {
+		s.users = stored
+	}
+	return results, nil
+}
+
+func (s *fakeStorage) exists(users []models.PortableUser, email string) bool {
+	for _, u := range users {
+		if u.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *fakeStorage) ExportUsers(_ context.Context, afterID int64, limit int) ([]models.PortableUser, error) {
+	var page []models.PortableUser
+	for _, u := range s.users {
+		if u.ID > afterID && len(page) < limit {
+			page = append(page, u)
+		}
+	}
+	return page, nil
+}
+
+// rows returns a next func for Import over recs and errs, a non-nil
+// errs[i] is returned in place of recs[i].
+func rows(recs []userfile.Record, errs []error) func() (userfile.Record, error) {
+	i := 0
+	return func() (userfile.Record, error) {
+		if i == len(recs) {
+			return userfile.Record{}, io.EOF
+		}
+		i++
+		if errs != nil && errs[i-1] != nil {
+			return userfile.Record{}, errs[i-1]
+		}
+		return recs[i-1], nil
+	}
+}
+
+func newTestBulk(s *fakeStorage) *Bulk {
+	return New(slog.New(slog.DiscardHandler), s, passhashtest.Hasher{PepperVersion: 3})
+}
+
+func TestImport(t *testing.T) {
+	s := &fakeStorage{users: []models.PortableUser{{ID: 1, Email: "taken@example.com"}}}
+	b := newTestBulk(s)
+
+	recs := []userfile.Record{
+		{Email: "alice@example.com", Name: "Alice", PasswordHash: bcryptHash, PepperVersion: 1, EmailVerified: true},
+		{Email: "bob@example.com", Name: "Bob", Password: "correct horse", Status: "disabled"},
+		{Email: "taken@example.com", Name: "Taken", Password: "pw"},
+		{Email: "not an email", Name: "X", Password: "pw"},
+		{},
+		{Email: "carol@example.com", Name: "Carol", PasswordHash: "md5:abc"},
+		{Email: "dave@example.com", Name: "Dave", Password: "pw", PasswordHash: bcryptHash},
+		{Email: "erin@example.com", Name: "Erin", Password: "pw", Status: "superuser"},
+		{Email: "alice@example.com", Name: "Alice again", Password: "pw"},
+	}
+	errs := make([]error, len(recs))
+	errs[4] = &userfile.RowError{Line: 6, Err: errors.New("bad row")}
+
+	var results []Result
+	summary, err := b.Import(context.Background(), rows(recs, errs), ImportOptions{BatchSize: 4}, func(r Result) error {
+		results = append(results, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+
+	if want := (Summary{Imported: 2, Existing: 2, Invalid: 5}); summary != want {
+		t.Errorf("summary = %+v, want %+v", summary, want)
+	}
+	if len(results) != len(recs) {
+		t.Fatalf("reported %d rows, want %d", len(results), len(recs))
+	}
+	for i, r := range results {
+		if r.Row != i+1 {
+			t.Errorf("result %d is for row %d, rows are reported in order", i, r.Row)
+		}
+	}
+	for _, i := range []int{3, 4, 5, 6, 7} {
+		if !errors.Is(results[i].Err, ErrInvalidRow) {
+			t.Errorf("row %d: err = %v, want ErrInvalidRow", i+1, results[i].Err)
+		}
+	}
+	// duplicates against stored users and against earlier batches
+	for _, i := range []int{2, 8} {
+		if !errors.Is(results[i].Err, ErrUserExists) {
+			t.Errorf("row %d: err = %v, want ErrUserExists", i+1, results[i].Err)
+		}
+	}
+	if results[0].UserID == 0 || results[1].UserID == 0 {
+		t.Errorf("imported rows have no user id: %+v, %+v", results[0], results[1])
+	}
+	// the second batch has only invalid rows, storage is not called for it
+	if s.batches != 2 {
+		t.Errorf("imported in %d batches, want 2", s.batches)
+	}
+
+	alice, bob := s.users[1], s.users[2]
+	if string(alice.PassHash) != bcryptHash || alice.PepperVersion != 1 || !alice.EmailVerified {
+		t.Errorf("a known hash is stored as is, got %+v", alice)
+	}
+	if string(bob.PassHash) != "hashed:correct horse" || bob.PepperVersion != 3 || bob.Status != models.UserStatusDisabled {
+		t.Errorf("a plaintext password is hashed on import, got %+v", bob)
+	}
+	if alice.Status != models.UserStatusActive || alice.CreatedAt.IsZero() {
+		t.Errorf("status and created_at default, got %+v", alice)
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	s := &fakeStorage{}
+	b := newTestBulk(s)
+
+	recs := []userfile.Record{
+		{Email: "alice@example.com", Name: "Alice", Password: "pw"},
+		{Email: "alice@example.com", Name: "Alice", Password: "pw"},
+		{Email: "bob@example.com", Name: "Bob"},
+	}
+	var results []Result
+	summary, err := b.Import(context.Background(), rows(recs, nil), ImportOptions{DryRun: true}, func(r Result) error {
+		results = append(results, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if want := (Summary{Imported: 1, Existing: 1, Invalid: 1}); summary != want {
+		t.Errorf("summary = %+v, want %+v", summary, want)
+	}
+	if len(s.users) != 0 {
+		t.Errorf("a dry run stored %d users", len(s.users))
+	}
+	if results[0].UserID != 0 {
+		t.Errorf("a dry run reported user id %d", results[0].UserID)
+	}
+}
+
+func TestImportStops(t *testing.T) {
+	recs := []userfile.Record{
+		{Email: "alice@example.com", Name: "Alice", Password: "pw"},
+		{Email: "bob@example.com", Name: "Bob", Password: "pw"},
+		{Email: "carol@example.com", Name: "Carol", Password: "pw"},
+	}
+	ctx := context.Background()
+
+	t.Run("read error", func(t *testing.T) {
+		s := &fakeStorage{}
+		readErr := errors.New("disk on fire")
+		_, err := newTestBulk(s).Import(ctx, rows(recs, []error{nil, nil, readErr}), ImportOptions{BatchSize: 2}, func(Result) error { return nil })
+		if !errors.Is(err, readErr) {
+			t.Fatalf("Import = %v, want the read error", err)
+		}
+		// batches written before the stop stay committed
+		if len(s.users) != 2 {
+			t.Errorf("stored %d users, want the 2 of the first batch", len(s.users))
+		}
+	})
+
+	t.Run("report error", func(t *testing.T) {
+		s := &fakeStorage{}
+		reportErr := errors.New("client went away")
+		_, err := newTestBulk(s).Import(ctx, rows(recs, nil), ImportOptions{BatchSize: 1}, func(Result) error { return reportErr })
+		if !errors.Is(err, reportErr) {
+			t.Fatalf("Import = %v, want the report error", err)
+		}
+		if s.batches != 1 {
+			t.Errorf("imported %d batches after the report failed, want 1", s.batches)
+		}
+	})
+}
+
+func TestExport(t *testing.T) {
+	s := &fakeStorage{}
+	for i := range exportPageSize + 5 {
+		s.users = append(s.users, models.PortableUser{
+			ID:            int64(i + 1),
+			Email:         "user@example.com",
+			PassHash:      []byte(bcryptHash),
+			PepperVersion: 2,
+			Status:        models.UserStatusActive,
+		})
+	}
+	b := newTestBulk(s)
+
+	var recs []userfile.Record
+	n, err := b.Export(context.Background(), func(rec userfile.Record) error {
+		recs = append(recs, rec)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if n != len(s.users) || len(recs) != len(s.users) {
+		t.Fatalf("exported %d (%d written), want %d", n, len(recs), len(s.users))
+	}
+	for i, rec := range recs {
+		if rec.ID != int64(i+1) {
+			t.Fatalf("record %d has id %d, want users ordered by id", i, rec.ID)
+		}
+	}
+	if rec := recs[0]; rec.PasswordHash != bcryptHash || rec.PepperVersion != 2 || rec.Status != "active" || rec.CreatedAt == nil {
+		t.Errorf("exported record = %+v", rec)
+	}
+}
@@ -0,0 +1,195 @@
+// Package gdpr answers data subject requests: it exports everything stored
+// about a user and erases it for good. Callers are trusted, authorization
+// is up to the admin service or the operator running the CLI.
+package gdpr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sso/internal/domain/models"
+	"sso/internal/storage"
+	"time"
+)
+
+type GDPR struct {
+	log     *slog.Logger
+	storage Storage
+}
+
+type Storage interface {
+	UserData(ctx context.Context, userID int64) (models.UserData, error)
+	EraseUser(ctx context.Context, tombstone models.ErasedUser) error
+	ErasedUser(ctx context.Context, userID int64) (models.ErasedUser, error)
+}
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserErased   = errors.New("user was erased")
+)
+
+// ArchiveVersion is bumped whenever the archive layout changes.
+const ArchiveVersion = 3
+
+// Archive is the export handed to the user, it covers everything Erase
+// removes. The service keeps no sessions (tokens are stateless JWTs), no
+// audit trail and no MFA enrollments, so there is nothing to export for
+// those. Failed logins counted by client address are not the user's and
+// those counted in memory are never stored, they are left out.
+type Archive struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+
+	Profile            ArchivedProfile        `json:"profile"`
+	Roles              []string               `json:"roles"`
+	Account            ArchivedAccount        `json:"account"`
+	EmailVerifications []ArchivedVerification `json:"pending_email_verifications"`
+	Groups             []ArchivedGroup        `json:"groups"`
+	ProvisionedBy      []ArchivedProvisioning `json:"provisioned_by"`
+	FailedLogins       *ArchivedFailedLogins  `json:"failed_logins,omitempty"`
+}
+
+type ArchivedProfile struct {
+	ID            int64  `json:"id"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+type ArchivedAccount struct {
+	Status          string     `json:"status"`
+	StatusReason    string     `json:"status_reason,omitempty"`
+	StatusChangedAt *time.Time `json:"status_changed_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// ArchivedVerification leaves out the token hash, it is a credential
+// rather than data about the user.
+type ArchivedVerification struct {
+	Email     string    `json:"email"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ArchivedGroup is a group the user was provisioned into over SCIM.
+type ArchivedGroup struct {
+	AppID int64  `json:"app_id"`
+	Name  string `json:"name"`
+}
+
+// ArchivedProvisioning is an app that provisioned the user over SCIM.
+type ArchivedProvisioning struct {
+	AppID int64 `json:"app_id"`
+}
+
+// ArchivedFailedLogins are the failed logins counted against the account
+// by the login throttle.
+type ArchivedFailedLogins struct {
+	Count         int       `json:"count"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+}
+
+func New(log *slog.Logger, storage Storage) *GDPR {
+	return &GDPR{log: log, storage: storage}
+}
+
+// Export returns the archive of everything stored about the user.
+func (g *GDPR) Export(ctx context.Context, userID int64) (Archive, error) {
+	const op = "gdpr.Export"
+	log := g.log.With(slog.String("op", op), slog.Int64("user_id", userID))
+
+	data, err := g.storage.UserData(ctx, userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return Archive{}, fmt.Errorf("%s: %w", op, g.missing(ctx, userID))
+		}
+		log.Error("failed to read user data", slog.String("error", err.Error()))
+		return Archive{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("user data exported")
+	return newArchive(data, time.Now()), nil
+}
+
+// Erase deletes the user and all their data in one transaction and leaves
+// a tombstone. erasedBy is the admin asking for it, zero for operators.
+func (g *GDPR) Erase(ctx context.Context, userID int64, erasedBy int64, reason string) error {
+	const op = "gdpr.Erase"
+	log := g.log.With(
+		slog.String("op", op),
+		slog.Int64("user_id", userID),
+		slog.Int64("erased_by", erasedBy),
+	)
+
+	err := g.storage.EraseUser(ctx, models.ErasedUser{
+		UserID:   userID,
+		ErasedBy: erasedBy,
+		Reason:   reason,
+		ErasedAt: time.Now(),
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return fmt.Errorf("%s: %w", op, g.missing(ctx, userID))
+		}
+		log.Error("failed to erase user", slog.String("error", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("user erased", slog.String("reason", reason))
+	return nil
+}
+
+// missing tells a user that never existed from one that was erased.
+func (g *GDPR) missing(ctx context.Context, userID int64) error {
+	if _, err := g.storage.ErasedUser(ctx, userID); err == nil {
+		return ErrUserErased
+	}
+	return ErrUserNotFound
+}
+
+func newArchive(data models.UserData, now time.Time) Archive {
+	u := data.User
+
+	archive := Archive{
+		Version:    ArchiveVersion,
+		ExportedAt: now.UTC(),
+		Profile: ArchivedProfile{
+			ID:            u.ID,
+			Name:          u.Name,
+			Email:         u.Email,
+			EmailVerified: u.EmailVerified,
+		},
+		Roles: []string{},
+		Account: ArchivedAccount{
+			Status:       string(u.Status),
+			StatusReason: u.StatusReason,
+			CreatedAt:    u.CreatedAt.UTC(),
+		},
+		EmailVerifications: []ArchivedVerification{},
+		Groups:             []ArchivedGroup{},
+		ProvisionedBy:      []ArchivedProvisioning{},
+	}
+	if u.IsAdmin {
+		archive.Roles = append(archive.Roles, "admin")
+	}
+	if !u.StatusChangedAt.IsZero() {
+		changedAt := u.StatusChangedAt.UTC()
+		archive.Account.StatusChangedAt = &changedAt
+	}
+	for _, v := range data.Verifications {
+		archive.EmailVerifications = append(archive.EmailVerifications, ArchivedVerification{
+			Email:     v.Email,
+			ExpiresAt: v.ExpiresAt.UTC(),
+		})
+	}
+	for _, g := range data.Groups {
+		archive.Groups = append(archive.Groups, ArchivedGroup{AppID: g.AppID, Name: g.DisplayName})
+	}
+	for _, appID := range data.SCIMApps {
+		archive.ProvisionedBy = append(archive.ProvisionedBy, ArchivedProvisioning{AppID: appID})
+	}
+	if f := data.LoginFailures; f != nil {
+		archive.FailedLogins = &ArchivedFailedLogins{Count: f.Failures, LastFailureAt: f.LastFailureAt.UTC()}
+	}
+	return archive
+}
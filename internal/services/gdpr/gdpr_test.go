@@ -0,0 +1,159 @@
+package gdpr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"sso/internal/domain/models"
+	"sso/internal/storage"
+)
+
+type fakeStorage struct {
+	data   map[int64]models.UserData
+	erased map[int64]models.ErasedUser
+}
+
+func (s *fakeStorage) UserData(_ context.Context, userID int64) (models.UserData, error) {
+	data, ok := s.data[userID]
+	if !ok {
+		return models.UserData{}, storage.ErrUserNotFound
+	}
+	return data, nil
+}
+
+func (s *fakeStorage) EraseUser(_ context.Context, tombstone models.ErasedUser) error {
+	if _, ok := s.data[tombstone.UserID]; !ok {
+		return storage.ErrUserNotFound
+	}
+	delete(s.data, tombstone.UserID)
+	s.erased[tombstone.UserID] = tombstone
+	return nil
+}
+
+func (s *fakeStorage) ErasedUser(_ context.Context, userID int64) (models.ErasedUser, error) {
+	e, ok := s.erased[userID]
+	if !ok {
+		return models.ErasedUser{}, storage.ErrUserNotFound
+	}
+	return e, nil
+}
+
+func newTestGDPR() (*GDPR, *fakeStorage) {
+	changedAt := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	s := &fakeStorage{
+		data: map[int64]models.UserData{
+			1: {
+				User: models.UserInfo{
+					ID: 1, Name: "Alice", Email: "alice@example.com", EmailVerified: true, IsAdmin: true,
+					Status: models.UserStatusLocked, StatusReason: "too many attempts", StatusChangedAt: changedAt,
+					CreatedAt: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+				},
+				Verifications: []models.EmailVerification{
+					{TokenHash: []byte("token-hash"), UserID: 1, Email: "alice@new.example.com", ExpiresAt: changedAt},
+				},
+				Groups:        []models.Group{{ID: 7, AppID: 2, DisplayName: "Engineering"}},
+				SCIMApps:      []int64{2},
+				LoginFailures: &models.LoginFailures{Failures: 4, LastFailureAt: changedAt},
+			},
+			2: {User: models.UserInfo{ID: 2, Name: "Bob", Email: "bob@example.com", Status: models.UserStatusActive}},
+		},
+		erased: make(map[int64]models.ErasedUser),
+	}
+	return New(slog.New(slog.DiscardHandler), s), s
+}
+
+func TestExport(t *testing.T) {
+	g, _ := newTestGDPR()
+
+	archive, err := g.Export(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if archive.Version != ArchiveVersion {
+		t.Errorf("archive version = %d, want %d", archive.Version, ArchiveVersion)
+	}
+	if p := archive.Profile; p.ID != 1 || p.Email != "alice@example.com" || !p.EmailVerified {
+		t.Errorf("archived profile = %+v", p)
+	}
+	if len(archive.Roles) != 1 || archive.Roles[0] != "admin" {
+		t.Errorf("archived roles = %v, want [admin]", archive.Roles)
+	}
+	if a := archive.Account; a.Status != "locked" || a.StatusReason != "too many attempts" || a.StatusChangedAt == nil {
+		t.Errorf("archived account = %+v", a)
+	}
+	if len(archive.EmailVerifications) != 1 || archive.EmailVerifications[0].Email != "alice@new.example.com" {
+		t.Errorf("archived verifications = %+v", archive.EmailVerifications)
+	}
+	if len(archive.Groups) != 1 || archive.Groups[0] != (ArchivedGroup{AppID: 2, Name: "Engineering"}) {
+		t.Errorf("archived groups = %+v", archive.Groups)
+	}
+	if len(archive.ProvisionedBy) != 1 || archive.ProvisionedBy[0].AppID != 2 {
+		t.Errorf("archived provisioning = %+v", archive.ProvisionedBy)
+	}
+	if f := archive.FailedLogins; f == nil || f.Count != 4 {
+		t.Errorf("archived failed logins = %+v, want 4", f)
+	}
+
+	// the token hash is a credential, it stays out of the archive
+	out, err := json.Marshal(archive)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if strings.Contains(string(out), "token-hash") || strings.Contains(string(out), "dG9rZW4taGFzaA") {
+		t.Errorf("archive carries the verification token hash: %s", out)
+	}
+}
+
+func TestExportEmpty(t *testing.T) {
+	g, _ := newTestGDPR()
+
+	archive, err := g.Export(context.Background(), 2)
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	out, err := json.Marshal(archive)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	// lists are empty rather than null for consumers of the archive
+	for _, field := range []string{`"roles":[]`, `"pending_email_verifications":[]`, `"groups":[]`, `"provisioned_by":[]`} {
+		if !strings.Contains(string(out), field) {
+			t.Errorf("archive lacks %s: %s", field, out)
+		}
+	}
+	if archive.Account.StatusChangedAt != nil {
+		t.Errorf("status_changed_at = %v for a user whose status never changed", archive.Account.StatusChangedAt)
+	}
+}
+
+func TestErase(t *testing.T) {
+	g, s := newTestGDPR()
+	ctx := context.Background()
+
+	if err := g.Erase(ctx, 1, 9, "request #1"); err != nil {
+		t.Fatalf("Erase: %v", err)
+	}
+	tombstone, ok := s.erased[1]
+	if !ok || tombstone.ErasedBy != 9 || tombstone.Reason != "request #1" || tombstone.ErasedAt.IsZero() {
+		t.Fatalf("tombstone = %+v, %v", tombstone, ok)
+	}
+
+	// an erased user is told apart from one that never existed
+	if _, err := g.Export(ctx, 1); !errors.Is(err, ErrUserErased) {
+		t.Errorf("Export of an erased user = %v, want ErrUserErased", err)
+	}
+	if err := g.Erase(ctx, 1, 9, "again"); !errors.Is(err, ErrUserErased) {
+		t.Errorf("Erase of an erased user = %v, want ErrUserErased", err)
+	}
+	if _, err := g.Export(ctx, 42); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Export of an unknown user = %v, want ErrUserNotFound", err)
+	}
+	if err := g.Erase(ctx, 42, 9, "unknown"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Erase of an unknown user = %v, want ErrUserNotFound", err)
+	}
+}
@@ -0,0 +1,288 @@
+package profile
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sso/internal/domain/models"
+	"sso/internal/lib/jwt"
+	"sso/internal/lib/notify"
+	"sso/internal/storage"
+	"time"
+)
+
+type Profile struct {
+	log             *slog.Logger
+	usrProvider     UserProvider
+	usrUpdater      UserUpdater
+	appProvider     AppProvider
+	appID           int64
+	notifier        notify.Notifier
+	verificationTTL time.Duration
+}
+
+type UserProvider interface {
+	UserByID(ctx context.Context, userID int64) (models.User, error)
+	IsAdmin(ctx context.Context, userID int64) (bool, error)
+}
+
+type UserUpdater interface {
+	UpdateProfile(ctx context.Context, userID int64, name string, verification *models.EmailVerification) error
+	VerifyEmail(ctx context.Context, tokenHash []byte, now time.Time) (int64, error)
+}
+
+type AppProvider interface {
+	App(ctx context.Context, appID int64) (models.App, error)
+}
+
+var (
+	ErrInvalidToken        = errors.New("invalid token")
+	ErrPermissionDenied    = errors.New("permission denied")
+	ErrUserNotFound        = errors.New("user not found")
+	ErrUserExists          = errors.New("user already exists")
+	ErrInvalidVerification = errors.New("invalid or expired verification token")
+)
+
+// New creates the profile service. It accepts the tokens of the app with
+// appID only, any other app could sign a token for any user.
+func New(
+	log *slog.Logger,
+	userProvider UserProvider,
+	userUpdater UserUpdater,
+	appProvider AppProvider,
+	appID int64,
+	notifier notify.Notifier,
+	verificationTTL time.Duration,
+) *Profile {
+	return &Profile{
+		log:             log,
+		usrProvider:     userProvider,
+		usrUpdater:      userUpdater,
+		appProvider:     appProvider,
+		appID:           appID,
+		notifier:        notifier,
+		verificationTTL: verificationTTL,
+	}
+}
+
+// GetUser returns the user with userID. Users may read their own profile,
+// admins may read anyone's.
+func (p *Profile) GetUser(ctx context.Context, token string, userID int64) (models.User, error) {
+	const op = "profile.GetUser"
+	log := p.log.With(
+		slog.String("op", op),
+		slog.Int64("user_id", userID),
+	)
+
+	caller, err := p.authenticate(ctx, token)
+	if err != nil {
+		log.Warn("failed to authenticate", slog.String("error", err.Error()))
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if caller.ID == userID {
+		return caller, nil
+	}
+
+	isAdmin, err := p.usrProvider.IsAdmin(ctx, caller.ID)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return models.User{}, fmt.Errorf("%s: %w", op, ErrInvalidToken)
+		}
+		log.Error("failed to check admin", slog.String("error", err.Error()))
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if !isAdmin {
+		log.Warn("non-admin requested another user", slog.Int64("caller_id", caller.ID))
+		return models.User{}, fmt.Errorf("%s: %w", op, ErrPermissionDenied)
+	}
+
+	user, err := p.user(ctx, userID)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return user, nil
+}
+
+// GetMe returns the user the token was issued to.
+func (p *Profile) GetMe(ctx context.Context, token string) (models.User, error) {
+	const op = "profile.GetMe"
+	log := p.log.With(slog.String("op", op))
+
+	user, err := p.authenticate(ctx, token)
+	if err != nil {
+		log.Warn("failed to authenticate", slog.String("error", err.Error()))
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return user, nil
+}
+
+// UpdateProfile changes the name and email of the token owner, nil leaves a
+// field as is. A new email is only pending: a verification token is sent
+// to it, verificationSent reports whether that happened, and the email
+// replaces the current one once VerifyEmail confirms it.
+func (p *Profile) UpdateProfile(
+	ctx context.Context,
+	token string,
+	name *string,
+	email *string,
+) (user models.User, verificationSent bool, err error) {
+	const op = "profile.UpdateProfile"
+	log := p.log.With(slog.String("op", op))
+
+	current, err := p.authenticate(ctx, token)
+	if err != nil {
+		log.Warn("failed to authenticate", slog.String("error", err.Error()))
+		return models.User{}, false, fmt.Errorf("%s: %w", op, err)
+	}
+	userID := current.ID
+	log = log.With(slog.Int64("user_id", userID))
+
+	var newName string
+	if name != nil && *name != current.Name {
+		newName = *name
+	}
+
+	var (
+		verification *models.EmailVerification
+		rawToken     string
+	)
+	if email != nil && *email != current.Email {
+		rawToken, verification, err = p.newVerification(userID, *email)
+		if err != nil {
+			log.Error("failed to generate verification token", slog.String("error", err.Error()))
+			return models.User{}, false, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if newName == "" && verification == nil {
+		return current, false, nil
+	}
+
+	if err := p.usrUpdater.UpdateProfile(ctx, userID, newName, verification); err != nil {
+		if errors.Is(err, storage.ErrUserExists) {
+			log.Warn("email already taken")
+			return models.User{}, false, fmt.Errorf("%s: %w", op, ErrUserExists)
+		}
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return models.User{}, false, fmt.Errorf("%s: %w", op, ErrUserNotFound)
+		}
+		log.Error("failed to update profile", slog.String("error", err.Error()))
+		return models.User{}, false, fmt.Errorf("%s: %w", op, err)
+	}
+	log.Info("profile updated")
+
+	if verification != nil {
+		err := p.notifier.Notify(ctx, verification.Email,
+			"Confirm your email address",
+			"Use this token to confirm your new email address: "+rawToken,
+		)
+		if err != nil {
+			// the change is stored, the user can ask for another token by
+			// setting the email again
+			log.Error("failed to send verification", slog.String("error", err.Error()))
+		} else {
+			verificationSent = true
+		}
+	}
+
+	// read our own write, a replica may not have it yet
+	user, err = p.user(storage.WithPrimary(ctx), userID)
+	if err != nil {
+		return models.User{}, false, fmt.Errorf("%s: %w", op, err)
+	}
+	return user, verificationSent, nil
+}
+
+// VerifyEmail confirms the email address the verification token was sent to
+// and makes it the user's. It is ErrUserExists when another user took the
+// address in the meantime.
+func (p *Profile) VerifyEmail(ctx context.Context, verificationToken string) error {
+	const op = "profile.VerifyEmail"
+	log := p.log.With(slog.String("op", op))
+
+	userID, err := p.usrUpdater.VerifyEmail(ctx, hashToken(verificationToken), time.Now())
+	if err != nil {
+		if errors.Is(err, storage.ErrVerificationNotFound) {
+			log.Warn("invalid verification token")
+			return fmt.Errorf("%s: %w", op, ErrInvalidVerification)
+		}
+		if errors.Is(err, storage.ErrUserExists) {
+			log.Warn("verified email taken meanwhile")
+			return fmt.Errorf("%s: %w", op, ErrUserExists)
+		}
+		log.Error("failed to verify email", slog.String("error", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("email verified", slog.Int64("user_id", userID))
+	return nil
+}
+
+// authenticate verifies that the token was issued for the app the profile
+// endpoints accept and returns its user, who must still be active.
+func (p *Profile) authenticate(ctx context.Context, token string) (models.User, error) {
+	claims, err := jwt.ParseToken(token, func(appID int) (string, error) {
+		if int64(appID) != p.appID {
+			return "", fmt.Errorf("%w: issued for app %d", jwt.ErrInvalidToken, appID)
+		}
+		app, err := p.appProvider.App(ctx, p.appID)
+		if err != nil {
+			return "", err
+		}
+		return app.Secret, nil
+	})
+	if err != nil {
+		if errors.Is(err, jwt.ErrInvalidToken) {
+			return models.User{}, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+		}
+		return models.User{}, err
+	}
+
+	user, err := p.user(ctx, claims.UserID)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			// the token outlived its user
+			return models.User{}, ErrInvalidToken
+		}
+		return models.User{}, err
+	}
+	if user.Status != models.UserStatusActive {
+		return models.User{}, ErrPermissionDenied
+	}
+	return user, nil
+}
+
+func (p *Profile) user(ctx context.Context, userID int64) (models.User, error) {
+	user, err := p.usrProvider.UserByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return models.User{}, ErrUserNotFound
+		}
+		return models.User{}, err
+	}
+	return user, nil
+}
+
+func (p *Profile) newVerification(userID int64, email string) (string, *models.EmailVerification, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	return token, &models.EmailVerification{
+		TokenHash: hashToken(token),
+		UserID:    userID,
+		Email:     email,
+		ExpiresAt: time.Now().Add(p.verificationTTL),
+	}, nil
+}
+
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
@@ -0,0 +1,290 @@
+package profile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"sso/internal/domain/models"
+	"sso/internal/lib/jwt"
+	"sso/internal/storage"
+)
+
+var testApp = models.App{ID: 1, Name: "test", Secret: "test-secret"}
+
+// fakeStorage keeps users and pending verifications the way the storage
+// backends do, a new email only replaces the current one once verified.
+type fakeStorage struct {
+	users   map[int64]models.User
+	admins  map[int64]bool
+	pending map[string]models.EmailVerification
+}
+
+func newFakeStorage(users ...models.User) *fakeStorage {
+	s := &fakeStorage{
+		users:   make(map[int64]models.User),
+		admins:  make(map[int64]bool),
+		pending: make(map[string]models.EmailVerification),
+	}
+	for _, u := range users {
+		if u.Status == "" {
+			u.Status = models.UserStatusActive
+		}
+		s.users[u.ID] = u
+	}
+	return s
+}
+
+func (s *fakeStorage) UserByID(_ context.Context, userID int64) (models.User, error) {
+	user, ok := s.users[userID]
+	if !ok {
+		return models.User{}, storage.ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *fakeStorage) IsAdmin(_ context.Context, userID int64) (bool, error) {
+	if _, ok := s.users[userID]; !ok {
+		return false, storage.ErrUserNotFound
+	}
+	return s.admins[userID], nil
+}
+
+func (s *fakeStorage) App(_ context.Context, appID int64) (models.App, error) {
+	if appID != int64(testApp.ID) {
+		return models.App{}, storage.ErrAppNotFound
+	}
+	return testApp, nil
+}
+
+func (s *fakeStorage) emailTaken(email string, except int64) bool {
+	for _, u := range s.users {
+		if u.Email == email && u.ID != except {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *fakeStorage) UpdateProfile(_ context.Context, userID int64, name string, v *models.EmailVerification) error {
+	user, ok := s.users[userID]
+	if !ok {
+		return storage.ErrUserNotFound
+	}
+	if v != nil {
+		if s.emailTaken(v.Email, userID) {
+			return storage.ErrUserExists
+		}
+		for hash, p := range s.pending {
+			if p.UserID == userID {
+				delete(s.pending, hash)
+			}
+		}
+		s.pending[string(v.TokenHash)] = *v
+	}
+	if name != "" {
+		user.Name = name
+	}
+	s.users[userID] = user
+	return nil
+}
+
+func (s *fakeStorage) VerifyEmail(_ context.Context, tokenHash []byte, now time.Time) (int64, error) {
+	v, ok := s.pending[string(tokenHash)]
+	if !ok || now.After(v.ExpiresAt) {
+		return 0, storage.ErrVerificationNotFound
+	}
+	if s.emailTaken(v.Email, v.UserID) {
+		return 0, storage.ErrUserExists
+	}
+	delete(s.pending, string(tokenHash))
+	user := s.users[v.UserID]
+	user.Email, user.EmailVerified = v.Email, true
+	s.users[v.UserID] = user
+	return v.UserID, nil
+}
+
+// outbox keeps the messages sent to each address.
+type outbox map[string][]string
+
+func (o outbox) Notify(_ context.Context, to string, _ string, body string) error {
+	o[to] = append(o[to], body)
+	return nil
+}
+
+func newTestProfile(t *testing.T, s *fakeStorage) (*Profile, outbox) {
+	t.Helper()
+	sent := outbox{}
+	log := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	return New(log, s, s, s, int64(testApp.ID), sent, time.Hour), sent
+}
+
+func tokenFor(t *testing.T, user models.User) string {
+	t.Helper()
+	token, err := jwt.NewToken(user, testApp, time.Hour)
+	if err != nil {
+		t.Fatalf("NewToken: %v", err)
+	}
+	return token
+}
+
+func TestGetUser(t *testing.T) {
+	alice := models.User{ID: 1, Email: "alice@example.com", Name: "Alice"}
+	bob := models.User{ID: 2, Email: "bob@example.com", Name: "Bob"}
+	admin := models.User{ID: 3, Email: "admin@example.com", Name: "Admin"}
+	s := newFakeStorage(alice, bob, admin)
+	s.admins[admin.ID] = true
+	p, _ := newTestProfile(t, s)
+
+	tests := []struct {
+		name    string
+		token   string
+		userID  int64
+		wantErr error
+	}{
+		{name: "own profile", token: tokenFor(t, alice), userID: alice.ID},
+		{name: "another user", token: tokenFor(t, alice), userID: bob.ID, wantErr: ErrPermissionDenied},
+		{name: "admin", token: tokenFor(t, admin), userID: bob.ID},
+		{name: "admin, missing user", token: tokenFor(t, admin), userID: 42, wantErr: ErrUserNotFound},
+		{name: "forged token", token: tokenFor(t, alice) + "x", userID: alice.ID, wantErr: ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := p.GetUser(context.Background(), tt.token, tt.userID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("GetUser = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && user.ID != tt.userID {
+				t.Errorf("GetUser returned user %d, want %d", user.ID, tt.userID)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	alice := models.User{ID: 1, Email: "alice@example.com", Name: "Alice"}
+	disabled := models.User{ID: 2, Email: "disabled@example.com", Status: models.UserStatusDisabled}
+	deleted := models.User{ID: 3, Email: "deleted@example.com", Status: models.UserStatusDeleted}
+	s := newFakeStorage(alice, disabled, deleted)
+	p, _ := newTestProfile(t, s)
+
+	// a relying app signs tokens with its own secret, for whichever user
+	relying := models.App{ID: 2, Name: "relying", Secret: "relying-secret"}
+	foreign, err := jwt.NewToken(alice, relying, time.Hour)
+	if err != nil {
+		t.Fatalf("NewToken: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{name: "active user", token: tokenFor(t, alice)},
+		{name: "token of another app", token: foreign, wantErr: ErrInvalidToken},
+		{name: "disabled user", token: tokenFor(t, disabled), wantErr: ErrPermissionDenied},
+		{name: "deleted user", token: tokenFor(t, deleted), wantErr: ErrPermissionDenied},
+		{name: "missing user", token: tokenFor(t, models.User{ID: 42}), wantErr: ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := p.GetMe(context.Background(), tt.token); !errors.Is(err, tt.wantErr) {
+				t.Errorf("GetMe = %v, want %v", err, tt.wantErr)
+			}
+			name := "Renamed"
+			if _, _, err := p.UpdateProfile(context.Background(), tt.token, &name, nil); !errors.Is(err, tt.wantErr) {
+				t.Errorf("UpdateProfile = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// brokenApps fails every app lookup, the way a storage that is down does.
+type brokenApps struct{}
+
+func (brokenApps) App(context.Context, int64) (models.App, error) {
+	return models.App{}, errors.New("connection refused")
+}
+
+// TestAuthenticateAppLookupFails checks that a token is not taken for an
+// invalid one when its app could not be looked up, callers answer with an
+// internal error rather than ask for another token.
+func TestAuthenticateAppLookupFails(t *testing.T) {
+	alice := models.User{ID: 1, Email: "alice@example.com", Name: "Alice"}
+	s := newFakeStorage(alice)
+	p := New(slog.New(slog.DiscardHandler), s, s, brokenApps{}, int64(testApp.ID), outbox{}, time.Hour)
+
+	_, err := p.GetMe(context.Background(), tokenFor(t, alice))
+	if err == nil || errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("GetMe = %v, want the error of the app lookup", err)
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	alice := models.User{ID: 1, Email: "alice@example.com", Name: "Alice", EmailVerified: true}
+	s := newFakeStorage(alice)
+	p, sent := newTestProfile(t, s)
+	ctx := context.Background()
+
+	newEmail := "alice@new.example.com"
+	user, verificationSent, err := p.UpdateProfile(ctx, tokenFor(t, alice), nil, &newEmail)
+	if err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+	if !verificationSent {
+		t.Error("UpdateProfile sent no verification")
+	}
+	// nobody proved owning the new address yet
+	if user.Email != alice.Email || !user.EmailVerified {
+		t.Errorf("UpdateProfile returned %+v, want the old verified email", user)
+	}
+	if len(sent[newEmail]) != 1 {
+		t.Fatalf("sent %d messages to the new address, want 1", len(sent[newEmail]))
+	}
+	body := sent[newEmail][0]
+	token := body[strings.LastIndex(body, " ")+1:]
+
+	if err := p.VerifyEmail(ctx, "not-the-token"); !errors.Is(err, ErrInvalidVerification) {
+		t.Fatalf("VerifyEmail with a wrong token = %v, want ErrInvalidVerification", err)
+	}
+	if err := p.VerifyEmail(ctx, token); err != nil {
+		t.Fatalf("VerifyEmail: %v", err)
+	}
+	if got := s.users[alice.ID]; got.Email != newEmail || !got.EmailVerified {
+		t.Errorf("after VerifyEmail user = %+v, want %s verified", got, newEmail)
+	}
+}
+
+func TestChangeEmailTaken(t *testing.T) {
+	alice := models.User{ID: 1, Email: "alice@example.com"}
+	bob := models.User{ID: 2, Email: "bob@example.com"}
+	s := newFakeStorage(alice, bob)
+	p, sent := newTestProfile(t, s)
+	ctx := context.Background()
+
+	taken := bob.Email
+	if _, _, err := p.UpdateProfile(ctx, tokenFor(t, alice), nil, &taken); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("UpdateProfile to a taken email = %v, want ErrUserExists", err)
+	}
+	if len(sent[taken]) != 0 {
+		t.Error("a verification was sent to a taken address")
+	}
+
+	// taken between the request and its verification
+	contested := "contested@example.com"
+	if _, _, err := p.UpdateProfile(ctx, tokenFor(t, alice), nil, &contested); err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+	s.users[bob.ID] = models.User{ID: bob.ID, Email: contested}
+	body := sent[contested][0]
+	if err := p.VerifyEmail(ctx, body[strings.LastIndex(body, " ")+1:]); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("VerifyEmail of a taken address = %v, want ErrUserExists", err)
+	}
+	if got := s.users[alice.ID].Email; got != alice.Email {
+		t.Errorf("user email = %s, want %s", got, alice.Email)
+	}
+}
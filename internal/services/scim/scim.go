@@ -0,0 +1,525 @@
+// Package scim provisions users and groups for identity providers speaking
+// SCIM 2.0. Every client authenticates with a bearer token issued to one
+// app. A client sees and changes only the users its app provisioned and
+// the groups its app created, admin users are never managed over SCIM.
+package scim
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"slices"
+	"sso/internal/domain/models"
+	"sso/internal/storage"
+	"time"
+)
+
+type SCIM struct {
+	log    *slog.Logger
+	users  UserStore
+	groups GroupStore
+	tokens TokenStore
+	hasher PasswordHasher
+	policy PasswordPolicy
+}
+
+type UserStore interface {
+	SaveSCIMUser(ctx context.Context, appID int64, email string, name string, passHash []byte, pepperVersion int) (int, error)
+	SCIMUser(ctx context.Context, appID int64, userID int64) (models.UserInfo, error)
+	ListUsers(ctx context.Context, filter models.UserFilter) ([]models.UserInfo, error)
+	CountUsers(ctx context.Context, filter models.UserFilter) (int, error)
+	UpdateUser(ctx context.Context, userID int64, name string, email string) error
+	SetStatus(ctx context.Context, userID int64, status models.UserStatus, reason string, at time.Time) error
+}
+
+type GroupStore interface {
+	SaveGroup(ctx context.Context, group models.Group) (int64, error)
+	Group(ctx context.Context, appID int64, groupID int64) (models.Group, error)
+	Groups(ctx context.Context, appID int64) ([]models.Group, error)
+	UpdateGroup(ctx context.Context, group models.Group) error
+	DeleteGroup(ctx context.Context, appID int64, groupID int64) error
+}
+
+type TokenStore interface {
+	SaveSCIMToken(ctx context.Context, token models.SCIMToken) error
+	SCIMTokenApp(ctx context.Context, tokenHash []byte) (int64, error)
+	RevokeSCIMTokens(ctx context.Context, appID int64) (int64, error)
+}
+
+type PasswordHasher interface {
+	Hash(password string) (hash []byte, pepperVersion int, err error)
+}
+
+type PasswordPolicy interface {
+	Check(password string, email string, name string) error
+}
+
+var (
+	ErrInvalidToken  = errors.New("invalid token")
+	ErrAppNotFound   = errors.New("app not found")
+	ErrInvalidUser   = errors.New("invalid user")
+	ErrUserNotFound  = errors.New("user not found")
+	ErrUserExists    = errors.New("user already exists")
+	ErrAdminUser     = errors.New("admin users are not managed over SCIM")
+	ErrInvalidGroup  = errors.New("invalid group")
+	ErrGroupNotFound = errors.New("group not found")
+	ErrGroupExists   = errors.New("group already exists")
+	ErrInvalidMember = errors.New("invalid group member")
+)
+
+func New(
+	log *slog.Logger,
+	users UserStore,
+	groups GroupStore,
+	tokens TokenStore,
+	hasher PasswordHasher,
+	policy PasswordPolicy,
+) *SCIM {
+	return &SCIM{log: log, users: users, groups: groups, tokens: tokens, hasher: hasher, policy: policy}
+}
+
+// IssueToken creates a token for the SCIM client of the app. Only its hash
+// is stored, the token is shown once.
+func (s *SCIM) IssueToken(ctx context.Context, appID int64) (string, error) {
+	const op = "scim.IssueToken"
+	log := s.log.With(slog.String("op", op), slog.Int64("app_id", appID))
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	err := s.tokens.SaveSCIMToken(ctx, models.SCIMToken{
+		TokenHash: hashToken(token),
+		AppID:     appID,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrAppNotFound) {
+			return "", fmt.Errorf("%s: %w", op, ErrAppNotFound)
+		}
+		log.Error("failed to save token", slog.String("error", err.Error()))
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("scim token issued")
+	return token, nil
+}
+
+// RevokeTokens revokes every token of the app and returns how many there
+// were.
+func (s *SCIM) RevokeTokens(ctx context.Context, appID int64) (int64, error) {
+	const op = "scim.RevokeTokens"
+	log := s.log.With(slog.String("op", op), slog.Int64("app_id", appID))
+
+	n, err := s.tokens.RevokeSCIMTokens(ctx, appID)
+	if err != nil {
+		log.Error("failed to revoke tokens", slog.String("error", err.Error()))
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("scim tokens revoked", slog.Int64("count", n))
+	return n, nil
+}
+
+// Authenticate returns the id of the app the token was issued to.
+func (s *SCIM) Authenticate(ctx context.Context, token string) (int64, error) {
+	const op = "scim.Authenticate"
+
+	if token == "" {
+		return 0, fmt.Errorf("%s: %w", op, ErrInvalidToken)
+	}
+	appID, err := s.tokens.SCIMTokenApp(ctx, hashToken(token))
+	if err != nil {
+		if errors.Is(err, storage.ErrSCIMTokenNotFound) {
+			return 0, fmt.Errorf("%s: %w", op, ErrInvalidToken)
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return appID, nil
+}
+
+// CreateUser provisions a user. Without a password the user gets a random
+// one and can only sign in once it is set some other way.
+func (s *SCIM) CreateUser(
+	ctx context.Context,
+	appID int64,
+	email string,
+	name string,
+	password string,
+	active bool,
+) (models.UserInfo, error) {
+	const op = "scim.CreateUser"
+	log := s.log.With(slog.String("op", op), slog.Int64("app_id", appID))
+
+	if err := validateUser(email, name); err != nil {
+		return models.UserInfo{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if password != "" {
+		if err := s.policy.Check(password, email, name); err != nil {
+			return models.UserInfo{}, fmt.Errorf("%s: %w: %w", op, ErrInvalidUser, err)
+		}
+	} else {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return models.UserInfo{}, fmt.Errorf("%s: %w", op, err)
+		}
+		password = base64.RawStdEncoding.EncodeToString(raw)
+	}
+	passHash, pepperVersion, err := s.hasher.Hash(password)
+	if err != nil {
+		return models.UserInfo{}, fmt.Errorf("%s: %w: %s", op, ErrInvalidUser, err)
+	}
+
+	id, err := s.users.SaveSCIMUser(ctx, appID, email, name, passHash, pepperVersion)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserExists) {
+			return models.UserInfo{}, fmt.Errorf("%s: %w", op, ErrUserExists)
+		}
+		if errors.Is(err, storage.ErrAppNotFound) {
+			return models.UserInfo{}, fmt.Errorf("%s: %w", op, ErrAppNotFound)
+		}
+		log.Error("failed to save user", slog.String("error", err.Error()))
+		return models.UserInfo{}, fmt.Errorf("%s: %w", op, err)
+	}
+	log = log.With(slog.Int("user_id", id))
+
+	if !active {
+		err := s.users.SetStatus(ctx, int64(id), models.UserStatusDisabled, provisionedBy(appID), time.Now())
+		if err != nil {
+			log.Error("failed to disable user", slog.String("error", err.Error()))
+			return models.UserInfo{}, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	log.Info("user provisioned")
+	return s.user(storage.WithPrimary(ctx), op, appID, int64(id))
+}
+
+// User returns a user the app provisioned. Deleted users are not found, as
+// SCIM expects after a DELETE.
+func (s *SCIM) User(ctx context.Context, appID int64, userID int64) (models.UserInfo, error) {
+	return s.user(ctx, "scim.User", appID, userID)
+}
+
+// ListUsers returns a page of the users the app provisioned that match
+// filter. Deleted and admin users are left out.
+func (s *SCIM) ListUsers(ctx context.Context, appID int64, filter models.UserFilter) ([]models.UserInfo, error) {
+	const op = "scim.ListUsers"
+
+	filter, ok := scope(appID, filter)
+	if !ok {
+		return nil, nil
+	}
+	users, err := s.users.ListUsers(ctx, filter)
+	if err != nil {
+		s.log.Error("failed to list users", slog.String("op", op), slog.String("error", err.Error()))
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return users, nil
+}
+
+// CountUsers returns how many users ListUsers would list with no paging.
+func (s *SCIM) CountUsers(ctx context.Context, appID int64, filter models.UserFilter) (int, error) {
+	const op = "scim.CountUsers"
+
+	filter, ok := scope(appID, filter)
+	if !ok {
+		return 0, nil
+	}
+	n, err := s.users.CountUsers(ctx, filter)
+	if err != nil {
+		s.log.Error("failed to count users", slog.String("op", op), slog.String("error", err.Error()))
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return n, nil
+}
+
+// scope narrows filter to the users the app can see. It returns false when
+// filter asks for statuses none of them can have.
+func scope(appID int64, filter models.UserFilter) (models.UserFilter, bool) {
+	notAdmin := false
+	filter.ProvisionedBy, filter.IsAdmin = appID, &notAdmin
+
+	visible := []models.UserStatus{models.UserStatusActive, models.UserStatusDisabled, models.UserStatusLocked}
+	if len(filter.Statuses) == 0 {
+		filter.Statuses = visible
+		return filter, true
+	}
+	filter.Statuses = slices.DeleteFunc(slices.Clone(filter.Statuses), func(st models.UserStatus) bool {
+		return !slices.Contains(visible, st)
+	})
+	return filter, len(filter.Statuses) > 0
+}
+
+// UpdateUser brings a user to the given state. Email changes take effect
+// right away, the identity provider vouches for them, but leave the email
+// unverified. Deactivating disables the user, activating also unlocks.
+func (s *SCIM) UpdateUser(
+	ctx context.Context,
+	appID int64,
+	userID int64,
+	email string,
+	name string,
+	active bool,
+) (models.UserInfo, error) {
+	const op = "scim.UpdateUser"
+	log := s.log.With(slog.String("op", op), slog.Int64("app_id", appID), slog.Int64("user_id", userID))
+
+	if err := validateUser(email, name); err != nil {
+		return models.UserInfo{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	user, err := s.user(ctx, op, appID, userID)
+	if err != nil {
+		return models.UserInfo{}, err
+	}
+
+	if user.Email != email || user.Name != name {
+		if err := s.users.UpdateUser(ctx, userID, name, email); err != nil {
+			if errors.Is(err, storage.ErrUserExists) {
+				return models.UserInfo{}, fmt.Errorf("%s: %w", op, ErrUserExists)
+			}
+			log.Error("failed to update user", slog.String("error", err.Error()))
+			return models.UserInfo{}, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	status := user.Status
+	switch {
+	case active && user.Status != models.UserStatusActive:
+		status = models.UserStatusActive
+	case !active && user.Status == models.UserStatusActive:
+		status = models.UserStatusDisabled
+	}
+	if status != user.Status {
+		if err := s.users.SetStatus(ctx, userID, status, provisionedBy(appID), time.Now()); err != nil {
+			log.Error("failed to set status", slog.String("error", err.Error()))
+			return models.UserInfo{}, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	log.Info("user updated", slog.String("status", string(status)))
+	return s.user(storage.WithPrimary(ctx), op, appID, userID)
+}
+
+// DeleteUser soft deletes a user, admins can restore them until the
+// retention period ends.
+func (s *SCIM) DeleteUser(ctx context.Context, appID int64, userID int64) error {
+	const op = "scim.DeleteUser"
+	log := s.log.With(slog.String("op", op), slog.Int64("app_id", appID), slog.Int64("user_id", userID))
+
+	if _, err := s.user(ctx, op, appID, userID); err != nil {
+		return err
+	}
+
+	if err := s.users.SetStatus(ctx, userID, models.UserStatusDeleted, provisionedBy(appID), time.Now()); err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return fmt.Errorf("%s: %w", op, ErrUserNotFound)
+		}
+		log.Error("failed to delete user", slog.String("error", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("user deprovisioned")
+	return nil
+}
+
+// user returns a user the app provisioned, refusing admins: a user
+// promoted since provisioning is no longer the identity provider's to
+// manage.
+func (s *SCIM) user(ctx context.Context, op string, appID int64, userID int64) (models.UserInfo, error) {
+	user, err := s.users.SCIMUser(ctx, appID, userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return models.UserInfo{}, fmt.Errorf("%s: %w", op, ErrUserNotFound)
+		}
+		s.log.Error("failed to get user", slog.String("op", op), slog.String("error", err.Error()))
+		return models.UserInfo{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if user.Status == models.UserStatusDeleted {
+		return models.UserInfo{}, fmt.Errorf("%s: %w", op, ErrUserNotFound)
+	}
+	if user.IsAdmin {
+		return models.UserInfo{}, fmt.Errorf("%s: %w", op, ErrAdminUser)
+	}
+	return user, nil
+}
+
+func (s *SCIM) CreateGroup(ctx context.Context, appID int64, name string, memberIDs []int64) (models.Group, error) {
+	const op = "scim.CreateGroup"
+	log := s.log.With(slog.String("op", op), slog.Int64("app_id", appID))
+
+	if name == "" {
+		return models.Group{}, fmt.Errorf("%s: %w: displayName is required", op, ErrInvalidGroup)
+	}
+	members, err := s.members(ctx, appID, memberIDs)
+	if err != nil {
+		return models.Group{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	now := time.Now()
+	id, err := s.groups.SaveGroup(ctx, models.Group{
+		AppID:       appID,
+		DisplayName: name,
+		Members:     members,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	})
+	if err != nil {
+		if err := groupError(err); err != nil {
+			return models.Group{}, fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to save group", slog.String("error", err.Error()))
+		return models.Group{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("group created", slog.Int64("group_id", id))
+	return s.group(storage.WithPrimary(ctx), op, appID, id)
+}
+
+func (s *SCIM) Group(ctx context.Context, appID int64, groupID int64) (models.Group, error) {
+	return s.group(ctx, "scim.Group", appID, groupID)
+}
+
+// Groups returns every group of the app. Apps have few groups, filtering
+// and paging is left to the caller.
+func (s *SCIM) Groups(ctx context.Context, appID int64) ([]models.Group, error) {
+	const op = "scim.Groups"
+
+	groups, err := s.groups.Groups(ctx, appID)
+	if err != nil {
+		s.log.Error("failed to list groups", slog.String("op", op), slog.String("error", err.Error()))
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return groups, nil
+}
+
+// UpdateGroup renames a group and replaces its members.
+func (s *SCIM) UpdateGroup(
+	ctx context.Context,
+	appID int64,
+	groupID int64,
+	name string,
+	memberIDs []int64,
+) (models.Group, error) {
+	const op = "scim.UpdateGroup"
+	log := s.log.With(slog.String("op", op), slog.Int64("app_id", appID), slog.Int64("group_id", groupID))
+
+	if name == "" {
+		return models.Group{}, fmt.Errorf("%s: %w: displayName is required", op, ErrInvalidGroup)
+	}
+	members, err := s.members(ctx, appID, memberIDs)
+	if err != nil {
+		return models.Group{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = s.groups.UpdateGroup(ctx, models.Group{
+		ID:          groupID,
+		AppID:       appID,
+		DisplayName: name,
+		Members:     members,
+		UpdatedAt:   time.Now(),
+	})
+	if err != nil {
+		if err := groupError(err); err != nil {
+			return models.Group{}, fmt.Errorf("%s: %w", op, err)
+		}
+		log.Error("failed to update group", slog.String("error", err.Error()))
+		return models.Group{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("group updated", slog.Int("members", len(members)))
+	return s.group(storage.WithPrimary(ctx), op, appID, groupID)
+}
+
+func (s *SCIM) DeleteGroup(ctx context.Context, appID int64, groupID int64) error {
+	const op = "scim.DeleteGroup"
+	log := s.log.With(slog.String("op", op), slog.Int64("app_id", appID), slog.Int64("group_id", groupID))
+
+	if err := s.groups.DeleteGroup(ctx, appID, groupID); err != nil {
+		if errors.Is(err, storage.ErrGroupNotFound) {
+			return fmt.Errorf("%s: %w", op, ErrGroupNotFound)
+		}
+		log.Error("failed to delete group", slog.String("error", err.Error()))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("group deleted")
+	return nil
+}
+
+func (s *SCIM) group(ctx context.Context, op string, appID int64, groupID int64) (models.Group, error) {
+	group, err := s.groups.Group(ctx, appID, groupID)
+	if err != nil {
+		if errors.Is(err, storage.ErrGroupNotFound) {
+			return models.Group{}, fmt.Errorf("%s: %w", op, ErrGroupNotFound)
+		}
+		s.log.Error("failed to get group", slog.String("op", op), slog.String("error", err.Error()))
+		return models.Group{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return group, nil
+}
+
+// members dedupes ids and checks that every user is one the app can
+// manage.
+func (s *SCIM) members(ctx context.Context, appID int64, ids []int64) ([]models.GroupMember, error) {
+	ids = slices.Clone(ids)
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+
+	members := make([]models.GroupMember, 0, len(ids))
+	for _, id := range ids {
+		if _, err := s.user(ctx, "scim.members", appID, id); err != nil {
+			if errors.Is(err, ErrUserNotFound) || errors.Is(err, ErrAdminUser) {
+				return nil, fmt.Errorf("%w: no user %d", ErrInvalidMember, id)
+			}
+			return nil, err
+		}
+		members = append(members, models.GroupMember{UserID: id})
+	}
+	return members, nil
+}
+
+// groupError maps the storage errors of a group write, nil for the rest.
+func groupError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrGroupExists):
+		return ErrGroupExists
+	case errors.Is(err, storage.ErrGroupNotFound):
+		return ErrGroupNotFound
+	case errors.Is(err, storage.ErrUserNotFound):
+		// a member was erased since it was checked
+		return ErrInvalidMember
+	case errors.Is(err, storage.ErrAppNotFound):
+		return ErrAppNotFound
+	}
+	return nil
+}
+
+func validateUser(email string, name string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return fmt.Errorf("%w: userName must be an email address", ErrInvalidUser)
+	}
+	if name == "" {
+		return fmt.Errorf("%w: a name is required", ErrInvalidUser)
+	}
+	return nil
+}
+
+func provisionedBy(appID int64) string {
+	return fmt.Sprintf("scim provisioning by app %d", appID)
+}
+
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
@@ -0,0 +1,355 @@
+package scim
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"sso/internal/domain/models"
+	"sso/internal/lib/passhash/passhashtest"
+	"sso/internal/lib/passpolicy"
+	"sso/internal/storage"
+)
+
+// fakeStore keeps users, groups and tokens the way the storage backends
+// do, each user remembering the app that provisioned it.
+type fakeStore struct {
+	users       map[int64]models.UserInfo
+	provisioned map[int64]int64
+	groups      map[int64]models.Group
+	tokens      map[string]int64
+	nextID      int64
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		users:       make(map[int64]models.UserInfo),
+		provisioned: make(map[int64]int64),
+		groups:      make(map[int64]models.Group),
+		tokens:      make(map[string]int64),
+	}
+}
+
+func (s *fakeStore) SaveSCIMUser(_ context.Context, appID int64, email string, name string, _ []byte, _ int) (int, error) {
+	for _, u := range s.users {
+		if strings.EqualFold(u.Email, email) {
+			return 0, storage.ErrUserExists
+		}
+	}
+	id := s.register(email, name)
+	s.provisioned[id] = appID
+	return int(id), nil
+}
+
+// register adds a user no app provisioned, as Register does.
+func (s *fakeStore) register(email string, name string) int64 {
+	s.nextID++
+	s.users[s.nextID] = models.UserInfo{
+		ID: s.nextID, Email: email, Name: name, Status: models.UserStatusActive, CreatedAt: time.Now(),
+	}
+	return s.nextID
+}
+
+func (s *fakeStore) SCIMUser(_ context.Context, appID int64, userID int64) (models.UserInfo, error) {
+	u, ok := s.users[userID]
+	if !ok || s.provisioned[userID] != appID {
+		return models.UserInfo{}, storage.ErrUserNotFound
+	}
+	return u, nil
+}
+
+func (s *fakeStore) match(filter models.UserFilter) []models.UserInfo {
+	var users []models.UserInfo
+	for _, u := range s.users {
+		switch {
+		case filter.ProvisionedBy != 0 && s.provisioned[u.ID] != filter.ProvisionedBy,
+			filter.IsAdmin != nil && u.IsAdmin != *filter.IsAdmin,
+			len(filter.Statuses) > 0 && !slices.Contains(filter.Statuses, u.Status),
+			filter.Email != "" && !strings.EqualFold(u.Email, filter.Email):
+			continue
+		}
+		users = append(users, u)
+	}
+	slices.SortFunc(users, func(a, b models.UserInfo) int { return int(a.ID - b.ID) })
+	return users
+}
+
+func (s *fakeStore) ListUsers(_ context.Context, filter models.UserFilter) ([]models.UserInfo, error) {
+	users := slices.DeleteFunc(s.match(filter), func(u models.UserInfo) bool { return u.ID <= filter.AfterID })
+	users = users[min(filter.Offset, len(users)):]
+	return users[:min(filter.Limit, len(users))], nil
+}
+
+func (s *fakeStore) CountUsers(_ context.Context, filter models.UserFilter) (int, error) {
+	return len(s.match(filter)), nil
+}
+
+func (s *fakeStore) UpdateUser(_ context.Context, userID int64, name string, email string) error {
+	u, ok := s.users[userID]
+	if !ok {
+		return storage.ErrUserNotFound
+	}
+	u.Name, u.Email = name, email
+	s.users[userID] = u
+	return nil
+}
+
+func (s *fakeStore) SetStatus(_ context.Context, userID int64, status models.UserStatus, reason string, at time.Time) error {
+	u, ok := s.users[userID]
+	if !ok {
+		return storage.ErrUserNotFound
+	}
+	u.Status, u.StatusReason, u.StatusChangedAt = status, reason, at
+	s.users[userID] = u
+	return nil
+}
+
+func (s *fakeStore) SaveGroup(_ context.Context, group models.Group) (int64, error) {
+	s.nextID++
+	group.ID = s.nextID
+	s.groups[group.ID] = group
+	return group.ID, nil
+}
+
+func (s *fakeStore) Group(_ context.Context, appID int64, groupID int64) (models.Group, error) {
+	g, ok := s.groups[groupID]
+	if !ok || g.AppID != appID {
+		return models.Group{}, storage.ErrGroupNotFound
+	}
+	return g, nil
+}
+
+func (s *fakeStore) Groups(_ context.Context, appID int64) ([]models.Group, error) {
+	var groups []models.Group
+	for _, g := range s.groups {
+		if g.AppID == appID {
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
+
+func (s *fakeStore) UpdateGroup(_ context.Context, group models.Group) error {
+	if _, err := s.Group(context.Background(), group.AppID, group.ID); err != nil {
+		return err
+	}
+	s.groups[group.ID] = group
+	return nil
+}
+
+func (s *fakeStore) DeleteGroup(_ context.Context, appID int64, groupID int64) error {
+	if _, err := s.Group(context.Background(), appID, groupID); err != nil {
+		return err
+	}
+	delete(s.groups, groupID)
+	return nil
+}
+
+func (s *fakeStore) SaveSCIMToken(_ context.Context, token models.SCIMToken) error {
+	s.tokens[string(token.TokenHash)] = token.AppID
+	return nil
+}
+
+func (s *fakeStore) SCIMTokenApp(_ context.Context, tokenHash []byte) (int64, error) {
+	appID, ok := s.tokens[string(tokenHash)]
+	if !ok {
+		return 0, storage.ErrSCIMTokenNotFound
+	}
+	return appID, nil
+}
+
+func (s *fakeStore) RevokeSCIMTokens(_ context.Context, appID int64) (int64, error) {
+	var n int64
+	for hash, id := range s.tokens {
+		if id == appID {
+			delete(s.tokens, hash)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func newTestSCIM() (*SCIM, *fakeStore) {
+	s := newFakeStore()
+	return New(slog.New(slog.DiscardHandler), s, s, s, passhashtest.Hasher{}, &passpolicy.Policy{}), s
+}
+
+func mustCreateUser(t *testing.T, s *SCIM, appID int64, email string) models.UserInfo {
+	t.Helper()
+	user, err := s.CreateUser(context.Background(), appID, email, "Name of "+email, "", true)
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	return user
+}
+
+func TestAuthenticate(t *testing.T) {
+	s, _ := newTestSCIM()
+	ctx := context.Background()
+
+	token, err := s.IssueToken(ctx, 7)
+	if err != nil {
+		t.Fatalf("IssueToken: %v", err)
+	}
+	appID, err := s.Authenticate(ctx, token)
+	if err != nil || appID != 7 {
+		t.Fatalf("Authenticate = %d, %v, want app 7", appID, err)
+	}
+
+	for _, bad := range []string{"", token + "x", strings.ToUpper(token)} {
+		if _, err := s.Authenticate(ctx, bad); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Authenticate(%q) = %v, want ErrInvalidToken", bad, err)
+		}
+	}
+
+	if n, err := s.RevokeTokens(ctx, 7); err != nil || n != 1 {
+		t.Fatalf("RevokeTokens = %d, %v", n, err)
+	}
+	if _, err := s.Authenticate(ctx, token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Authenticate with a revoked token = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestUserIsolation(t *testing.T) {
+	s, store := newTestSCIM()
+	ctx := context.Background()
+
+	alice := mustCreateUser(t, s, 1, "alice@example.com")
+	registered := store.register("registered@example.com", "Registered")
+
+	// another app's user and a user no app provisioned are out of reach
+	for _, id := range []int64{alice.ID, registered} {
+		if _, err := s.User(ctx, 2, id); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("User(%d) from app 2 = %v, want ErrUserNotFound", id, err)
+		}
+		if _, err := s.UpdateUser(ctx, 2, id, "taken@example.com", "Taken", false); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("UpdateUser(%d) from app 2 = %v, want ErrUserNotFound", id, err)
+		}
+		if err := s.DeleteUser(ctx, 2, id); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("DeleteUser(%d) from app 2 = %v, want ErrUserNotFound", id, err)
+		}
+	}
+	if got := store.users[alice.ID]; got.Email != alice.Email || got.Status != models.UserStatusActive {
+		t.Errorf("app 2 changed app 1's user: %+v", got)
+	}
+
+	if _, err := s.User(ctx, 1, alice.ID); err != nil {
+		t.Errorf("User from app 1: %v", err)
+	}
+	if err := s.DeleteUser(ctx, 1, alice.ID); err != nil {
+		t.Fatalf("DeleteUser from app 1: %v", err)
+	}
+	if _, err := s.User(ctx, 1, alice.ID); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("User after DeleteUser = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestAdminUsers(t *testing.T) {
+	s, store := newTestSCIM()
+	ctx := context.Background()
+
+	bob := mustCreateUser(t, s, 1, "bob@example.com")
+	// promoted after provisioning
+	u := store.users[bob.ID]
+	u.IsAdmin = true
+	store.users[bob.ID] = u
+
+	if _, err := s.User(ctx, 1, bob.ID); !errors.Is(err, ErrAdminUser) {
+		t.Errorf("User = %v, want ErrAdminUser", err)
+	}
+	if _, err := s.UpdateUser(ctx, 1, bob.ID, bob.Email, bob.Name, false); !errors.Is(err, ErrAdminUser) {
+		t.Errorf("UpdateUser = %v, want ErrAdminUser", err)
+	}
+	if err := s.DeleteUser(ctx, 1, bob.ID); !errors.Is(err, ErrAdminUser) {
+		t.Errorf("DeleteUser = %v, want ErrAdminUser", err)
+	}
+	if got := store.users[bob.ID].Status; got != models.UserStatusActive {
+		t.Errorf("admin status = %s, want active", got)
+	}
+
+	users, err := s.ListUsers(ctx, 1, models.UserFilter{Limit: 10})
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	if len(users) != 0 {
+		t.Errorf("ListUsers listed %+v, admins are left out", users)
+	}
+	if _, err := s.CreateGroup(ctx, 1, "Admins", []int64{bob.ID}); !errors.Is(err, ErrInvalidMember) {
+		t.Errorf("CreateGroup with an admin member = %v, want ErrInvalidMember", err)
+	}
+}
+
+func TestListUsersScope(t *testing.T) {
+	s, store := newTestSCIM()
+	ctx := context.Background()
+
+	alice := mustCreateUser(t, s, 1, "alice@example.com")
+	carol := mustCreateUser(t, s, 1, "carol@example.com")
+	mustCreateUser(t, s, 2, "bob@example.com")
+	store.register("registered@example.com", "Registered")
+	if err := s.DeleteUser(ctx, 1, carol.ID); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		filter models.UserFilter
+		want   []int64
+	}{
+		{"all", models.UserFilter{}, []int64{alice.ID}},
+		{"by email", models.UserFilter{Email: "ALICE@example.com"}, []int64{alice.ID}},
+		{"another app's email", models.UserFilter{Email: "bob@example.com"}, nil},
+		{"deleted", models.UserFilter{Statuses: []models.UserStatus{models.UserStatusDeleted}}, nil},
+		{"inactive", models.UserFilter{Statuses: []models.UserStatus{models.UserStatusDisabled, models.UserStatusDeleted}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.filter.Limit = 10
+			users, err := s.ListUsers(ctx, 1, tt.filter)
+			if err != nil {
+				t.Fatalf("ListUsers: %v", err)
+			}
+			var got []int64
+			for _, u := range users {
+				got = append(got, u.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ListUsers = %v, want %v", got, tt.want)
+			}
+
+			n, err := s.CountUsers(ctx, 1, tt.filter)
+			if err != nil {
+				t.Fatalf("CountUsers: %v", err)
+			}
+			if n != len(tt.want) {
+				t.Errorf("CountUsers = %d, want %d", n, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestGroupMembersScope(t *testing.T) {
+	s, _ := newTestSCIM()
+	ctx := context.Background()
+
+	alice := mustCreateUser(t, s, 1, "alice@example.com")
+	bob := mustCreateUser(t, s, 2, "bob@example.com")
+
+	if _, err := s.CreateGroup(ctx, 2, "Team", []int64{bob.ID, alice.ID}); !errors.Is(err, ErrInvalidMember) {
+		t.Fatalf("CreateGroup with another app's user = %v, want ErrInvalidMember", err)
+	}
+	group, err := s.CreateGroup(ctx, 2, "Team", []int64{bob.ID, bob.ID})
+	if err != nil {
+		t.Fatalf("CreateGroup: %v", err)
+	}
+	if len(group.Members) != 1 || group.Members[0].UserID != bob.ID {
+		t.Errorf("group members = %+v, want bob once", group.Members)
+	}
+	if _, err := s.Group(ctx, 1, group.ID); !errors.Is(err, ErrGroupNotFound) {
+		t.Errorf("Group from app 1 = %v, want ErrGroupNotFound", err)
+	}
+}
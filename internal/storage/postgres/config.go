@@ -0,0 +1,20 @@
+package postgres
+
+import "sso/internal/config"
+
+// ConnConfigFrom maps the service database settings onto ConnConfig, so the
+// service and the tooling connect with exactly the same parameters.
+func ConnConfigFrom(db config.DBConfig) ConnConfig {
+	return ConnConfig{
+		URL:         db.URL,
+		Host:        db.Host,
+		Port:        db.Port,
+		User:        db.Username,
+		Password:    db.Password,
+		Database:    db.Database,
+		SSLMode:     db.SSLMode,
+		SSLRootCert: db.SSLRootCert,
+		SSLCert:     db.SSLCert,
+		SSLKey:      db.SSLKey,
+	}
+}
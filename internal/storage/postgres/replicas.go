@@ -0,0 +1,188 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"sso/internal/storage"
+)
+
+// ReplicaConfig describes the read replicas. With no DSNs every query goes
+// to the primary.
+type ReplicaConfig struct {
+	DSNs []string
+	// MaxLag is the replication lag after which a replica stops serving reads.
+	MaxLag time.Duration
+	// CheckInterval is how often replicas are health-checked.
+	CheckInterval time.Duration
+	Log           *slog.Logger
+}
+
+// replicaLagQuery returns the replay lag in seconds. A replica that has
+// replayed everything it received reports zero, otherwise an idle primary
+// would make the lag look like it grows forever. It is NULL for a replica
+// that never replayed anything or receives no WAL, whose lag is unknown.
+const replicaLagQuery = `
+	SELECT CASE
+		WHEN NOT pg_is_in_recovery() THEN 0
+		WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())
+	END::float8`
+
+// lagProbe returns the replay lag of a replica in seconds, nil when it is
+// unknown.
+type lagProbe func(ctx context.Context, pool *pgxpool.Pool) (*float64, error)
+
+func queryLag(ctx context.Context, pool *pgxpool.Pool) (*float64, error) {
+	var lag *float64
+	err := pool.QueryRow(ctx, replicaLagQuery).Scan(&lag)
+	return lag, err
+}
+
+type replica struct {
+	pool    *pgxpool.Pool
+	healthy atomic.Bool
+}
+
+type replicaSet struct {
+	log      *slog.Logger
+	maxLag   time.Duration
+	interval time.Duration
+	probe    lagProbe
+	replicas []*replica
+	next     atomic.Uint64
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newReplicaSet(cfg ReplicaConfig, poolCfg PoolConfig) (*replicaSet, error) {
+	const op = "storage.newReplicaSet"
+
+	log := cfg.Log
+	if log == nil {
+		log = slog.New(slog.DiscardHandler)
+	}
+
+	rs := &replicaSet{
+		log:      log.With(slog.String("op", op)),
+		maxLag:   cfg.MaxLag,
+		interval: cfg.CheckInterval,
+		probe:    queryLag,
+		stop:     make(chan struct{}),
+	}
+
+	for _, dsn := range cfg.DSNs {
+		pgCfg, err := parsePoolConfig(dsn, poolCfg)
+		if err != nil {
+			rs.close()
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		// a replica that is down at startup is not fatal, the health check
+		// keeps it out of rotation until it comes back
+		pool, err := pgxpool.NewWithConfig(context.Background(), pgCfg)
+		if err != nil {
+			rs.close()
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		rs.replicas = append(rs.replicas, &replica{pool: pool})
+	}
+
+	if len(rs.replicas) == 0 {
+		return rs, nil
+	}
+
+	rs.check()
+
+	rs.wg.Add(1)
+	go rs.run()
+
+	return rs, nil
+}
+
+func (rs *replicaSet) run() {
+	defer rs.wg.Done()
+
+	ticker := time.NewTicker(rs.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rs.stop:
+			return
+		case <-ticker.C:
+			rs.check()
+		}
+	}
+}
+
+func (rs *replicaSet) check() {
+	for i, r := range rs.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), rs.interval)
+		lagSeconds, err := rs.probe(ctx, r.pool)
+		cancel()
+
+		var lag time.Duration
+		if lagSeconds != nil {
+			lag = time.Duration(*lagSeconds * float64(time.Second))
+		}
+		healthy := err == nil && lagSeconds != nil && lag <= rs.maxLag
+
+		if was := r.healthy.Swap(healthy); was != healthy {
+			log := rs.log.With(slog.Int("replica", i), slog.Duration("lag", lag))
+			switch {
+			case healthy:
+				log.Info("replica is back in rotation")
+			case err != nil:
+				log.Warn("replica dropped from rotation", slog.String("error", err.Error()))
+			case lagSeconds == nil:
+				log.Warn("replica dropped from rotation, it replays no WAL")
+			default:
+				log.Warn("replica dropped from rotation, lag exceeds threshold", slog.Duration("max_lag", rs.maxLag))
+			}
+		}
+	}
+}
+
+// pick returns a healthy replica in round-robin order, or nil when none is.
+func (rs *replicaSet) pick() *pgxpool.Pool {
+	n := len(rs.replicas)
+	if n == 0 {
+		return nil
+	}
+
+	start := rs.next.Add(1)
+	for i := 0; i < n; i++ {
+		r := rs.replicas[(start+uint64(i))%uint64(n)]
+		if r.healthy.Load() {
+			return r.pool
+		}
+	}
+	return nil
+}
+
+func (rs *replicaSet) close() {
+	close(rs.stop)
+	rs.wg.Wait()
+	for _, r := range rs.replicas {
+		r.pool.Close()
+	}
+}
+
+// reader returns the pool to serve a read-only query from: a healthy replica
+// unless the caller asked for the primary with storage.WithPrimary.
+func (s *Storage) reader(ctx context.Context) *pgxpool.Pool {
+	if storage.UsePrimary(ctx) {
+		return s.pool
+	}
+	if pool := s.replicas.pick(); pool != nil {
+		return pool
+	}
+	return s.pool
+}
@@ -0,0 +1,114 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"sso/internal/storage"
+)
+
+// lags is a probe answering from a map, a missing pool has an unknown lag.
+type lags map[*pgxpool.Pool]any
+
+func (l lags) probe(_ context.Context, pool *pgxpool.Pool) (*float64, error) {
+	switch lag := l[pool].(type) {
+	case float64:
+		return &lag, nil
+	case error:
+		return nil, lag
+	}
+	return nil, nil
+}
+
+// newTestStorage has a primary and n replicas that are never connected
+// to, pgxpool dials lazily.
+func newTestStorage(t *testing.T, n int, probe lagProbe) (*Storage, []*pgxpool.Pool) {
+	t.Helper()
+
+	open := func() *pgxpool.Pool {
+		pool, err := pgxpool.New(context.Background(), "postgres://sso@127.0.0.1:1/sso")
+		if err != nil {
+			t.Fatalf("pgxpool.New: %v", err)
+		}
+		t.Cleanup(pool.Close)
+		return pool
+	}
+
+	rs := &replicaSet{
+		log:      slog.New(slog.DiscardHandler),
+		maxLag:   5 * time.Second,
+		interval: time.Second,
+		probe:    probe,
+		stop:     make(chan struct{}),
+	}
+	pools := make([]*pgxpool.Pool, n)
+	for i := range pools {
+		pools[i] = open()
+		rs.replicas = append(rs.replicas, &replica{pool: pools[i]})
+	}
+	return &Storage{pool: open(), replicas: rs}, pools
+}
+
+func readers(ctx context.Context, s *Storage, n int) map[*pgxpool.Pool]int {
+	got := make(map[*pgxpool.Pool]int)
+	for range n {
+		got[s.reader(ctx)]++
+	}
+	return got
+}
+
+func TestReaderRouting(t *testing.T) {
+	probe := lags{}
+	s, replicas := newTestStorage(t, 2, probe.probe)
+	probe[replicas[0]] = 0.0
+	probe[replicas[1]] = 1.0
+	s.replicas.check()
+
+	got := readers(context.Background(), s, 10)
+	if got[replicas[0]] != 5 || got[replicas[1]] != 5 {
+		t.Errorf("reads were not spread over both replicas: %v", got)
+	}
+
+	if pool := s.reader(storage.WithPrimary(context.Background())); pool != s.pool {
+		t.Error("a read marked WithPrimary went to a replica")
+	}
+}
+
+func TestReplicaHealth(t *testing.T) {
+	probe := lags{}
+	s, replicas := newTestStorage(t, 2, probe.probe)
+	healthy := replicas[1]
+	probe[healthy] = 0.0
+
+	for name, lag := range map[string]any{
+		"unreachable": errors.New("connection refused"),
+		"lagging":     6.0,
+		"unknown lag": nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			probe[replicas[0]] = lag
+			s.replicas.check()
+			if got := readers(context.Background(), s, 4); got[healthy] != 4 {
+				t.Errorf("reads went to a %s replica: %v", name, got)
+			}
+		})
+	}
+
+	probe[replicas[0]] = 4.0
+	s.replicas.check()
+	if got := readers(context.Background(), s, 4); got[replicas[0]] != 2 {
+		t.Errorf("a recovered replica serves %d of 4 reads, want 2", got[replicas[0]])
+	}
+
+	probe[replicas[0]] = nil
+	probe[healthy] = nil
+	s.replicas.check()
+	if pool := s.reader(context.Background()); pool != s.pool {
+		t.Error("with no healthy replica a read did not go to the primary")
+	}
+}
@@ -2,63 +2,230 @@ package postgres
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
-	"github.com/lib/pq"
+	"net"
+	"net/url"
+	"os"
 	"sso/internal/domain/models"
+	"sso/internal/lib/attempts"
 	"sso/internal/storage"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// SQLSTATEs of the constraint violations the storage maps to its errors.
+const (
+	uniqueViolation     = "23505"
+	foreignKeyViolation = "23503"
 )
 
+// Storage sends writes to the primary pool and read-only queries to a
+// healthy replica when replicas are configured.
 type Storage struct {
-	db *sql.DB
+	pool     *pgxpool.Pool
+	replicas *replicaSet
 }
 
-func DSN(host string, port int, user, password, dbname, sslmode string) string {
-	return fmt.Sprintf(
-		"host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
-		host, port, user, password, dbname, sslmode,
-	)
+// PoolConfig tunes the connection pool. Zero values keep the pgxpool defaults.
+type PoolConfig struct {
+	MaxConns        int32
+	MinConns        int32
+	MaxConnLifetime time.Duration
+	MaxConnIdleTime time.Duration
+	// StatementCacheMode is one of cache_statement, cache_describe,
+	// describe_exec, exec or simple_protocol. Use exec or simple_protocol
+	// behind PgBouncer in transaction pooling mode.
+	StatementCacheMode string
+}
+
+// ConnConfig describes how to reach the database.
+type ConnConfig struct {
+	// URL is a full postgres:// DSN. When set it is the base of the
+	// connection string and the fields below only fill in what it lacks.
+	URL string
+
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Database string
+
+	// SSLMode empty leaves the mode to the URL or PGSSLMODE, and to
+	// DefaultSSLMode when neither sets one.
+	SSLMode     string
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+}
+
+// DefaultSSLMode is the sslmode of a connection nothing else sets one for.
+const DefaultSSLMode = "disable"
+
+// DSN builds a postgres:// connection URL from cfg. Every component is
+// escaped, so passwords and paths may contain any characters.
+func DSN(cfg ConnConfig) (string, error) {
+	const op = "storage.DSN"
+
+	u := &url.URL{Scheme: "postgres"}
+	if cfg.URL != "" {
+		var err error
+		u, err = url.Parse(cfg.URL)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", op, err)
+		}
+		if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+			return "", fmt.Errorf("%s: unsupported scheme %q", op, u.Scheme)
+		}
+	}
+
+	if u.Host == "" && cfg.Host != "" {
+		u.Host = cfg.Host
+		if cfg.Port != 0 {
+			u.Host = net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+		}
+	}
+	if u.User == nil && cfg.User != "" {
+		u.User = url.UserPassword(cfg.User, cfg.Password)
+	}
+	if (u.Path == "" || u.Path == "/") && cfg.Database != "" {
+		u.Path = "/" + cfg.Database
+	}
+
+	q := u.Query()
+	sslMode := cfg.SSLMode
+	// requiressl is the older spelling of sslmode=require
+	if q.Has("sslmode") || q.Has("requiressl") {
+		sslMode = ""
+	} else if sslMode == "" && os.Getenv("PGSSLMODE") == "" {
+		sslMode = DefaultSSLMode
+	}
+	for key, value := range map[string]string{
+		"sslmode":     sslMode,
+		"sslrootcert": cfg.SSLRootCert,
+		"sslcert":     cfg.SSLCert,
+		"sslkey":      cfg.SSLKey,
+	} {
+		if value != "" && !q.Has(key) {
+			q.Set(key, value)
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
 }
 
-func New(dsn string) (*Storage, error) {
+func New(dsn string, poolCfg PoolConfig, replicaCfg ReplicaConfig) (*Storage, error) {
 	const op = "storage.New"
 
-	// Открываем соединение с PostgreSQL
-	db, err := sql.Open("postgres", dsn)
+	cfg, err := parsePoolConfig(dsn, poolCfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	pool, err := pgxpool.NewWithConfig(context.Background(), cfg)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
 	// Проверяем подключение
-	if err := db.Ping(); err != nil {
+	if err := pool.Ping(context.Background()); err != nil {
+		pool.Close()
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	return &Storage{db: db}, nil
-}
+	replicas, err := newReplicaSet(replicaCfg, poolCfg)
+	if err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
 
-func (s *Storage) SaveUser(ctx context.Context, email string, name string, passHash []byte) (int, error) {
-	const op = "storage.SaveUser"
+	return &Storage{pool: pool, replicas: replicas}, nil
+}
 
-	// Добавлен RETURNING id
-	stmt, err := s.db.Prepare(`
-        INSERT INTO users (email, name, pass_hash) 
-        VALUES ($1, $2, $3)
-        RETURNING id
-    `)
+func parsePoolConfig(dsn string, poolCfg PoolConfig) (*pgxpool.Config, error) {
+	cfg, err := pgxpool.ParseConfig(dsn)
 	if err != nil {
-		return 0, fmt.Errorf("%s: %w", op, err)
+		return nil, err
+	}
+
+	if poolCfg.MaxConns > 0 {
+		cfg.MaxConns = poolCfg.MaxConns
+	}
+	if poolCfg.MinConns > 0 {
+		cfg.MinConns = poolCfg.MinConns
+	}
+	if poolCfg.MaxConnLifetime > 0 {
+		cfg.MaxConnLifetime = poolCfg.MaxConnLifetime
+	}
+	if poolCfg.MaxConnIdleTime > 0 {
+		cfg.MaxConnIdleTime = poolCfg.MaxConnIdleTime
+	}
+	if poolCfg.StatementCacheMode != "" {
+		mode, err := queryExecMode(poolCfg.StatementCacheMode)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ConnConfig.DefaultQueryExecMode = mode
 	}
-	defer stmt.Close()
+
+	return cfg, nil
+}
+
+func queryExecMode(mode string) (pgx.QueryExecMode, error) {
+	switch mode {
+	case "cache_statement":
+		return pgx.QueryExecModeCacheStatement, nil
+	case "cache_describe":
+		return pgx.QueryExecModeCacheDescribe, nil
+	case "describe_exec":
+		return pgx.QueryExecModeDescribeExec, nil
+	case "exec":
+		return pgx.QueryExecModeExec, nil
+	case "simple_protocol":
+		return pgx.QueryExecModeSimpleProtocol, nil
+	}
+	return 0, fmt.Errorf("unknown statement cache mode %q", mode)
+}
+
+// Close stops the replica health checks and closes all connection pools.
+func (s *Storage) Close() error {
+	s.replicas.close()
+	s.pool.Close()
+	return nil
+}
+
+// PoolStats are the connections of the pool of the primary.
+func (s *Storage) PoolStats() storage.PoolStats {
+	st := s.pool.Stat()
+	return storage.PoolStats{
+		Max:   int(st.MaxConns()),
+		Open:  int(st.TotalConns()),
+		InUse: int(st.AcquiredConns()),
+		Idle:  int(st.IdleConns()),
+	}
+}
+
+// SaveUser stores a new user. pepperVersion is the version of the pepper
+// passHash was made with, 0 for none.
+func (s *Storage) SaveUser(ctx context.Context, email string, name string, passHash []byte, pepperVersion int) (int, error) {
+	const op = "storage.SaveUser"
+
 	var id int
-	err = stmt.QueryRowContext(ctx, name, email, passHash).Scan(&id)
+	err := s.pool.QueryRow(ctx, `
+        INSERT INTO users (email, name, pass_hash, pepper_version)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id
+    `, email, name, string(passHash), pepperVersion).Scan(&id)
 	if err != nil {
-		var pqErr *pq.Error
-		if errors.As(err, &pqErr) {
-			if pqErr.Code == "23505" {
-				return 0, fmt.Errorf("%s: %w", op, storage.ErrUserExists)
-			}
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrUserExists)
 		}
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
@@ -69,38 +236,1073 @@ func (s *Storage) SaveUser(ctx context.Context, email string, name string, passH
 func (s *Storage) User(ctx context.Context, email string) (models.User, error) {
 	const op = "storage.User"
 
-	stmt, err := s.db.Prepare("SELECT id, email, name, pass_hash FROM users WHERE email = $1")
+	row := s.reader(ctx).QueryRow(ctx, "SELECT id, name, email, pass_hash, pepper_version, email_verified, status FROM users WHERE email = $1", email)
+
+	var user models.User
+	err := row.Scan(&user.ID, &user.Name, &user.Email, &user.PassHash, &user.PepperVersion, &user.EmailVerified, &user.Status)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.User{}, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
 		return models.User{}, fmt.Errorf("%s: %w", op, err)
 	}
-	defer stmt.Close()
+	return user, nil
+}
+
+func (s *Storage) UserByID(ctx context.Context, userID int64) (models.User, error) {
+	const op = "storage.UserByID"
+
+	row := s.reader(ctx).QueryRow(ctx, "SELECT id, name, email, pass_hash, pepper_version, email_verified, status FROM users WHERE id = $1", userID)
 
-	row := stmt.QueryRowContext(ctx, email)
 	var user models.User
-	err = row.Scan(&user.ID, &user.Name, &user.Email, &user.PassHash)
+	err := row.Scan(&user.ID, &user.Name, &user.Email, &user.PassHash, &user.PepperVersion, &user.EmailVerified, &user.Status)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return models.User{}, storage.ErrUserNotFound
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.User{}, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
 		}
 		return models.User{}, fmt.Errorf("%s: %w", op, err)
 	}
 	return user, nil
 }
 
-func (s *Storage) IsAdmin(ctx context.Context, userID int64) (bool, error) {
-	const op = "storage.IsAdmin"
+// UpdateProfile sets the name unless it is empty and, when verification is
+// not nil, replaces any pending verification with the given one. The email
+// stays as it is until VerifyEmail, a new one taken by another user is
+// ErrUserExists already here.
+func (s *Storage) UpdateProfile(ctx context.Context, userID int64, name string, verification *models.EmailVerification) error {
+	const op = "storage.UpdateProfile"
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback(ctx)
+
+	if name != "" {
+		tag, err := tx.Exec(ctx, "UPDATE users SET name = $2 WHERE id = $1", userID, name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+	}
+
+	if verification != nil {
+		var exists, taken bool
+		err := tx.QueryRow(ctx, `
+            SELECT EXISTS (SELECT 1 FROM users WHERE id = $1),
+                   EXISTS (SELECT 1 FROM users WHERE email = $2 AND id <> $1)
+        `, userID, verification.Email).Scan(&exists, &taken)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		if !exists {
+			return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		if taken {
+			return fmt.Errorf("%s: %w", op, storage.ErrUserExists)
+		}
+
+		if _, err := tx.Exec(ctx, "DELETE FROM email_verifications WHERE user_id = $1", userID); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
+		_, err = tx.Exec(ctx, `
+            INSERT INTO email_verifications (token_hash, user_id, email, expires_at)
+            VALUES ($1, $2, $3, $4)
+        `, verification.TokenHash, userID, verification.Email, verification.ExpiresAt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// VerifyEmail consumes the verification with tokenHash and makes its email
+// the user's, verified. Expired and superseded tokens are
+// ErrVerificationNotFound, an email another user took since the change
+// was requested ErrUserExists.
+func (s *Storage) VerifyEmail(ctx context.Context, tokenHash []byte, now time.Time) (int64, error) {
+	const op = "storage.VerifyEmail"
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback(ctx)
 
-	stmt, err := s.db.Prepare("SELECT is_admin FROM users WHERE id = $1")
+	var v models.EmailVerification
+	err = tx.QueryRow(ctx, `
+        DELETE FROM email_verifications WHERE token_hash = $1
+        RETURNING user_id, email, expires_at
+    `, tokenHash).Scan(&v.UserID, &v.Email, &v.ExpiresAt)
 	if err != nil {
-		return false, fmt.Errorf("%s: %w", op, err) // Возвращаем оригинальную ошибку
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrVerificationNotFound)
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if now.After(v.ExpiresAt) {
+		// keep the expired token deleted
+		if err := tx.Commit(ctx); err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+		return 0, fmt.Errorf("%s: %w", op, storage.ErrVerificationNotFound)
+	}
+
+	tag, err := tx.Exec(ctx, "UPDATE users SET email = $2, email_verified = TRUE WHERE id = $1", v.UserID, v.Email)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrUserExists)
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return 0, fmt.Errorf("%s: %w", op, storage.ErrVerificationNotFound)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return v.UserID, nil
+}
+
+// ListUsers returns up to filter.Limit users matching filter with ids above
+// filter.AfterID, ordered by id.
+func (s *Storage) ListUsers(ctx context.Context, filter models.UserFilter) ([]models.UserInfo, error) {
+	const op = "storage.ListUsers"
+
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	conds := append(userConds(filter, arg), "id > "+arg(filter.AfterID))
+	limit := " LIMIT " + arg(filter.Limit)
+	if filter.Offset > 0 {
+		limit += " OFFSET " + arg(filter.Offset)
 	}
-	defer stmt.Close()
 
-	row := stmt.QueryRowContext(ctx, userID)
+	query := `
+        SELECT id, name, email, email_verified, is_admin, status, status_reason, status_changed_at, created_at
+        FROM users
+        WHERE ` + strings.Join(conds, " AND ") + `
+        ORDER BY id` + limit
+
+	rows, err := s.reader(ctx).Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var users []models.UserInfo
+	for rows.Next() {
+		var (
+			u         models.UserInfo
+			changedAt *time.Time
+		)
+		if err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.EmailVerified, &u.IsAdmin, &u.Status, &u.StatusReason, &changedAt, &u.CreatedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if changedAt != nil {
+			u.StatusChangedAt = *changedAt
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return users, nil
+}
+
+// CountUsers returns how many users match filter, AfterID, Offset and
+// Limit aside.
+func (s *Storage) CountUsers(ctx context.Context, filter models.UserFilter) (int, error) {
+	const op = "storage.CountUsers"
+
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	query := "SELECT count(*) FROM users"
+	if conds := userConds(filter, arg); len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	var n int
+	if err := s.reader(ctx).QueryRow(ctx, query, args...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return n, nil
+}
+
+// userConds returns the conditions of filter, cursor and paging left out.
+// arg binds a value and returns its placeholder.
+func userConds(filter models.UserFilter, arg func(any) string) []string {
+	var conds []string
+	if filter.Email != "" {
+		conds = append(conds, "lower(email) = lower("+arg(filter.Email)+")")
+	}
+	if filter.EmailPrefix != "" {
+		conds = append(conds, "email ILIKE "+arg(storage.EscapeLike(filter.EmailPrefix)+"%")+` ESCAPE '\'`)
+	}
+	if filter.Name != "" {
+		conds = append(conds, "name ILIKE "+arg("%"+storage.EscapeLike(filter.Name)+"%")+` ESCAPE '\'`)
+	}
+	if filter.IsAdmin != nil {
+		conds = append(conds, "is_admin = "+arg(*filter.IsAdmin))
+	}
+	if !filter.CreatedAfter.IsZero() {
+		conds = append(conds, "created_at >= "+arg(filter.CreatedAfter))
+	}
+	if !filter.CreatedBefore.IsZero() {
+		conds = append(conds, "created_at < "+arg(filter.CreatedBefore))
+	}
+	if len(filter.Statuses) > 0 {
+		placeholders := make([]string, len(filter.Statuses))
+		for i, status := range filter.Statuses {
+			placeholders[i] = arg(string(status))
+		}
+		conds = append(conds, "status IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if filter.ProvisionedBy != 0 {
+		conds = append(conds, "id IN (SELECT user_id FROM scim_users WHERE app_id = "+arg(filter.ProvisionedBy)+")")
+	}
+	return conds
+}
+
+// SetStatus changes the status of the user. Users whose email was released
+// after deletion can no longer be changed.
+func (s *Storage) SetStatus(ctx context.Context, userID int64, status models.UserStatus, reason string, at time.Time) error {
+	const op = "storage.SetStatus"
+
+	tag, err := s.pool.Exec(ctx, `
+        UPDATE users
+        SET status = $2, status_reason = $3, status_changed_at = $4
+        WHERE id = $1 AND email_released_at IS NULL`,
+		userID, string(status), reason, at,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if tag.RowsAffected() == 1 {
+		return nil
+	}
+
+	var exists bool
+	err = s.pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", userID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if exists {
+		return fmt.Errorf("%s: %w", op, storage.ErrEmailReleased)
+	}
+	return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+}
+
+// ReleaseDeletedEmails replaces the email of users deleted before
+// deletedBefore with a placeholder, so it can be registered again, and
+// drops their pending verifications. It returns the number of users released.
+func (s *Storage) ReleaseDeletedEmails(ctx context.Context, deletedBefore time.Time, now time.Time) (int64, error) {
+	const op = "storage.ReleaseDeletedEmails"
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+        UPDATE users
+        SET email = 'deleted-' || id || '@deleted.invalid', email_released_at = $2
+        WHERE status = 'deleted' AND email_released_at IS NULL AND status_changed_at < $1
+        RETURNING id`,
+		deletedBefore, now,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM email_verifications WHERE user_id = ANY($1)", ids); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return int64(len(ids)), nil
+}
+
+// UserData returns everything stored about the user, read in a single
+// snapshot from the primary.
+func (s *Storage) UserData(ctx context.Context, userID int64) (models.UserData, error) {
+	const op = "storage.UserData"
+
+	tx, err := s.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		data      models.UserData
+		u         = &data.User
+		changedAt *time.Time
+	)
+	err = tx.QueryRow(ctx, `
+        SELECT id, name, email, email_verified, is_admin, status, status_reason, status_changed_at, created_at
+        FROM users
+        WHERE id = $1`,
+		userID,
+	).Scan(&u.ID, &u.Name, &u.Email, &u.EmailVerified, &u.IsAdmin, &u.Status, &u.StatusReason, &changedAt, &u.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.UserData{}, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if changedAt != nil {
+		u.StatusChangedAt = *changedAt
+	}
+
+	rows, err := tx.Query(ctx, `
+        SELECT token_hash, user_id, email, expires_at
+        FROM email_verifications
+        WHERE user_id = $1
+        ORDER BY expires_at`,
+		userID,
+	)
+	if err != nil {
+		return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+	}
+	data.Verifications, err = pgx.CollectRows(rows, pgx.RowToStructByPos[models.EmailVerification])
+	if err != nil {
+		return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	rows, err = tx.Query(ctx, `
+        SELECT g.id, g.app_id, g.display_name, g.created_at, g.updated_at
+        FROM user_groups g
+        JOIN user_group_members m ON m.group_id = g.id
+        WHERE m.user_id = $1
+        ORDER BY g.id`,
+		userID,
+	)
+	if err != nil {
+		return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+	}
+	data.Groups, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.Group, error) {
+		var g models.Group
+		err := row.Scan(&g.ID, &g.AppID, &g.DisplayName, &g.CreatedAt, &g.UpdatedAt)
+		return g, err
+	})
+	if err != nil {
+		return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	rows, err = tx.Query(ctx, "SELECT app_id FROM scim_users WHERE user_id = $1 ORDER BY app_id", userID)
+	if err != nil {
+		return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+	}
+	data.SCIMApps, err = pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// the failed logins are counted under the email, as EraseUser drops them
+	var failures models.LoginFailures
+	err = tx.QueryRow(ctx,
+		"SELECT failures, last_failure_at FROM login_failures WHERE key = $1", attempts.AccountKey(u.Email),
+	).Scan(&failures.Failures, &failures.LastFailureAt)
+	switch {
+	case err == nil:
+		data.LoginFailures = &failures
+	case !errors.Is(err, pgx.ErrNoRows):
+		return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return data, nil
+}
+
+// EraseUser deletes the user and everything referencing them and records
+// the tombstone, all in one transaction.
+func (s *Storage) EraseUser(ctx context.Context, tombstone models.ErasedUser) error {
+	const op = "storage.EraseUser"
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM email_verifications WHERE user_id = $1", tombstone.UserID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM user_group_members WHERE user_id = $1", tombstone.UserID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM scim_users WHERE user_id = $1", tombstone.UserID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	var email string
+	err = tx.QueryRow(ctx, "DELETE FROM users WHERE id = $1 RETURNING email", tombstone.UserID).Scan(&email)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	// the failed logins are counted under the email
+	if _, err := tx.Exec(ctx, "DELETE FROM login_failures WHERE key = $1", attempts.AccountKey(email)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	var erasedBy *int64
+	if tombstone.ErasedBy != 0 {
+		erasedBy = &tombstone.ErasedBy
+	}
+	_, err = tx.Exec(ctx,
+		"INSERT INTO erased_users (user_id, erased_by, reason, erased_at) VALUES ($1, $2, $3, $4)",
+		tombstone.UserID, erasedBy, tombstone.Reason, tombstone.ErasedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// ErasedUser returns the tombstone of an erased user.
+func (s *Storage) ErasedUser(ctx context.Context, userID int64) (models.ErasedUser, error) {
+	const op = "storage.ErasedUser"
+
+	var (
+		e        models.ErasedUser
+		erasedBy *int64
+	)
+	err := s.reader(ctx).QueryRow(ctx,
+		"SELECT user_id, erased_by, reason, erased_at FROM erased_users WHERE user_id = $1", userID,
+	).Scan(&e.UserID, &erasedBy, &e.Reason, &e.ErasedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.ErasedUser{}, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		return models.ErasedUser{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if erasedBy != nil {
+		e.ErasedBy = *erasedBy
+	}
+	return e, nil
+}
+
+// ImportUsers inserts users in one transaction, Status and CreatedAt must
+// be set. A row that fails with storage.ErrUserExists is skipped and
+// reported in its result, any other error aborts the whole batch. With
+// dryRun the transaction is rolled back.
+func (s *Storage) ImportUsers(ctx context.Context, users []models.PortableUser, dryRun bool) ([]models.ImportResult, error) {
+	const op = "storage.ImportUsers"
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	results := make([]models.ImportResult, len(users))
+	for i, u := range users {
+		// users imported inactive changed status on import
+		var changedAt *time.Time
+		if u.Status != models.UserStatusActive {
+			changedAt = &now
+		}
+
+		// a savepoint per row, so a duplicate does not abort the transaction
+		row, err := tx.Begin(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		err = row.QueryRow(ctx, `
+            INSERT INTO users (email, name, pass_hash, pepper_version, email_verified, status, status_changed_at, created_at)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+            RETURNING id`,
+			u.Email, u.Name, string(u.PassHash), u.PepperVersion, u.EmailVerified, string(u.Status), changedAt, u.CreatedAt,
+		).Scan(&results[i].ID)
+		if err != nil {
+			row.Rollback(ctx)
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+				results[i].Err = fmt.Errorf("%s: %w", op, storage.ErrUserExists)
+				continue
+			}
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if err := row.Commit(ctx); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if dryRun {
+		return results, nil
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return results, nil
+}
+
+// ExportUsers returns up to limit users with ids above afterID, ordered by
+// id, password hashes included.
+func (s *Storage) ExportUsers(ctx context.Context, afterID int64, limit int) ([]models.PortableUser, error) {
+	const op = "storage.ExportUsers"
+
+	rows, err := s.reader(ctx).Query(ctx, `
+        SELECT id, email, name, pass_hash, pepper_version, email_verified, status, created_at
+        FROM users
+        WHERE id > $1
+        ORDER BY id
+        LIMIT $2`,
+		afterID, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var users []models.PortableUser
+	for rows.Next() {
+		var u models.PortableUser
+		if err := rows.Scan(&u.ID, &u.Email, &u.Name, &u.PassHash, &u.PepperVersion, &u.EmailVerified, &u.Status, &u.CreatedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return users, nil
+}
+
+// UpdateUser sets the name and email of a user directly, with no
+// verification. A changed email is no longer verified.
+func (s *Storage) UpdateUser(ctx context.Context, userID int64, name string, email string) error {
+	const op = "storage.UpdateUser"
+
+	tag, err := s.pool.Exec(ctx, `
+        UPDATE users
+        SET name = $2, email = $3, email_verified = (email_verified AND email = $3)
+        WHERE id = $1`,
+		userID, name, email,
+	)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			return fmt.Errorf("%s: %w", op, storage.ErrUserExists)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+	return nil
+}
+
+// SaveGroup creates a group with its members and returns its id. A member
+// that does not exist fails with storage.ErrUserNotFound.
+func (s *Storage) SaveGroup(ctx context.Context, group models.Group) (int64, error) {
+	const op = "storage.SaveGroup"
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback(ctx)
+
+	var id int64
+	err = tx.QueryRow(ctx, `
+        INSERT INTO user_groups (app_id, display_name, created_at, updated_at)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id`,
+		group.AppID, group.DisplayName, group.CreatedAt, group.UpdatedAt,
+	).Scan(&id)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			switch pgErr.Code {
+			case uniqueViolation:
+				return 0, fmt.Errorf("%s: %w", op, storage.ErrGroupExists)
+			case foreignKeyViolation:
+				return 0, fmt.Errorf("%s: %w", op, storage.ErrAppNotFound)
+			}
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := addMembers(ctx, tx, id, group.Members); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return id, nil
+}
+
+// Group returns a group of the app with its members. Deleted users are left
+// out of the members.
+func (s *Storage) Group(ctx context.Context, appID int64, groupID int64) (models.Group, error) {
+	const op = "storage.Group"
+
+	var g models.Group
+	err := s.reader(ctx).QueryRow(ctx, `
+        SELECT id, app_id, display_name, created_at, updated_at
+        FROM user_groups
+        WHERE id = $1 AND app_id = $2`,
+		groupID, appID,
+	).Scan(&g.ID, &g.AppID, &g.DisplayName, &g.CreatedAt, &g.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.Group{}, fmt.Errorf("%s: %w", op, storage.ErrGroupNotFound)
+		}
+		return models.Group{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	members, err := s.members(ctx, "g.id = $1", groupID)
+	if err != nil {
+		return models.Group{}, fmt.Errorf("%s: %w", op, err)
+	}
+	g.Members = members[g.ID]
+	return g, nil
+}
+
+// Groups returns every group of the app with its members, ordered by id.
+func (s *Storage) Groups(ctx context.Context, appID int64) ([]models.Group, error) {
+	const op = "storage.Groups"
+
+	rows, err := s.reader(ctx).Query(ctx, `
+        SELECT id, app_id, display_name, created_at, updated_at
+        FROM user_groups
+        WHERE app_id = $1
+        ORDER BY id`,
+		appID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	groups, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.Group, error) {
+		var g models.Group
+		err := row.Scan(&g.ID, &g.AppID, &g.DisplayName, &g.CreatedAt, &g.UpdatedAt)
+		return g, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	members, err := s.members(ctx, "g.app_id = $1", appID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	for i := range groups {
+		groups[i].Members = members[groups[i].ID]
+	}
+	return groups, nil
+}
+
+// UpdateGroup renames a group and replaces its members. Memberships of
+// deleted users are kept, so they are back if the user is restored.
+func (s *Storage) UpdateGroup(ctx context.Context, group models.Group) error {
+	const op = "storage.UpdateGroup"
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `
+        UPDATE user_groups
+        SET display_name = $3, updated_at = $4
+        WHERE id = $1 AND app_id = $2`,
+		group.ID, group.AppID, group.DisplayName, group.UpdatedAt,
+	)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			return fmt.Errorf("%s: %w", op, storage.ErrGroupExists)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrGroupNotFound)
+	}
+
+	_, err = tx.Exec(ctx, `
+        DELETE FROM user_group_members
+        WHERE group_id = $1
+          AND user_id NOT IN (SELECT id FROM users WHERE status = 'deleted')`,
+		group.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := addMembers(ctx, tx, group.ID, group.Members); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func (s *Storage) DeleteGroup(ctx context.Context, appID int64, groupID int64) error {
+	const op = "storage.DeleteGroup"
+
+	tag, err := s.pool.Exec(ctx, "DELETE FROM user_groups WHERE id = $1 AND app_id = $2", groupID, appID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrGroupNotFound)
+	}
+	return nil
+}
+
+// members returns the members of the groups matching cond, a condition on
+// user_groups g, keyed by group id and ordered by user id.
+func (s *Storage) members(ctx context.Context, cond string, args ...any) (map[int64][]models.GroupMember, error) {
+	rows, err := s.reader(ctx).Query(ctx, `
+        SELECT m.group_id, u.id, u.name
+        FROM user_group_members m
+        JOIN user_groups g ON g.id = m.group_id
+        JOIN users u ON u.id = m.user_id
+        WHERE `+cond+` AND u.status <> 'deleted'
+        ORDER BY m.group_id, u.id`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make(map[int64][]models.GroupMember)
+	for rows.Next() {
+		var (
+			groupID int64
+			m       models.GroupMember
+		)
+		if err := rows.Scan(&groupID, &m.UserID, &m.Name); err != nil {
+			return nil, err
+		}
+		members[groupID] = append(members[groupID], m)
+	}
+	return members, rows.Err()
+}
+
+func addMembers(ctx context.Context, tx pgx.Tx, groupID int64, members []models.GroupMember) error {
+	for _, m := range members {
+		_, err := tx.Exec(ctx,
+			"INSERT INTO user_group_members (group_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			groupID, m.UserID,
+		)
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == foreignKeyViolation {
+				return storage.ErrUserNotFound
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveSCIMUser stores a new user provisioned by the app's SCIM client and
+// records the app as its provisioner, in one transaction.
+func (s *Storage) SaveSCIMUser(ctx context.Context, appID int64, email string, name string, passHash []byte, pepperVersion int) (int, error) {
+	const op = "storage.SaveSCIMUser"
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback(ctx)
+
+	var id int
+	err = tx.QueryRow(ctx, `
+        INSERT INTO users (email, name, pass_hash, pepper_version)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id
+    `, email, name, string(passHash), pepperVersion).Scan(&id)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrUserExists)
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if _, err := tx.Exec(ctx, "INSERT INTO scim_users (app_id, user_id) VALUES ($1, $2)", appID, id); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == foreignKeyViolation {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrAppNotFound)
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return id, nil
+}
+
+// SCIMUser returns a user provisioned by the app's SCIM client. Users the
+// app did not provision are not found.
+func (s *Storage) SCIMUser(ctx context.Context, appID int64, userID int64) (models.UserInfo, error) {
+	const op = "storage.SCIMUser"
+
+	var (
+		u         models.UserInfo
+		changedAt *time.Time
+	)
+	err := s.reader(ctx).QueryRow(ctx, `
+        SELECT u.id, u.name, u.email, u.email_verified, u.is_admin, u.status, u.status_reason, u.status_changed_at, u.created_at
+        FROM users u
+        JOIN scim_users p ON p.user_id = u.id
+        WHERE p.app_id = $1 AND u.id = $2`,
+		appID, userID,
+	).Scan(&u.ID, &u.Name, &u.Email, &u.EmailVerified, &u.IsAdmin, &u.Status, &u.StatusReason, &changedAt, &u.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.UserInfo{}, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		return models.UserInfo{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if changedAt != nil {
+		u.StatusChangedAt = *changedAt
+	}
+	return u, nil
+}
+
+// SaveSCIMToken stores a token for the app's SCIM client.
+func (s *Storage) SaveSCIMToken(ctx context.Context, token models.SCIMToken) error {
+	const op = "storage.SaveSCIMToken"
+
+	_, err := s.pool.Exec(ctx,
+		"INSERT INTO scim_tokens (token_hash, app_id, created_at) VALUES ($1, $2, $3)",
+		token.TokenHash, token.AppID, token.CreatedAt,
+	)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == foreignKeyViolation {
+			return fmt.Errorf("%s: %w", op, storage.ErrAppNotFound)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// SCIMTokenApp returns the id of the app the token was issued to. It reads
+// from the primary so a revoked token stops working right away.
+func (s *Storage) SCIMTokenApp(ctx context.Context, tokenHash []byte) (int64, error) {
+	const op = "storage.SCIMTokenApp"
+
+	var appID int64
+	err := s.pool.QueryRow(ctx, "SELECT app_id FROM scim_tokens WHERE token_hash = $1", tokenHash).Scan(&appID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrSCIMTokenNotFound)
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return appID, nil
+}
+
+// RevokeSCIMTokens deletes every token of the app and returns how many
+// there were.
+func (s *Storage) RevokeSCIMTokens(ctx context.Context, appID int64) (int64, error) {
+	const op = "storage.RevokeSCIMTokens"
+
+	tag, err := s.pool.Exec(ctx, "DELETE FROM scim_tokens WHERE app_id = $1", appID)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// LoginFailures returns the failed logins counted on key since the given
+// time and when the last one was. It reads the primary, a lagging replica
+// would hand out extra attempts.
+func (s *Storage) LoginFailures(ctx context.Context, key string, since time.Time) (int, time.Time, error) {
+	const op = "storage.LoginFailures"
+
+	var (
+		failures int
+		last     time.Time
+	)
+	err := s.pool.QueryRow(ctx,
+		"SELECT failures, last_failure_at FROM login_failures WHERE key = $1 AND last_failure_at >= $2",
+		key, since,
+	).Scan(&failures, &last)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, time.Time{}, nil
+		}
+		return 0, time.Time{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return failures, last, nil
+}
+
+// ReserveLoginAttempt counts a login attempt on key at the given time as
+// a failure, starting over when the last one was before since. It returns
+// the new count and the time of the failure before, zero if there was
+// none. The row is locked while it is read, so concurrent attempts are
+// counted one after another.
+func (s *Storage) ReserveLoginAttempt(ctx context.Context, key string, at time.Time, since time.Time) (int, time.Time, error) {
+	const op = "storage.ReserveLoginAttempt"
+
+	var (
+		failures int
+		prev     *time.Time
+	)
+	err := s.pool.QueryRow(ctx, `
+        WITH prev AS (
+            SELECT last_failure_at FROM login_failures WHERE key = $1 FOR UPDATE
+        )
+        INSERT INTO login_failures (key, failures, last_failure_at)
+        VALUES ($1, 1, $2)
+        ON CONFLICT (key) DO UPDATE
+        SET failures = CASE WHEN login_failures.last_failure_at < $3 THEN 1 ELSE login_failures.failures + 1 END,
+            last_failure_at = EXCLUDED.last_failure_at
+        RETURNING failures, (SELECT last_failure_at FROM prev)`,
+		key, at, since,
+	).Scan(&failures, &prev)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if prev == nil {
+		return failures, time.Time{}, nil
+	}
+	return failures, *prev, nil
+}
+
+// ReleaseLoginAttempt takes back the attempt on key reserved at the given
+// time. The last failure goes back to prev unless a later attempt moved
+// it.
+func (s *Storage) ReleaseLoginAttempt(ctx context.Context, key string, at time.Time, prev time.Time) error {
+	const op = "storage.ReleaseLoginAttempt"
+
+	if prev.IsZero() {
+		prev = at
+	}
+	_, err := s.pool.Exec(ctx, `
+        UPDATE login_failures
+        SET failures = GREATEST(failures - 1, 0),
+            last_failure_at = CASE WHEN last_failure_at = $2 THEN $3 ELSE last_failure_at END
+        WHERE key = $1`,
+		key, at, prev,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func (s *Storage) ResetLoginFailures(ctx context.Context, key string) error {
+	const op = "storage.ResetLoginFailures"
+
+	if _, err := s.pool.Exec(ctx, "DELETE FROM login_failures WHERE key = $1", key); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// PruneLoginFailures deletes the counters whose last failure was before
+// the given time and returns how many there were.
+func (s *Storage) PruneLoginFailures(ctx context.Context, before time.Time) (int64, error) {
+	const op = "storage.PruneLoginFailures"
+
+	tag, err := s.pool.Exec(ctx, "DELETE FROM login_failures WHERE last_failure_at < $1", before)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// ConsumeRateLimit takes a token from the bucket at key, kept as the
+// theoretical arrival time of its next request. The upsert only moves that
+// time while it stays within tolerance of now, so concurrent instances
+// cannot overdraw a bucket. It writes the primary, like every call here.
+func (s *Storage) ConsumeRateLimit(ctx context.Context, key string, now time.Time, interval time.Duration, tolerance time.Duration) (bool, time.Time, error) {
+	const op = "storage.ConsumeRateLimit"
+
+	var tat int64
+	err := s.pool.QueryRow(ctx, `
+        INSERT INTO rate_limits (key, tat)
+        VALUES ($1, $2::bigint + $3::bigint)
+        ON CONFLICT (key) DO UPDATE
+        SET tat = GREATEST(rate_limits.tat, $2::bigint) + $3::bigint
+        WHERE GREATEST(rate_limits.tat, $2::bigint) + $3::bigint - $2::bigint <= $4::bigint
+        RETURNING tat`,
+		key, now.UnixNano(), int64(interval), int64(tolerance),
+	).Scan(&tat)
+	if err == nil {
+		return true, time.Unix(0, tat), nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return false, time.Time{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// the bucket is empty and was left as it is
+	if err := s.pool.QueryRow(ctx, "SELECT tat FROM rate_limits WHERE key = $1", key).Scan(&tat); err != nil {
+		return false, time.Time{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return false, time.Unix(0, tat), nil
+}
+
+// PruneRateLimits deletes the buckets that were full before the given time
+// and returns how many there were.
+func (s *Storage) PruneRateLimits(ctx context.Context, before time.Time) (int64, error) {
+	const op = "storage.PruneRateLimits"
+
+	tag, err := s.pool.Exec(ctx, "DELETE FROM rate_limits WHERE tat < $1", before.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (s *Storage) IsAdmin(ctx context.Context, userID int64) (bool, error) {
+	const op = "storage.IsAdmin"
+
+	row := s.reader(ctx).QueryRow(ctx, "SELECT is_admin FROM users WHERE id = $1", userID)
 
 	var isAdmin bool
 	if err := row.Scan(&isAdmin); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, pgx.ErrNoRows) {
 			return false, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
 		}
 		return false, fmt.Errorf("%s: %w", op, err)
@@ -111,21 +1313,68 @@ func (s *Storage) IsAdmin(ctx context.Context, userID int64) (bool, error) {
 
 func (s *Storage) App(ctx context.Context, appID int64) (models.App, error) {
 	const op = "storage.App"
-	stmt, err := s.db.Prepare("SELECT id, name, secret FROM apps WHERE id=$1")
-	if err != nil {
-		return models.App{}, fmt.Errorf("%s: %w", op, err)
-	}
 
-	row := stmt.QueryRowContext(ctx, appID)
+	row := s.reader(ctx).QueryRow(ctx, "SELECT id, name, secret FROM apps WHERE id = $1", appID)
 
 	var app models.App
-	err = row.Scan(&app.ID, &app.Name, &app.Secret)
-
+	err := row.Scan(&app.ID, &app.Name, &app.Secret)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, pgx.ErrNoRows) {
 			return models.App{}, fmt.Errorf("%s: %w", op, storage.ErrAppNotFound)
 		}
 		return models.App{}, fmt.Errorf("%s: %w", op, err)
 	}
 	return app, nil
 }
+
+// UpdatePassHash replaces the password hash of the user and the version of
+// its pepper, but only while the hash is still oldHash, so a rehash cannot
+// undo a password change that raced it. A user whose hash changed
+// meanwhile is ErrUserNotFound.
+func (s *Storage) UpdatePassHash(ctx context.Context, userID int64, oldHash []byte, newHash []byte, pepperVersion int) error {
+	const op = "storage.UpdatePassHash"
+
+	tag, err := s.pool.Exec(ctx,
+		"UPDATE users SET pass_hash = $3, pepper_version = $4 WHERE id = $1 AND pass_hash = $2",
+		userID, string(oldHash), string(newHash), pepperVersion)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+	return nil
+}
+
+func (s *Storage) SetAdmin(ctx context.Context, userID int64, isAdmin bool) error {
+	const op = "storage.SetAdmin"
+
+	tag, err := s.pool.Exec(ctx, "UPDATE users SET is_admin = $2 WHERE id = $1", userID, isAdmin)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+	return nil
+}
+
+// SaveApp creates the app or updates the name and secret of an app with the
+// same id. Another app already using the name or secret is ErrAppExists.
+func (s *Storage) SaveApp(ctx context.Context, app models.App) error {
+	const op = "storage.SaveApp"
+
+	_, err := s.pool.Exec(ctx, `
+        INSERT INTO apps (id, name, secret)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, secret = EXCLUDED.secret
+    `, app.ID, app.Name, app.Secret)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+			return fmt.Errorf("%s: %w", op, storage.ErrAppExists)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
@@ -0,0 +1,1307 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"sso/internal/domain/models"
+	"sso/internal/lib/attempts"
+	"sso/internal/storage"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+type Storage struct {
+	db *sql.DB
+}
+
+// DSN builds a connection string for the database file at path with the
+// pragmas the service relies on: foreign keys, WAL and a busy timeout so
+// concurrent writers wait instead of failing with SQLITE_BUSY. Times are
+// written in a sortable format so they can be compared in SQL. The path is
+// escaped, so a ?, # or % in it stays part of the file name.
+func DSN(path string) string {
+	u := url.URL{
+		Scheme:   "file",
+		Opaque:   (&url.URL{Path: path}).EscapedPath(),
+		RawQuery: "_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_time_format=sqlite",
+	}
+	return u.String()
+}
+
+func New(dsn string) (*Storage, error) {
+	const op = "storage.sqlite.New"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// SQLite allows a single writer at a time, a bigger pool only adds lock contention
+	db.SetMaxOpenConns(1)
+
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &Storage{db: db}, nil
+}
+
+// Close closes the underlying database handle.
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+// PoolStats are the connections of the database handle, one at most.
+func (s *Storage) PoolStats() storage.PoolStats {
+	st := s.db.Stats()
+	return storage.PoolStats{
+		Max:   st.MaxOpenConnections,
+		Open:  st.OpenConnections,
+		InUse: st.InUse,
+		Idle:  st.Idle,
+	}
+}
+
+// SaveUser stores a new user. pepperVersion is the version of the pepper
+// passHash was made with, 0 for none.
+func (s *Storage) SaveUser(ctx context.Context, email string, name string, passHash []byte, pepperVersion int) (int, error) {
+	const op = "storage.SaveUser"
+
+	var id int
+	err := s.db.QueryRowContext(ctx, `
+        INSERT INTO users (email, name, pass_hash, pepper_version, created_at)
+        VALUES (?, ?, ?, ?, ?)
+        RETURNING id
+    `, email, name, passHash, pepperVersion, time.Now().UTC()).Scan(&id)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrUserExists)
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return id, nil
+}
+
+func (s *Storage) User(ctx context.Context, email string) (models.User, error) {
+	const op = "storage.User"
+
+	row := s.db.QueryRowContext(ctx, "SELECT id, name, email, pass_hash, pepper_version, email_verified, status FROM users WHERE email = ?", email)
+
+	var user models.User
+	err := row.Scan(&user.ID, &user.Name, &user.Email, &user.PassHash, &user.PepperVersion, &user.EmailVerified, &user.Status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.User{}, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return user, nil
+}
+
+func (s *Storage) UserByID(ctx context.Context, userID int64) (models.User, error) {
+	const op = "storage.UserByID"
+
+	row := s.db.QueryRowContext(ctx, "SELECT id, name, email, pass_hash, pepper_version, email_verified, status FROM users WHERE id = ?", userID)
+
+	var user models.User
+	err := row.Scan(&user.ID, &user.Name, &user.Email, &user.PassHash, &user.PepperVersion, &user.EmailVerified, &user.Status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.User{}, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return user, nil
+}
+
+// UpdateProfile sets the name unless it is empty and, when verification is
+// not nil, replaces any pending verification with the given one. The email
+// stays as it is until VerifyEmail, a new one taken by another user is
+// ErrUserExists already here.
+func (s *Storage) UpdateProfile(ctx context.Context, userID int64, name string, verification *models.EmailVerification) error {
+	const op = "storage.UpdateProfile"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	if name != "" {
+		res, err := tx.ExecContext(ctx, "UPDATE users SET name = ? WHERE id = ?", name, userID)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		if err := requireAffected(res); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if verification != nil {
+		var exists, taken bool
+		err := tx.QueryRowContext(ctx, `
+            SELECT EXISTS (SELECT 1 FROM users WHERE id = ?1),
+                   EXISTS (SELECT 1 FROM users WHERE email = ?2 AND id <> ?1)
+        `, userID, verification.Email).Scan(&exists, &taken)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		if !exists {
+			return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		if taken {
+			return fmt.Errorf("%s: %w", op, storage.ErrUserExists)
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM email_verifications WHERE user_id = ?", userID); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
+		_, err = tx.ExecContext(ctx, `
+            INSERT INTO email_verifications (token_hash, user_id, email, expires_at)
+            VALUES (?, ?, ?, ?)
+        `, verification.TokenHash, userID, verification.Email, verification.ExpiresAt.UTC())
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// VerifyEmail consumes the verification with tokenHash and makes its email
+// the user's, verified. Expired and superseded tokens are
+// ErrVerificationNotFound, an email another user took since the change
+// was requested ErrUserExists.
+func (s *Storage) VerifyEmail(ctx context.Context, tokenHash []byte, now time.Time) (int64, error) {
+	const op = "storage.VerifyEmail"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var v models.EmailVerification
+	err = tx.QueryRowContext(ctx, `
+        DELETE FROM email_verifications WHERE token_hash = ?
+        RETURNING user_id, email, expires_at
+    `, tokenHash).Scan(&v.UserID, &v.Email, &v.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrVerificationNotFound)
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if now.After(v.ExpiresAt) {
+		// keep the expired token deleted
+		if err := tx.Commit(); err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+		return 0, fmt.Errorf("%s: %w", op, storage.ErrVerificationNotFound)
+	}
+
+	res, err := tx.ExecContext(ctx, "UPDATE users SET email = ?, email_verified = TRUE WHERE id = ?", v.Email, v.UserID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrUserExists)
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	} else if affected == 0 {
+		return 0, fmt.Errorf("%s: %w", op, storage.ErrVerificationNotFound)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return v.UserID, nil
+}
+
+// ListUsers returns up to filter.Limit users matching filter with ids above
+// filter.AfterID, ordered by id.
+func (s *Storage) ListUsers(ctx context.Context, filter models.UserFilter) ([]models.UserInfo, error) {
+	const op = "storage.ListUsers"
+
+	conds, args := userConds(filter)
+	conds, args = append(conds, "id > ?"), append(args, filter.AfterID)
+	// SQLite takes an OFFSET only after a LIMIT
+	args = append(args, filter.Limit, filter.Offset)
+
+	query := `
+        SELECT id, name, email, email_verified, is_admin, status, status_reason, status_changed_at, created_at
+        FROM users
+        WHERE ` + strings.Join(conds, " AND ") + `
+        ORDER BY id
+        LIMIT ? OFFSET ?`
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var users []models.UserInfo
+	for rows.Next() {
+		var (
+			u         models.UserInfo
+			changedAt sql.NullTime
+		)
+		if err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.EmailVerified, &u.IsAdmin, &u.Status, &u.StatusReason, &changedAt, &u.CreatedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		u.StatusChangedAt = changedAt.Time
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return users, nil
+}
+
+// CountUsers returns how many users match filter, AfterID, Offset and
+// Limit aside.
+func (s *Storage) CountUsers(ctx context.Context, filter models.UserFilter) (int, error) {
+	const op = "storage.CountUsers"
+
+	query := "SELECT count(*) FROM users"
+	conds, args := userConds(filter)
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	var n int
+	if err := s.db.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return n, nil
+}
+
+// userConds returns the conditions of filter and their arguments, cursor
+// and paging left out.
+func userConds(filter models.UserFilter) ([]string, []any) {
+	var (
+		conds []string
+		args  []any
+	)
+	// LIKE and NOCASE are case-insensitive for ASCII in SQLite
+	if filter.Email != "" {
+		conds, args = append(conds, "email = ? COLLATE NOCASE"), append(args, filter.Email)
+	}
+	if filter.EmailPrefix != "" {
+		conds = append(conds, `email LIKE ? ESCAPE '\'`)
+		args = append(args, storage.EscapeLike(filter.EmailPrefix)+"%")
+	}
+	if filter.Name != "" {
+		conds = append(conds, `name LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+storage.EscapeLike(filter.Name)+"%")
+	}
+	if filter.IsAdmin != nil {
+		conds, args = append(conds, "is_admin = ?"), append(args, *filter.IsAdmin)
+	}
+	if !filter.CreatedAfter.IsZero() {
+		conds, args = append(conds, "created_at >= ?"), append(args, filter.CreatedAfter.UTC())
+	}
+	if !filter.CreatedBefore.IsZero() {
+		conds, args = append(conds, "created_at < ?"), append(args, filter.CreatedBefore.UTC())
+	}
+	if len(filter.Statuses) > 0 {
+		placeholders := make([]string, len(filter.Statuses))
+		for i, status := range filter.Statuses {
+			placeholders[i] = "?"
+			args = append(args, string(status))
+		}
+		conds = append(conds, "status IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if filter.ProvisionedBy != 0 {
+		conds = append(conds, "id IN (SELECT user_id FROM scim_users WHERE app_id = ?)")
+		args = append(args, filter.ProvisionedBy)
+	}
+	return conds, args
+}
+
+// SetStatus changes the status of the user. Users whose email was released
+// after deletion can no longer be changed.
+func (s *Storage) SetStatus(ctx context.Context, userID int64, status models.UserStatus, reason string, at time.Time) error {
+	const op = "storage.SetStatus"
+
+	res, err := s.db.ExecContext(ctx, `
+        UPDATE users
+        SET status = ?, status_reason = ?, status_changed_at = ?
+        WHERE id = ? AND email_released_at IS NULL`,
+		string(status), reason, at.UTC(), userID,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 1 {
+		return nil
+	}
+
+	var exists bool
+	err = s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if exists {
+		return fmt.Errorf("%s: %w", op, storage.ErrEmailReleased)
+	}
+	return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+}
+
+// ReleaseDeletedEmails replaces the email of users deleted before
+// deletedBefore with a placeholder, so it can be registered again, and
+// drops their pending verifications. It returns the number of users released.
+func (s *Storage) ReleaseDeletedEmails(ctx context.Context, deletedBefore time.Time, now time.Time) (int64, error) {
+	const op = "storage.ReleaseDeletedEmails"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+        UPDATE users
+        SET email = 'deleted-' || id || '@deleted.invalid', email_released_at = ?
+        WHERE status = 'deleted' AND email_released_at IS NULL AND status_changed_at < ?
+        RETURNING id`,
+		now.UTC(), deletedBefore.UTC(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	var ids []any
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	_, err = tx.ExecContext(ctx, "DELETE FROM email_verifications WHERE user_id IN ("+placeholders+")", ids...)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return int64(len(ids)), nil
+}
+
+// UserData returns everything stored about the user, read in a single
+// transaction.
+func (s *Storage) UserData(ctx context.Context, userID int64) (models.UserData, error) {
+	const op = "storage.UserData"
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var (
+		data      models.UserData
+		u         = &data.User
+		changedAt sql.NullTime
+	)
+	err = tx.QueryRowContext(ctx, `
+        SELECT id, name, email, email_verified, is_admin, status, status_reason, status_changed_at, created_at
+        FROM users
+        WHERE id = ?`,
+		userID,
+	).Scan(&u.ID, &u.Name, &u.Email, &u.EmailVerified, &u.IsAdmin, &u.Status, &u.StatusReason, &changedAt, &u.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.UserData{}, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+	}
+	u.StatusChangedAt = changedAt.Time
+
+	rows, err := tx.QueryContext(ctx, `
+        SELECT token_hash, user_id, email, expires_at
+        FROM email_verifications
+        WHERE user_id = ?
+        ORDER BY expires_at`,
+		userID,
+	)
+	if err != nil {
+		return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v models.EmailVerification
+		if err := rows.Scan(&v.TokenHash, &v.UserID, &v.Email, &v.ExpiresAt); err != nil {
+			return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+		}
+		data.Verifications = append(data.Verifications, v)
+	}
+	if err := rows.Err(); err != nil {
+		return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	groups, err := tx.QueryContext(ctx, `
+        SELECT g.id, g.app_id, g.display_name, g.created_at, g.updated_at
+        FROM user_groups g
+        JOIN user_group_members m ON m.group_id = g.id
+        WHERE m.user_id = ?
+        ORDER BY g.id`,
+		userID,
+	)
+	if err != nil {
+		return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer groups.Close()
+
+	for groups.Next() {
+		var g models.Group
+		if err := groups.Scan(&g.ID, &g.AppID, &g.DisplayName, &g.CreatedAt, &g.UpdatedAt); err != nil {
+			return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+		}
+		data.Groups = append(data.Groups, g)
+	}
+	if err := groups.Err(); err != nil {
+		return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	apps, err := tx.QueryContext(ctx, "SELECT app_id FROM scim_users WHERE user_id = ? ORDER BY app_id", userID)
+	if err != nil {
+		return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer apps.Close()
+
+	for apps.Next() {
+		var appID int64
+		if err := apps.Scan(&appID); err != nil {
+			return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+		}
+		data.SCIMApps = append(data.SCIMApps, appID)
+	}
+	if err := apps.Err(); err != nil {
+		return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// the failed logins are counted under the email, as EraseUser drops them
+	var failures models.LoginFailures
+	err = tx.QueryRowContext(ctx,
+		"SELECT failures, last_failure_at FROM login_failures WHERE key = ?", attempts.AccountKey(u.Email),
+	).Scan(&failures.Failures, &failures.LastFailureAt)
+	switch {
+	case err == nil:
+		data.LoginFailures = &failures
+	case !errors.Is(err, sql.ErrNoRows):
+		return models.UserData{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return data, nil
+}
+
+// EraseUser deletes the user and everything referencing them and records
+// the tombstone, all in one transaction.
+func (s *Storage) EraseUser(ctx context.Context, tombstone models.ErasedUser) error {
+	const op = "storage.EraseUser"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM email_verifications WHERE user_id = ?", tombstone.UserID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_group_members WHERE user_id = ?", tombstone.UserID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM scim_users WHERE user_id = ?", tombstone.UserID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	var email string
+	err = tx.QueryRowContext(ctx, "DELETE FROM users WHERE id = ? RETURNING email", tombstone.UserID).Scan(&email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	// the failed logins are counted under the email
+	if _, err := tx.ExecContext(ctx, "DELETE FROM login_failures WHERE key = ?", attempts.AccountKey(email)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	var erasedBy sql.NullInt64
+	if tombstone.ErasedBy != 0 {
+		erasedBy = sql.NullInt64{Int64: tombstone.ErasedBy, Valid: true}
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO erased_users (user_id, erased_by, reason, erased_at) VALUES (?, ?, ?, ?)",
+		tombstone.UserID, erasedBy, tombstone.Reason, tombstone.ErasedAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// ErasedUser returns the tombstone of an erased user.
+func (s *Storage) ErasedUser(ctx context.Context, userID int64) (models.ErasedUser, error) {
+	const op = "storage.ErasedUser"
+
+	var (
+		e        models.ErasedUser
+		erasedBy sql.NullInt64
+	)
+	err := s.db.QueryRowContext(ctx,
+		"SELECT user_id, erased_by, reason, erased_at FROM erased_users WHERE user_id = ?", userID,
+	).Scan(&e.UserID, &erasedBy, &e.Reason, &e.ErasedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.ErasedUser{}, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		return models.ErasedUser{}, fmt.Errorf("%s: %w", op, err)
+	}
+	e.ErasedBy = erasedBy.Int64
+	return e, nil
+}
+
+// ImportUsers inserts users in one transaction, Status and CreatedAt must
+// be set. A row that fails with storage.ErrUserExists is skipped and
+// reported in its result, any other error aborts the whole batch. With
+// dryRun the transaction is rolled back.
+func (s *Storage) ImportUsers(ctx context.Context, users []models.PortableUser, dryRun bool) ([]models.ImportResult, error) {
+	const op = "storage.ImportUsers"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	results := make([]models.ImportResult, len(users))
+	for i, u := range users {
+		// users imported inactive changed status on import
+		var changedAt *time.Time
+		if u.Status != models.UserStatusActive {
+			changedAt = &now
+		}
+
+		// a savepoint per row, so a duplicate does not abort the transaction
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT import_row"); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		err := tx.QueryRowContext(ctx, `
+            INSERT INTO users (email, name, pass_hash, pepper_version, email_verified, status, status_changed_at, created_at)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+            RETURNING id`,
+			u.Email, u.Name, u.PassHash, u.PepperVersion, u.EmailVerified, string(u.Status), changedAt, u.CreatedAt.UTC(),
+		).Scan(&results[i].ID)
+		if err != nil {
+			if _, rbErr := tx.ExecContext(ctx, "ROLLBACK TO import_row"); rbErr != nil {
+				return nil, fmt.Errorf("%s: %w", op, rbErr)
+			}
+			if isUniqueViolation(err) {
+				results[i].Err = fmt.Errorf("%s: %w", op, storage.ErrUserExists)
+				continue
+			}
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if _, err := tx.ExecContext(ctx, "RELEASE import_row"); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if dryRun {
+		return results, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return results, nil
+}
+
+// ExportUsers returns up to limit users with ids above afterID, ordered by
+// id, password hashes included.
+func (s *Storage) ExportUsers(ctx context.Context, afterID int64, limit int) ([]models.PortableUser, error) {
+	const op = "storage.ExportUsers"
+
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT id, email, name, pass_hash, pepper_version, email_verified, status, created_at
+        FROM users
+        WHERE id > ?
+        ORDER BY id
+        LIMIT ?`,
+		afterID, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var users []models.PortableUser
+	for rows.Next() {
+		var u models.PortableUser
+		if err := rows.Scan(&u.ID, &u.Email, &u.Name, &u.PassHash, &u.PepperVersion, &u.EmailVerified, &u.Status, &u.CreatedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return users, nil
+}
+
+// UpdateUser sets the name and email of a user directly, with no
+// verification. A changed email is no longer verified.
+func (s *Storage) UpdateUser(ctx context.Context, userID int64, name string, email string) error {
+	const op = "storage.UpdateUser"
+
+	res, err := s.db.ExecContext(ctx, `
+        UPDATE users
+        SET name = ?, email = ?, email_verified = (email_verified AND email = ?)
+        WHERE id = ?`,
+		name, email, email, userID,
+	)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("%s: %w", op, storage.ErrUserExists)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := requireAffected(res); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// SaveGroup creates a group with its members and returns its id. A member
+// that does not exist fails with storage.ErrUserNotFound.
+func (s *Storage) SaveGroup(ctx context.Context, group models.Group) (int64, error) {
+	const op = "storage.SaveGroup"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRowContext(ctx, `
+        INSERT INTO user_groups (app_id, display_name, created_at, updated_at)
+        VALUES (?, ?, ?, ?)
+        RETURNING id`,
+		group.AppID, group.DisplayName, group.CreatedAt.UTC(), group.UpdatedAt.UTC(),
+	).Scan(&id)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrGroupExists)
+		}
+		if isForeignKeyViolation(err) {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrAppNotFound)
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := addMembers(ctx, tx, id, group.Members); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return id, nil
+}
+
+// Group returns a group of the app with its members. Deleted users are left
+// out of the members.
+func (s *Storage) Group(ctx context.Context, appID int64, groupID int64) (models.Group, error) {
+	const op = "storage.Group"
+
+	var g models.Group
+	err := s.db.QueryRowContext(ctx, `
+        SELECT id, app_id, display_name, created_at, updated_at
+        FROM user_groups
+        WHERE id = ? AND app_id = ?`,
+		groupID, appID,
+	).Scan(&g.ID, &g.AppID, &g.DisplayName, &g.CreatedAt, &g.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Group{}, fmt.Errorf("%s: %w", op, storage.ErrGroupNotFound)
+		}
+		return models.Group{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	members, err := s.members(ctx, "g.id = ?", groupID)
+	if err != nil {
+		return models.Group{}, fmt.Errorf("%s: %w", op, err)
+	}
+	g.Members = members[g.ID]
+	return g, nil
+}
+
+// Groups returns every group of the app with its members, ordered by id.
+func (s *Storage) Groups(ctx context.Context, appID int64) ([]models.Group, error) {
+	const op = "storage.Groups"
+
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT id, app_id, display_name, created_at, updated_at
+        FROM user_groups
+        WHERE app_id = ?
+        ORDER BY id`,
+		appID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var groups []models.Group
+	for rows.Next() {
+		var g models.Group
+		if err := rows.Scan(&g.ID, &g.AppID, &g.DisplayName, &g.CreatedAt, &g.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		groups = append(groups, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	members, err := s.members(ctx, "g.app_id = ?", appID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	for i := range groups {
+		groups[i].Members = members[groups[i].ID]
+	}
+	return groups, nil
+}
+
+// UpdateGroup renames a group and replaces its members. Memberships of
+// deleted users are kept, so they are back if the user is restored.
+func (s *Storage) UpdateGroup(ctx context.Context, group models.Group) error {
+	const op = "storage.UpdateGroup"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+        UPDATE user_groups
+        SET display_name = ?, updated_at = ?
+        WHERE id = ? AND app_id = ?`,
+		group.DisplayName, group.UpdatedAt.UTC(), group.ID, group.AppID,
+	)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("%s: %w", op, storage.ErrGroupExists)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	} else if n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrGroupNotFound)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        DELETE FROM user_group_members
+        WHERE group_id = ?
+          AND user_id NOT IN (SELECT id FROM users WHERE status = 'deleted')`,
+		group.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := addMembers(ctx, tx, group.ID, group.Members); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func (s *Storage) DeleteGroup(ctx context.Context, appID int64, groupID int64) error {
+	const op = "storage.DeleteGroup"
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM user_groups WHERE id = ? AND app_id = ?", groupID, appID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	} else if n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrGroupNotFound)
+	}
+	return nil
+}
+
+// members returns the members of the groups matching cond, a condition on
+// user_groups g, keyed by group id and ordered by user id.
+func (s *Storage) members(ctx context.Context, cond string, args ...any) (map[int64][]models.GroupMember, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT m.group_id, u.id, u.name
+        FROM user_group_members m
+        JOIN user_groups g ON g.id = m.group_id
+        JOIN users u ON u.id = m.user_id
+        WHERE `+cond+` AND u.status <> 'deleted'
+        ORDER BY m.group_id, u.id`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make(map[int64][]models.GroupMember)
+	for rows.Next() {
+		var (
+			groupID int64
+			m       models.GroupMember
+		)
+		if err := rows.Scan(&groupID, &m.UserID, &m.Name); err != nil {
+			return nil, err
+		}
+		members[groupID] = append(members[groupID], m)
+	}
+	return members, rows.Err()
+}
+
+func addMembers(ctx context.Context, tx *sql.Tx, groupID int64, members []models.GroupMember) error {
+	for _, m := range members {
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO user_group_members (group_id, user_id) VALUES (?, ?) ON CONFLICT DO NOTHING",
+			groupID, m.UserID,
+		)
+		if err != nil {
+			if isForeignKeyViolation(err) {
+				return storage.ErrUserNotFound
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveSCIMUser stores a new user provisioned by the app's SCIM client and
+// records the app as its provisioner, in one transaction.
+func (s *Storage) SaveSCIMUser(ctx context.Context, appID int64, email string, name string, passHash []byte, pepperVersion int) (int, error) {
+	const op = "storage.SaveSCIMUser"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx, `
+        INSERT INTO users (email, name, pass_hash, pepper_version, created_at)
+        VALUES (?, ?, ?, ?, ?)
+        RETURNING id
+    `, email, name, passHash, pepperVersion, time.Now().UTC()).Scan(&id)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrUserExists)
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO scim_users (app_id, user_id) VALUES (?, ?)", appID, id); err != nil {
+		if isForeignKeyViolation(err) {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrAppNotFound)
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return id, nil
+}
+
+// SCIMUser returns a user provisioned by the app's SCIM client. Users the
+// app did not provision are not found.
+func (s *Storage) SCIMUser(ctx context.Context, appID int64, userID int64) (models.UserInfo, error) {
+	const op = "storage.SCIMUser"
+
+	var (
+		u         models.UserInfo
+		changedAt sql.NullTime
+	)
+	err := s.db.QueryRowContext(ctx, `
+        SELECT u.id, u.name, u.email, u.email_verified, u.is_admin, u.status, u.status_reason, u.status_changed_at, u.created_at
+        FROM users u
+        JOIN scim_users p ON p.user_id = u.id
+        WHERE p.app_id = ? AND u.id = ?`,
+		appID, userID,
+	).Scan(&u.ID, &u.Name, &u.Email, &u.EmailVerified, &u.IsAdmin, &u.Status, &u.StatusReason, &changedAt, &u.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.UserInfo{}, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		return models.UserInfo{}, fmt.Errorf("%s: %w", op, err)
+	}
+	u.StatusChangedAt = changedAt.Time
+	return u, nil
+}
+
+// SaveSCIMToken stores a token for the app's SCIM client.
+func (s *Storage) SaveSCIMToken(ctx context.Context, token models.SCIMToken) error {
+	const op = "storage.SaveSCIMToken"
+
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO scim_tokens (token_hash, app_id, created_at) VALUES (?, ?, ?)",
+		token.TokenHash, token.AppID, token.CreatedAt.UTC(),
+	)
+	if err != nil {
+		if isForeignKeyViolation(err) {
+			return fmt.Errorf("%s: %w", op, storage.ErrAppNotFound)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// SCIMTokenApp returns the id of the app the token was issued to.
+func (s *Storage) SCIMTokenApp(ctx context.Context, tokenHash []byte) (int64, error) {
+	const op = "storage.SCIMTokenApp"
+
+	var appID int64
+	err := s.db.QueryRowContext(ctx, "SELECT app_id FROM scim_tokens WHERE token_hash = ?", tokenHash).Scan(&appID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrSCIMTokenNotFound)
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return appID, nil
+}
+
+// RevokeSCIMTokens deletes every token of the app and returns how many
+// there were.
+func (s *Storage) RevokeSCIMTokens(ctx context.Context, appID int64) (int64, error) {
+	const op = "storage.RevokeSCIMTokens"
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM scim_tokens WHERE app_id = ?", appID)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return n, nil
+}
+
+// LoginFailures returns the failed logins counted on key since the given
+// time and when the last one was.
+func (s *Storage) LoginFailures(ctx context.Context, key string, since time.Time) (int, time.Time, error) {
+	const op = "storage.LoginFailures"
+
+	var (
+		failures int
+		last     time.Time
+	)
+	err := s.db.QueryRowContext(ctx,
+		"SELECT failures, last_failure_at FROM login_failures WHERE key = ? AND last_failure_at >= ?",
+		key, since.UTC(),
+	).Scan(&failures, &last)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, time.Time{}, nil
+		}
+		return 0, time.Time{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return failures, last, nil
+}
+
+// ReserveLoginAttempt counts a login attempt on key at the given time as
+// a failure, starting over when the last one was before since. It returns
+// the new count and the time of the failure before, zero if there was
+// none.
+func (s *Storage) ReserveLoginAttempt(ctx context.Context, key string, at time.Time, since time.Time) (int, time.Time, error) {
+	const op = "storage.ReserveLoginAttempt"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var prev time.Time
+	err = tx.QueryRowContext(ctx, "SELECT last_failure_at FROM login_failures WHERE key = ?", key).Scan(&prev)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, time.Time{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var failures int
+	err = tx.QueryRowContext(ctx, `
+        INSERT INTO login_failures (key, failures, last_failure_at)
+        VALUES (?, 1, ?)
+        ON CONFLICT (key) DO UPDATE
+        SET failures = CASE WHEN last_failure_at < ? THEN 1 ELSE failures + 1 END,
+            last_failure_at = excluded.last_failure_at
+        RETURNING failures`,
+		key, at.UTC(), since.UTC(),
+	).Scan(&failures)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, time.Time{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return failures, prev, nil
+}
+
+// ReleaseLoginAttempt takes back the attempt on key reserved at the given
+// time. The last failure goes back to prev unless a later attempt moved
+// it.
+func (s *Storage) ReleaseLoginAttempt(ctx context.Context, key string, at time.Time, prev time.Time) error {
+	const op = "storage.ReleaseLoginAttempt"
+
+	if prev.IsZero() {
+		prev = at
+	}
+	_, err := s.db.ExecContext(ctx, `
+        UPDATE login_failures
+        SET failures = MAX(failures - 1, 0),
+            last_failure_at = CASE WHEN last_failure_at = ? THEN ? ELSE last_failure_at END
+        WHERE key = ?`,
+		at.UTC(), prev.UTC(), key,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func (s *Storage) ResetLoginFailures(ctx context.Context, key string) error {
+	const op = "storage.ResetLoginFailures"
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM login_failures WHERE key = ?", key); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// PruneLoginFailures deletes the counters whose last failure was before
+// the given time and returns how many there were.
+func (s *Storage) PruneLoginFailures(ctx context.Context, before time.Time) (int64, error) {
+	const op = "storage.PruneLoginFailures"
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM login_failures WHERE last_failure_at < ?", before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return n, nil
+}
+
+// ConsumeRateLimit takes a token from the bucket at key, kept as the
+// theoretical arrival time of its next request. The upsert only moves that
+// time while it stays within tolerance of now.
+func (s *Storage) ConsumeRateLimit(ctx context.Context, key string, now time.Time, interval time.Duration, tolerance time.Duration) (bool, time.Time, error) {
+	const op = "storage.ConsumeRateLimit"
+
+	var tat int64
+	err := s.db.QueryRowContext(ctx, `
+        INSERT INTO rate_limits (key, tat)
+        VALUES (?1, ?2 + ?3)
+        ON CONFLICT (key) DO UPDATE
+        SET tat = MAX(tat, ?2) + ?3
+        WHERE MAX(tat, ?2) + ?3 - ?2 <= ?4
+        RETURNING tat`,
+		key, now.UnixNano(), int64(interval), int64(tolerance),
+	).Scan(&tat)
+	if err == nil {
+		return true, time.Unix(0, tat), nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, time.Time{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// the bucket is empty and was left as it is
+	if err := s.db.QueryRowContext(ctx, "SELECT tat FROM rate_limits WHERE key = ?", key).Scan(&tat); err != nil {
+		return false, time.Time{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return false, time.Unix(0, tat), nil
+}
+
+// PruneRateLimits deletes the buckets that were full before the given time
+// and returns how many there were.
+func (s *Storage) PruneRateLimits(ctx context.Context, before time.Time) (int64, error) {
+	const op = "storage.PruneRateLimits"
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM rate_limits WHERE tat < ?", before.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return n, nil
+}
+
+func (s *Storage) IsAdmin(ctx context.Context, userID int64) (bool, error) {
+	const op = "storage.IsAdmin"
+
+	row := s.db.QueryRowContext(ctx, "SELECT is_admin FROM users WHERE id = ?", userID)
+
+	var isAdmin bool
+	if err := row.Scan(&isAdmin); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+		}
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return isAdmin, nil
+}
+
+func (s *Storage) App(ctx context.Context, appID int64) (models.App, error) {
+	const op = "storage.App"
+
+	row := s.db.QueryRowContext(ctx, "SELECT id, name, secret FROM apps WHERE id = ?", appID)
+
+	var app models.App
+	err := row.Scan(&app.ID, &app.Name, &app.Secret)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.App{}, fmt.Errorf("%s: %w", op, storage.ErrAppNotFound)
+		}
+		return models.App{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return app, nil
+}
+
+// UpdatePassHash replaces the password hash of the user and the version of
+// its pepper, but only while the hash is still oldHash, so a rehash cannot
+// undo a password change that raced it. A user whose hash changed
+// meanwhile is ErrUserNotFound.
+func (s *Storage) UpdatePassHash(ctx context.Context, userID int64, oldHash []byte, newHash []byte, pepperVersion int) error {
+	const op = "storage.UpdatePassHash"
+
+	res, err := s.db.ExecContext(ctx,
+		"UPDATE users SET pass_hash = ?, pepper_version = ? WHERE id = ? AND pass_hash = ?",
+		newHash, pepperVersion, userID, oldHash)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := requireAffected(res); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func (s *Storage) SetAdmin(ctx context.Context, userID int64, isAdmin bool) error {
+	const op = "storage.SetAdmin"
+
+	res, err := s.db.ExecContext(ctx, "UPDATE users SET is_admin = ? WHERE id = ?", isAdmin, userID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := requireAffected(res); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// SaveApp creates the app or updates the name and secret of an app with the
+// same id. Another app already using the name or secret is ErrAppExists.
+func (s *Storage) SaveApp(ctx context.Context, app models.App) error {
+	const op = "storage.SaveApp"
+
+	_, err := s.db.ExecContext(ctx, `
+        INSERT INTO apps (id, name, secret)
+        VALUES (?, ?, ?)
+        ON CONFLICT (id) DO UPDATE SET name = excluded.name, secret = excluded.secret
+    `, app.ID, app.Name, app.Secret)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("%s: %w", op, storage.ErrAppExists)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// requireAffected turns an update that matched no user into ErrUserNotFound.
+func requireAffected(res sql.Result) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return storage.ErrUserNotFound
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is a UNIQUE or PRIMARY KEY
+// constraint failure, the SQLite counterpart of Postgres code 23505.
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	switch sqliteErr.Code() {
+	case sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+		return true
+	}
+	return false
+}
+
+// isForeignKeyViolation is the SQLite counterpart of Postgres code 23503.
+func isForeignKeyViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY
+}
@@ -0,0 +1,61 @@
+package sqlite
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/sqlite"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+
+	"sso/internal/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		path := filepath.Join(t.TempDir(), "sso.db")
+
+		m, err := migrate.New("file://../../../migrations/sqlite", "sqlite://"+path)
+		if err != nil {
+			t.Fatalf("migrate: %v", err)
+		}
+		if err := m.Up(); err != nil {
+			t.Fatalf("migrate up: %v", err)
+		}
+		m.Close()
+
+		s, err := New(DSN(path))
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+
+		return s
+	})
+}
+
+func TestDSNEscapesPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "odd?name#with%25.db")
+
+	s, err := New(DSN(path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+
+	var fk int
+	if err := s.db.QueryRow("PRAGMA foreign_keys").Scan(&fk); err != nil {
+		t.Fatalf("foreign_keys: %v", err)
+	}
+	if fk != 1 {
+		t.Errorf("foreign_keys = %d, pragmas of the DSN were dropped", fk)
+	}
+
+	var file string
+	if err := s.db.QueryRow("SELECT file FROM pragma_database_list WHERE name = 'main'").Scan(&file); err != nil {
+		t.Fatalf("database_list: %v", err)
+	}
+	if file != path {
+		t.Errorf("opened %q, want %q", file, path)
+	}
+}
@@ -1,9 +1,52 @@
 package storage
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"strings"
+)
 
 var (
 	ErrUserExists   = errors.New("User already exists")
 	ErrUserNotFound = errors.New("User not found")
 	ErrAppNotFound  = errors.New("App not found")
+	ErrAppExists    = errors.New("App already exists")
+
+	ErrVerificationNotFound = errors.New("Email verification not found")
+	ErrEmailReleased        = errors.New("User email released")
+
+	ErrGroupNotFound     = errors.New("Group not found")
+	ErrGroupExists       = errors.New("Group already exists")
+	ErrSCIMTokenNotFound = errors.New("SCIM token not found")
 )
+
+// PoolStats are the connections of the pool of a backend. Max is 0 when
+// the pool is unbounded.
+type PoolStats struct {
+	Max   int
+	Open  int
+	InUse int
+	Idle  int
+}
+
+type primaryKey struct{}
+
+// WithPrimary marks ctx so that backends with read replicas serve reads
+// from the primary. Use it for reads that must observe a preceding write.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// UsePrimary reports whether ctx was marked with WithPrimary.
+func UsePrimary(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryKey{}).(bool)
+	return primary
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// EscapeLike escapes the LIKE wildcards in s, so it matches literally in a
+// pattern used with ESCAPE '\'.
+func EscapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
@@ -0,0 +1,1522 @@
+// Package storagetest is a conformance suite for storage backends. Every
+// backend runs the same suite from its own tests, so semantics such as
+// error wrapping cannot silently drift between implementations.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sso/internal/domain/models"
+	"sso/internal/lib/attempts"
+	"sso/internal/storage"
+)
+
+// Storage is the behaviour every backend must provide.
+type Storage interface {
+	SaveUser(ctx context.Context, email string, name string, passHash []byte, pepperVersion int) (int, error)
+	User(ctx context.Context, email string) (models.User, error)
+	IsAdmin(ctx context.Context, userID int64) (bool, error)
+	App(ctx context.Context, appID int64) (models.App, error)
+	SetAdmin(ctx context.Context, userID int64, isAdmin bool) error
+	SaveApp(ctx context.Context, app models.App) error
+	UserByID(ctx context.Context, userID int64) (models.User, error)
+	UpdateProfile(ctx context.Context, userID int64, name string, verification *models.EmailVerification) error
+	VerifyEmail(ctx context.Context, tokenHash []byte, now time.Time) (int64, error)
+	ListUsers(ctx context.Context, filter models.UserFilter) ([]models.UserInfo, error)
+	CountUsers(ctx context.Context, filter models.UserFilter) (int, error)
+	SetStatus(ctx context.Context, userID int64, status models.UserStatus, reason string, at time.Time) error
+	ReleaseDeletedEmails(ctx context.Context, deletedBefore time.Time, now time.Time) (int64, error)
+	UserData(ctx context.Context, userID int64) (models.UserData, error)
+	EraseUser(ctx context.Context, tombstone models.ErasedUser) error
+	ErasedUser(ctx context.Context, userID int64) (models.ErasedUser, error)
+	ImportUsers(ctx context.Context, users []models.PortableUser, dryRun bool) ([]models.ImportResult, error)
+	ExportUsers(ctx context.Context, afterID int64, limit int) ([]models.PortableUser, error)
+	SaveSCIMUser(ctx context.Context, appID int64, email string, name string, passHash []byte, pepperVersion int) (int, error)
+	SCIMUser(ctx context.Context, appID int64, userID int64) (models.UserInfo, error)
+	UpdateUser(ctx context.Context, userID int64, name string, email string) error
+	SaveGroup(ctx context.Context, group models.Group) (int64, error)
+	Group(ctx context.Context, appID int64, groupID int64) (models.Group, error)
+	Groups(ctx context.Context, appID int64) ([]models.Group, error)
+	UpdateGroup(ctx context.Context, group models.Group) error
+	DeleteGroup(ctx context.Context, appID int64, groupID int64) error
+	SaveSCIMToken(ctx context.Context, token models.SCIMToken) error
+	SCIMTokenApp(ctx context.Context, tokenHash []byte) (int64, error)
+	RevokeSCIMTokens(ctx context.Context, appID int64) (int64, error)
+	UpdatePassHash(ctx context.Context, userID int64, oldHash []byte, newHash []byte, pepperVersion int) error
+	LoginFailures(ctx context.Context, key string, since time.Time) (int, time.Time, error)
+	ReserveLoginAttempt(ctx context.Context, key string, at time.Time, since time.Time) (int, time.Time, error)
+	ReleaseLoginAttempt(ctx context.Context, key string, at time.Time, prev time.Time) error
+	ResetLoginFailures(ctx context.Context, key string) error
+	PruneLoginFailures(ctx context.Context, before time.Time) (int64, error)
+	ConsumeRateLimit(ctx context.Context, key string, now time.Time, interval time.Duration, tolerance time.Duration) (bool, time.Time, error)
+	PruneRateLimits(ctx context.Context, before time.Time) (int64, error)
+}
+
+// Factory returns an empty, fully migrated backend. It is called once per
+// test case and must register its own cleanup with t.Cleanup.
+type Factory func(t *testing.T) Storage
+
+// Run runs the whole suite against the backend built by newStorage.
+func Run(t *testing.T, newStorage Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s Storage)
+	}{
+		{"SaveUser", testSaveUser},
+		{"SaveUserDuplicateEmail", testSaveUserDuplicateEmail},
+		{"User", testUser},
+		{"UserNotFound", testUserNotFound},
+		{"IsAdmin", testIsAdmin},
+		{"IsAdminNotFound", testIsAdminNotFound},
+		{"SetAdminNotFound", testSetAdminNotFound},
+		{"App", testApp},
+		{"AppNotFound", testAppNotFound},
+		{"SaveAppUpdatesExisting", testSaveAppUpdatesExisting},
+		{"SaveAppDuplicateName", testSaveAppDuplicateName},
+		{"UserByID", testUserByID},
+		{"UserByIDNotFound", testUserByIDNotFound},
+		{"UpdateProfileName", testUpdateProfileName},
+		{"UpdateProfileNotFound", testUpdateProfileNotFound},
+		{"UpdateProfileEmailTaken", testUpdateProfileEmailTaken},
+		{"VerifyEmail", testVerifyEmail},
+		{"VerifyEmailTaken", testVerifyEmailTaken},
+		{"VerifyEmailExpired", testVerifyEmailExpired},
+		{"VerifyEmailSuperseded", testVerifyEmailSuperseded},
+		{"ListUsersFilters", testListUsersFilters},
+		{"ListUsersPagination", testListUsersPagination},
+		{"ListUsersCreatedRange", testListUsersCreatedRange},
+		{"ListUsersOffset", testListUsersOffset},
+		{"CountUsers", testCountUsers},
+		{"SetStatus", testSetStatus},
+		{"SetStatusNotFound", testSetStatusNotFound},
+		{"ReleaseDeletedEmails", testReleaseDeletedEmails},
+		{"UserData", testUserData},
+		{"UserDataNotFound", testUserDataNotFound},
+		{"UserDataProvisioningAndLoginFailures", testUserDataProvisioningAndLoginFailures},
+		{"EraseUser", testEraseUser},
+		{"EraseUserNotFound", testEraseUserNotFound},
+		{"ImportUsers", testImportUsers},
+		{"ImportUsersDryRun", testImportUsersDryRun},
+		{"ExportUsers", testExportUsers},
+		{"SCIMUser", testSCIMUser},
+		{"SCIMUserScope", testSCIMUserScope},
+		{"UpdateUser", testUpdateUser},
+		{"Groups", testGroups},
+		{"GroupsNotFound", testGroupsNotFound},
+		{"GroupDeletedMembers", testGroupDeletedMembers},
+		{"SCIMTokens", testSCIMTokens},
+		{"UpdatePassHash", testUpdatePassHash},
+		{"LoginFailures", testLoginFailures},
+		{"ReleaseLoginAttempt", testReleaseLoginAttempt},
+		{"ReserveLoginAttemptConcurrent", testReserveLoginAttemptConcurrent},
+		{"RateLimits", testRateLimits},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStorage(t))
+		})
+	}
+}
+
+func testSaveUser(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	first := mustSaveUser(t, s, "first@example.com", "First")
+	second := mustSaveUser(t, s, "second@example.com", "Second")
+
+	if first <= 0 || second <= 0 {
+		t.Fatalf("SaveUser returned non-positive ids %d, %d", first, second)
+	}
+	if first == second {
+		t.Fatalf("SaveUser returned the same id %d twice", first)
+	}
+
+	if _, err := s.User(ctx, "second@example.com"); err != nil {
+		t.Fatalf("User after SaveUser: %v", err)
+	}
+}
+
+func testSaveUserDuplicateEmail(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	mustSaveUser(t, s, "dup@example.com", "Original")
+
+	_, err := s.SaveUser(ctx, "dup@example.com", "Copy", []byte("hash"), 0)
+	requireWrapped(t, err, storage.ErrUserExists, "storage.SaveUser")
+
+	user, err := s.User(ctx, "dup@example.com")
+	if err != nil {
+		t.Fatalf("User: %v", err)
+	}
+	if user.Name != "Original" {
+		t.Fatalf("duplicate SaveUser overwrote the user: name = %q", user.Name)
+	}
+}
+
+func testUser(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	// a real bcrypt hash, backends must hand back the exact bytes
+	passHash := []byte("$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy")
+
+	id, err := s.SaveUser(ctx, "user@example.com", "User Name", passHash, 2)
+	if err != nil {
+		t.Fatalf("SaveUser: %v", err)
+	}
+
+	user, err := s.User(ctx, "user@example.com")
+	if err != nil {
+		t.Fatalf("User: %v", err)
+	}
+
+	want := models.User{ID: int64(id), Name: "User Name", Email: "user@example.com", PassHash: passHash, PepperVersion: 2}
+	if user.ID != want.ID || user.Name != want.Name || user.Email != want.Email ||
+		string(user.PassHash) != string(want.PassHash) || user.PepperVersion != want.PepperVersion {
+		t.Fatalf("User = %+v, want %+v", user, want)
+	}
+}
+
+func testUserNotFound(t *testing.T, s Storage) {
+	_, err := s.User(context.Background(), "missing@example.com")
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.User")
+}
+
+func testIsAdmin(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	id := int64(mustSaveUser(t, s, "admin@example.com", "Admin"))
+
+	isAdmin, err := s.IsAdmin(ctx, id)
+	if err != nil {
+		t.Fatalf("IsAdmin: %v", err)
+	}
+	if isAdmin {
+		t.Fatal("new users must not be admins")
+	}
+
+	if err := s.SetAdmin(ctx, id, true); err != nil {
+		t.Fatalf("SetAdmin: %v", err)
+	}
+
+	isAdmin, err = s.IsAdmin(ctx, id)
+	if err != nil {
+		t.Fatalf("IsAdmin: %v", err)
+	}
+	if !isAdmin {
+		t.Fatal("IsAdmin = false after SetAdmin")
+	}
+
+	if err := s.SetAdmin(ctx, id, false); err != nil {
+		t.Fatalf("SetAdmin: %v", err)
+	}
+
+	isAdmin, err = s.IsAdmin(ctx, id)
+	if err != nil {
+		t.Fatalf("IsAdmin: %v", err)
+	}
+	if isAdmin {
+		t.Fatal("IsAdmin = true after SetAdmin(false)")
+	}
+}
+
+func testSetAdminNotFound(t *testing.T, s Storage) {
+	err := s.SetAdmin(context.Background(), 424242, true)
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.SetAdmin")
+}
+
+func testIsAdminNotFound(t *testing.T, s Storage) {
+	_, err := s.IsAdmin(context.Background(), 424242)
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.IsAdmin")
+}
+
+func testApp(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	want := models.App{ID: 7, Name: "test-app", Secret: "test-secret"}
+	if err := s.SaveApp(ctx, want); err != nil {
+		t.Fatalf("SaveApp: %v", err)
+	}
+
+	app, err := s.App(ctx, int64(want.ID))
+	if err != nil {
+		t.Fatalf("App: %v", err)
+	}
+	if app != want {
+		t.Fatalf("App = %+v, want %+v", app, want)
+	}
+}
+
+func testAppNotFound(t *testing.T, s Storage) {
+	_, err := s.App(context.Background(), 424242)
+	requireWrapped(t, err, storage.ErrAppNotFound, "storage.App")
+}
+
+func testSaveAppUpdatesExisting(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	if err := s.SaveApp(ctx, models.App{ID: 1, Name: "old", Secret: "old-secret"}); err != nil {
+		t.Fatalf("SaveApp: %v", err)
+	}
+
+	want := models.App{ID: 1, Name: "new", Secret: "new-secret"}
+	if err := s.SaveApp(ctx, want); err != nil {
+		t.Fatalf("SaveApp again: %v", err)
+	}
+
+	app, err := s.App(ctx, 1)
+	if err != nil {
+		t.Fatalf("App: %v", err)
+	}
+	if app != want {
+		t.Fatalf("App = %+v, want %+v", app, want)
+	}
+}
+
+func testSaveAppDuplicateName(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	if err := s.SaveApp(ctx, models.App{ID: 1, Name: "taken", Secret: "secret-1"}); err != nil {
+		t.Fatalf("SaveApp: %v", err)
+	}
+
+	err := s.SaveApp(ctx, models.App{ID: 2, Name: "taken", Secret: "secret-2"})
+	requireWrapped(t, err, storage.ErrAppExists, "storage.SaveApp")
+}
+
+func testUserByID(t *testing.T, s Storage) {
+	id := int64(mustSaveUser(t, s, "byid@example.com", "By ID"))
+
+	user, err := s.UserByID(context.Background(), id)
+	if err != nil {
+		t.Fatalf("UserByID: %v", err)
+	}
+	if user.ID != id || user.Email != "byid@example.com" || user.Name != "By ID" || user.EmailVerified {
+		t.Fatalf("UserByID = %+v", user)
+	}
+}
+
+func testUserByIDNotFound(t *testing.T, s Storage) {
+	_, err := s.UserByID(context.Background(), 424242)
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.UserByID")
+}
+
+func testUpdateProfileName(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	id := int64(mustSaveUser(t, s, "rename@example.com", "Old"))
+
+	if err := s.UpdateProfile(ctx, id, "New", nil); err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+
+	user, err := s.UserByID(ctx, id)
+	if err != nil {
+		t.Fatalf("UserByID: %v", err)
+	}
+	if user.Name != "New" || user.Email != "rename@example.com" {
+		t.Fatalf("UserByID after rename = %+v", user)
+	}
+}
+
+func testUpdateProfileNotFound(t *testing.T, s Storage) {
+	err := s.UpdateProfile(context.Background(), 424242, "Name", nil)
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.UpdateProfile")
+}
+
+func testUpdateProfileEmailTaken(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	mustSaveUser(t, s, "taken@example.com", "Taken")
+	id := int64(mustSaveUser(t, s, "mover@example.com", "Mover"))
+
+	err := s.UpdateProfile(ctx, id, "Renamed", verification(id, "taken@example.com", "token", time.Hour))
+	requireWrapped(t, err, storage.ErrUserExists, "storage.UpdateProfile")
+
+	// the whole update is rolled back, including the name
+	user, err := s.UserByID(ctx, id)
+	if err != nil {
+		t.Fatalf("UserByID: %v", err)
+	}
+	if user.Name != "Mover" || user.Email != "mover@example.com" {
+		t.Fatalf("failed UpdateProfile changed the user: %+v", user)
+	}
+}
+
+func testVerifyEmail(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	id := int64(mustSaveUser(t, s, "old@example.com", "Verify"))
+
+	v := verification(id, "new@example.com", "token", time.Hour)
+	if err := s.UpdateProfile(ctx, id, "", v); err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+
+	// the new address is pending, logins keep using the old one
+	user, err := s.UserByID(ctx, id)
+	if err != nil {
+		t.Fatalf("UserByID: %v", err)
+	}
+	if user.Email != "old@example.com" {
+		t.Fatalf("after email change request user = %+v, want the old email", user)
+	}
+	if _, err := s.User(ctx, "new@example.com"); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Fatalf("User by the unverified email = %v, want ErrUserNotFound", err)
+	}
+
+	verifiedID, err := s.VerifyEmail(ctx, v.TokenHash, time.Now())
+	if err != nil {
+		t.Fatalf("VerifyEmail: %v", err)
+	}
+	if verifiedID != id {
+		t.Fatalf("VerifyEmail = %d, want %d", verifiedID, id)
+	}
+
+	user, err = s.UserByID(ctx, id)
+	if err != nil {
+		t.Fatalf("UserByID: %v", err)
+	}
+	if user.Email != "new@example.com" || !user.EmailVerified {
+		t.Fatalf("after VerifyEmail user = %+v, want the new email verified", user)
+	}
+
+	// tokens are single use
+	_, err = s.VerifyEmail(ctx, v.TokenHash, time.Now())
+	requireWrapped(t, err, storage.ErrVerificationNotFound, "storage.VerifyEmail")
+}
+
+func testVerifyEmailTaken(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	id := int64(mustSaveUser(t, s, "slow@example.com", "Slow"))
+	v := verification(id, "contested@example.com", "token", time.Hour)
+	if err := s.UpdateProfile(ctx, id, "", v); err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+	mustSaveUser(t, s, "contested@example.com", "Fast")
+
+	_, err := s.VerifyEmail(ctx, v.TokenHash, time.Now())
+	requireWrapped(t, err, storage.ErrUserExists, "storage.VerifyEmail")
+
+	user, err := s.UserByID(ctx, id)
+	if err != nil {
+		t.Fatalf("UserByID: %v", err)
+	}
+	if user.Email != "slow@example.com" {
+		t.Fatalf("VerifyEmail of a taken address changed the user: %+v", user)
+	}
+}
+
+func testVerifyEmailExpired(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	id := int64(mustSaveUser(t, s, "expired@example.com", "Expired"))
+
+	v := verification(id, "expired-new@example.com", "token", time.Hour)
+	if err := s.UpdateProfile(ctx, id, "", v); err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+
+	_, err := s.VerifyEmail(ctx, v.TokenHash, time.Now().Add(2*time.Hour))
+	requireWrapped(t, err, storage.ErrVerificationNotFound, "storage.VerifyEmail")
+}
+
+func testVerifyEmailSuperseded(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	id := int64(mustSaveUser(t, s, "first@example.com", "Superseded"))
+
+	first := verification(id, "second@example.com", "first-token", time.Hour)
+	if err := s.UpdateProfile(ctx, id, "", first); err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+	second := verification(id, "third@example.com", "second-token", time.Hour)
+	if err := s.UpdateProfile(ctx, id, "", second); err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+
+	_, err := s.VerifyEmail(ctx, first.TokenHash, time.Now())
+	requireWrapped(t, err, storage.ErrVerificationNotFound, "storage.VerifyEmail")
+
+	if _, err := s.VerifyEmail(ctx, second.TokenHash, time.Now()); err != nil {
+		t.Fatalf("VerifyEmail with the latest token: %v", err)
+	}
+}
+
+func testListUsersFilters(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	alice := int64(mustSaveUser(t, s, "alice@example.com", "Alice Smith"))
+	mustSaveUser(t, s, "bob@example.com", "Bob Jones")
+	mustSaveUser(t, s, "al_x@example.com", "Alex Smithers")
+	if err := s.SetAdmin(ctx, alice, true); err != nil {
+		t.Fatalf("SetAdmin: %v", err)
+	}
+
+	admin, notAdmin := true, false
+	tests := []struct {
+		name   string
+		filter models.UserFilter
+		want   []string
+	}{
+		{"All", models.UserFilter{}, []string{"alice@example.com", "bob@example.com", "al_x@example.com"}},
+		{"EmailPrefix", models.UserFilter{EmailPrefix: "AL"}, []string{"alice@example.com", "al_x@example.com"}},
+		{"EmailPrefixIsLiteral", models.UserFilter{EmailPrefix: "al_"}, []string{"al_x@example.com"}},
+		{"Name", models.UserFilter{Name: "smith"}, []string{"alice@example.com", "al_x@example.com"}},
+		{"Admin", models.UserFilter{IsAdmin: &admin}, []string{"alice@example.com"}},
+		{"NotAdmin", models.UserFilter{IsAdmin: &notAdmin}, []string{"bob@example.com", "al_x@example.com"}},
+		{"Status", models.UserFilter{Statuses: []models.UserStatus{models.UserStatusActive}}, []string{"alice@example.com", "bob@example.com", "al_x@example.com"}},
+		{"NoStatusMatch", models.UserFilter{Statuses: []models.UserStatus{"gone"}}, nil},
+		{"Combined", models.UserFilter{EmailPrefix: "al", IsAdmin: &notAdmin}, []string{"al_x@example.com"}},
+	}
+
+	for _, tt := range tests {
+		tt.filter.Limit = 10
+		users, err := s.ListUsers(ctx, tt.filter)
+		if err != nil {
+			t.Fatalf("%s: ListUsers: %v", tt.name, err)
+		}
+		if got := emails(users); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: ListUsers = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	users, err := s.ListUsers(ctx, models.UserFilter{EmailPrefix: "alice", Limit: 10})
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	u := users[0]
+	if u.ID != alice || u.Name != "Alice Smith" || !u.IsAdmin || u.Status != models.UserStatusActive || u.CreatedAt.IsZero() {
+		t.Fatalf("ListUsers returned %+v", u)
+	}
+}
+
+func testListUsersPagination(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	var want []string
+	for i := 0; i < 5; i++ {
+		email := fmt.Sprintf("page%d@example.com", i)
+		mustSaveUser(t, s, email, "Paged")
+		want = append(want, email)
+	}
+
+	var (
+		got     []string
+		afterID int64
+	)
+	for {
+		users, err := s.ListUsers(ctx, models.UserFilter{AfterID: afterID, Limit: 2})
+		if err != nil {
+			t.Fatalf("ListUsers: %v", err)
+		}
+		if len(users) > 2 {
+			t.Fatalf("ListUsers returned %d users, limit is 2", len(users))
+		}
+		if len(users) == 0 {
+			break
+		}
+		for _, u := range users {
+			if u.ID <= afterID {
+				t.Fatalf("ListUsers returned id %d after cursor %d", u.ID, afterID)
+			}
+			afterID = u.ID
+		}
+		got = append(got, emails(users)...)
+	}
+
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("paged through %v, want %v", got, want)
+	}
+}
+
+func testListUsersCreatedRange(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	mustSaveUser(t, s, "created@example.com", "Created")
+
+	hour := time.Hour
+	tests := []struct {
+		name   string
+		after  time.Time
+		before time.Time
+		want   int
+	}{
+		{"Around", time.Now().Add(-hour), time.Now().Add(hour), 1},
+		{"Future", time.Now().Add(hour), time.Time{}, 0},
+		{"Past", time.Time{}, time.Now().Add(-hour), 0},
+	}
+
+	for _, tt := range tests {
+		users, err := s.ListUsers(ctx, models.UserFilter{CreatedAfter: tt.after, CreatedBefore: tt.before, Limit: 10})
+		if err != nil {
+			t.Fatalf("%s: ListUsers: %v", tt.name, err)
+		}
+		if len(users) != tt.want {
+			t.Errorf("%s: ListUsers returned %d users, want %d", tt.name, len(users), tt.want)
+		}
+	}
+}
+
+func testListUsersOffset(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		mustSaveUser(t, s, fmt.Sprintf("offset%d@example.com", i), "Offset")
+	}
+
+	users, err := s.ListUsers(ctx, models.UserFilter{Offset: 3, Limit: 10})
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	if got := emails(users); strings.Join(got, ",") != "offset3@example.com,offset4@example.com" {
+		t.Fatalf("ListUsers with offset 3 = %v", got)
+	}
+}
+
+func testCountUsers(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	alice := int64(mustSaveUser(t, s, "alice@example.com", "Alice Smith"))
+	mustSaveUser(t, s, "bob@example.com", "Bob Jones")
+	mustSaveUser(t, s, "al_x@example.com", "Alex Smithers")
+	if err := s.SetAdmin(ctx, alice, true); err != nil {
+		t.Fatalf("SetAdmin: %v", err)
+	}
+
+	notAdmin := false
+	tests := []struct {
+		name   string
+		filter models.UserFilter
+		want   int
+	}{
+		{"All", models.UserFilter{}, 3},
+		{"Email", models.UserFilter{Email: "ALICE@example.com"}, 1},
+		{"EmailIsWhole", models.UserFilter{Email: "alice"}, 0},
+		{"Combined", models.UserFilter{Name: "smith", IsAdmin: &notAdmin}, 1},
+		// the cursor and paging do not narrow a count
+		{"Paging", models.UserFilter{AfterID: alice, Offset: 2, Limit: 1}, 3},
+	}
+	for _, tt := range tests {
+		n, err := s.CountUsers(ctx, tt.filter)
+		if err != nil {
+			t.Fatalf("%s: CountUsers: %v", tt.name, err)
+		}
+		if n != tt.want {
+			t.Errorf("%s: CountUsers = %d, want %d", tt.name, n, tt.want)
+		}
+	}
+}
+
+func testSetStatus(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	id := int64(mustSaveUser(t, s, "status@example.com", "Status"))
+
+	user, err := s.User(ctx, "status@example.com")
+	if err != nil {
+		t.Fatalf("User: %v", err)
+	}
+	if user.Status != models.UserStatusActive {
+		t.Fatalf("new user status = %q, want %q", user.Status, models.UserStatusActive)
+	}
+
+	at := time.Now().Add(-time.Minute)
+	if err := s.SetStatus(ctx, id, models.UserStatusLocked, "suspicious activity", at); err != nil {
+		t.Fatalf("SetStatus: %v", err)
+	}
+
+	user, err = s.UserByID(ctx, id)
+	if err != nil {
+		t.Fatalf("UserByID: %v", err)
+	}
+	if user.Status != models.UserStatusLocked {
+		t.Fatalf("status = %q after SetStatus, want %q", user.Status, models.UserStatusLocked)
+	}
+
+	users, err := s.ListUsers(ctx, models.UserFilter{Limit: 10})
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	info := users[0]
+	if info.StatusReason != "suspicious activity" || !info.StatusChangedAt.Round(time.Second).Equal(at.Round(time.Second)) {
+		t.Fatalf("ListUsers = %+v, want reason and change time from SetStatus", info)
+	}
+}
+
+func testSetStatusNotFound(t *testing.T, s Storage) {
+	err := s.SetStatus(context.Background(), 424242, models.UserStatusDisabled, "", time.Now())
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.SetStatus")
+}
+
+func testReleaseDeletedEmails(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	old := int64(mustSaveUser(t, s, "old@example.com", "Old"))
+	recent := int64(mustSaveUser(t, s, "recent@example.com", "Recent"))
+	mustSaveUser(t, s, "active@example.com", "Active")
+
+	now := time.Now()
+	if err := s.SetStatus(ctx, old, models.UserStatusDeleted, "", now.Add(-48*time.Hour)); err != nil {
+		t.Fatalf("SetStatus: %v", err)
+	}
+	if err := s.SetStatus(ctx, recent, models.UserStatusDeleted, "", now.Add(-time.Hour)); err != nil {
+		t.Fatalf("SetStatus: %v", err)
+	}
+	if err := s.UpdateProfile(ctx, old, "", verification(old, "pending@example.com", "old-token", time.Hour)); err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+
+	n, err := s.ReleaseDeletedEmails(ctx, now.Add(-24*time.Hour), now)
+	if err != nil {
+		t.Fatalf("ReleaseDeletedEmails: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("ReleaseDeletedEmails released %d users, want 1", n)
+	}
+
+	// the email changed by UpdateProfile is free again, the recent one is not
+	if _, err := s.SaveUser(ctx, "pending@example.com", "Reused", []byte("hash"), 0); err != nil {
+		t.Fatalf("SaveUser with a released email: %v", err)
+	}
+	_, err = s.SaveUser(ctx, "recent@example.com", "Reused", []byte("hash"), 0)
+	requireWrapped(t, err, storage.ErrUserExists, "storage.SaveUser")
+
+	_, err = s.VerifyEmail(ctx, []byte("old-token"), now)
+	requireWrapped(t, err, storage.ErrVerificationNotFound, "storage.VerifyEmail")
+
+	err = s.SetStatus(ctx, old, models.UserStatusActive, "", now)
+	requireWrapped(t, err, storage.ErrEmailReleased, "storage.SetStatus")
+
+	if err := s.SetStatus(ctx, recent, models.UserStatusActive, "restored", now); err != nil {
+		t.Fatalf("restoring a user within retention: %v", err)
+	}
+
+	if n, err := s.ReleaseDeletedEmails(ctx, now.Add(-24*time.Hour), now); err != nil || n != 0 {
+		t.Fatalf("second ReleaseDeletedEmails = %d, %v, want 0, nil", n, err)
+	}
+}
+
+func testUserData(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	id := int64(mustSaveUser(t, s, "data@example.com", "Data"))
+	if err := s.SetAdmin(ctx, id, true); err != nil {
+		t.Fatalf("SetAdmin: %v", err)
+	}
+	v := verification(id, "new-data@example.com", "data-token", time.Hour)
+	if err := s.UpdateProfile(ctx, id, "", v); err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+
+	data, err := s.UserData(ctx, id)
+	if err != nil {
+		t.Fatalf("UserData: %v", err)
+	}
+	u := data.User
+	if u.ID != id || u.Name != "Data" || u.Email != "data@example.com" || !u.IsAdmin || u.Status != models.UserStatusActive {
+		t.Fatalf("UserData.User = %+v", u)
+	}
+	if len(data.Verifications) != 1 {
+		t.Fatalf("UserData returned %d verifications, want 1", len(data.Verifications))
+	}
+	got := data.Verifications[0]
+	if got.Email != v.Email || string(got.TokenHash) != string(v.TokenHash) || got.UserID != id {
+		t.Fatalf("UserData.Verifications[0] = %+v, want %+v", got, *v)
+	}
+}
+
+// testUserDataProvisioningAndLoginFailures checks that the export covers
+// the rows EraseUser drops besides the user's own.
+func testUserDataProvisioningAndLoginFailures(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	if err := s.SaveApp(ctx, models.App{ID: 1, Name: "idp", Secret: "secret"}); err != nil {
+		t.Fatalf("SaveApp: %v", err)
+	}
+	id, err := s.SaveSCIMUser(ctx, 1, "provisioned@example.com", "Provisioned", []byte("hash"), 0)
+	if err != nil {
+		t.Fatalf("SaveSCIMUser: %v", err)
+	}
+
+	data, err := s.UserData(ctx, int64(id))
+	if err != nil {
+		t.Fatalf("UserData: %v", err)
+	}
+	if data.LoginFailures != nil {
+		t.Fatalf("UserData.LoginFailures = %+v before any failure", *data.LoginFailures)
+	}
+
+	at := time.Now().Truncate(time.Second)
+	key := attempts.AccountKey("provisioned@example.com")
+	for i := 0; i < 2; i++ {
+		if _, _, err := s.ReserveLoginAttempt(ctx, key, at, at.Add(-time.Hour)); err != nil {
+			t.Fatalf("ReserveLoginAttempt: %v", err)
+		}
+	}
+
+	data, err = s.UserData(ctx, int64(id))
+	if err != nil {
+		t.Fatalf("UserData: %v", err)
+	}
+	if len(data.SCIMApps) != 1 || data.SCIMApps[0] != 1 {
+		t.Errorf("UserData.SCIMApps = %v, want [1]", data.SCIMApps)
+	}
+	if f := data.LoginFailures; f == nil || f.Failures != 2 || !f.LastFailureAt.Equal(at) {
+		t.Errorf("UserData.LoginFailures = %+v, want 2 failures at %v", f, at)
+	}
+}
+
+func testUserDataNotFound(t *testing.T, s Storage) {
+	_, err := s.UserData(context.Background(), 424242)
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.UserData")
+}
+
+func testEraseUser(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	id := int64(mustSaveUser(t, s, "erase@example.com", "Erase"))
+	admin := int64(mustSaveUser(t, s, "eraser@example.com", "Eraser"))
+	if err := s.UpdateProfile(ctx, id, "", verification(id, "pending-erase@example.com", "erase-token", time.Hour)); err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+
+	now := time.Now()
+	for _, key := range []string{attempts.AccountKey("erase@example.com"), "ip:192.0.2.1"} {
+		if _, _, err := s.ReserveLoginAttempt(ctx, key, now, now.Add(-time.Hour)); err != nil {
+			t.Fatalf("ReserveLoginAttempt(%s): %v", key, err)
+		}
+	}
+
+	_, err := s.ErasedUser(ctx, id)
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.ErasedUser")
+
+	erasedAt := time.Now().Add(-time.Minute)
+	if err := s.EraseUser(ctx, models.ErasedUser{UserID: id, ErasedBy: admin, Reason: "request #1", ErasedAt: erasedAt}); err != nil {
+		t.Fatalf("EraseUser: %v", err)
+	}
+
+	_, err = s.UserByID(ctx, id)
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.UserByID")
+	_, err = s.VerifyEmail(ctx, []byte("erase-token"), time.Now())
+	requireWrapped(t, err, storage.ErrVerificationNotFound, "storage.VerifyEmail")
+
+	// the throttle counters keyed by the email go too, not those of addresses
+	if n, _, err := s.LoginFailures(ctx, attempts.AccountKey("erase@example.com"), now.Add(-time.Hour)); err != nil || n != 0 {
+		t.Fatalf("LoginFailures of the erased email = %d, %v, want 0", n, err)
+	}
+	if n, _, err := s.LoginFailures(ctx, "ip:192.0.2.1", now.Add(-time.Hour)); err != nil || n != 1 {
+		t.Fatalf("LoginFailures of an address = %d, %v, want 1", n, err)
+	}
+
+	if _, err := s.SaveUser(ctx, "pending-erase@example.com", "Again", []byte("hash"), 0); err != nil {
+		t.Fatalf("SaveUser with the email of an erased user: %v", err)
+	}
+
+	tombstone, err := s.ErasedUser(ctx, id)
+	if err != nil {
+		t.Fatalf("ErasedUser: %v", err)
+	}
+	if tombstone.UserID != id || tombstone.ErasedBy != admin || tombstone.Reason != "request #1" ||
+		!tombstone.ErasedAt.Round(time.Second).Equal(erasedAt.Round(time.Second)) {
+		t.Fatalf("ErasedUser = %+v", tombstone)
+	}
+
+	err = s.EraseUser(ctx, models.ErasedUser{UserID: id, ErasedAt: time.Now()})
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.EraseUser")
+}
+
+func testEraseUserNotFound(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	err := s.EraseUser(ctx, models.ErasedUser{UserID: 424242, ErasedAt: time.Now()})
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.EraseUser")
+
+	// a failed erase must not leave a tombstone behind
+	_, err = s.ErasedUser(ctx, 424242)
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.ErasedUser")
+}
+
+func testImportUsers(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	mustSaveUser(t, s, "existing@example.com", "Existing")
+
+	createdAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	argon := []byte("$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$2mzTAI85jwP6+k/mHDeH3OgNt7E86G5W")
+	users := []models.PortableUser{
+		{Email: "imported@example.com", Name: "Imported", PassHash: argon, PepperVersion: 3, EmailVerified: true, Status: models.UserStatusActive, CreatedAt: createdAt},
+		{Email: "existing@example.com", Name: "Clash", PassHash: []byte("hash"), Status: models.UserStatusActive, CreatedAt: createdAt},
+		{Email: "locked@example.com", Name: "Locked", PassHash: []byte("hash"), Status: models.UserStatusLocked, CreatedAt: createdAt},
+		{Email: "imported@example.com", Name: "Twice", PassHash: []byte("hash"), Status: models.UserStatusActive, CreatedAt: createdAt},
+	}
+
+	results, err := s.ImportUsers(ctx, users, false)
+	if err != nil {
+		t.Fatalf("ImportUsers: %v", err)
+	}
+	if len(results) != len(users) {
+		t.Fatalf("ImportUsers returned %d results for %d users", len(results), len(users))
+	}
+	if results[0].Err != nil || results[0].ID <= 0 || results[2].Err != nil || results[2].ID <= 0 {
+		t.Fatalf("ImportUsers results = %+v, want rows 0 and 2 imported", results)
+	}
+	requireWrapped(t, results[1].Err, storage.ErrUserExists, "storage.ImportUsers")
+	requireWrapped(t, results[3].Err, storage.ErrUserExists, "storage.ImportUsers")
+
+	user, err := s.User(ctx, "imported@example.com")
+	if err != nil {
+		t.Fatalf("User: %v", err)
+	}
+	if user.ID != results[0].ID || user.Name != "Imported" || string(user.PassHash) != string(argon) || user.PepperVersion != 3 || !user.EmailVerified {
+		t.Fatalf("imported user = %+v", user)
+	}
+
+	listed, err := s.ListUsers(ctx, models.UserFilter{Statuses: []models.UserStatus{models.UserStatusLocked}, Limit: 10})
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	if len(listed) != 1 || !listed[0].CreatedAt.Equal(createdAt) || listed[0].StatusChangedAt.IsZero() {
+		t.Fatalf("imported locked user = %+v, want created_at kept and status change recorded", listed)
+	}
+}
+
+func testImportUsersDryRun(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	users := []models.PortableUser{
+		{Email: "dry@example.com", Name: "Dry", PassHash: []byte("hash"), Status: models.UserStatusActive, CreatedAt: time.Now()},
+	}
+	results, err := s.ImportUsers(ctx, users, true)
+	if err != nil {
+		t.Fatalf("ImportUsers: %v", err)
+	}
+	if results[0].Err != nil {
+		t.Fatalf("dry run result = %+v", results[0])
+	}
+
+	_, err = s.User(ctx, "dry@example.com")
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.User")
+}
+
+func testExportUsers(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	var want []string
+	for i := 0; i < 3; i++ {
+		email := fmt.Sprintf("export%d@example.com", i)
+		mustSaveUser(t, s, email, "Export")
+		want = append(want, email)
+	}
+
+	var (
+		got     []string
+		afterID int64
+	)
+	for {
+		users, err := s.ExportUsers(ctx, afterID, 2)
+		if err != nil {
+			t.Fatalf("ExportUsers: %v", err)
+		}
+		if len(users) == 0 {
+			break
+		}
+		for _, u := range users {
+			if string(u.PassHash) != "hash" || u.PepperVersion != 0 || u.Status != models.UserStatusActive || u.CreatedAt.IsZero() {
+				t.Fatalf("ExportUsers returned %+v", u)
+			}
+			got = append(got, u.Email)
+			afterID = u.ID
+		}
+	}
+
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("exported %v, want %v", got, want)
+	}
+}
+
+func testSCIMUser(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	if err := s.SaveApp(ctx, models.App{ID: 1, Name: "idp", Secret: "secret"}); err != nil {
+		t.Fatalf("SaveApp: %v", err)
+	}
+	n, err := s.SaveSCIMUser(ctx, 1, "info@example.com", "Info", []byte("hash"), 2)
+	if err != nil {
+		t.Fatalf("SaveSCIMUser: %v", err)
+	}
+	id := int64(n)
+	if err := s.SetAdmin(ctx, id, true); err != nil {
+		t.Fatalf("SetAdmin: %v", err)
+	}
+
+	u, err := s.SCIMUser(ctx, 1, id)
+	if err != nil {
+		t.Fatalf("SCIMUser: %v", err)
+	}
+	if u.ID != id || u.Name != "Info" || u.Email != "info@example.com" || !u.IsAdmin ||
+		u.Status != models.UserStatusActive || u.CreatedAt.IsZero() {
+		t.Fatalf("SCIMUser = %+v", u)
+	}
+
+	user, err := s.UserByID(ctx, id)
+	if err != nil {
+		t.Fatalf("UserByID: %v", err)
+	}
+	if string(user.PassHash) != "hash" || user.PepperVersion != 2 {
+		t.Fatalf("SaveSCIMUser stored %+v", user)
+	}
+
+	_, err = s.SCIMUser(ctx, 1, 424242)
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.SCIMUser")
+
+	_, err = s.SaveSCIMUser(ctx, 1, "info@example.com", "Again", []byte("hash"), 0)
+	requireWrapped(t, err, storage.ErrUserExists, "storage.SaveSCIMUser")
+
+	_, err = s.SaveSCIMUser(ctx, 42, "orphan@example.com", "Orphan", []byte("hash"), 0)
+	requireWrapped(t, err, storage.ErrAppNotFound, "storage.SaveSCIMUser")
+	// the user insert is rolled back with the provisioning
+	_, err = s.User(ctx, "orphan@example.com")
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.User")
+}
+
+func testSCIMUserScope(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	for _, app := range []models.App{{ID: 1, Name: "first", Secret: "s1"}, {ID: 2, Name: "second", Secret: "s2"}} {
+		if err := s.SaveApp(ctx, app); err != nil {
+			t.Fatalf("SaveApp: %v", err)
+		}
+	}
+	first, err := s.SaveSCIMUser(ctx, 1, "first@example.com", "First", []byte("hash"), 0)
+	if err != nil {
+		t.Fatalf("SaveSCIMUser: %v", err)
+	}
+	if _, err := s.SaveSCIMUser(ctx, 2, "second@example.com", "Second", []byte("hash"), 0); err != nil {
+		t.Fatalf("SaveSCIMUser: %v", err)
+	}
+	registered := mustSaveUser(t, s, "registered@example.com", "Registered")
+
+	_, err = s.SCIMUser(ctx, 2, int64(first))
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.SCIMUser")
+	_, err = s.SCIMUser(ctx, 1, int64(registered))
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.SCIMUser")
+
+	users, err := s.ListUsers(ctx, models.UserFilter{ProvisionedBy: 1, Limit: 10})
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	if got := emails(users); strings.Join(got, ",") != "first@example.com" {
+		t.Errorf("ListUsers provisioned by app 1 = %v", got)
+	}
+	n, err := s.CountUsers(ctx, models.UserFilter{ProvisionedBy: 2})
+	if err != nil {
+		t.Fatalf("CountUsers: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("CountUsers provisioned by app 2 = %d, want 1", n)
+	}
+
+	// erasing the user drops its provisioning
+	if err := s.EraseUser(ctx, models.ErasedUser{UserID: int64(first), ErasedAt: time.Now()}); err != nil {
+		t.Fatalf("EraseUser: %v", err)
+	}
+	n, err = s.CountUsers(ctx, models.UserFilter{ProvisionedBy: 1})
+	if err != nil {
+		t.Fatalf("CountUsers: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("CountUsers after the erase = %d, want 0", n)
+	}
+}
+
+func testUpdateUser(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	id := int64(mustSaveUser(t, s, "update@example.com", "Update"))
+	mustSaveUser(t, s, "taken@example.com", "Taken")
+	if err := s.UpdateProfile(ctx, id, "", verification(id, "update@example.com", "update-token", time.Hour)); err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+	if _, err := s.VerifyEmail(ctx, []byte("update-token"), time.Now()); err != nil {
+		t.Fatalf("VerifyEmail: %v", err)
+	}
+
+	// a rename keeps the email verified
+	if err := s.UpdateUser(ctx, id, "Renamed", "update@example.com"); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	user, err := s.UserByID(ctx, id)
+	if err != nil {
+		t.Fatalf("UserByID: %v", err)
+	}
+	if user.Name != "Renamed" || !user.EmailVerified {
+		t.Fatalf("after rename: %+v", user)
+	}
+
+	if err := s.UpdateUser(ctx, id, "Renamed", "moved@example.com"); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	user, err = s.UserByID(ctx, id)
+	if err != nil {
+		t.Fatalf("UserByID: %v", err)
+	}
+	if user.Email != "moved@example.com" || user.EmailVerified {
+		t.Fatalf("after email change: %+v", user)
+	}
+
+	err = s.UpdateUser(ctx, id, "Renamed", "taken@example.com")
+	requireWrapped(t, err, storage.ErrUserExists, "storage.UpdateUser")
+
+	err = s.UpdateUser(ctx, 424242, "Nobody", "nobody@example.com")
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.UpdateUser")
+}
+
+func testGroups(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	for _, app := range []models.App{{ID: 1, Name: "one", Secret: "one"}, {ID: 2, Name: "two", Secret: "two"}} {
+		if err := s.SaveApp(ctx, app); err != nil {
+			t.Fatalf("SaveApp: %v", err)
+		}
+	}
+	alice := int64(mustSaveUser(t, s, "alice@example.com", "Alice"))
+	bob := int64(mustSaveUser(t, s, "bob@example.com", "Bob"))
+
+	now := time.Now()
+	id, err := s.SaveGroup(ctx, models.Group{
+		AppID:       1,
+		DisplayName: "Engineering",
+		Members:     []models.GroupMember{{UserID: bob}, {UserID: alice}},
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	})
+	if err != nil {
+		t.Fatalf("SaveGroup: %v", err)
+	}
+
+	group, err := s.Group(ctx, 1, id)
+	if err != nil {
+		t.Fatalf("Group: %v", err)
+	}
+	want := []models.GroupMember{{UserID: alice, Name: "Alice"}, {UserID: bob, Name: "Bob"}}
+	if group.DisplayName != "Engineering" || fmt.Sprint(group.Members) != fmt.Sprint(want) {
+		t.Fatalf("Group = %+v, want members %+v", group, want)
+	}
+
+	// the same name is fine in another app, not in the same one
+	if _, err := s.SaveGroup(ctx, models.Group{AppID: 2, DisplayName: "Engineering", CreatedAt: now, UpdatedAt: now}); err != nil {
+		t.Fatalf("SaveGroup in another app: %v", err)
+	}
+	_, err = s.SaveGroup(ctx, models.Group{AppID: 1, DisplayName: "Engineering", CreatedAt: now, UpdatedAt: now})
+	requireWrapped(t, err, storage.ErrGroupExists, "storage.SaveGroup")
+
+	_, err = s.Group(ctx, 2, id)
+	requireWrapped(t, err, storage.ErrGroupNotFound, "storage.Group")
+
+	group.DisplayName = "Platform"
+	group.Members = []models.GroupMember{{UserID: bob}}
+	group.UpdatedAt = now.Add(time.Minute)
+	if err := s.UpdateGroup(ctx, group); err != nil {
+		t.Fatalf("UpdateGroup: %v", err)
+	}
+
+	groups, err := s.Groups(ctx, 1)
+	if err != nil {
+		t.Fatalf("Groups: %v", err)
+	}
+	if len(groups) != 1 || groups[0].DisplayName != "Platform" ||
+		len(groups[0].Members) != 1 || groups[0].Members[0].UserID != bob {
+		t.Fatalf("Groups after update = %+v", groups)
+	}
+
+	data, err := s.UserData(ctx, bob)
+	if err != nil {
+		t.Fatalf("UserData: %v", err)
+	}
+	if len(data.Groups) != 1 || data.Groups[0].ID != id || data.Groups[0].DisplayName != "Platform" {
+		t.Fatalf("UserData.Groups = %+v", data.Groups)
+	}
+
+	if err := s.DeleteGroup(ctx, 1, id); err != nil {
+		t.Fatalf("DeleteGroup: %v", err)
+	}
+	_, err = s.Group(ctx, 1, id)
+	requireWrapped(t, err, storage.ErrGroupNotFound, "storage.Group")
+}
+
+func testGroupsNotFound(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	if err := s.SaveApp(ctx, models.App{ID: 1, Name: "one", Secret: "one"}); err != nil {
+		t.Fatalf("SaveApp: %v", err)
+	}
+	now := time.Now()
+
+	_, err := s.SaveGroup(ctx, models.Group{AppID: 404, DisplayName: "G", CreatedAt: now, UpdatedAt: now})
+	requireWrapped(t, err, storage.ErrAppNotFound, "storage.SaveGroup")
+
+	_, err = s.SaveGroup(ctx, models.Group{
+		AppID:       1,
+		DisplayName: "G",
+		Members:     []models.GroupMember{{UserID: 424242}},
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	})
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.SaveGroup")
+
+	// the failed save must not leave the group behind
+	groups, err := s.Groups(ctx, 1)
+	if err != nil {
+		t.Fatalf("Groups: %v", err)
+	}
+	if len(groups) != 0 {
+		t.Fatalf("Groups = %+v, want none", groups)
+	}
+
+	err = s.UpdateGroup(ctx, models.Group{ID: 424242, AppID: 1, DisplayName: "G", UpdatedAt: now})
+	requireWrapped(t, err, storage.ErrGroupNotFound, "storage.UpdateGroup")
+	err = s.DeleteGroup(ctx, 1, 424242)
+	requireWrapped(t, err, storage.ErrGroupNotFound, "storage.DeleteGroup")
+}
+
+func testGroupDeletedMembers(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	if err := s.SaveApp(ctx, models.App{ID: 1, Name: "one", Secret: "one"}); err != nil {
+		t.Fatalf("SaveApp: %v", err)
+	}
+	kept := int64(mustSaveUser(t, s, "kept@example.com", "Kept"))
+	gone := int64(mustSaveUser(t, s, "gone@example.com", "Gone"))
+
+	now := time.Now()
+	id, err := s.SaveGroup(ctx, models.Group{
+		AppID:       1,
+		DisplayName: "G",
+		Members:     []models.GroupMember{{UserID: kept}, {UserID: gone}},
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	})
+	if err != nil {
+		t.Fatalf("SaveGroup: %v", err)
+	}
+
+	if err := s.SetStatus(ctx, gone, models.UserStatusDeleted, "", now); err != nil {
+		t.Fatalf("SetStatus: %v", err)
+	}
+	group, err := s.Group(ctx, 1, id)
+	if err != nil {
+		t.Fatalf("Group: %v", err)
+	}
+	if len(group.Members) != 1 || group.Members[0].UserID != kept {
+		t.Fatalf("members with a deleted user = %+v", group.Members)
+	}
+
+	// replacing the members keeps the hidden membership of the deleted user
+	if err := s.UpdateGroup(ctx, group); err != nil {
+		t.Fatalf("UpdateGroup: %v", err)
+	}
+	if err := s.SetStatus(ctx, gone, models.UserStatusActive, "", now); err != nil {
+		t.Fatalf("SetStatus: %v", err)
+	}
+	group, err = s.Group(ctx, 1, id)
+	if err != nil {
+		t.Fatalf("Group: %v", err)
+	}
+	if len(group.Members) != 2 {
+		t.Fatalf("members after restoring the user = %+v", group.Members)
+	}
+}
+
+func testSCIMTokens(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	if err := s.SaveApp(ctx, models.App{ID: 1, Name: "one", Secret: "one"}); err != nil {
+		t.Fatalf("SaveApp: %v", err)
+	}
+
+	for _, hash := range []string{"first", "second"} {
+		if err := s.SaveSCIMToken(ctx, models.SCIMToken{TokenHash: []byte(hash), AppID: 1, CreatedAt: time.Now()}); err != nil {
+			t.Fatalf("SaveSCIMToken: %v", err)
+		}
+	}
+	err := s.SaveSCIMToken(ctx, models.SCIMToken{TokenHash: []byte("orphan"), AppID: 404, CreatedAt: time.Now()})
+	requireWrapped(t, err, storage.ErrAppNotFound, "storage.SaveSCIMToken")
+
+	appID, err := s.SCIMTokenApp(ctx, []byte("second"))
+	if err != nil {
+		t.Fatalf("SCIMTokenApp: %v", err)
+	}
+	if appID != 1 {
+		t.Fatalf("SCIMTokenApp = %d, want 1", appID)
+	}
+
+	revoked, err := s.RevokeSCIMTokens(ctx, 1)
+	if err != nil {
+		t.Fatalf("RevokeSCIMTokens: %v", err)
+	}
+	if revoked != 2 {
+		t.Fatalf("RevokeSCIMTokens = %d, want 2", revoked)
+	}
+	_, err = s.SCIMTokenApp(ctx, []byte("first"))
+	requireWrapped(t, err, storage.ErrSCIMTokenNotFound, "storage.SCIMTokenApp")
+}
+
+func testUpdatePassHash(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	id := int64(mustSaveUser(t, s, "rehash@example.com", "Rehash"))
+
+	if err := s.UpdatePassHash(ctx, id, []byte("hash"), []byte("new-hash"), 2); err != nil {
+		t.Fatalf("UpdatePassHash: %v", err)
+	}
+	user, err := s.UserByID(ctx, id)
+	if err != nil {
+		t.Fatalf("UserByID: %v", err)
+	}
+	if string(user.PassHash) != "new-hash" || user.PepperVersion != 2 {
+		t.Fatalf("PassHash = %q with pepper %d, want %q with pepper 2", user.PassHash, user.PepperVersion, "new-hash")
+	}
+
+	// the hash changed since it was read
+	err = s.UpdatePassHash(ctx, id, []byte("hash"), []byte("stale-hash"), 2)
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.UpdatePassHash")
+
+	err = s.UpdatePassHash(ctx, 424242, []byte("hash"), []byte("new-hash"), 2)
+	requireWrapped(t, err, storage.ErrUserNotFound, "storage.UpdatePassHash")
+}
+
+func testLoginFailures(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	start := time.Now().UTC().Truncate(time.Second)
+	for i := range 3 {
+		n, prev, err := s.ReserveLoginAttempt(ctx, "account:a@example.com", start.Add(time.Duration(i)*time.Second), start.Add(-time.Hour))
+		if err != nil {
+			t.Fatalf("ReserveLoginAttempt: %v", err)
+		}
+		wantPrev := time.Time{}
+		if i > 0 {
+			wantPrev = start.Add(time.Duration(i-1) * time.Second)
+		}
+		if n != i+1 || !prev.Equal(wantPrev) {
+			t.Fatalf("ReserveLoginAttempt = %d after %v, want %d after %v", n, prev, i+1, wantPrev)
+		}
+	}
+
+	failures, last, err := s.LoginFailures(ctx, "account:a@example.com", start.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("LoginFailures: %v", err)
+	}
+	if failures != 3 || !last.Equal(start.Add(2*time.Second)) {
+		t.Fatalf("LoginFailures = %d at %v, want 3 at %v", failures, last, start.Add(2*time.Second))
+	}
+
+	// past the window the counter is gone and starts over
+	failures, _, err = s.LoginFailures(ctx, "account:a@example.com", start.Add(time.Minute))
+	if err != nil || failures != 0 {
+		t.Fatalf("LoginFailures past the window = %d, %v, want 0", failures, err)
+	}
+	n, _, err := s.ReserveLoginAttempt(ctx, "account:a@example.com", start.Add(2*time.Minute), start.Add(time.Minute))
+	if err != nil || n != 1 {
+		t.Fatalf("ReserveLoginAttempt past the window = %d, %v, want 1", n, err)
+	}
+
+	if err := s.ResetLoginFailures(ctx, "account:a@example.com"); err != nil {
+		t.Fatalf("ResetLoginFailures: %v", err)
+	}
+	failures, _, err = s.LoginFailures(ctx, "account:a@example.com", start.Add(-time.Hour))
+	if err != nil || failures != 0 {
+		t.Fatalf("LoginFailures after reset = %d, %v, want 0", failures, err)
+	}
+
+	if _, _, err := s.ReserveLoginAttempt(ctx, "ip:old", start.Add(-2*time.Hour), start.Add(-3*time.Hour)); err != nil {
+		t.Fatalf("ReserveLoginAttempt: %v", err)
+	}
+	if _, _, err := s.ReserveLoginAttempt(ctx, "ip:new", start, start.Add(-time.Hour)); err != nil {
+		t.Fatalf("ReserveLoginAttempt: %v", err)
+	}
+	pruned, err := s.PruneLoginFailures(ctx, start.Add(-time.Hour))
+	if err != nil || pruned != 1 {
+		t.Fatalf("PruneLoginFailures = %d, %v, want 1", pruned, err)
+	}
+	failures, _, err = s.LoginFailures(ctx, "ip:new", start.Add(-time.Hour))
+	if err != nil || failures != 1 {
+		t.Fatalf("LoginFailures of a kept counter = %d, %v, want 1", failures, err)
+	}
+}
+
+func testReleaseLoginAttempt(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	start := time.Now().UTC().Truncate(time.Second)
+	since := start.Add(-time.Hour)
+	for i := range 2 {
+		if _, _, err := s.ReserveLoginAttempt(ctx, "ip:a", start.Add(time.Duration(i)*time.Second), since); err != nil {
+			t.Fatalf("ReserveLoginAttempt: %v", err)
+		}
+	}
+
+	// the last attempt taken back puts the last failure back
+	if err := s.ReleaseLoginAttempt(ctx, "ip:a", start.Add(time.Second), start); err != nil {
+		t.Fatalf("ReleaseLoginAttempt: %v", err)
+	}
+	failures, last, err := s.LoginFailures(ctx, "ip:a", since)
+	if err != nil || failures != 1 || !last.Equal(start) {
+		t.Fatalf("LoginFailures = %d at %v, %v, want 1 at %v", failures, last, err, start)
+	}
+
+	// an earlier one leaves the time of a later attempt
+	for i := 2; i < 4; i++ {
+		if _, _, err := s.ReserveLoginAttempt(ctx, "ip:a", start.Add(time.Duration(i)*time.Second), since); err != nil {
+			t.Fatalf("ReserveLoginAttempt: %v", err)
+		}
+	}
+	if err := s.ReleaseLoginAttempt(ctx, "ip:a", start.Add(2*time.Second), start); err != nil {
+		t.Fatalf("ReleaseLoginAttempt: %v", err)
+	}
+	failures, last, err = s.LoginFailures(ctx, "ip:a", since)
+	if err != nil || failures != 2 || !last.Equal(start.Add(3*time.Second)) {
+		t.Fatalf("LoginFailures = %d at %v, %v, want 2 at %v", failures, last, err, start.Add(3*time.Second))
+	}
+
+	if err := s.ReleaseLoginAttempt(ctx, "ip:none", start, time.Time{}); err != nil {
+		t.Fatalf("ReleaseLoginAttempt of no counter: %v", err)
+	}
+}
+
+// testReserveLoginAttemptConcurrent reserves attempts on one key at once,
+// each of them has to see a count of its own.
+func testReserveLoginAttemptConcurrent(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	const n = 20
+	now := time.Now().UTC()
+	counts := make(chan int, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			failures, _, err := s.ReserveLoginAttempt(ctx, "account:a@example.com", now.Add(time.Duration(i)*time.Millisecond), now.Add(-time.Hour))
+			if err != nil {
+				t.Errorf("ReserveLoginAttempt: %v", err)
+				return
+			}
+			counts <- failures
+		}()
+	}
+	wg.Wait()
+	close(counts)
+
+	seen := make(map[int]bool)
+	for c := range counts {
+		if seen[c] {
+			t.Errorf("count %d reserved twice", c)
+		}
+		seen[c] = true
+	}
+	if len(seen) != n {
+		t.Errorf("reserved %d distinct counts, want %d", len(seen), n)
+	}
+}
+
+func testRateLimits(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	now := time.Now().Truncate(time.Second)
+	interval, tolerance := time.Second, 3*time.Second
+
+	// a full bucket of three lets three requests through, then none
+	for i := range 3 {
+		allowed, tat, err := s.ConsumeRateLimit(ctx, "login|192.0.2.1", now, interval, tolerance)
+		if err != nil {
+			t.Fatalf("ConsumeRateLimit: %v", err)
+		}
+		if want := now.Add(time.Duration(i+1) * interval); !allowed || !tat.Equal(want) {
+			t.Fatalf("ConsumeRateLimit %d = %v at %v, want allowed at %v", i+1, allowed, tat, want)
+		}
+	}
+	allowed, tat, err := s.ConsumeRateLimit(ctx, "login|192.0.2.1", now, interval, tolerance)
+	if err != nil {
+		t.Fatalf("ConsumeRateLimit: %v", err)
+	}
+	if allowed || !tat.Equal(now.Add(3*interval)) {
+		t.Fatalf("ConsumeRateLimit of an empty bucket = %v at %v, want rejected at %v", allowed, tat, now.Add(3*interval))
+	}
+
+	// a token comes back every interval
+	allowed, tat, err = s.ConsumeRateLimit(ctx, "login|192.0.2.1", now.Add(interval), interval, tolerance)
+	if err != nil || !allowed || !tat.Equal(now.Add(4*interval)) {
+		t.Fatalf("ConsumeRateLimit after an interval = %v at %v, %v, want allowed at %v", allowed, tat, err, now.Add(4*interval))
+	}
+
+	// other keys have their own buckets
+	allowed, _, err = s.ConsumeRateLimit(ctx, "login|192.0.2.2", now, interval, tolerance)
+	if err != nil || !allowed {
+		t.Fatalf("ConsumeRateLimit of another key = %v, %v, want allowed", allowed, err)
+	}
+
+	pruned, err := s.PruneRateLimits(ctx, now.Add(2*interval))
+	if err != nil || pruned != 1 {
+		t.Fatalf("PruneRateLimits = %d, %v, want 1", pruned, err)
+	}
+	allowed, _, err = s.ConsumeRateLimit(ctx, "login|192.0.2.1", now.Add(interval), interval, tolerance)
+	if err != nil || allowed {
+		t.Fatalf("ConsumeRateLimit of a kept bucket = %v, %v, want rejected", allowed, err)
+	}
+}
+
+func emails(users []models.UserInfo) []string {
+	var out []string
+	for _, u := range users {
+		out = append(out, u.Email)
+	}
+	return out
+}
+
+func verification(userID int64, email, token string, ttl time.Duration) *models.EmailVerification {
+	return &models.EmailVerification{
+		TokenHash: []byte(token),
+		UserID:    userID,
+		Email:     email,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+}
+
+func mustSaveUser(t *testing.T, s Storage, email, name string) int {
+	t.Helper()
+
+	id, err := s.SaveUser(context.Background(), email, name, []byte("hash"), 0)
+	if err != nil {
+		t.Fatalf("SaveUser(%q): %v", email, err)
+	}
+	return id
+}
+
+// requireWrapped checks the error contract shared by all storage methods:
+// the sentinel is reachable through errors.Is and the error is wrapped with
+// the operation name rather than returned bare.
+func requireWrapped(t *testing.T, err error, target error, op string) {
+	t.Helper()
+
+	if err == nil {
+		t.Fatalf("%s: expected %v, got nil", op, target)
+	}
+	if !errors.Is(err, target) {
+		t.Fatalf("%s: expected errors.Is(err, %v), got %v", op, target, err)
+	}
+	if err == target {
+		t.Fatalf("%s: returned bare %v, expected it wrapped with the operation name", op, target)
+	}
+	if !strings.HasPrefix(err.Error(), fmt.Sprintf("%s: ", op)) {
+		t.Fatalf("%s: error %q is not prefixed with the operation name", op, err)
+	}
+}
@@ -0,0 +1,12 @@
+ALTER TABLE users
+        ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS email_verifications
+(
+    token_hash bytea primary key,
+    user_id integer not null references users (id) on delete cascade,
+    email text not null,
+    expires_at timestamptz not null
+);
+
+CREATE INDEX IF NOT EXISTS idx_email_verifications_user_id on email_verifications (user_id);
@@ -0,0 +1,5 @@
+ALTER TABLE users
+        ADD COLUMN created_at timestamptz NOT NULL DEFAULT now(),
+        ADD COLUMN status text NOT NULL DEFAULT 'active';
+
+CREATE INDEX IF NOT EXISTS idx_users_created_at on users (created_at);
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_users_deleted;
+
+ALTER TABLE users
+        DROP CONSTRAINT IF EXISTS users_status_check,
+        DROP COLUMN IF EXISTS email_released_at,
+        DROP COLUMN IF EXISTS status_changed_at,
+        DROP COLUMN IF EXISTS status_reason;
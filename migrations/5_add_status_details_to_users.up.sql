@@ -0,0 +1,8 @@
+ALTER TABLE users
+        ADD COLUMN status_reason text NOT NULL DEFAULT '',
+        ADD COLUMN status_changed_at timestamptz,
+        ADD COLUMN email_released_at timestamptz,
+        ADD CONSTRAINT users_status_check CHECK (status IN ('active', 'disabled', 'locked', 'deleted'));
+
+CREATE INDEX IF NOT EXISTS idx_users_deleted on users (status_changed_at)
+        WHERE status = 'deleted' AND email_released_at IS NULL;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS scim_users
+(
+    app_id integer not null references apps (id) on delete cascade,
+    user_id integer not null references users (id) on delete cascade,
+    primary key (app_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_scim_users_user_id on scim_users (user_id);
@@ -0,0 +1,2 @@
+ALTER TABLE users
+        ADD COLUMN pepper_version integer NOT NULL DEFAULT 0;
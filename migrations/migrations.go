@@ -0,0 +1,26 @@
+// Package migrations embeds the SQL migrations so the binaries do not need
+// the migrations directory next to them at runtime.
+package migrations
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+)
+
+//go:embed *.sql
+var postgres embed.FS
+
+//go:embed sqlite/*.sql
+var sqlite embed.FS
+
+// FS returns the migrations for the given storage driver.
+func FS(driver string) (fs.FS, error) {
+	switch driver {
+	case "postgres":
+		return postgres, nil
+	case "sqlite":
+		return fs.Sub(sqlite, "sqlite")
+	}
+	return nil, fmt.Errorf("migrations: unknown driver %q", driver)
+}
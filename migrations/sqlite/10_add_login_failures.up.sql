@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS login_failures
+(
+    key text primary key,
+    failures integer not null,
+    last_failure_at timestamp not null
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_failures_last_failure_at on login_failures (last_failure_at);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS rate_limits
+(
+    key text primary key,
+    tat bigint not null
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_limits_tat on rate_limits (tat);
@@ -0,0 +1,2 @@
+ALTER TABLE users
+        ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_users_created_at;
+
+ALTER TABLE users
+        DROP COLUMN status;
+
+ALTER TABLE users
+        DROP COLUMN created_at;
@@ -0,0 +1,11 @@
+-- SQLite cannot add a column defaulting to the current time, SaveUser sets
+-- created_at explicitly and existing users get the migration time.
+ALTER TABLE users
+        ADD COLUMN created_at timestamp NOT NULL DEFAULT '1970-01-01 00:00:00+00:00';
+
+ALTER TABLE users
+        ADD COLUMN status text NOT NULL DEFAULT 'active';
+
+UPDATE users SET created_at = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now');
+
+CREATE INDEX IF NOT EXISTS idx_users_created_at on users (created_at);
@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS idx_users_deleted;
+
+ALTER TABLE users
+        DROP COLUMN email_released_at;
+
+ALTER TABLE users
+        DROP COLUMN status_changed_at;
+
+ALTER TABLE users
+        DROP COLUMN status_reason;
@@ -0,0 +1,11 @@
+ALTER TABLE users
+        ADD COLUMN status_reason text NOT NULL DEFAULT '';
+
+ALTER TABLE users
+        ADD COLUMN status_changed_at timestamp;
+
+ALTER TABLE users
+        ADD COLUMN email_released_at timestamp;
+
+CREATE INDEX IF NOT EXISTS idx_users_deleted on users (status_changed_at)
+        WHERE status = 'deleted' AND email_released_at IS NULL;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS erased_users
+(
+    user_id integer primary key,
+    erased_by integer,
+    reason text not null default '',
+    erased_at timestamp not null
+);
@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS user_groups
+(
+    id integer primary key autoincrement,
+    app_id integer not null references apps (id) on delete cascade,
+    display_name text not null,
+    created_at timestamp not null,
+    updated_at timestamp not null,
+    unique (app_id, display_name)
+);
+
+CREATE TABLE IF NOT EXISTS user_group_members
+(
+    group_id integer not null references user_groups (id) on delete cascade,
+    user_id integer not null references users (id) on delete cascade,
+    primary key (group_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_group_members_user_id on user_group_members (user_id);
+
+CREATE TABLE IF NOT EXISTS scim_tokens
+(
+    token_hash blob primary key,
+    app_id integer not null references apps (id) on delete cascade,
+    created_at timestamp not null
+);
+
+CREATE INDEX IF NOT EXISTS idx_scim_tokens_app_id on scim_tokens (app_id);